@@ -0,0 +1,303 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"github.com/go-json-experiment/json"
+)
+
+// adminConfig holds the configuration for the admin API.
+type adminConfig struct {
+	ListenAddr string     `json:"listenAddr"`
+	TLS        *tlsConfig `json:"tls,omitempty"`
+
+	// Token holds the bearer token that clients must
+	// present. TokenFile names a file holding it instead.
+	Token     string `json:"token,omitempty"`
+	TokenFile string `json:"tokenFile,omitempty"`
+}
+
+// token returns the bearer token for the admin API.
+func (c *adminConfig) token() (string, error) {
+	if c.TokenFile == "" {
+		if c.Token == "" {
+			return "", fmt.Errorf("no admin token configured")
+		}
+		return c.Token, nil
+	}
+	data, err := os.ReadFile(c.TokenFile)
+	if err != nil {
+		return "", fmt.Errorf("cannot read admin token: %v", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("empty admin token in %q", c.TokenFile)
+	}
+	return token, nil
+}
+
+// adminHandler serves the admin API. The in-memory registries
+// are identified by their position in the configuration,
+// as found in the "registry" field of the results.
+//
+//	GET /config             the configuration, as printed by ocisrv vet
+//	GET /stats              statistics for each mem registry
+//	GET /uploads            the chunked uploads in progress
+//	POST /gc                remove unreferenced blobs from mem registries;
+//	                        the minAge query parameter holds how long
+//	                        ago blobs must have been pushed to be removed
+//	                        (default 1h), so pushes in progress are safe
+//	POST /flush-caches      discard data cached by registry wrappers
+//	DELETE /repos/$repo     delete a repository from mem registries;
+//	                        the registry query parameter restricts
+//	                        which registry it's deleted from, and
+//	                        the result for each registry is returned
+type adminHandler struct {
+	rl    *reloader
+	token string
+}
+
+type adminStats struct {
+	Registry     string `json:"registry"`
+	Repos        int    `json:"repos"`
+	Tags         int    `json:"tags"`
+	Manifests    int    `json:"manifests"`
+	Blobs        int    `json:"blobs"`
+	Bytes        int64  `json:"bytes"`
+	Content      int    `json:"content"`
+	ContentBytes int64  `json:"contentBytes"`
+	MaxBytes     int64  `json:"maxBytes,omitzero"`
+	Evictions    int    `json:"evictions"`
+	EvictedBytes int64  `json:"evictedBytes"`
+	Uploads      int    `json:"uploads"`
+	UploadBytes  int64  `json:"uploadBytes"`
+}
+
+type adminUpload struct {
+	Registry string    `json:"registry"`
+	Repo     string    `json:"repo"`
+	ID       string    `json:"id"`
+	Size     int64     `json:"size"`
+	LastUsed time.Time `json:"lastUsed"`
+}
+
+// defaultGCMinAge holds how long ago a blob must have been
+// pushed for POST /gc to remove it when minAge isn't given.
+const defaultGCMinAge = time.Hour
+
+// adminDeleteResult holds the result of deleting a
+// repository from a registry. Result is one of "deleted",
+// "notFound" or "error", in which case Error holds the error.
+type adminDeleteResult struct {
+	Registry string `json:"registry"`
+	Result   string `json:"result"`
+	Error    string `json:"error,omitempty"`
+}
+
+type adminGCStats struct {
+	Registry string `json:"registry"`
+	Blobs    int    `json:"blobs"`
+	Bytes    int64  `json:"bytes"`
+}
+
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="ocisrv admin"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	path := req.URL.Path
+	switch {
+	case path == "/config":
+		if !checkMethod(w, req, "GET") {
+			return
+		}
+		var buf bytes.Buffer
+		if err := printConfig(&buf, h.rl.config()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(buf.Bytes())
+	case path == "/stats":
+		if !checkMethod(w, req, "GET") {
+			return
+		}
+		stats := []adminStats{}
+		regs := h.rl.memRegistries()
+		for _, pos := range sortedKeys(regs) {
+			s := regs[pos].Stats()
+			stats = append(stats, adminStats{
+				Registry:     pos,
+				Repos:        s.Repos,
+				Tags:         s.Tags,
+				Manifests:    s.Manifests,
+				Blobs:        s.Blobs,
+				Bytes:        s.Bytes,
+				Content:      s.Content,
+				ContentBytes: s.ContentBytes,
+				MaxBytes:     s.MaxBytes,
+				Evictions:    s.Evictions,
+				EvictedBytes: s.EvictedBytes,
+				Uploads:      s.Uploads,
+				UploadBytes:  s.UploadBytes,
+			})
+		}
+		writeJSON(w, http.StatusOK, stats)
+	case path == "/uploads":
+		if !checkMethod(w, req, "GET") {
+			return
+		}
+		uploads := []adminUpload{}
+		regs := h.rl.memRegistries()
+		for _, pos := range sortedKeys(regs) {
+			for _, u := range regs[pos].Uploads() {
+				uploads = append(uploads, adminUpload{
+					Registry: pos,
+					Repo:     u.Repo,
+					ID:       u.ID,
+					Size:     u.Size,
+					LastUsed: u.LastUsed,
+				})
+			}
+		}
+		writeJSON(w, http.StatusOK, uploads)
+	case path == "/gc":
+		if !checkMethod(w, req, "POST") {
+			return
+		}
+		minAge := defaultGCMinAge
+		if s := req.URL.Query().Get("minAge"); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil || d < 0 {
+				http.Error(w, fmt.Sprintf("invalid minAge %q", s), http.StatusBadRequest)
+				return
+			}
+			minAge = d
+		}
+		results := []adminGCStats{}
+		regs := h.rl.memRegistries()
+		for _, pos := range sortedKeys(regs) {
+			s := regs[pos].GC(minAge)
+			results = append(results, adminGCStats{
+				Registry: pos,
+				Blobs:    s.Blobs,
+				Bytes:    s.Bytes,
+			})
+		}
+		writeJSON(w, http.StatusOK, results)
+	case path == "/flush-caches":
+		if !checkMethod(w, req, "POST") {
+			return
+		}
+		if err := h.rl.flushCaches(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasPrefix(path, "/repos/"):
+		if !checkMethod(w, req, "DELETE") {
+			return
+		}
+		h.deleteRepo(w, req, strings.TrimPrefix(path, "/repos/"))
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// deleteRepo deletes the repository from all the mem registries
+// that hold it, or only the one in the registry query parameter,
+// responding with the result for each registry. The response
+// status is 404 Not Found if no registry held the repository, and
+// 207 Multi-Status if it was deleted from some registries but
+// could not be deleted from others.
+func (h *adminHandler) deleteRepo(w http.ResponseWriter, req *http.Request, repo string) {
+	only := req.URL.Query().Get("registry")
+	regs := h.rl.memRegistries()
+	if only != "" && regs[only] == nil {
+		http.Error(w, fmt.Sprintf("no mem registry %q", only), http.StatusNotFound)
+		return
+	}
+	results := []adminDeleteResult{}
+	deleted, denied, failed := 0, 0, 0
+	for _, pos := range sortedKeys(regs) {
+		if only != "" && pos != only {
+			continue
+		}
+		result := adminDeleteResult{
+			Registry: pos,
+		}
+		err := regs[pos].DeleteRepository(context.Background(), repo)
+		switch {
+		case err == nil:
+			result.Result = "deleted"
+			deleted++
+		case errors.Is(err, ociregistry.ErrNameUnknown):
+			result.Result = "notFound"
+		default:
+			result.Result = "error"
+			result.Error = err.Error()
+			if errors.Is(err, ociregistry.ErrDenied) {
+				denied++
+			}
+			failed++
+		}
+		results = append(results, result)
+	}
+	code := http.StatusOK
+	switch {
+	case failed > 0 && deleted > 0:
+		code = http.StatusMultiStatus
+	case failed > 0 && denied == failed:
+		code = http.StatusForbidden
+	case failed > 0:
+		code = http.StatusInternalServerError
+	case deleted == 0:
+		code = http.StatusNotFound
+	}
+	writeJSON(w, code, results)
+}
+
+func checkMethod(w http.ResponseWriter, req *http.Request, method string) bool {
+	if req.Method != method {
+		w.Header().Set("Allow", method)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, code int, x any) {
+	data, err := json.MarshalOptions{}.Marshal(json.EncodeOptions{Indent: "\t"}, x)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(append(data, '\n'))
+}
@@ -0,0 +1,242 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocitest"
+	"github.com/go-json-experiment/json"
+	"github.com/opencontainers/go-digest"
+)
+
+const adminTestConfig = `
+listenAddr: "localhost:0"
+registry: {
+	kind: "convertSchema1"
+	registry: kind: "mem"
+}
+paths: "scratch": registry: kind: "mem"
+admin: {
+	listenAddr: "localhost:0"
+	token: "sesame"
+}
+`
+
+func TestAdmin(t *testing.T) {
+	ctx := context.Background()
+	rl := newTestReloader(t, adminTestConfig)
+	srv := httptest.NewServer(rl.handler(0))
+	defer srv.Close()
+	admin := httptest.NewServer(&adminHandler{
+		rl:    rl,
+		token: "sesame",
+	})
+	defer admin.Close()
+
+	data := []byte("hello")
+	desc := ociregistry.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	client := hostClient(t, srv, "")
+	_, err := client.PushBlob(ctx, "foo", desc, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.PushBlob(ctx, "bar", desc, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := client.PushBlobChunked(ctx, "foo", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	// A token is required.
+	resp, err := http.Get(admin.URL + "/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unexpected status %v without token", resp.Status)
+	}
+	if code, _ := adminRequest(t, admin, "GET", "/stats", "wrong"); code != http.StatusUnauthorized {
+		t.Fatalf("unexpected status %v with wrong token", code)
+	}
+
+	var stats []adminStats
+	adminJSON(t, admin, "GET", "/stats", &stats)
+	if len(stats) != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	// The registries are sorted by position.
+	if s := stats[0]; s.Registry != `listeners[0].paths["scratch"]` || s.Repos != 0 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+	if s := stats[1]; s.Registry != "listeners[0]/0" || s.Repos != 2 || s.Blobs != 2 || s.Bytes != 10 || s.ContentBytes != 5 || s.Uploads != 1 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+
+	var uploads []adminUpload
+	adminJSON(t, admin, "GET", "/uploads", &uploads)
+	if len(uploads) != 1 || uploads[0].Repo != "foo" || uploads[0].Registry != "listeners[0]/0" {
+		t.Fatalf("unexpected uploads %+v", uploads)
+	}
+
+	// Flushing caches constructs the wrappers again but
+	// keeps the mem registries and their content.
+	oldWrapper, oldMem := rl.registries["listeners[0]"].r, rl.registries["listeners[0]/0"].r
+	if code, body := adminRequest(t, admin, "POST", "/flush-caches", "sesame"); code != http.StatusNoContent {
+		t.Fatalf("unexpected status %v from flush: %s", code, body)
+	}
+	if rl.registries["listeners[0]"].r == oldWrapper || rl.registries["listeners[0]/0"].r != oldMem {
+		t.Fatalf("unexpected registries after flush")
+	}
+	if _, err := client.ResolveBlob(ctx, "foo", desc.Digest); err != nil {
+		t.Fatalf("blob not found after flush: %v", err)
+	}
+
+	var deleted []adminDeleteResult
+	adminJSON(t, admin, "DELETE", "/repos/bar", &deleted)
+	if len(deleted) != 2 || deleted[1] != (adminDeleteResult{Registry: "listeners[0]/0", Result: "deleted"}) {
+		t.Fatalf("unexpected delete results %+v", deleted)
+	}
+	if code, _ := adminRequest(t, admin, "DELETE", "/repos/bar", "sesame"); code != http.StatusNotFound {
+		t.Fatalf("unexpected status %v deleting missing repository", code)
+	}
+
+	// By default, recently pushed blobs are left alone
+	// because their manifests might not have been pushed yet.
+	var gc []adminGCStats
+	adminJSON(t, admin, "POST", "/gc", &gc)
+	if len(gc) != 2 || gc[1].Blobs != 0 {
+		t.Fatalf("unexpected GC result %+v", gc)
+	}
+	if _, err := client.ResolveBlob(ctx, "foo", desc.Digest); err != nil {
+		t.Fatalf("recent blob removed by GC: %v", err)
+	}
+	adminJSON(t, admin, "POST", "/gc?minAge=0s", &gc)
+	if len(gc) != 2 || gc[1].Blobs != 1 || gc[1].Bytes != 5 {
+		t.Fatalf("unexpected GC result %+v", gc)
+	}
+	if _, err := client.ResolveBlob(ctx, "foo", desc.Digest); err == nil {
+		t.Fatalf("blob unexpectedly found after GC")
+	}
+
+	code, body := adminRequest(t, admin, "GET", "/config", "sesame")
+	if code != http.StatusOK || !strings.Contains(body, `path "scratch": mem`) {
+		t.Fatalf("unexpected config response %v: %s", code, body)
+	}
+	if code, _ := adminRequest(t, admin, "GET", "/gc", "sesame"); code != http.StatusMethodNotAllowed {
+		t.Fatalf("unexpected status %v for wrong method", code)
+	}
+	if code, _ := adminRequest(t, admin, "POST", "/gc?minAge=soon", "sesame"); code != http.StatusBadRequest {
+		t.Fatalf("unexpected status %v for invalid minAge", code)
+	}
+}
+
+func TestAdminDeleteRepoPartially(t *testing.T) {
+	rl := newTestReloader(t, `
+listenAddr: "localhost:0"
+registry: kind: "mem"
+paths: "locked": registry: {
+	kind: "mem"
+	immutableTags: true
+}
+`)
+	admin := httptest.NewServer(&adminHandler{
+		rl:    rl,
+		token: "sesame",
+	})
+	defer admin.Close()
+	content := ocitest.RegistryContent{
+		"foo": {
+			Blobs: map[string]string{
+				"config": "{}",
+			},
+			Manifests: map[string]ociregistry.Manifest{
+				"image": {
+					Config: ociregistry.Descriptor{Digest: "config"},
+				},
+			},
+			Tags: map[string]string{
+				"latest": "image",
+			},
+		},
+	}
+	for _, r := range rl.memRegistries() {
+		ocitest.NewRegistry(t, r).MustPushContent(content)
+	}
+
+	// The repository can't be deleted from the registry with
+	// immutable tags, but it is deleted from the other one.
+	code, body := adminRequest(t, admin, "DELETE", "/repos/foo", "sesame")
+	if code != http.StatusMultiStatus {
+		t.Fatalf("unexpected status %v: %s", code, body)
+	}
+	var results []adminDeleteResult
+	if err := json.Unmarshal([]byte(body), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 ||
+		results[0].Registry != "listeners[0]" || results[0].Result != "deleted" ||
+		results[1].Registry != `listeners[0].paths["locked"]` || results[1].Result != "error" || results[1].Error == "" {
+		t.Fatalf("unexpected delete results %+v", results)
+	}
+
+	code, body = adminRequest(t, admin, "DELETE", "/repos/foo", "sesame")
+	if code != http.StatusForbidden {
+		t.Fatalf("unexpected status %v: %s", code, body)
+	}
+}
+
+func adminRequest(t *testing.T, srv *httptest.Server, method, path, token string) (int, string) {
+	req, err := http.NewRequest(method, srv.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(data)
+}
+
+func adminJSON(t *testing.T, srv *httptest.Server, method, path string, x any) {
+	code, body := adminRequest(t, srv, method, path, "sesame")
+	if code != http.StatusOK {
+		t.Fatalf("unexpected status %v from %s %s: %s", code, method, path, body)
+	}
+	if err := json.Unmarshal([]byte(body), x); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -14,4 +14,7 @@
 
 package ocisrv
 
-listenAddr: *"localhost:5000" | _
+listenAddr:        *"localhost:5000" | _
+readHeaderTimeout: *"10s" | _
+idleTimeout:       *"2m" | _
+shutdownTimeout:   *"30s" | _
@@ -0,0 +1,232 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"cuelabs.dev/go/oci/ociregistry/ociserver"
+)
+
+// listenerConfig holds the configuration for a single listener.
+// Requests are routed to a registry by their Host header, then
+// by the prefix of their path, falling back to Registry.
+type listenerConfig struct {
+	ListenAddr string     `json:"listenAddr"`
+	TLS        *tlsConfig `json:"tls,omitempty"`
+
+	// Registry and Server configure the registry that serves
+	// requests that don't match any of Hosts or Paths.
+	Registry registry      `json:"registry,omitempty"`
+	Server   serverOptions `json:"server,omitempty"`
+
+	// Hosts holds the registries to serve by host name,
+	// which may include a port.
+	Hosts map[string]siteConfig `json:"hosts,omitempty"`
+
+	// Paths holds the registries to serve by path prefix.
+	// The prefix is removed from the request path before
+	// the request is served, so a request for /foo/v2/bar/tags/list
+	// will be served by the registry with prefix "foo" as
+	// a request for /v2/bar/tags/list.
+	Paths map[string]siteConfig `json:"paths,omitempty"`
+}
+
+// siteConfig holds the configuration for a registry
+// served at a given host or path.
+type siteConfig struct {
+	Registry registry      `json:"registry"`
+	Server   serverOptions `json:"server,omitempty"`
+}
+
+// listeners returns the configuration of all the listeners,
+// including the main listener configured by the top level
+// fields of cfg.
+func (cfg *config) listeners() []listenerConfig {
+	return append([]listenerConfig{{
+		ListenAddr: cfg.ListenAddr,
+		TLS:        cfg.TLS,
+		Registry:   cfg.Registry,
+		Server:     cfg.Server,
+		Hosts:      cfg.Hosts,
+		Paths:      cfg.Paths,
+	}}, cfg.Listeners...)
+}
+
+// checkRegistries returns an error if lc
+// doesn't configure any registries to serve.
+func (lc *listenerConfig) checkRegistries() error {
+	if lc.Registry == nil && len(lc.Hosts) == 0 && len(lc.Paths) == 0 {
+		return fmt.Errorf("no registries configured for listener %s", lc.ListenAddr)
+	}
+	return nil
+}
+
+// handler returns the handler for the ith listener,
+// using b to construct its registries.
+func (lc *listenerConfig) handler(i int, b *builder) (http.Handler, error) {
+	if err := lc.checkRegistries(); err != nil {
+		return nil, err
+	}
+	rt := &router{
+		hosts: make(map[string]http.Handler),
+	}
+	newHandler := func(name string, sc siteConfig) (http.Handler, error) {
+		r, err := b.build(name, sc.Registry)
+		if err != nil {
+			return nil, fmt.Errorf("cannot construct registry for %s: %v", name, err)
+		}
+		return ociserver.New(r, sc.Server.new()), nil
+	}
+	if lc.Registry != nil {
+		h, err := newHandler(fmt.Sprintf("listeners[%d]", i), siteConfig{lc.Registry, lc.Server})
+		if err != nil {
+			return nil, err
+		}
+		rt.fallback = h
+	}
+	for _, host := range sortedKeys(lc.Hosts) {
+		h, err := newHandler(fmt.Sprintf("listeners[%d].hosts[%q]", i, host), lc.Hosts[host])
+		if err != nil {
+			return nil, err
+		}
+		rt.hosts[strings.ToLower(host)] = h
+	}
+	for _, prefix := range sortedKeys(lc.Paths) {
+		h, err := newHandler(fmt.Sprintf("listeners[%d].paths[%q]", i, prefix), lc.Paths[prefix])
+		if err != nil {
+			return nil, err
+		}
+		p := strings.Trim(prefix, "/")
+		if p == "" {
+			return nil, fmt.Errorf("empty path prefix in listener %s", lc.ListenAddr)
+		}
+		rt.paths = append(rt.paths, pathRoute{
+			prefix:  "/" + p,
+			handler: h,
+		})
+	}
+	// Try longer prefixes first so that the most
+	// specific one matches.
+	sort.SliceStable(rt.paths, func(i, j int) bool {
+		return len(rt.paths[i].prefix) > len(rt.paths[j].prefix)
+	})
+	return rt, nil
+}
+
+// router routes requests to handlers by host name
+// or path prefix.
+type router struct {
+	hosts    map[string]http.Handler
+	paths    []pathRoute
+	fallback http.Handler
+}
+
+type pathRoute struct {
+	prefix  string
+	handler http.Handler
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	host := strings.ToLower(req.Host)
+	h, ok := rt.hosts[host]
+	if !ok {
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			h, ok = rt.hosts[hostname]
+		}
+	}
+	if ok {
+		h.ServeHTTP(w, req)
+		return
+	}
+	for _, route := range rt.paths {
+		if strings.HasPrefix(req.URL.Path, route.prefix+"/") {
+			route.serve(w, req)
+			return
+		}
+	}
+	if rt.fallback != nil {
+		rt.fallback.ServeHTTP(w, req)
+		return
+	}
+	http.Error(w, "no registry found for request", http.StatusNotFound)
+}
+
+// serve serves req with the route's handler, removing
+// the prefix from the request path and adding it to
+// any host-relative Location header in the response.
+func (route pathRoute) serve(w http.ResponseWriter, req *http.Request) {
+	req1 := req.Clone(req.Context())
+	req1.URL.Path = strings.TrimPrefix(req.URL.Path, route.prefix)
+	req1.URL.RawPath = strings.TrimPrefix(req.URL.RawPath, route.prefix)
+	req1.RequestURI = req1.URL.RequestURI()
+	route.handler.ServeHTTP(&prefixWriter{
+		ResponseWriter: w,
+		prefix:         route.prefix,
+	}, req1)
+}
+
+// prefixWriter adds a prefix to any host-relative
+// Location header written to the underlying ResponseWriter.
+type prefixWriter struct {
+	http.ResponseWriter
+	prefix      string
+	wroteHeader bool
+}
+
+func (w *prefixWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if loc := w.Header().Get("Location"); strings.HasPrefix(loc, "/") && !strings.HasPrefix(loc, "//") {
+			w.Header().Set("Location", w.prefix+loc)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *prefixWriter) Write(buf []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(buf)
+}
+
+// Flush implements [http.Flusher] by flushing the
+// underlying ResponseWriter if it supports flushing.
+func (w *prefixWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap returns the underlying ResponseWriter
+// for the use of [http.ResponseController].
+func (w *prefixWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,243 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ociclient"
+	"github.com/opencontainers/go-digest"
+)
+
+const hostTestConfig = `
+listenAddr: "localhost:0"
+registry: kind: "mem"
+hosts: "mirror.internal": registry: {
+	kind: "readOnly"
+	registry: kind: "mem"
+}
+hosts: "scratch.internal": registry: kind: "mem"
+paths: "scratch": registry: kind: "mem"
+paths: "scratch/deeper": registry: kind: "mem"
+listeners: [{
+	listenAddr: "localhost:0"
+	hosts: "other.internal": registry: kind: "mem"
+}]
+`
+
+func TestRouting(t *testing.T) {
+	ctx := context.Background()
+	rl := newTestReloader(t, hostTestConfig)
+	srv := httptest.NewServer(rl.handler(0))
+	defer srv.Close()
+
+	data := []byte("hello")
+	desc := ociregistry.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	push := func(host string) error {
+		_, err := hostClient(t, srv, host).PushBlob(ctx, "foo", desc, bytes.NewReader(data))
+		return err
+	}
+	has := func(host string) bool {
+		_, err := hostClient(t, srv, host).ResolveBlob(ctx, "foo", desc.Digest)
+		return err == nil
+	}
+
+	// The scratch host has its own registry.
+	if err := push("scratch.internal"); err != nil {
+		t.Fatal(err)
+	}
+	if !has("scratch.internal") || has("") {
+		t.Fatalf("blob pushed to wrong registry")
+	}
+	// The port is ignored when there's no exact match.
+	if !has("scratch.internal:1234") {
+		t.Fatalf("host with port not routed")
+	}
+	// The mirror is read-only.
+	if err := push("mirror.internal"); err == nil {
+		t.Fatalf("unexpected success pushing to read-only registry")
+	}
+	// Unknown hosts use the default registry.
+	if err := push("unknown.internal"); err != nil {
+		t.Fatal(err)
+	}
+	if !has("") {
+		t.Fatalf("blob not pushed to default registry")
+	}
+
+	// Path prefixes are removed, and added to the locations
+	// returned by the server so that chunked uploads work.
+	resp, err := http.Post(srv.URL+"/scratch/v2/bar/blobs/uploads/", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("unexpected status %v", resp.Status)
+	}
+	loc := resp.Header.Get("Location")
+	if !strings.HasPrefix(loc, "/scratch/v2/bar/blobs/uploads/") {
+		t.Fatalf("unexpected location %q", loc)
+	}
+	req, err := http.NewRequest("PUT", srv.URL+loc+"?digest="+string(desc.Digest), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("unexpected status %v", resp.Status)
+	}
+	if got := resp.Header.Get("Location"); got != "/scratch/v2/bar/blobs/"+string(desc.Digest) {
+		t.Fatalf("unexpected location %q", got)
+	}
+	if got := getBody(t, srv.URL+"/scratch/v2/bar/blobs/"+string(desc.Digest)); got != "hello" {
+		t.Fatalf("unexpected blob content %q", got)
+	}
+	// The longest prefix wins.
+	resp, err = http.Get(srv.URL + "/scratch/deeper/v2/bar/blobs/" + string(desc.Digest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unexpected status %v from deeper prefix", resp.Status)
+	}
+
+	// The second listener only serves its own host.
+	srv1 := httptest.NewServer(rl.handler(1))
+	defer srv1.Close()
+	resp, err = http.Get(srv1.URL + "/v2/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unexpected status %v for unknown host", resp.Status)
+	}
+	if _, err := hostClient(t, srv1, "other.internal").ResolveBlob(ctx, "foo", desc.Digest); err == nil {
+		t.Fatalf("blob unexpectedly found in other listener's registry")
+	}
+}
+
+func TestPrefixWriter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &prefixWriter{
+		ResponseWriter: rec,
+		prefix:         "/scratch",
+	}
+	w.Header().Set("Location", "/v2/foo")
+	w.Flush()
+	if !rec.Flushed {
+		t.Errorf("response not flushed")
+	}
+	if got, want := rec.Header().Get("Location"), "/scratch/v2/foo"; got != want {
+		t.Errorf("unexpected Location header; got %q want %q", got, want)
+	}
+
+	// The features of the underlying ResponseWriter are
+	// available through http.ResponseController.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rc := http.NewResponseController(&prefixWriter{
+			ResponseWriter: w,
+			prefix:         "/scratch",
+		})
+		if err := rc.SetWriteDeadline(time.Now().Add(time.Minute)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("cannot set write deadline; got status %s", resp.Status)
+	}
+}
+
+func newTestReloader(t *testing.T, cfgText string) *reloader {
+	configFile := filepath.Join(t.TempDir(), "config.cue")
+	if err := os.WriteFile(configFile, []byte(cfgText), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl, err := newReloader(configFile, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rl
+}
+
+// hostClient returns a client that talks to srv, sending
+// the given Host header if it's not empty.
+func hostClient(t *testing.T, srv *httptest.Server, host string) ociregistry.Interface {
+	client, err := ociclient.New(strings.TrimPrefix(srv.URL, "http://"), &ociclient.Options{
+		Insecure: true,
+		HTTPClient: &http.Client{
+			Transport: hostTransport{host},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+type hostTransport struct {
+	host string
+}
+
+func (t hostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.host != "" {
+		req = req.Clone(req.Context())
+		req.Host = t.host
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func getBody(t *testing.T, url string) string {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
@@ -15,13 +15,17 @@
 package main
 
 import (
+	"context"
 	_ "embed"
 	"flag"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"reflect"
+	"syscall"
+	"time"
 
 	"cuelabs.dev/go/oci/ociregistry/ociserver"
 	"github.com/cue-exp/cueconfig"
@@ -37,8 +41,42 @@ var (
 )
 
 type config struct {
-	Registry   registry `json:"registry"`
-	ListenAddr string   `json:"listenAddr"`
+	// The following fields configure the main listener
+	// (see listenerConfig).
+	Registry   registry              `json:"registry,omitempty"`
+	ListenAddr string                `json:"listenAddr"`
+	TLS        *tlsConfig            `json:"tls,omitempty"`
+	Server     serverOptions         `json:"server,omitempty"`
+	Hosts      map[string]siteConfig `json:"hosts,omitempty"`
+	Paths      map[string]siteConfig `json:"paths,omitempty"`
+
+	// Listeners holds any additional listeners.
+	Listeners []listenerConfig `json:"listeners,omitempty"`
+
+	// Admin configures the admin API. It's
+	// only served when this is present.
+	Admin *adminConfig `json:"admin,omitempty"`
+
+	ReadTimeout       duration `json:"readTimeout,omitempty"`
+	ReadHeaderTimeout duration `json:"readHeaderTimeout,omitempty"`
+	WriteTimeout      duration `json:"writeTimeout,omitempty"`
+	IdleTimeout       duration `json:"idleTimeout,omitempty"`
+	ShutdownTimeout   duration `json:"shutdownTimeout,omitempty"`
+}
+
+// serverOptions holds the configurable fields of [ociserver.Options].
+type serverOptions struct {
+	DisableReferrersAPI     bool   `json:"disableReferrersAPI,omitempty"`
+	DisableSinglePostUpload bool   `json:"disableSinglePostUpload,omitempty"`
+	DebugID                 string `json:"debugID,omitempty"`
+}
+
+func (o serverOptions) new() *ociserver.Options {
+	return &ociserver.Options{
+		DisableReferrersAPI:     o.DisableReferrersAPI,
+		DisableSinglePostUpload: o.DisableSinglePostUpload,
+		DebugID:                 o.DebugID,
+	}
 }
 
 func main() {
@@ -52,40 +90,125 @@ var writeNetAddr func(l net.Listener)
 
 func main1() error {
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "usage: ocisrv $configfile.cue\n")
+		fmt.Fprintf(os.Stderr, "usage: ocisrv [vet] $configfile.cue\n")
+		fmt.Fprintf(os.Stderr, "\nThe vet command checks the configuration and prints\n")
+		fmt.Fprintf(os.Stderr, "the registry tree that it describes without serving it.\n")
+		fmt.Fprintf(os.Stderr, "\nThe server reloads its configuration on SIGHUP.\n")
 		os.Exit(2)
 	}
 	flag.Parse()
-	if flag.NArg() != 1 {
+	vet := false
+	switch {
+	case flag.NArg() == 2 && flag.Arg(0) == "vet":
+		vet = true
+	case flag.NArg() != 1:
 		flag.Usage()
 	}
-	configFile := flag.Arg(0)
+	configFile := flag.Arg(flag.NArg() - 1)
+
+	cfg, err := loadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	if vet {
+		// Don't construct any registries or servers, so that
+		// vet doesn't read credentials, certificates or secrets.
+		return printConfig(os.Stdout, cfg)
+	}
+	rl, err := newReloader(configFile, cfg)
+	if err != nil {
+		return err
+	}
+	listeners := cfg.listeners()
+	srvs := make([]*http.Server, len(listeners))
+	for i := range listeners {
+		srv, err := newServer(cfg, &listeners[i], rl.handler(i))
+		if err != nil {
+			return err
+		}
+		srvs[i] = srv
+	}
+	if cfg.Admin != nil {
+		token, err := cfg.Admin.token()
+		if err != nil {
+			return err
+		}
+		srv, err := newServer(cfg, &listenerConfig{
+			ListenAddr: cfg.Admin.ListenAddr,
+			TLS:        cfg.Admin.TLS,
+		}, &adminHandler{
+			rl:    rl,
+			token: token,
+		})
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, listenerConfig{ListenAddr: cfg.Admin.ListenAddr})
+		srvs = append(srvs, srv)
+	}
+	ls := make([]net.Listener, len(listeners))
+	for i, lc := range listeners {
+		l, err := net.Listen("tcp", lc.ListenAddr)
+		if err != nil {
+			return fmt.Errorf("cannot listen on %q: %v", lc.ListenAddr, err)
+		}
+		defer l.Close()
+		if i == 0 && writeNetAddr != nil {
+			writeNetAddr(l)
+		}
+		if cfg.Admin != nil && i == len(listeners)-1 {
+			fmt.Printf("admin API listening on %v\n", l.Addr())
+		} else {
+			fmt.Printf("listening on %v\n", l.Addr())
+		}
+		ls[i] = l
+	}
+
+	// Stop gracefully on SIGTERM or interrupt: new work is
+	// refused, but requests already in progress and chunked
+	// uploads that have been started have a chance to complete.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Reload the configuration on SIGHUP.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for {
+			select {
+			case <-hup:
+			case <-ctx.Done():
+				return
+			}
+			if err := rl.reload(); err != nil {
+				fmt.Fprintf(os.Stderr, "ocisrv: cannot reload configuration: %v\n", err)
+			} else {
+				fmt.Printf("reloaded configuration\n")
+			}
+		}
+	}()
+	if err := serveAll(ctx, srvs, ls, time.Duration(cfg.ShutdownTimeout)); err != nil {
+		return err
+	}
+	fmt.Printf("shut down\n")
+	return nil
+}
 
+// loadConfig loads the configuration from the given file.
+func loadConfig(configFile string) (*config, error) {
 	// Don't decode into Go struct yet because we want to use
 	// json v2 for that so we can decode into the registry interface
 	// type.
 	var cfgRaw json.RawValue
 	if err := cueconfig.Load(configFile, configSchema, configDefaults, nil, &cfgRaw); err != nil {
-		return err
+		return nil, err
 	}
 	cfg, err := unmarshalConfig(cfgRaw)
 	if err != nil {
-		return fmt.Errorf("cannot decode config: %v", err)
-	}
-	r, err := cfg.Registry.new()
-	if err != nil {
-		return fmt.Errorf("cannot construct registry: %v", err)
-	}
-	l, err := net.Listen("tcp", cfg.ListenAddr)
-	if err != nil {
-		return fmt.Errorf("cannot listen on %q: %v", cfg.ListenAddr, err)
-	}
-	if writeNetAddr != nil {
-		writeNetAddr(l)
+		return nil, fmt.Errorf("cannot decode config: %v", err)
 	}
-	fmt.Printf("listening on %v\n", l.Addr())
-	err = http.Serve(l, ociserver.New(r, nil))
-	return fmt.Errorf("http server error: %v", err)
+	return cfg, nil
 }
 
 func unmarshalConfig(cfgRaw []byte) (*config, error) {
@@ -17,18 +17,21 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"os"
-	"os/signal"
 	"path/filepath"
 	"testing"
 	"time"
 
 	"cuelabs.dev/go/oci/ociregistry"
 	"cuelabs.dev/go/oci/ociregistry/ociclient"
+	"cuelabs.dev/go/oci/ociregistry/ocitest"
 	"github.com/opencontainers/go-digest"
 	"github.com/rogpeppe/go-internal/testscript"
 	"github.com/rogpeppe/retry"
@@ -36,15 +39,6 @@ import (
 
 func init() {
 	writeNetAddr = writeNetAddrForTest
-
-	// Process the interrupt signal sent by testscript
-	// to ensure a clean exit.
-	sigc := make(chan os.Signal, 1)
-	signal.Notify(sigc, os.Interrupt)
-	go func() {
-		<-sigc
-		os.Exit(0)
-	}()
 }
 
 func TestMain(m *testing.M) {
@@ -65,6 +59,7 @@ func TestScript(t *testing.T) {
 		},
 		Cmds: map[string]func(ts *testscript.TestScript, neg bool, args []string){
 			"pushblob": cmdPushBlob,
+			"gencerts": cmdGenCerts,
 		},
 	})
 }
@@ -76,16 +71,16 @@ func cmdPushBlob(ts *testscript.TestScript, neg bool, args []string) {
 	repo, blobFile, dg := args[0], args[1], args[2]
 	data, err := os.ReadFile(ts.MkAbs(blobFile))
 	ts.Check(err)
-	r, err := connect(ts)
-	ts.Check(err)
 	if !neg && digest.FromBytes(data) != digest.Digest(dg) {
 		ts.Fatalf("blob digest mismatch")
 	}
-
-	_, err = r.PushBlob(context.Background(), repo, ociregistry.Descriptor{
-		Size:   int64(len(data)),
-		Digest: digest.Digest(dg),
-	}, bytes.NewReader(data))
+	r, err := connect(ts)
+	if err == nil {
+		_, err = r.PushBlob(context.Background(), repo, ociregistry.Descriptor{
+			Size:   int64(len(data)),
+			Digest: digest.Digest(dg),
+		}, bytes.NewReader(data))
+	}
 	if neg {
 		if err == nil {
 			ts.Fatalf("unexpected success")
@@ -146,7 +141,15 @@ func connect(ts *testscript.TestScript) (ociregistry.Interface, error) {
 			return nil, fmt.Errorf("timed out waiting for server")
 		}
 	}
-	resp, err := http.Get("http://" + addr + "/v2/")
+	client, err := httpClient(ts)
+	if err != nil {
+		return nil, err
+	}
+	scheme := "http"
+	if client != http.DefaultClient {
+		scheme = "https"
+	}
+	resp, err := client.Get(scheme + "://" + addr + "/v2/")
 	if err != nil {
 		return nil, fmt.Errorf("cannot ping server: %v", err)
 	}
@@ -155,10 +158,81 @@ func connect(ts *testscript.TestScript) (ociregistry.Interface, error) {
 		return nil, fmt.Errorf("unexpected ping status (%v)", resp.Status)
 	}
 	return ociclient.New(addr, &ociclient.Options{
-		Insecure: true,
+		HTTPClient: client,
+		Insecure:   scheme == "http",
 	})
 }
 
+// httpClient returns the client to use to talk to the server.
+// When $TLS_CA is set, it names a file holding the CA certificate
+// used to verify the server and TLS is used. When $TLS_CLIENT
+// is also set, the client authenticates with the certificate
+// and key in $TLS_CLIENT.pem and $TLS_CLIENT.key.
+func httpClient(ts *testscript.TestScript) (*http.Client, error) {
+	caFile := ts.Getenv("TLS_CA")
+	if caFile == "" {
+		return http.DefaultClient, nil
+	}
+	data, err := os.ReadFile(ts.MkAbs(caFile))
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		RootCAs: x509.NewCertPool(),
+	}
+	if !cfg.RootCAs.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in %q", caFile)
+	}
+	if name := ts.Getenv("TLS_CLIENT"); name != "" {
+		cert, err := tls.LoadX509KeyPair(ts.MkAbs(name+".pem"), ts.MkAbs(name+".key"))
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: cfg,
+		},
+	}, nil
+}
+
+// cmdGenCerts generates a CA certificate in ca.pem,
+// a server certificate for localhost signed by it in server.pem
+// and server.key, and a client certificate signed by it
+// in client.pem and client.key.
+func cmdGenCerts(ts *testscript.TestScript, neg bool, args []string) {
+	if neg || len(args) != 0 {
+		ts.Fatalf("usage: gencerts")
+	}
+	ca, err := ocitest.NewCertAuthority()
+	ts.Check(err)
+	writePEM(ts, "ca.pem", "CERTIFICATE", ca.Cert.Raw)
+
+	server, err := ca.ServerCert("localhost", "127.0.0.1", "::1")
+	ts.Check(err)
+	writeCert(ts, "server", server)
+	client, err := ca.ClientCert("client")
+	ts.Check(err)
+	writeCert(ts, "client", client)
+}
+
+// writeCert writes the leaf certificate of cert to name.pem
+// and its private key to name.key.
+func writeCert(ts *testscript.TestScript, name string, cert tls.Certificate) {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	ts.Check(err)
+	writePEM(ts, name+".pem", "CERTIFICATE", cert.Certificate[0])
+	writePEM(ts, name+".key", "PRIVATE KEY", keyDER)
+}
+
+func writePEM(ts *testscript.TestScript, file string, blockType string, data []byte) {
+	ts.Check(os.WriteFile(ts.MkAbs(file), pem.EncodeToMemory(&pem.Block{
+		Type:  blockType,
+		Bytes: data,
+	}), 0o666))
+}
+
 func writeNetAddrForTest(l net.Listener) {
 	f := os.Getenv("ADDR_FILE")
 	if f == "" {
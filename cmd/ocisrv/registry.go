@@ -16,12 +16,16 @@ package main
 
 import (
 	"fmt"
+	"net/url"
 	"reflect"
 	"regexp"
 	"strings"
+	"time"
 
 	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ociauth"
 	"cuelabs.dev/go/oci/ociregistry/ociclient"
+	"cuelabs.dev/go/oci/ociregistry/ociconvert"
 	"cuelabs.dev/go/oci/ociregistry/ocidebug"
 	"cuelabs.dev/go/oci/ociregistry/ocifilter"
 	"cuelabs.dev/go/oci/ociregistry/ocimem"
@@ -39,6 +43,9 @@ func init() {
 		unifyRegistry{},
 		memRegistry{},
 		debugRegistry{},
+		subRegistry{},
+		convertSchema1Registry{},
+		convertImagesRegistry{},
 	} {
 		t := reflect.TypeOf(r)
 		name, ok := strings.CutSuffix(t.Name(), "Registry")
@@ -50,20 +57,100 @@ func init() {
 }
 
 type registry interface {
-	new() (ociregistry.Interface, error)
+	// new constructs the registry, using b to
+	// construct any registries that it wraps.
+	new(b *builder) (ociregistry.Interface, error)
 }
 
 type clientRegistry struct {
-	Host     string `json:"host"`
-	Insecure bool   `json:"insecure"`
-	DebugID  string `json:"debugID,omitempty"`
+	HostURL            string      `json:"hostURL"`
+	DebugID            string      `json:"debugID,omitempty"`
+	Auth               *clientAuth `json:"auth,omitempty"`
+	MaxBlobResumes     int         `json:"maxBlobResumes,omitempty"`
+	ManifestMediaTypes []string    `json:"manifestMediaTypes,omitempty"`
 }
 
-func (r clientRegistry) new() (ociregistry.Interface, error) {
-	return ociclient.New(r.Host, &ociclient.Options{
-		DebugID:  r.DebugID,
-		Insecure: r.Insecure,
-	})
+// clientAuth holds the credentials used by a client registry.
+type clientAuth struct {
+	// DockerConfig causes credentials to be read from the
+	// usual Docker configuration files (see [ociauth.Load]).
+	DockerConfig bool `json:"dockerConfig,omitempty"`
+
+	// The remaining fields hold explicit credentials,
+	// which take precedence over any in the Docker
+	// configuration.
+	Username     string `json:"username,omitempty"`
+	Password     string `json:"password,omitempty"`
+	RefreshToken string `json:"refreshToken,omitempty"`
+	AccessToken  string `json:"accessToken,omitempty"`
+}
+
+func (r clientRegistry) new(b *builder) (ociregistry.Interface, error) {
+	u, err := url.Parse(r.HostURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid host URL: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("host URL %q has unsupported scheme (need http or https)", r.HostURL)
+	}
+	if u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.User != nil {
+		return nil, fmt.Errorf("host URL %q must contain only a scheme and a host", r.HostURL)
+	}
+	opts := &ociclient.Options{
+		DebugID:            r.DebugID,
+		Insecure:           u.Scheme == "http",
+		MaxBlobResumes:     r.MaxBlobResumes,
+		ManifestMediaTypes: r.ManifestMediaTypes,
+	}
+	if r.Auth != nil {
+		cfg, err := r.Auth.config(u.Host)
+		if err != nil {
+			return nil, err
+		}
+		opts.Authorizer = ociauth.NewStdAuthorizer(ociauth.StdAuthorizerParams{
+			Config: cfg,
+		})
+	}
+	return ociclient.New(u.Host, opts)
+}
+
+func (a *clientAuth) config(host string) (ociauth.Config, error) {
+	cfg := &staticAuthConfig{
+		host: host,
+		entry: ociauth.ConfigEntry{
+			RefreshToken: a.RefreshToken,
+			AccessToken:  a.AccessToken,
+			Username:     a.Username,
+			Password:     a.Password,
+		},
+	}
+	if a.DockerConfig {
+		f, err := ociauth.Load(nil)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load Docker auth configuration: %v", err)
+		}
+		cfg.fallback = f
+	}
+	return cfg, nil
+}
+
+// staticAuthConfig implements [ociauth.Config] by returning
+// a fixed entry for a single host, falling back to another
+// configuration when the entry is empty or for other hosts.
+type staticAuthConfig struct {
+	host     string
+	entry    ociauth.ConfigEntry
+	fallback ociauth.Config
+}
+
+func (c *staticAuthConfig) EntryForRegistry(host string) (ociauth.ConfigEntry, error) {
+	if host == c.host && c.entry != (ociauth.ConfigEntry{}) {
+		return c.entry, nil
+	}
+	if c.fallback == nil {
+		return ociauth.ConfigEntry{}, nil
+	}
+	return c.fallback.EntryForRegistry(host)
 }
 
 type selectRegistry struct {
@@ -72,16 +159,16 @@ type selectRegistry struct {
 	Exclude  *regexp.Regexp `json:"exclude,omitempty"`
 }
 
-func (r selectRegistry) new() (ociregistry.Interface, error) {
-	r1, err := r.Registry.new()
+func (r selectRegistry) new(b *builder) (ociregistry.Interface, error) {
+	r1, err := b.new(r.Registry)
 	if err != nil {
 		return nil, err
 	}
 	return ocifilter.Select(r1, func(repo string) bool {
-		if !r.Include.MatchString(repo) {
+		if r.Include != nil && !r.Include.MatchString(repo) {
 			return false
 		}
-		if r.Exclude.MatchString(repo) {
+		if r.Exclude != nil && r.Exclude.MatchString(repo) {
 			return false
 		}
 		return true
@@ -92,8 +179,8 @@ type readOnlyRegistry struct {
 	Registry registry `json:"registry"`
 }
 
-func (r readOnlyRegistry) new() (ociregistry.Interface, error) {
-	r1, err := r.Registry.new()
+func (r readOnlyRegistry) new(b *builder) (ociregistry.Interface, error) {
+	r1, err := b.new(r.Registry)
 	if err != nil {
 		return nil, err
 	}
@@ -104,8 +191,8 @@ type immutableRegistry struct {
 	Registry registry `json:"registry"`
 }
 
-func (r immutableRegistry) new() (ociregistry.Interface, error) {
-	r1, err := r.Registry.new()
+func (r immutableRegistry) new(b *builder) (ociregistry.Interface, error) {
+	r1, err := b.new(r.Registry)
 	if err != nil {
 		return nil, err
 	}
@@ -114,38 +201,124 @@ func (r immutableRegistry) new() (ociregistry.Interface, error) {
 
 type unifyRegistry struct {
 	Registries []registry `json:"registries"`
-	// TODO options
+	ReadPolicy string     `json:"readPolicy,omitempty"`
 }
 
-func (r unifyRegistry) new() (ociregistry.Interface, error) {
+func (r unifyRegistry) new(b *builder) (ociregistry.Interface, error) {
 	if len(r.Registries) != 2 {
 		return nil, fmt.Errorf("can currently unify exactly two registries only")
 	}
+	var opts ociunify.Options
+	switch r.ReadPolicy {
+	case "", "sequential":
+		opts.ReadPolicy = ociunify.ReadSequential
+	case "concurrent":
+		opts.ReadPolicy = ociunify.ReadConcurrent
+	default:
+		return nil, fmt.Errorf("unknown read policy %q", r.ReadPolicy)
+	}
 	r1 := make([]ociregistry.Interface, len(r.Registries))
 	for i := range r.Registries {
-		ri, err := r.Registries[i].new()
+		ri, err := b.new(r.Registries[i])
 		if err != nil {
 			return nil, err
 		}
 		r1[i] = ri
 	}
-	return ociunify.New(r1[0], r1[1], nil), nil
+	return ociunify.New(r1[0], r1[1], &opts), nil
 }
 
-type memRegistry struct{}
+type memRegistry struct {
+	ImmutableTags     bool     `json:"immutableTags,omitempty"`
+	UploadTimeout     duration `json:"uploadTimeout,omitempty"`
+	MaxUploadsPerRepo int      `json:"maxUploadsPerRepo,omitempty"`
+	MaxBytes          int64    `json:"maxBytes,omitempty"`
+	Evict             bool     `json:"evict,omitempty"`
+}
 
-func (r memRegistry) new() (ociregistry.Interface, error) {
-	return ocimem.New(), nil
+func (r memRegistry) new(b *builder) (ociregistry.Interface, error) {
+	return ocimem.NewWithConfig(&ocimem.Config{
+		ImmutableTags:     r.ImmutableTags,
+		UploadTimeout:     time.Duration(r.UploadTimeout),
+		MaxUploadsPerRepo: r.MaxUploadsPerRepo,
+		MaxBytes:          r.MaxBytes,
+		Evict:             r.Evict,
+	}), nil
 }
 
 type debugRegistry struct {
 	Registry registry `json:"registry"`
 }
 
-func (r debugRegistry) new() (ociregistry.Interface, error) {
-	r1, err := r.Registry.new()
+func (r debugRegistry) new(b *builder) (ociregistry.Interface, error) {
+	r1, err := b.new(r.Registry)
 	if err != nil {
 		return nil, err
 	}
 	return ocidebug.New(r1, nil), nil
 }
+
+type subRegistry struct {
+	Registry registry `json:"registry"`
+	Prefix   string   `json:"prefix"`
+}
+
+func (r subRegistry) new(b *builder) (ociregistry.Interface, error) {
+	r1, err := b.new(r.Registry)
+	if err != nil {
+		return nil, err
+	}
+	return ocifilter.Sub(r1, r.Prefix), nil
+}
+
+type convertSchema1Registry struct {
+	Registry registry `json:"registry"`
+}
+
+func (r convertSchema1Registry) new(b *builder) (ociregistry.Interface, error) {
+	r1, err := b.new(r.Registry)
+	if err != nil {
+		return nil, err
+	}
+	return ocifilter.ConvertSchema1(r1), nil
+}
+
+type convertImagesRegistry struct {
+	Registry registry `json:"registry"`
+
+	// Store holds the registry that converted images are
+	// written to. If it's nil, they're held in memory
+	// with a size limit, as by [ocifilter.ConvertImages].
+	Store            registry `json:"store,omitempty"`
+	LayerCompression string   `json:"layerCompression,omitempty"`
+	OCIMediaTypes    bool     `json:"ociMediaTypes,omitempty"`
+}
+
+func (r convertImagesRegistry) new(b *builder) (ociregistry.Interface, error) {
+	r1, err := b.new(r.Registry)
+	if err != nil {
+		return nil, err
+	}
+	var store ociregistry.Interface
+	if r.Store != nil {
+		store, err = b.new(r.Store)
+		if err != nil {
+			return nil, err
+		}
+	}
+	opts := &ociconvert.Options{
+		OCIMediaTypes: r.OCIMediaTypes,
+	}
+	switch r.LayerCompression {
+	case "":
+	case "gzip":
+		opts.LayerCompression = ociconvert.Gzip
+	case "zstd":
+		opts.LayerCompression = ociconvert.Zstd
+	case "uncompressed":
+		opts.LayerCompression = ociconvert.Uncompressed
+	default:
+		return nil, fmt.Errorf("unknown layer compression %q", r.LayerCompression)
+	}
+	return ocifilter.ConvertImages(r1, store, opts), nil
+}
@@ -0,0 +1,254 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+)
+
+// builder constructs registries from their configuration.
+// When the configuration is reloaded, registries whose
+// configuration (including that of all the registries they
+// wrap) hasn't changed are reused rather than constructed
+// again, so that, for example, the content of an in-memory
+// registry and any uploads in progress are preserved.
+//
+// Each registry is identified by its position in the
+// configuration, so a registry is only reused when the
+// registry in the same position has the same configuration.
+type builder struct {
+	// prev holds the registries constructed from the
+	// previous configuration, keyed by position.
+	prev map[string]builtRegistry
+
+	// built holds the registries constructed from
+	// the current configuration.
+	built map[string]builtRegistry
+
+	// reuse, if not nil, reports whether a registry
+	// from the previous configuration can be reused.
+	reuse func(r registry) bool
+
+	// pos holds the position of the registry
+	// currently being constructed and n holds
+	// the number of registries it has constructed.
+	pos string
+	n   int
+}
+
+// builtRegistry holds a registry and the key
+// of the configuration it was constructed from.
+type builtRegistry struct {
+	key string
+	r   ociregistry.Interface
+}
+
+func newBuilder(prev map[string]builtRegistry) *builder {
+	return &builder{
+		prev:  prev,
+		built: make(map[string]builtRegistry),
+	}
+}
+
+// build returns the registry for the configuration r
+// at the top level position with the given name.
+func (b *builder) build(name string, r registry) (ociregistry.Interface, error) {
+	b.pos, b.n = name, 0
+	return b.construct(name, r)
+}
+
+// new returns the registry for the configuration r.
+// It is called by the new method of registry
+// implementations to construct the registries that
+// they wrap.
+func (b *builder) new(r registry) (ociregistry.Interface, error) {
+	pos := fmt.Sprintf("%s/%d", b.pos, b.n)
+	b.n++
+	return b.construct(pos, r)
+}
+
+func (b *builder) construct(pos string, r registry) (ociregistry.Interface, error) {
+	key := registryKey(r)
+	if prev, ok := b.prev[pos]; ok && prev.key == key && (b.reuse == nil || b.reuse(r)) {
+		// Carry over the registries that it wraps too,
+		// so they can be reused by later reloads.
+		for p, br := range b.prev {
+			if p == pos || strings.HasPrefix(p, pos+"/") {
+				b.built[p] = br
+			}
+		}
+		return prev.r, nil
+	}
+	parentPos, parentN := b.pos, b.n
+	b.pos, b.n = pos, 0
+	ri, err := r.new(b)
+	b.pos, b.n = parentPos, parentN
+	if err != nil {
+		return nil, err
+	}
+	b.built[pos] = builtRegistry{key, ri}
+	return ri, nil
+}
+
+// reloader serves the registries configured by a
+// configuration file that can be reloaded.
+type reloader struct {
+	configFile string
+
+	// handlers holds the current handler for each listener.
+	handlers []atomic.Pointer[http.Handler]
+
+	// mu guards the fields below and serializes reloads.
+	mu         sync.Mutex
+	cfg        *config
+	registries map[string]builtRegistry
+}
+
+// newReloader returns a reloader that serves the registries
+// configured by cfg, which has been loaded from configFile.
+func newReloader(configFile string, cfg *config) (*reloader, error) {
+	rl := &reloader{
+		configFile: configFile,
+		handlers:   make([]atomic.Pointer[http.Handler], len(cfg.listeners())),
+	}
+	if err := rl.set(cfg, nil); err != nil {
+		return nil, err
+	}
+	return rl, nil
+}
+
+// handler returns the handler for the ith listener. It serves
+// each request with the handler for the most recently loaded
+// configuration. Requests in progress when the configuration
+// is reloaded complete using the old handler.
+func (rl *reloader) handler(i int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		(*rl.handlers[i].Load()).ServeHTTP(w, req)
+	})
+}
+
+// reload reloads the configuration file. The registries served
+// by each listener and their server options can be changed without
+// a restart. If the new configuration is invalid or anything else
+// has changed, it returns an error and the current configuration
+// remains in use.
+func (rl *reloader) reload() error {
+	cfg, err := loadConfig(rl.configFile)
+	if err != nil {
+		return err
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if len(cfg.listeners()) != len(rl.handlers) {
+		return fmt.Errorf("changing the number of listeners requires a restart")
+	}
+	if !equalStaticConfig(rl.cfg, cfg) {
+		return fmt.Errorf("changing listen addresses, TLS, timeouts or the admin API requires a restart")
+	}
+	return rl.set(cfg, nil)
+}
+
+// flushCaches discards any cached data held by the registries
+// by constructing them all again, except for mem registries,
+// which hold content rather than caching it.
+func (rl *reloader) flushCaches() error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.set(rl.cfg, func(r registry) bool {
+		_, ok := r.(memRegistry)
+		return ok
+	})
+}
+
+// memRegistries returns all the in-memory registries
+// that are currently in use, keyed by their position
+// in the configuration.
+func (rl *reloader) memRegistries() map[string]*ocimem.Registry {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	regs := make(map[string]*ocimem.Registry)
+	for pos, br := range rl.registries {
+		if r, ok := br.r.(*ocimem.Registry); ok {
+			regs[pos] = r
+		}
+	}
+	return regs
+}
+
+// config returns the current configuration.
+func (rl *reloader) config() *config {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.cfg
+}
+
+// set constructs the registries configured by cfg and starts
+// serving them. If reuse is not nil, it reports whether a
+// registry with unchanged configuration can be reused.
+// It must be called with rl.mu held or before rl is used.
+func (rl *reloader) set(cfg *config, reuse func(registry) bool) error {
+	b := newBuilder(rl.registries)
+	b.reuse = reuse
+	listeners := cfg.listeners()
+	handlers := make([]http.Handler, len(listeners))
+	for i := range listeners {
+		h, err := listeners[i].handler(i, b)
+		if err != nil {
+			return err
+		}
+		handlers[i] = h
+	}
+	for i := range handlers {
+		rl.handlers[i].Store(&handlers[i])
+	}
+	rl.cfg = cfg
+	rl.registries = b.built
+	return nil
+}
+
+// equalStaticConfig reports whether the fields of the two
+// configurations that can't be reloaded are the same.
+func equalStaticConfig(c0, c1 *config) bool {
+	l0, l1 := c0.listeners(), c1.listeners()
+	if len(l0) != len(l1) {
+		return false
+	}
+	for i := range l0 {
+		if l0[i].ListenAddr != l1[i].ListenAddr || !equalTLS(l0[i].TLS, l1[i].TLS) {
+			return false
+		}
+	}
+	return reflect.DeepEqual(c0.Admin, c1.Admin) &&
+		c0.ReadTimeout == c1.ReadTimeout &&
+		c0.ReadHeaderTimeout == c1.ReadHeaderTimeout &&
+		c0.WriteTimeout == c1.WriteTimeout &&
+		c0.IdleTimeout == c1.IdleTimeout &&
+		c0.ShutdownTimeout == c1.ShutdownTimeout
+}
+
+func equalTLS(t0, t1 *tlsConfig) bool {
+	if t0 == nil || t1 == nil {
+		return t0 == t1
+	}
+	return *t0 == *t1
+}
@@ -0,0 +1,144 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ociclient"
+	"github.com/opencontainers/go-digest"
+)
+
+const reloadTestConfig = `
+registry: {
+	kind: "select"
+	include: %q
+	registry: kind: "mem"
+}
+listenAddr: %q
+`
+
+func TestReload(t *testing.T) {
+	ctx := context.Background()
+	configFile := filepath.Join(t.TempDir(), "config.cue")
+	writeReloadTestConfig(t, configFile, "^foo/", "localhost:0")
+	cfg, err := loadConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl, err := newReloader(configFile, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(rl.handler(0))
+	defer srv.Close()
+	client, err := ociclient.New(strings.TrimPrefix(srv.URL, "http://"), &ociclient.Options{
+		Insecure: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("hello")
+	desc := ociregistry.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	if _, err := client.PushBlob(ctx, "foo/a", desc, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.PushBlob(ctx, "bar/a", desc, bytes.NewReader(data)); err == nil {
+		t.Fatalf("unexpected success pushing to excluded repository")
+	}
+
+	// Start a chunked upload that should survive the reload.
+	w, err := client.PushBlobChunked(ctx, "foo/a", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("other")); err != nil {
+		t.Fatal(err)
+	}
+	uploadID := w.ID()
+	w.Close()
+
+	// Reloading an unchanged configuration reuses everything.
+	if err := rl.reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Change the include regexp: the in-memory registry
+	// should be reused, so its contents remain.
+	writeReloadTestConfig(t, configFile, "^(foo|bar)/", "localhost:0")
+	if err := rl.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.ResolveBlob(ctx, "foo/a", desc.Digest); err != nil {
+		t.Fatalf("blob not found after reload: %v", err)
+	}
+	if _, err := client.PushBlob(ctx, "bar/a", desc, bytes.NewReader(data)); err != nil {
+		t.Fatalf("cannot push to newly included repository: %v", err)
+	}
+	w, err = client.PushBlobChunkedResume(ctx, "foo/a", uploadID, 5, 0)
+	if err != nil {
+		t.Fatalf("cannot resume upload after reload: %v", err)
+	}
+	if _, err := w.Commit(digest.FromString("other")); err != nil {
+		t.Fatal(err)
+	}
+
+	// An invalid configuration leaves the current one in place.
+	if err := os.WriteFile(configFile, []byte("registry: kind: \"unknown\"\n"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	if err := rl.reload(); err == nil {
+		t.Fatalf("unexpected success reloading invalid configuration")
+	}
+	if _, err := client.ResolveBlob(ctx, "bar/a", desc.Digest); err != nil {
+		t.Fatalf("blob not found after failed reload: %v", err)
+	}
+
+	// Changes to other fields cause the whole reload to
+	// be rejected, every time until the server is restarted.
+	writeReloadTestConfig(t, configFile, "^foo/", "localhost:1234")
+	for range 2 {
+		err = rl.reload()
+		if err == nil || !strings.Contains(err.Error(), "requires a restart") {
+			t.Fatalf("unexpected error from reload: %v", err)
+		}
+	}
+	if _, err := client.PushBlob(ctx, "bar/b", desc, bytes.NewReader(data)); err != nil {
+		t.Fatalf("registries changed by rejected reload: %v", err)
+	}
+	if got := rl.config().listeners()[0].ListenAddr; got != "localhost:0" {
+		t.Fatalf("unexpected listen address after rejected reload: %q", got)
+	}
+}
+
+func writeReloadTestConfig(t *testing.T, file string, include string, listenAddr string) {
+	cfg := fmt.Sprintf(reloadTestConfig, include, listenAddr)
+	if err := os.WriteFile(file, []byte(cfg), 0o666); err != nil {
+		t.Fatal(err)
+	}
+}
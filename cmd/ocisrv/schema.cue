@@ -17,9 +17,24 @@ package ocisrv
 import "regexp"
 
 #client: {
-	kind:     "client"
-	hostURL!: string
+	kind: "client"
+
+	// hostURL holds the URL of the registry host, for
+	// example "https://registry.example.com". An http
+	// scheme causes an insecure connection to be used.
+	hostURL!: =~"^https?://[^/]+/?$"
 	debugID?: string
+	auth?: {
+		// dockerConfig causes credentials to be read
+		// from the usual Docker configuration files.
+		dockerConfig?: bool
+		username?:     string
+		password?:     string
+		refreshToken?: string
+		accessToken?:  string
+	}
+	maxBlobResumes?: int
+	manifestMediaTypes?: [...string]
 }
 
 #select: {
@@ -42,10 +57,27 @@ import "regexp"
 #unify: {
 	kind: "unify"
 	registries!: [#registry, #registry]
+	readPolicy?: "sequential" | "concurrent"
 }
 
 #mem: {
-	kind: "mem"
+	kind:           "mem"
+	immutableTags?: bool
+
+	// uploadTimeout holds how long a chunked upload can be
+	// idle before it's discarded. A negative duration
+	// means that uploads never expire.
+	uploadTimeout?:     #duration
+	maxUploadsPerRepo?: int & >=0
+
+	// maxBytes holds the maximum total size of the content
+	// in the registry. Zero means no limit.
+	maxBytes?: int & >=0
+
+	// evict specifies that, when the registry is full,
+	// least recently used untagged content is removed
+	// to make room instead of rejecting the write.
+	evict?: bool
 }
 
 #debug: {
@@ -53,17 +85,99 @@ import "regexp"
 	registry!: #registry
 }
 
+#sub: {
+	kind:      "sub"
+	registry!: #registry
+	prefix!:   string
+}
+
+#convertSchema1: {
+	kind:      "convertSchema1"
+	registry!: #registry
+}
+
+#convertImages: {
+	kind:      "convertImages"
+	registry!: #registry
+
+	// store holds the registry that converted images are
+	// written to. By default they're held in memory, up to
+	// 1GiB, with the least recently used discarded to make
+	// room. A mem store with maxBytes and evict set gives
+	// a different limit.
+	store?:            #registry
+	layerCompression?: "gzip" | "zstd" | "uncompressed"
+	ociMediaTypes?:    bool
+}
+
 #registry: #client |
 	#select |
 	#readOnly |
 	#immutable |
 	#unify |
 	#mem |
-	#debug
+	#debug |
+	#sub |
+	#convertSchema1 |
+	#convertImages
 
 #registry: {
 	kind!: string
 }
 
-registry!:   #registry
-listenAddr!: string
+// #duration holds a duration as understood by Go's time.ParseDuration.
+#duration: =~"^-?([0-9]+(\\.[0-9]*)?(ns|us|µs|ms|s|m|h))+$|^0$"
+
+#tls: {
+	certFile!:     string
+	keyFile!:      string
+	clientCAFile?: string
+	clientAuth?:   "require" | "verifyIfGiven"
+}
+
+#server: {
+	disableReferrersAPI?:     bool
+	disableSinglePostUpload?: bool
+	debugID?:                 string
+}
+
+// #site configures a registry served
+// for a host name or path prefix.
+#site: {
+	registry!: #registry
+	server?:   #server
+}
+
+// #listener configures a listener. Requests are routed by
+// host name first, then by path prefix, and then to registry
+// if it's present.
+#listener: {
+	listenAddr!: string
+	tls?:        #tls
+	registry?:   #registry
+	server?:     #server
+	hosts?: [string]: #site
+	paths?: [=~"^/?[^/]+(/[^/]+)*/?$"]: #site
+}
+
+// The top level configures the main listener.
+#listener
+
+// listeners configures any additional listeners.
+listeners?: [...#listener]
+
+// admin configures the admin API, which is served on its
+// own listener and requires a bearer token: either token
+// or tokenFile must be present.
+admin?: {
+	listenAddr!: string
+	tls?:        #tls
+	token?:      string
+	tokenFile?:  string
+}
+
+readTimeout?:       #duration
+readHeaderTimeout?: #duration
+writeTimeout?:      #duration
+idleTimeout?:       #duration
+shutdownTimeout?:   #duration
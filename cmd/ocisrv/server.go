@@ -0,0 +1,272 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tlsConfig holds the TLS configuration for the server.
+type tlsConfig struct {
+	// CertFile and KeyFile hold the PEM-encoded
+	// certificate chain and private key for the server.
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+
+	// ClientCAFile holds PEM-encoded certificates of the CAs
+	// used to verify client certificates. If it's empty,
+	// clients aren't asked for certificates.
+	ClientCAFile string `json:"clientCAFile,omitempty"`
+
+	// ClientAuth determines whether clients must present
+	// a certificate when ClientCAFile is set: it's either
+	// "require" or "verifyIfGiven".
+	ClientAuth string `json:"clientAuth,omitempty"`
+}
+
+// duration is a time.Duration that's unmarshaled from
+// a string as understood by time.ParseDuration.
+type duration time.Duration
+
+func (d *duration) UnmarshalText(data []byte) error {
+	d1, err := time.ParseDuration(string(data))
+	if err != nil {
+		return err
+	}
+	*d = duration(d1)
+	return nil
+}
+
+// newServer returns an HTTP server that serves h on
+// the listener configured by lc, with the timeouts
+// configured by cfg.
+func newServer(cfg *config, lc *listenerConfig, h http.Handler) (*http.Server, error) {
+	srv := &http.Server{
+		Handler:           newDrainHandler(h),
+		ReadTimeout:       time.Duration(cfg.ReadTimeout),
+		ReadHeaderTimeout: time.Duration(cfg.ReadHeaderTimeout),
+		WriteTimeout:      time.Duration(cfg.WriteTimeout),
+		IdleTimeout:       time.Duration(cfg.IdleTimeout),
+	}
+	if lc.TLS == nil {
+		return srv, nil
+	}
+	tlsCfg, err := lc.TLS.new()
+	if err != nil {
+		return nil, err
+	}
+	srv.TLSConfig = tlsCfg
+	return srv, nil
+}
+
+func (c *tlsConfig) new() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load TLS certificate: %v", err)
+	}
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if c.ClientCAFile == "" {
+		return cfg, nil
+	}
+	data, err := os.ReadFile(c.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read client CA file: %v", err)
+	}
+	cfg.ClientCAs = x509.NewCertPool()
+	if !cfg.ClientCAs.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %q", c.ClientCAFile)
+	}
+	switch c.ClientAuth {
+	case "", "require":
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	case "verifyIfGiven":
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("unknown client auth mode %q", c.ClientAuth)
+	}
+	return cfg, nil
+}
+
+// serveAll calls serve for each of the servers with the
+// corresponding listener. If any server fails, the others
+// are shut down.
+func serveAll(ctx context.Context, srvs []*http.Server, ls []net.Listener, shutdownTimeout time.Duration) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make([]error, len(srvs))
+	var wg sync.WaitGroup
+	for i := range srvs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if errs[i] = serve(ctx, srvs[i], ls[i], shutdownTimeout); errs[i] != nil {
+				cancel()
+			}
+		}(i)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// serve serves requests on l until ctx is done, at which point it
+// stops accepting new work and waits up to shutdownTimeout for
+// requests in progress to complete. If srv's handler was created by
+// newServer, chunked uploads that are in progress can continue until
+// they're finished or the timeout expires.
+func serve(ctx context.Context, srv *http.Server, l net.Listener, shutdownTimeout time.Duration) error {
+	errc := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			// The certificates are already in TLSConfig.
+			errc <- srv.ServeTLS(l, "", "")
+		} else {
+			errc <- srv.Serve(l)
+		}
+	}()
+	select {
+	case err := <-errc:
+		return fmt.Errorf("http server error: %v", err)
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if h, ok := srv.Handler.(*drainHandler); ok {
+		h.drain(shutdownCtx)
+	}
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		srv.Close()
+		return fmt.Errorf("cannot shut down cleanly: %v", err)
+	}
+	return nil
+}
+
+// maxUploadIdle holds how long a chunked upload can go without
+// a request before drainHandler stops treating it as in progress.
+const maxUploadIdle = 10 * time.Minute
+
+// drainHandler wraps an HTTP handler, keeping track of the chunked
+// uploads in progress so that, when the server is shutting down, the
+// requests that continue them can be served while other requests are
+// refused.
+type drainHandler struct {
+	handler http.Handler
+
+	mu sync.Mutex
+
+	// uploads maps from the URL path of each chunked upload
+	// in progress to the time of its most recent request.
+	uploads map[string]time.Time
+
+	// draining is set when the server is shutting down.
+	draining bool
+
+	// drained is closed when draining is set
+	// and there are no uploads in progress.
+	drained chan struct{}
+}
+
+func newDrainHandler(h http.Handler) *drainHandler {
+	return &drainHandler{
+		handler: h,
+		uploads: make(map[string]time.Time),
+		drained: make(chan struct{}),
+	}
+}
+
+func (h *drainHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := req.URL.Path
+	h.mu.Lock()
+	_, inUpload := h.uploads[path]
+	if inUpload {
+		h.uploads[path] = time.Now()
+	}
+	draining := h.draining
+	h.mu.Unlock()
+	if draining && !inUpload {
+		w.Header().Set("Connection", "close")
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	h.handler.ServeHTTP(w, req)
+
+	// The header map remains available after the response
+	// has been written. A Location header that refers to an
+	// upload is only sent when an upload has been started
+	// or continued.
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if u, err := url.Parse(w.Header().Get("Location")); err == nil && strings.Contains(u.Path, "/blobs/uploads/") {
+		h.addUpload(u.Path)
+	}
+	if inUpload && (req.Method == http.MethodPut || req.Method == http.MethodDelete) {
+		// The upload has been completed or cancelled.
+		delete(h.uploads, path)
+	}
+	h.checkDrained()
+}
+
+// addUpload records that the upload with the given path
+// is in progress, forgetting any that have been idle
+// for longer than maxUploadIdle.
+// It must be called with h.mu held.
+func (h *drainHandler) addUpload(path string) {
+	now := time.Now()
+	for p, t := range h.uploads {
+		if now.Sub(t) > maxUploadIdle {
+			delete(h.uploads, p)
+		}
+	}
+	h.uploads[path] = now
+}
+
+// drain causes new work to be refused and waits until there
+// are no uploads in progress or ctx is done.
+func (h *drainHandler) drain(ctx context.Context) {
+	h.mu.Lock()
+	h.draining = true
+	h.checkDrained()
+	h.mu.Unlock()
+	select {
+	case <-h.drained:
+	case <-ctx.Done():
+	}
+}
+
+// checkDrained closes h.drained if draining has
+// finished. It must be called with h.mu held.
+func (h *drainHandler) checkDrained() {
+	if !h.draining || len(h.uploads) > 0 {
+		return
+	}
+	select {
+	case <-h.drained:
+	default:
+		close(h.drained)
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ociserver"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestServeDrainsRequestsOnShutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			close(started)
+			<-release
+			io.WriteString(w, "done")
+		}),
+	}
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- serve(ctx, srv, l, time.Minute)
+	}()
+
+	type result struct {
+		body string
+		err  error
+	}
+	respc := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String())
+		if err != nil {
+			respc <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		respc <- result{string(data), err}
+	}()
+	<-started
+	cancel()
+
+	// The server should wait for the request to complete.
+	select {
+	case err := <-serveErr:
+		t.Fatalf("serve returned early with error %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if r := <-respc; r.err != nil || r.body != "done" {
+		t.Fatalf("unexpected response %q, error %v", r.body, r.err)
+	}
+	if err := <-serveErr; err != nil {
+		t.Fatalf("unexpected serve error: %v", err)
+	}
+}
+
+func TestServeShutdownTimeout(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			close(started)
+			<-release
+		}),
+	}
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- serve(ctx, srv, l, 10*time.Millisecond)
+	}()
+	go http.Get("http://" + l.Addr().String())
+	<-started
+	cancel()
+	if err := <-serveErr; err == nil {
+		t.Fatalf("expected error from serve after shutdown timeout")
+	}
+}
+
+func TestServeFinishesUploadsOnShutdown(t *testing.T) {
+	srv, err := newServer(&config{}, &listenerConfig{}, ociserver.New(ocimem.New(), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- serve(ctx, srv, l, time.Minute)
+	}()
+	srvURL := "http://" + l.Addr().String()
+	do := func(method, path string, body string) *http.Response {
+		req, err := http.NewRequest(method, srvURL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	resp := do("POST", "/v2/foo/blobs/uploads/", "")
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("unexpected status %v starting upload", resp.Status)
+	}
+	loc := resp.Header.Get("Location")
+	cancel()
+
+	// Wait for the server to start refusing new work.
+	for do("GET", "/v2/", "").StatusCode != http.StatusServiceUnavailable {
+		time.Sleep(time.Millisecond)
+	}
+	if resp := do("POST", "/v2/foo/blobs/uploads/", ""); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected status %v starting upload while shutting down", resp.Status)
+	}
+
+	// The upload in progress can still be finished.
+	resp = do("PATCH", loc, "hello")
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("unexpected status %v writing to upload", resp.Status)
+	}
+	select {
+	case err := <-serveErr:
+		t.Fatalf("serve returned early with error %v", err)
+	default:
+	}
+	resp = do("PUT", resp.Header.Get("Location")+"?digest="+string(digest.FromString("hello")), "")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("unexpected status %v committing upload", resp.Status)
+	}
+	if err := <-serveErr; err != nil {
+		t.Fatalf("unexpected serve error: %v", err)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	registryType = reflect.TypeOf((*registry)(nil)).Elem()
+	durationType = reflect.TypeOf(duration(0))
+	regexpType   = reflect.TypeOf((*regexp.Regexp)(nil))
+)
+
+// secretFields holds the JSON names of fields
+// whose values are not printed.
+var secretFields = map[string]bool{
+	"password":     true,
+	"refreshToken": true,
+	"accessToken":  true,
+}
+
+// printConfig writes a description of the registries configured
+// by cfg to w. When there's only a single registry, it's printed
+// as by printRegistry; otherwise the registries are listed under
+// the listener that serves them. It returns an error, without
+// printing anything, if a listener has no registries.
+func printConfig(w io.Writer, cfg *config) error {
+	listeners := cfg.listeners()
+	for i := range listeners {
+		if err := listeners[i].checkRegistries(); err != nil {
+			return err
+		}
+	}
+	if len(listeners) == 1 && len(cfg.Hosts) == 0 && len(cfg.Paths) == 0 {
+		printRegistry(w, cfg.Registry)
+		return nil
+	}
+	for _, lc := range listeners {
+		fmt.Fprintf(w, "listener %s\n", lc.ListenAddr)
+		if lc.Registry != nil {
+			printRegistry1(w, lc.Registry, true, "\t", "default: ")
+		}
+		for _, host := range sortedKeys(lc.Hosts) {
+			printRegistry1(w, lc.Hosts[host].Registry, true, "\t", fmt.Sprintf("host %q: ", host))
+		}
+		for _, prefix := range sortedKeys(lc.Paths) {
+			printRegistry1(w, lc.Paths[prefix].Registry, true, "\t", fmt.Sprintf("path %q: ", prefix))
+		}
+	}
+	return nil
+}
+
+// printRegistry writes a description of the registry
+// tree rooted at r to w, one registry per line, with
+// each registry indented below the one that wraps it.
+// Secret values are redacted.
+func printRegistry(w io.Writer, r registry) {
+	printRegistry1(w, r, true, "", "")
+}
+
+// registryKey returns a string that uniquely
+// identifies the configuration of r.
+func registryKey(r registry) string {
+	var buf strings.Builder
+	printRegistry1(&buf, r, false, "", "")
+	return buf.String()
+}
+
+func printRegistry1(w io.Writer, r registry, redact bool, indent, label string) {
+	v := reflect.ValueOf(r)
+	t := v.Type()
+	kind, _ := strings.CutSuffix(t.Name(), "Registry")
+	var params []string
+	type child struct {
+		label string
+		r     registry
+	}
+	var children []child
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := jsonName(f)
+		fv := v.Field(i)
+		switch {
+		case f.Type == registryType:
+			if !fv.IsNil() {
+				children = append(children, child{name, fv.Interface().(registry)})
+			}
+		case f.Type == reflect.SliceOf(registryType):
+			for j := 0; j < fv.Len(); j++ {
+				children = append(children, child{fmt.Sprintf("%s[%d]", name, j), fv.Index(j).Interface().(registry)})
+			}
+		default:
+			params = appendParams(params, name, fv, redact)
+		}
+	}
+	fmt.Fprintf(w, "%s%s%s", indent, label, kind)
+	for _, p := range params {
+		fmt.Fprintf(w, " %s", p)
+	}
+	fmt.Fprintln(w)
+	for _, c := range children {
+		printRegistry1(w, c.r, redact, indent+"\t", c.label+": ")
+	}
+}
+
+// appendParams appends name=value descriptions of v to params,
+// omitting zero values. Fields of structs are described individually.
+func appendParams(params []string, name string, v reflect.Value, redact bool) []string {
+	if v.IsZero() {
+		return params
+	}
+	switch {
+	case redact && secretFields[name[strings.LastIndex(name, ".")+1:]]:
+		return append(params, name+"=<redacted>")
+	case v.Type() == durationType:
+		return append(params, fmt.Sprintf("%s=%v", name, time.Duration(v.Int())))
+	case v.Type() == regexpType:
+		return append(params, fmt.Sprintf("%s=%q", name, v.Interface().(*regexp.Regexp).String()))
+	case v.Kind() == reflect.Pointer:
+		return appendParams(params, name, v.Elem(), redact)
+	case v.Kind() == reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).IsExported() {
+				params = appendParams(params, name+"."+jsonName(t.Field(i)), v.Field(i), redact)
+			}
+		}
+		return params
+	}
+	return append(params, fmt.Sprintf("%s=%#v", name, v.Interface()))
+}
+
+func jsonName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	if name == "" {
+		return f.Name
+	}
+	return name
+}
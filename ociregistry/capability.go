@@ -0,0 +1,149 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociregistry
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"cuelabs.dev/go/oci/ociregistry/internal/exp/slices"
+)
+
+// Capabilities represents a set of optional features
+// that a registry implementation may support.
+type Capabilities uint32
+
+const (
+	// CapReferrers indicates that the Referrers method is supported.
+	CapReferrers Capabilities = 1 << iota
+
+	// CapBlobRange indicates that the GetBlobRange method is supported.
+	CapBlobRange
+
+	// CapMount indicates that the MountBlob method is supported.
+	CapMount
+
+	// CapDelete indicates that the DeleteBlob, DeleteManifest
+	// and DeleteTag methods are supported.
+	CapDelete
+
+	// CapPush indicates that the PushBlob and PushManifest
+	// methods are supported.
+	CapPush
+
+	// CapChunkedUpload indicates that the PushBlobChunked
+	// method is supported.
+	CapChunkedUpload
+
+	// CapChunkedResume indicates that the PushBlobChunkedResume
+	// method is supported.
+	CapChunkedResume
+
+	// CapDeleteRepository indicates that the registry implements
+	// [RepositoryDeleter] and that its DeleteRepository method
+	// is supported.
+	CapDeleteRepository
+
+	// AllCapabilities holds all the known capabilities.
+	AllCapabilities = CapReferrers | CapBlobRange | CapMount | CapDelete | CapPush | CapChunkedUpload | CapChunkedResume | CapDeleteRepository
+
+	// WriteCapabilities holds all the capabilities that
+	// involve changing the contents of a registry.
+	WriteCapabilities = CapMount | CapDelete | CapPush | CapChunkedUpload | CapChunkedResume | CapDeleteRepository
+)
+
+var capabilityNames = []string{
+	"referrers",
+	"blobrange",
+	"mount",
+	"delete",
+	"push",
+	"chunkedupload",
+	"chunkedresume",
+	"deleterepository",
+}
+
+// Has reports whether c holds all the capabilities in c1.
+func (c Capabilities) Has(c1 Capabilities) bool {
+	return c&c1 == c1
+}
+
+// String returns the names of the capabilities in c
+// separated by "|" characters.
+func (c Capabilities) String() string {
+	var names []string
+	for i, name := range capabilityNames {
+		if c&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "|")
+}
+
+// ParseCapabilities parses capabilities in the format produced
+// by [Capabilities.String]. Unknown names are ignored so that
+// capabilities can be added in the future.
+func ParseCapabilities(s string) Capabilities {
+	var c Capabilities
+	for _, name := range strings.Split(s, "|") {
+		if i := slices.Index(capabilityNames, strings.TrimSpace(name)); i >= 0 {
+			c |= 1 << i
+		}
+	}
+	return c
+}
+
+// CapabilityReporter is an optional interface that may be
+// implemented by an [Interface] implementation to report
+// the optional features it supports.
+//
+// Implementations that wrap another registry should
+// report the capabilities of the underlying registry
+// (see [CapabilitiesOf]), minus those that the wrapper
+// itself does not provide.
+type CapabilityReporter interface {
+	Capabilities(ctx context.Context) Capabilities
+}
+
+// CapabilitiesOf returns the capabilities of r.
+// If r does not implement [CapabilityReporter],
+// it returns [AllCapabilities]: callers must always be
+// prepared for an operation to fail with [ErrUnsupported].
+// [CapDeleteRepository] is only reported when r
+// implements [RepositoryDeleter].
+func CapabilitiesOf(ctx context.Context, r Interface) Capabilities {
+	caps := AllCapabilities
+	if r, ok := r.(CapabilityReporter); ok {
+		caps = r.Capabilities(ctx)
+	}
+	if _, ok := r.(RepositoryDeleter); !ok {
+		caps &^= CapDeleteRepository
+	}
+	return caps
+}
+
+// DeleteRepository deletes the given repository from r.
+// It returns an [ErrUnsupported] error if r does not
+// implement [RepositoryDeleter].
+func DeleteRepository(ctx context.Context, r Interface, repo string) error {
+	if r, ok := r.(RepositoryDeleter); ok {
+		return r.DeleteRepository(ctx, repo)
+	}
+	return fmt.Errorf("%w: DeleteRepository", ErrUnsupported)
+}
@@ -1,9 +1,10 @@
 module cuelabs.dev/go/oci/ociregistry
 
-go 1.20
+go 1.23
 
 require (
 	github.com/go-quicktest/qt v1.100.0
+	github.com/klauspost/compress v1.18.0
 	github.com/opencontainers/go-digest v1.0.0
 	github.com/opencontainers/image-spec v1.1.0-rc4
 	github.com/rogpeppe/go-internal v1.10.1-0.20230524175051-ec119421bb97
@@ -99,6 +99,17 @@ type Reader interface {
 	// If offset1 is negative or exceeds the actual size of the blob, GetBlobRange will
 	// return all the data starting from offset0.
 	// The context also controls the lifetime of the returned BlobReader.
+	//
+	// The returned reader yields exactly the bytes in the requested range
+	// (which may be empty when offset0 is equal to the size of the blob
+	// or to offset1); its Descriptor method returns the descriptor of the
+	// whole blob, not of the range. The content is not verified against the digest.
+	//
+	// Errors:
+	// - ErrNameUnknown when the repository is not present.
+	// - ErrBlobUnknown when the blob is not present in the repository.
+	// - ErrRangeInvalid when offset0 is negative or greater than the size of
+	// the blob, or when offset1 is non-negative and less than offset0.
 	GetBlobRange(ctx context.Context, repo string, digest Digest, offset0, offset1 int64) (BlobReader, error)
 
 	// GetManifest returns the contents of the manifest with the given digest.
@@ -207,6 +218,17 @@ type Deleter interface {
 	DeleteTag(ctx context.Context, repo string, name string) error
 }
 
+// RepositoryDeleter is an optional interface that may be implemented
+// by an [Interface] implementation that can delete an entire repository
+// in one operation. Use [DeleteRepository] to call it.
+type RepositoryDeleter interface {
+	// DeleteRepository deletes the given repository, including
+	// all its tags, manifests and blobs.
+	// Errors:
+	// - ErrNameUnknown when the repository is not present.
+	DeleteRepository(ctx context.Context, repo string) error
+}
+
 // Lister defines registry operations that enumerate objects within the registry.
 // TODO support resumption from a given point.
 type Lister interface {
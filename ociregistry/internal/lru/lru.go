@@ -0,0 +1,92 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package lru implements a fixed-size cache that discards
+// the least recently used entries first.
+package lru
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Cache is a cache that holds at most a fixed number of entries.
+// It's safe to use concurrently.
+type Cache[K comparable, V any] struct {
+	max int
+
+	mu sync.Mutex
+
+	// items maps from key to the element in order
+	// that holds the entry for the key.
+	items map[K]*list.Element
+
+	// order holds the entries, most recently used first.
+	order list.List
+}
+
+type entry[K comparable, V any] struct {
+	key   K
+	value V
+}
+
+// New returns a new cache that holds at most max entries.
+// It panics if max isn't positive.
+func New[K comparable, V any](max int) *Cache[K, V] {
+	if max <= 0 {
+		panic("non-positive LRU cache size")
+	}
+	return &Cache[K, V]{
+		max:   max,
+		items: make(map[K]*list.Element),
+	}
+}
+
+// Get returns the value for the given key and
+// reports whether it was found.
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return *new(V), false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*entry[K, V]).value, true
+}
+
+// Add sets the value for the given key, discarding
+// the least recently used entry if the cache is full.
+func (c *Cache[K, V]) Add(key K, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok {
+		e.Value.(*entry[K, V]).value = value
+		c.order.MoveToFront(e)
+		return
+	}
+	c.items[key] = c.order.PushFront(&entry[K, V]{key, value})
+	if len(c.items) > c.max {
+		e := c.order.Back()
+		c.order.Remove(e)
+		delete(c.items, e.Value.(*entry[K, V]).key)
+	}
+}
+
+// Len returns the number of entries in the cache.
+func (c *Cache[K, V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.items)
+}
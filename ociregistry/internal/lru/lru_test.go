@@ -0,0 +1,45 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lru
+
+import (
+	"testing"
+
+	"github.com/go-quicktest/qt"
+)
+
+func TestCache(t *testing.T) {
+	c := New[string, int](2)
+	c.Add("a", 1)
+	c.Add("b", 2)
+
+	// Using a makes b the least recently used.
+	v, ok := c.Get("a")
+	qt.Check(t, qt.IsTrue(ok))
+	qt.Check(t, qt.Equals(v, 1))
+	c.Add("c", 3)
+	qt.Check(t, qt.Equals(c.Len(), 2))
+	_, ok = c.Get("b")
+	qt.Check(t, qt.IsFalse(ok))
+
+	// Replacing a value doesn't add an entry.
+	c.Add("a", 10)
+	qt.Check(t, qt.Equals(c.Len(), 2))
+	v, _ = c.Get("a")
+	qt.Check(t, qt.Equals(v, 10))
+	v, ok = c.Get("c")
+	qt.Check(t, qt.IsTrue(ok))
+	qt.Check(t, qt.Equals(v, 3))
+}
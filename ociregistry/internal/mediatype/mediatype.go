@@ -0,0 +1,69 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mediatype holds the Docker schema2 media types and
+// their relationship to the OCI media types, for the use of
+// the packages that understand both.
+package mediatype
+
+import (
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	DockerManifest         = "application/vnd.docker.distribution.manifest.v2+json"
+	DockerManifestList     = "application/vnd.docker.distribution.manifest.list.v2+json"
+	DockerConfig           = "application/vnd.docker.container.image.v1+json"
+	DockerLayer            = "application/vnd.docker.image.rootfs.diff.tar"
+	DockerLayerGzip        = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	DockerForeignLayerGzip = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+)
+
+// dockerToOCI maps from Docker schema2 media
+// types to their OCI equivalents.
+var dockerToOCI = map[string]string{
+	DockerManifest:         ocispec.MediaTypeImageManifest,
+	DockerManifestList:     ocispec.MediaTypeImageIndex,
+	DockerConfig:           ocispec.MediaTypeImageConfig,
+	DockerLayer:            ocispec.MediaTypeImageLayer,
+	DockerLayerGzip:        ocispec.MediaTypeImageLayerGzip,
+	DockerForeignLayerGzip: "application/vnd.oci.image.layer.nondistributable.v1.tar+gzip",
+}
+
+// OCI returns the OCI equivalent of the given Docker
+// schema2 media type. Any other media type is returned unchanged.
+func OCI(mediaType string) string {
+	if t, ok := dockerToOCI[mediaType]; ok {
+		return t
+	}
+	return mediaType
+}
+
+// IsManifest reports whether the media type is that
+// of an OCI image manifest or a Docker schema2 manifest.
+func IsManifest(mediaType string) bool {
+	return mediaType == ocispec.MediaTypeImageManifest || mediaType == DockerManifest
+}
+
+// IsIndex reports whether the media type is that of
+// an OCI image index or a Docker manifest list.
+func IsIndex(mediaType string) bool {
+	return mediaType == ocispec.MediaTypeImageIndex || mediaType == DockerManifestList
+}
+
+// IsImageConfig reports whether the media type is that of
+// an OCI or Docker image configuration.
+func IsImageConfig(mediaType string) bool {
+	return mediaType == ocispec.MediaTypeImageConfig || mediaType == DockerConfig
+}
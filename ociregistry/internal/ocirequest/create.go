@@ -80,6 +80,9 @@ func (req *Request) construct() (method string, url string) {
 		return "GET", "/v2/" + req.Repo + "/referrers/" + req.Digest
 	case ReqCatalogList:
 		return "GET", "/v2/_catalog" + req.listParams()
+	case ReqRepositoryDelete:
+		// Note: this is specific to the ociserver implementation.
+		return "DELETE", "/v2/" + req.Repo + "/_cuelabs/repository"
 	default:
 		panic("invalid request kind")
 	}
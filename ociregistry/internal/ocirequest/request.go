@@ -177,6 +177,11 @@ const (
 	// Catalog endpoints (out-of-spec)
 	// 	GET	/v2/_catalog
 	ReqCatalogList
+
+	// Extension endpoints (out-of-spec, specific to ociserver)
+
+	// 	DELETE	/v2/<name>/_cuelabs/repository	202	404
+	ReqRepositoryDelete
 )
 
 // Parse parses the given HTTP method and URL as an OCI registry request.
@@ -391,6 +396,22 @@ func parse(method string, u *url.URL) (*Request, error) {
 		rreq.Digest = last
 		rreq.Kind = ReqReferrersList
 		return &rreq, nil
+	case "_cuelabs":
+		// Note: repository names can't contain path elements
+		// starting with an underscore, so this can't be confused
+		// with a regular repository.
+		if last != "repository" {
+			return nil, ErrNotFound
+		}
+		if method != "DELETE" {
+			return nil, ErrMethodNotAllowed
+		}
+		rreq.Repo = path
+		if !ociregistry.IsValidRepoName(rreq.Repo) {
+			return nil, ociregistry.ErrNameInvalid
+		}
+		rreq.Kind = ReqRepositoryDelete
+		return &rreq, nil
 	}
 	return nil, ErrNotFound
 }
@@ -141,6 +141,19 @@ var parseRequestTests = []struct {
 		Repo:   "myorg/myrepo",
 		Digest: "sha256:681aef2367e055f33cb8a6ab9c3090931f6eefd0c3ef15c6e4a79bdadfdb8982",
 	},
+}, {
+	testName: "repositoryDelete",
+	method:   "DELETE",
+	url:      "/v2/myorg/myrepo/_cuelabs/repository",
+	wantRequest: &Request{
+		Kind: ReqRepositoryDelete,
+		Repo: "myorg/myrepo",
+	},
+}, {
+	testName:  "repositoryDeleteBadMethod",
+	method:    "GET",
+	url:       "/v2/myorg/myrepo/_cuelabs/repository",
+	wantError: `method not allowed`,
 }}
 
 func TestParseRequest(t *testing.T) {
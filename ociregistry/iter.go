@@ -14,13 +14,18 @@
 
 package ociregistry
 
+import "iter"
+
 type Iter[T any] interface {
 	Close()
 	Next() (T, bool)
 	Error() error
 }
 
+// All returns all the items in it. The iterator
+// is closed when All returns.
 func All[T any](it Iter[T]) ([]T, error) {
+	defer it.Close()
 	xs := []T{}
 	for {
 		x, ok := it.Next()
@@ -76,3 +81,254 @@ func (it errorIter[T]) Next() (T, bool) {
 func (it errorIter[T]) Error() error {
 	return it.err
 }
+
+// Seq returns a range-over-func sequence that yields all the
+// items in it, each with a nil error. If it finishes with an
+// error, the sequence yields a final item with the zero
+// value and that error.
+//
+// The iterator is closed when the sequence
+// finishes or the loop over it is terminated early.
+func Seq[T any](it Iter[T]) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		defer it.Close()
+		for {
+			x, ok := it.Next()
+			if !ok {
+				break
+			}
+			if !yield(x, nil) {
+				return
+			}
+		}
+		if err := it.Error(); err != nil {
+			yield(*new(T), err)
+		}
+	}
+}
+
+// FromSeq returns an iterator that yields the items produced by seq.
+// When seq yields a non-nil error, iteration stops and the
+// iterator's Error method returns that error.
+//
+// The returned iterator must be closed when
+// it's not used to completion.
+func FromSeq[T any](seq iter.Seq2[T, error]) Iter[T] {
+	next, stop := iter.Pull2(seq)
+	return &seqIter[T]{
+		next: next,
+		stop: stop,
+	}
+}
+
+type seqIter[T any] struct {
+	next func() (T, error, bool)
+	stop func()
+	err  error
+}
+
+func (it *seqIter[T]) Close() {
+	it.stop()
+}
+
+func (it *seqIter[T]) Next() (T, bool) {
+	if it.err != nil {
+		return *new(T), false
+	}
+	x, err, ok := it.next()
+	if !ok {
+		return *new(T), false
+	}
+	if err != nil {
+		it.err = err
+		it.stop()
+		return *new(T), false
+	}
+	return x, true
+}
+
+func (it *seqIter[T]) Error() error {
+	return it.err
+}
+
+// Map returns an iterator that yields f(x) for each item x in it.
+func Map[T, U any](it Iter[T], f func(T) U) Iter[U] {
+	return &mapIter[T, U]{it: it, f: f}
+}
+
+type mapIter[T, U any] struct {
+	it Iter[T]
+	f  func(T) U
+}
+
+func (it *mapIter[T, U]) Close() {
+	it.it.Close()
+}
+
+func (it *mapIter[T, U]) Next() (U, bool) {
+	x, ok := it.it.Next()
+	if !ok {
+		return *new(U), false
+	}
+	return it.f(x), true
+}
+
+func (it *mapIter[T, U]) Error() error {
+	return it.it.Error()
+}
+
+// Filter returns an iterator that yields only the
+// items x in it for which keep(x) returns true.
+func Filter[T any](it Iter[T], keep func(T) bool) Iter[T] {
+	return &filterIter[T]{it: it, keep: keep}
+}
+
+type filterIter[T any] struct {
+	it   Iter[T]
+	keep func(T) bool
+}
+
+func (it *filterIter[T]) Close() {
+	it.it.Close()
+}
+
+func (it *filterIter[T]) Next() (T, bool) {
+	for {
+		x, ok := it.it.Next()
+		if !ok || it.keep(x) {
+			return x, ok
+		}
+	}
+}
+
+func (it *filterIter[T]) Error() error {
+	return it.it.Error()
+}
+
+// Take returns an iterator that yields at most
+// the first n items from it.
+func Take[T any](it Iter[T], n int) Iter[T] {
+	return &takeIter[T]{it: it, n: n}
+}
+
+type takeIter[T any] struct {
+	it Iter[T]
+	n  int
+}
+
+func (it *takeIter[T]) Close() {
+	it.it.Close()
+}
+
+func (it *takeIter[T]) Next() (T, bool) {
+	if it.n <= 0 {
+		return *new(T), false
+	}
+	it.n--
+	return it.it.Next()
+}
+
+func (it *takeIter[T]) Error() error {
+	return it.it.Error()
+}
+
+// Merge returns an iterator that merges the items
+// from it0 and it1, both of which must be ordered according
+// to cmp. When items from it0 and it1 compare equal,
+// the item from it0 is produced first.
+//
+// If either iterator fails, the merged iterator fails
+// with the same error.
+func Merge[T any](it0, it1 Iter[T], cmp func(T, T) int) Iter[T] {
+	return &mergeIter[T]{
+		it0: it0,
+		it1: it1,
+		cmp: cmp,
+	}
+}
+
+type mergeIter[T any] struct {
+	it0, it1 Iter[T]
+	cmp      func(T, T) int
+	started  bool
+	x0, x1   T
+	ok0, ok1 bool
+	err      error
+}
+
+func (it *mergeIter[T]) Close() {
+	it.it0.Close()
+	it.it1.Close()
+}
+
+func (it *mergeIter[T]) Next() (T, bool) {
+	if it.err != nil {
+		return *new(T), false
+	}
+	if !it.started {
+		it.x0, it.ok0 = it.it0.Next()
+		it.x1, it.ok1 = it.it1.Next()
+		it.started = true
+	}
+	if !it.ok0 {
+		it.err = it.it0.Error()
+	}
+	if !it.ok1 && it.err == nil {
+		it.err = it.it1.Error()
+	}
+	if it.err != nil {
+		return *new(T), false
+	}
+	switch {
+	case it.ok0 && (!it.ok1 || it.cmp(it.x0, it.x1) <= 0):
+		x := it.x0
+		it.x0, it.ok0 = it.it0.Next()
+		return x, true
+	case it.ok1:
+		x := it.x1
+		it.x1, it.ok1 = it.it1.Next()
+		return x, true
+	}
+	return *new(T), false
+}
+
+func (it *mergeIter[T]) Error() error {
+	return it.err
+}
+
+// Dedupe returns an iterator that yields the items from it,
+// omitting any item that's equal to the previous item
+// according to eq. When it is ordered, this removes
+// all duplicates.
+func Dedupe[T any](it Iter[T], eq func(T, T) bool) Iter[T] {
+	return &dedupeIter[T]{it: it, eq: eq}
+}
+
+type dedupeIter[T any] struct {
+	it    Iter[T]
+	eq    func(T, T) bool
+	prev  T
+	valid bool
+}
+
+func (it *dedupeIter[T]) Close() {
+	it.it.Close()
+}
+
+func (it *dedupeIter[T]) Next() (T, bool) {
+	for {
+		x, ok := it.it.Next()
+		if !ok {
+			return x, false
+		}
+		if it.valid && it.eq(it.prev, x) {
+			continue
+		}
+		it.prev, it.valid = x, true
+		return x, true
+	}
+}
+
+func (it *dedupeIter[T]) Error() error {
+	return it.it.Error()
+}
@@ -0,0 +1,252 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociregistry_test
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+
+	"cuelabs.dev/go/oci/ociregistry"
+)
+
+var errTest = errors.New("test error")
+
+var iterTests = []struct {
+	testName string
+	it       func() ociregistry.Iter[int]
+	want     []int
+	wantErr  error
+}{{
+	testName: "FromSeqOfSeq",
+	it: func() ociregistry.Iter[int] {
+		return ociregistry.FromSeq(ociregistry.Seq(ociregistry.SliceIter([]int{1, 2, 3})))
+	},
+	want: []int{1, 2, 3},
+}, {
+	testName: "FromSeqWithError",
+	it: func() ociregistry.Iter[int] {
+		return ociregistry.FromSeq(ociregistry.Seq(errorAfter([]int{1, 2}, errTest)))
+	},
+	want:    []int{1, 2},
+	wantErr: errTest,
+}, {
+	testName: "Map",
+	it: func() ociregistry.Iter[int] {
+		return ociregistry.Map(ociregistry.SliceIter([]string{"1", "2", "3"}), func(s string) int {
+			n, _ := strconv.Atoi(s)
+			return n * 10
+		})
+	},
+	want: []int{10, 20, 30},
+}, {
+	testName: "Filter",
+	it: func() ociregistry.Iter[int] {
+		return ociregistry.Filter(ociregistry.SliceIter([]int{1, 2, 3, 4, 5}), func(x int) bool {
+			return x%2 == 1
+		})
+	},
+	want: []int{1, 3, 5},
+}, {
+	testName: "FilterWithError",
+	it: func() ociregistry.Iter[int] {
+		return ociregistry.Filter(errorAfter([]int{1, 2, 3}, errTest), func(x int) bool {
+			return x != 2
+		})
+	},
+	want:    []int{1, 3},
+	wantErr: errTest,
+}, {
+	testName: "Take",
+	it: func() ociregistry.Iter[int] {
+		return ociregistry.Take(ociregistry.SliceIter([]int{1, 2, 3, 4, 5}), 2)
+	},
+	want: []int{1, 2},
+}, {
+	testName: "TakeMoreThanAvailable",
+	it: func() ociregistry.Iter[int] {
+		return ociregistry.Take(ociregistry.SliceIter([]int{1, 2}), 5)
+	},
+	want: []int{1, 2},
+}, {
+	testName: "TakeZero",
+	it: func() ociregistry.Iter[int] {
+		return ociregistry.Take(ociregistry.SliceIter([]int{1, 2}), 0)
+	},
+	want: []int{},
+}, {
+	testName: "Merge",
+	it: func() ociregistry.Iter[int] {
+		return ociregistry.Merge(ociregistry.SliceIter([]int{1, 3, 5, 7}), ociregistry.SliceIter([]int{2, 3, 4, 8, 9}), cmpInt)
+	},
+	want: []int{1, 2, 3, 3, 4, 5, 7, 8, 9},
+}, {
+	testName: "MergeEmpty",
+	it: func() ociregistry.Iter[int] {
+		return ociregistry.Merge(ociregistry.SliceIter[int](nil), ociregistry.SliceIter([]int{1, 2}), cmpInt)
+	},
+	want: []int{1, 2},
+}, {
+	testName: "MergeWithError",
+	it: func() ociregistry.Iter[int] {
+		return ociregistry.Merge(ociregistry.SliceIter([]int{1, 3, 5}), errorAfter([]int{2}, errTest), cmpInt)
+	},
+	want:    []int{1, 2},
+	wantErr: errTest,
+}, {
+	testName: "Dedupe",
+	it: func() ociregistry.Iter[int] {
+		return ociregistry.Dedupe(ociregistry.SliceIter([]int{1, 1, 2, 3, 3, 3, 1}), func(x, y int) bool {
+			return x == y
+		})
+	},
+	want: []int{1, 2, 3, 1},
+}}
+
+func TestIter(t *testing.T) {
+	for _, test := range iterTests {
+		t.Run(test.testName, func(t *testing.T) {
+			xs, err := ociregistry.All(test.it())
+			qt.Check(t, qt.DeepEquals(xs, test.want))
+			qt.Check(t, qt.Equals(err, test.wantErr))
+		})
+	}
+}
+
+func TestSeqClosesIterator(t *testing.T) {
+	it := &closeIter{Iter: ociregistry.SliceIter([]int{1, 2, 3})}
+	for x, err := range ociregistry.Seq[int](it) {
+		qt.Assert(t, qt.IsNil(err))
+		if x == 2 {
+			break
+		}
+	}
+	qt.Check(t, qt.IsTrue(it.closed))
+}
+
+func TestFromSeqClose(t *testing.T) {
+	closed := false
+	it := ociregistry.FromSeq(func(yield func(int, error) bool) {
+		defer func() {
+			closed = true
+		}()
+		for i := 0; ; i++ {
+			if !yield(i, nil) {
+				return
+			}
+		}
+	})
+	x, ok := it.Next()
+	qt.Assert(t, qt.IsTrue(ok))
+	qt.Assert(t, qt.Equals(x, 0))
+	it.Close()
+	qt.Check(t, qt.IsTrue(closed))
+	_, ok = it.Next()
+	qt.Check(t, qt.IsFalse(ok))
+}
+
+func TestCombinatorsClose(t *testing.T) {
+	tests := []struct {
+		testName string
+		wrap     func(its ...ociregistry.Iter[int]) ociregistry.Iter[int]
+		n        int
+	}{{
+		testName: "Map",
+		wrap: func(its ...ociregistry.Iter[int]) ociregistry.Iter[int] {
+			return ociregistry.Map(its[0], func(x int) int { return x })
+		},
+		n: 1,
+	}, {
+		testName: "Filter",
+		wrap: func(its ...ociregistry.Iter[int]) ociregistry.Iter[int] {
+			return ociregistry.Filter(its[0], func(int) bool { return true })
+		},
+		n: 1,
+	}, {
+		testName: "Take",
+		wrap: func(its ...ociregistry.Iter[int]) ociregistry.Iter[int] {
+			return ociregistry.Take(its[0], 1)
+		},
+		n: 1,
+	}, {
+		testName: "Merge",
+		wrap: func(its ...ociregistry.Iter[int]) ociregistry.Iter[int] {
+			return ociregistry.Merge(its[0], its[1], cmpInt)
+		},
+		n: 2,
+	}, {
+		testName: "Dedupe",
+		wrap: func(its ...ociregistry.Iter[int]) ociregistry.Iter[int] {
+			return ociregistry.Dedupe(its[0], func(x, y int) bool { return x == y })
+		},
+		n: 1,
+	}}
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			var its []ociregistry.Iter[int]
+			for range test.n {
+				its = append(its, &closeIter{Iter: ociregistry.SliceIter([]int{1, 2, 3})})
+			}
+			it := test.wrap(its...)
+			_, ok := it.Next()
+			qt.Assert(t, qt.IsTrue(ok))
+			it.Close()
+			for _, it := range its {
+				qt.Check(t, qt.IsTrue(it.(*closeIter).closed))
+			}
+		})
+	}
+}
+
+func TestAllCloses(t *testing.T) {
+	it := &closeIter{Iter: ociregistry.SliceIter([]int{1, 2, 3})}
+	_, err := ociregistry.All[int](it)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.IsTrue(it.closed))
+}
+
+type closeIter struct {
+	ociregistry.Iter[int]
+	closed bool
+}
+
+func (it *closeIter) Close() {
+	it.closed = true
+}
+
+// errorAfter returns an iterator that yields xs and
+// then fails with the given error.
+func errorAfter(xs []int, err error) ociregistry.Iter[int] {
+	return ociregistry.FromSeq(func(yield func(int, error) bool) {
+		for _, x := range xs {
+			if !yield(x, nil) {
+				return
+			}
+		}
+		yield(0, err)
+	})
+}
+
+func cmpInt(i, j int) int {
+	if i < j {
+		return -1
+	}
+	if i > j {
+		return 1
+	}
+	return 0
+}
@@ -1,6 +1,7 @@
 package ociauth
 
 import (
+	"iter"
 	"math/bits"
 	"strings"
 
@@ -227,7 +228,7 @@ func (s Scope) IsEmpty() bool {
 // ordering.
 //
 // The unlimited scope does not yield any scopes.
-func (s Scope) Iter() func(yield func(ResourceScope) bool) {
+func (s Scope) Iter() iter.Seq[ResourceScope] {
 	return func(yield0 func(ResourceScope) bool) {
 		if s.unlimited {
 			return
@@ -457,14 +458,13 @@ func (s Scope) String() string {
 	}
 	var buf strings.Builder
 	var prev ResourceScope
-	// TODO use range when we can use range-over-func.
-	s.Iter()(func(s ResourceScope) bool {
+	for s := range s.Iter() {
 		prev0 := prev
 		prev = s
 		if s.ResourceType == TypeRepository && prev0.ResourceType == TypeRepository && s.Resource == prev0.Resource {
 			buf.WriteByte(',')
 			buf.WriteString(s.Action)
-			return true
+			continue
 		}
 		if buf.Len() > 0 {
 			buf.WriteByte(' ')
@@ -476,8 +476,7 @@ func (s Scope) String() string {
 			buf.WriteByte(':')
 			buf.WriteString(s.Action)
 		}
-		return true
-	})
+	}
 	return buf.String()
 }
 
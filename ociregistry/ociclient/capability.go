@@ -0,0 +1,177 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/internal/ocirequest"
+)
+
+// probeRepo holds the repository name used when
+// probing for referrers API support. It doesn't need to exist.
+const probeRepo = "ociclient-probe"
+
+// capsProbeRetryInterval holds how long to wait after
+// a failed probe before probing the registry again.
+const capsProbeRetryInterval = time.Minute
+
+// Capabilities implements [ociregistry.CapabilityReporter].
+//
+// The first call pings the registry and probes it for capabilities
+// (see [client.probeCapabilities]). The result is cached. Capabilities
+// are also removed when a later response shows that the registry
+// does not support them.
+//
+// Only one probe is made at a time: calls made while it's in progress,
+// or when the registry can't be reached, don't wait for it and return
+// the capabilities known so far. A failed probe is retried after
+// a while.
+func (c *client) Capabilities(ctx context.Context) ociregistry.Capabilities {
+	c.capsMu.Lock()
+	probe := !c.capsProbed && !c.capsProbing && !time.Now().Before(c.capsNextProbe)
+	if probe {
+		c.capsProbing = true
+	}
+	c.capsMu.Unlock()
+
+	if probe {
+		missing, ok := c.probeCapabilities(ctx)
+		c.capsMu.Lock()
+		c.capsProbing = false
+		if ok {
+			c.capsProbed = true
+			c.capsMissing |= missing
+		} else {
+			c.capsNextProbe = time.Now().Add(capsProbeRetryInterval)
+		}
+		c.capsMu.Unlock()
+	}
+
+	c.capsMu.Lock()
+	defer c.capsMu.Unlock()
+	return ociregistry.AllCapabilities &^ c.capsMissing
+}
+
+// probeCapabilities pings the registry and returns the capabilities
+// that it's found not to support. It reports false if the registry
+// couldn't be reached, in which case it should be probed again later.
+//
+// A registry served by package ociserver reports its capabilities
+// in the response to the ping. For other registries, only support for
+// the referrers API is probed: the distribution spec provides no way
+// to find out whether range requests, mounting, deletion or resuming
+// chunked uploads are supported short of trying them, which for most
+// of those would change the contents of the registry. They're assumed
+// to be supported; as with any registry, callers must be prepared for
+// those operations to fail with [ociregistry.ErrUnsupported].
+//
+// When the result of the referrers probe is ambiguous,
+// the capability is assumed to be present.
+func (c *client) probeCapabilities(ctx context.Context) (ociregistry.Capabilities, bool) {
+	resp, err := c.doRequest(ctx, &ocirequest.Request{
+		Kind: ocirequest.ReqPing,
+	})
+	if err != nil {
+		return 0, false
+	}
+	resp.Body.Close()
+	if caps := resp.Header.Get("Cuelabs-Capabilities"); caps != "" {
+		return ociregistry.AllCapabilities &^ ociregistry.ParseCapabilities(caps), true
+	}
+
+	resp, err = c.doReferrersRequest(ctx, &ocirequest.Request{
+		Kind:   ocirequest.ReqReferrersList,
+		Repo:   probeRepo,
+		Digest: string(digest.FromBytes(nil)),
+		ListN:  1,
+	}, false)
+	if err != nil {
+		if errors.Is(err, ociregistry.ErrUnsupported) {
+			return ociregistry.CapReferrers, true
+		}
+		if ctx.Err() != nil || errors.As(err, new(*url.Error)) {
+			// The registry couldn't be reached.
+			return 0, false
+		}
+		// We can't tell whether the API is supported or not (for
+		// example, the probe wasn't authorized), so assume that it is.
+		return 0, true
+	}
+	resp.Body.Close()
+	return 0, true
+}
+
+// removeCapability records that the registry has been found
+// not to support the given capabilities.
+func (c *client) removeCapability(caps ociregistry.Capabilities) {
+	c.capsMu.Lock()
+	defer c.capsMu.Unlock()
+	c.capsMissing |= caps
+}
+
+// doReferrersRequest makes a referrers API request. If the
+// response shows that the registry doesn't understand
+// the referrers API, it returns an error that satisfies
+// errors.Is(err, ociregistry.ErrUnsupported) and, if record is
+// true, records the lack of the capability.
+func (c *client) doReferrersRequest(ctx context.Context, rreq *ocirequest.Request, record bool) (*http.Response, error) {
+	req, err := newRequest(ctx, rreq, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req, scopeForRequest(rreq), http.StatusOK, http.StatusNotFound, http.StatusBadRequest, http.StatusMethodNotAllowed)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, errorBodySizeLimit+1))
+	if err != nil {
+		return nil, fmt.Errorf("%s: cannot read error body: %v", resp.Status, err)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	err = makeError(resp)
+	if resp.StatusCode == http.StatusNotFound && isKnownNotFoundError(err) {
+		// The registry understands the API but the repository
+		// or manifest isn't there.
+		return nil, err
+	}
+	if record {
+		c.removeCapability(ociregistry.CapReferrers)
+	}
+	return nil, fmt.Errorf("referrers API not supported by registry (%v): %w", err, ociregistry.ErrUnsupported)
+}
+
+// isKnownNotFoundError reports whether err is one of the
+// errors that a registry returns when it understands the request
+// but the content isn't present.
+func isKnownNotFoundError(err error) bool {
+	return errors.Is(err, ociregistry.ErrNameUnknown) ||
+		errors.Is(err, ociregistry.ErrManifestUnknown) ||
+		errors.Is(err, ociregistry.ErrBlobUnknown)
+}
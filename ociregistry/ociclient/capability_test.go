@@ -0,0 +1,168 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-quicktest/qt"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocifilter"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ociserver"
+)
+
+func TestCapabilities(t *testing.T) {
+	ctx := context.Background()
+	for _, disableReferrers := range []bool{false, true} {
+		srv := httptest.NewServer(ociserver.New(ocimem.New(), &ociserver.Options{
+			DisableReferrersAPI: disableReferrers,
+		}))
+		defer srv.Close()
+		srvURL, _ := url.Parse(srv.URL)
+		r, err := New(srvURL.Host, &Options{
+			Insecure: true,
+		})
+		qt.Assert(t, qt.IsNil(err))
+		caps := ociregistry.CapabilitiesOf(ctx, r)
+		qt.Check(t, qt.Equals(caps.Has(ociregistry.CapReferrers), !disableReferrers), qt.Commentf("caps %v", caps))
+		qt.Check(t, qt.IsTrue(caps.Has(ociregistry.WriteCapabilities|ociregistry.CapBlobRange)))
+	}
+}
+
+func TestReferrersUnsupportedRemovesCapability(t *testing.T) {
+	ctx := context.Background()
+	srv := httptest.NewServer(ociserver.New(ocimem.New(), &ociserver.Options{
+		DisableReferrersAPI: true,
+	}))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	r, err := New(srvURL.Host, &Options{
+		Insecure: true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	_, err = ociregistry.All(r.Referrers(ctx, "foo", "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", ""))
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrUnsupported))
+	qt.Check(t, qt.IsFalse(r.(ociregistry.CapabilityReporter).Capabilities(ctx).Has(ociregistry.CapReferrers)))
+}
+
+func TestDeleteRepositoryUnsupportedRemovesCapability(t *testing.T) {
+	ctx := context.Background()
+	// Hide the capabilities of the backend so that the server
+	// reports that it supports everything.
+	backend := unsupportedRepoDeleter{ocifilter.ReadOnly(ocimem.New())}
+	srv := httptest.NewServer(ociserver.New(backend, nil))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	r, err := New(srvURL.Host, &Options{
+		Insecure: true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.IsTrue(ociregistry.CapabilitiesOf(ctx, r).Has(ociregistry.CapDeleteRepository)))
+	err = ociregistry.DeleteRepository(ctx, r, "foo")
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrUnsupported))
+	qt.Check(t, qt.IsFalse(ociregistry.CapabilitiesOf(ctx, r).Has(ociregistry.CapDeleteRepository)))
+}
+
+type unsupportedRepoDeleter struct {
+	ociregistry.Interface
+}
+
+func (unsupportedRepoDeleter) DeleteRepository(ctx context.Context, repo string) error {
+	return ociregistry.ErrUnsupported
+}
+
+func TestCapabilitiesFromPing(t *testing.T) {
+	ctx := context.Background()
+	srv := httptest.NewServer(ociserver.New(ocifilter.ReadOnly(ocimem.New()), nil))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	r, err := New(srvURL.Host, &Options{
+		Insecure: true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	caps := ociregistry.CapabilitiesOf(ctx, r)
+	qt.Check(t, qt.Equals(caps, ociregistry.AllCapabilities&^ociregistry.WriteCapabilities))
+}
+
+func TestCapabilitiesProbeRetried(t *testing.T) {
+	ctx := context.Background()
+	var unavailable atomic.Bool
+	unavailable.Store(true)
+	h := ociserver.New(ocimem.New(), &ociserver.Options{
+		DisableReferrersAPI: true,
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if unavailable.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, req)
+	}))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	r, err := New(srvURL.Host, &Options{
+		Insecure: true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+
+	// When the probe fails, everything is assumed.
+	qt.Check(t, qt.Equals(ociregistry.CapabilitiesOf(ctx, r), ociregistry.AllCapabilities))
+
+	// The registry isn't probed again until the retry interval has passed.
+	unavailable.Store(false)
+	qt.Check(t, qt.Equals(ociregistry.CapabilitiesOf(ctx, r), ociregistry.AllCapabilities))
+	r.(*client).capsNextProbe = time.Time{}
+	qt.Check(t, qt.Equals(ociregistry.CapabilitiesOf(ctx, r), ociregistry.AllCapabilities&^ociregistry.CapReferrers))
+}
+
+func TestCapabilitiesProbeDoesNotBlock(t *testing.T) {
+	ctx := context.Background()
+	pinged := make(chan struct{})
+	release := make(chan struct{})
+	h := ociserver.New(ocifilter.ReadOnly(ocimem.New()), nil)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/v2/" {
+			close(pinged)
+			<-release
+		}
+		h.ServeHTTP(w, req)
+	}))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	r, err := New(srvURL.Host, &Options{
+		Insecure: true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	done := make(chan ociregistry.Capabilities)
+	go func() {
+		done <- ociregistry.CapabilitiesOf(ctx, r)
+	}()
+	<-pinged
+	// While the probe is in progress, other callers
+	// get the capabilities known so far without waiting.
+	qt.Check(t, qt.Equals(ociregistry.CapabilitiesOf(ctx, r), ociregistry.AllCapabilities))
+	close(release)
+	want := ociregistry.AllCapabilities &^ ociregistry.WriteCapabilities
+	qt.Check(t, qt.Equals(<-done, want))
+	qt.Check(t, qt.Equals(ociregistry.CapabilitiesOf(ctx, r), want))
+}
@@ -19,20 +19,26 @@ package ociclient
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"hash"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 
 	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/internal/lru"
 	"cuelabs.dev/go/oci/ociregistry/internal/ocirequest"
 	"cuelabs.dev/go/oci/ociregistry/ociauth"
 )
@@ -55,8 +61,44 @@ type Options struct {
 	// Insecure specifies whether an http scheme will be
 	// used to address the host instead of https.
 	Insecure bool
+
+	// MaxBlobResumes holds the maximum number of times that
+	// reading a blob returned by GetBlob will be resumed
+	// after a network error or a response body that ends
+	// early. Each resumption makes a ranged request starting
+	// from the current offset. Other errors, such as those
+	// from the registry or a digest mismatch, are never
+	// retried. If it's zero, defaultMaxBlobResumes is used;
+	// if it's negative, reads are never resumed.
+	MaxBlobResumes int
+
+	// ManifestMediaTypes holds the media types sent in the
+	// Accept header when fetching or resolving manifests.
+	// If it's empty, [DefaultManifestMediaTypes] is used.
+	// This can be overridden for individual requests
+	// with [ContextWithManifestMediaTypes].
+	ManifestMediaTypes []string
+
+	// ConvertDockerManifests causes Docker schema2 manifests
+	// and manifest lists to be converted to OCI image manifests and
+	// indexes when they are fetched or resolved. See [ConvertDockerManifest]
+	// for details of the conversion.
+	//
+	// Conversion changes the digest of a manifest, so only manifests
+	// fetched or resolved by tag are converted: a manifest fetched
+	// by its own digest is returned unchanged. The client remembers
+	// the digests of the manifests it has most recently converted (see
+	// [MaxConvertedDigests]), so a converted digest, such as one found
+	// in a converted index, can be used to fetch the converted content
+	// with the same client. Once forgotten, a converted digest can be
+	// found again by fetching the manifest that refers to it by tag.
+	ConvertDockerManifests bool
 }
 
+// defaultMaxBlobResumes holds the default value of
+// Options.MaxBlobResumes.
+const defaultMaxBlobResumes = 5
+
 type HTTPDoer interface {
 	Do(req *http.Request) (*http.Response, error)
 }
@@ -79,6 +121,14 @@ func New(host string, opts *Options) (ociregistry.Interface, error) {
 	if opts.HTTPClient == nil {
 		opts.HTTPClient = http.DefaultClient
 	}
+	manifestMediaTypes := slices.Clone(opts.ManifestMediaTypes)
+	if len(manifestMediaTypes) == 0 {
+		manifestMediaTypes = DefaultManifestMediaTypes()
+	}
+	maxBlobResumes := opts.MaxBlobResumes
+	if maxBlobResumes == 0 {
+		maxBlobResumes = defaultMaxBlobResumes
+	}
 	// Check that it's a valid host by forming a URL from it and checking that it matches.
 	u, err := url.Parse("https://" + host + "/path")
 	if err != nil {
@@ -96,6 +146,11 @@ func New(host string, opts *Options) (ociregistry.Interface, error) {
 		client:     opts.HTTPClient,
 		authorizer: opts.Authorizer,
 		debugID:    opts.DebugID,
+
+		maxBlobResumes:     maxBlobResumes,
+		manifestMediaTypes: manifestMediaTypes,
+		convertDocker:      opts.ConvertDockerManifests,
+		convertedDigests:   lru.New[ociregistry.Digest, ociregistry.Digest](MaxConvertedDigests),
 	}, nil
 }
 
@@ -106,6 +161,41 @@ type client struct {
 	client     HTTPDoer
 	authorizer ociauth.Authorizer
 	debugID    string
+
+	// maxBlobResumes holds the maximum number of times
+	// a blob read will be resumed. It's negative when
+	// resumption is disabled.
+	maxBlobResumes int
+
+	// manifestMediaTypes holds the default Accept list
+	// for manifest requests.
+	manifestMediaTypes []string
+
+	// convertDocker holds whether Docker manifests
+	// are converted to OCI manifests.
+	convertDocker bool
+
+	// convertedDigests maps from the digest of a recently converted
+	// manifest to the digest of the original manifest.
+	convertedDigests *lru.Cache[ociregistry.Digest, ociregistry.Digest]
+
+	// capsMu guards the fields below.
+	capsMu sync.Mutex
+
+	// capsProbed records whether Capabilities has
+	// successfully probed the registry.
+	capsProbed bool
+
+	// capsProbing records whether a probe is in progress.
+	capsProbing bool
+
+	// capsNextProbe holds the earliest time that the
+	// registry will be probed again after a failed probe.
+	capsNextProbe time.Time
+
+	// capsMissing holds capabilities that the registry
+	// has been found not to support.
+	capsMissing ociregistry.Capabilities
 }
 
 func descriptorFromResponse(resp *http.Response, knownDigest digest.Digest, requireSize bool) (ociregistry.Descriptor, error) {
@@ -127,17 +217,9 @@ func descriptorFromResponse(resp *http.Response, knownDigest digest.Digest, requ
 	size := int64(0)
 	if requireSize {
 		if resp.StatusCode == http.StatusPartialContent {
-			contentRange := resp.Header.Get("Content-Range")
-			if contentRange == "" {
-				return ociregistry.Descriptor{}, fmt.Errorf("no Content-Range in partial content response")
-			}
-			i := strings.LastIndex(contentRange, "/")
-			if i == -1 {
-				return ociregistry.Descriptor{}, fmt.Errorf("malformed Content-Range %q", contentRange)
-			}
-			contentSize, err := strconv.ParseInt(contentRange[i+1:], 10, 64)
+			_, _, contentSize, err := parseContentRange(resp.Header.Get("Content-Range"))
 			if err != nil {
-				return ociregistry.Descriptor{}, fmt.Errorf("malformed Content-Range %q", contentRange)
+				return ociregistry.Descriptor{}, err
 			}
 			size = contentSize
 		} else {
@@ -154,27 +236,55 @@ func descriptorFromResponse(resp *http.Response, knownDigest digest.Digest, requ
 	}, nil
 }
 
+// parseContentRange parses the value of a Content-Range header
+// in a partial content response, returning the first and last
+// byte positions and the complete size.
+func parseContentRange(contentRange string) (first, last, size int64, err error) {
+	if contentRange == "" {
+		return 0, 0, 0, fmt.Errorf("no Content-Range in partial content response")
+	}
+	rangeStr, ok := strings.CutPrefix(contentRange, "bytes ")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("malformed Content-Range %q", contentRange)
+	}
+	rangeStr, sizeStr, ok1 := strings.Cut(rangeStr, "/")
+	firstStr, lastStr, ok2 := strings.Cut(rangeStr, "-")
+	if !ok1 || !ok2 {
+		return 0, 0, 0, fmt.Errorf("malformed Content-Range %q", contentRange)
+	}
+	first, err1 := strconv.ParseInt(firstStr, 10, 64)
+	last, err2 := strconv.ParseInt(lastStr, 10, 64)
+	size, err3 := strconv.ParseInt(sizeStr, 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return 0, 0, 0, fmt.Errorf("malformed Content-Range %q", contentRange)
+	}
+	if first < 0 || last < first-1 || last >= size {
+		return 0, 0, 0, fmt.Errorf("Content-Range %q out of bounds", contentRange)
+	}
+	return first, last, size, nil
+}
+
 func newBlobReader(r io.ReadCloser, desc ociregistry.Descriptor) *blobReader {
 	return &blobReader{
 		r:        r,
 		digester: desc.Digest.Algorithm().Hash(),
 		desc:     desc,
-		verify:   true,
 	}
 }
 
-func newBlobReaderUnverified(r io.ReadCloser, desc ociregistry.Descriptor) *blobReader {
-	br := newBlobReader(r, desc)
-	br.verify = false
-	return br
-}
-
 type blobReader struct {
 	r        io.ReadCloser
 	n        int64
 	digester hash.Hash
 	desc     ociregistry.Descriptor
-	verify   bool
+
+	// resume, if non-nil, is used to reopen the blob at
+	// the given offset after a transient read error.
+	resume func(offset int64) (io.ReadCloser, error)
+
+	// resumesLeft holds the number of times that
+	// resume may still be called.
+	resumesLeft int
 }
 
 func (r *blobReader) Descriptor() ociregistry.Descriptor {
@@ -182,13 +292,12 @@ func (r *blobReader) Descriptor() ociregistry.Descriptor {
 }
 
 func (r *blobReader) Read(buf []byte) (int, error) {
-	n, err := r.r.Read(buf)
+	n, err := r.read(buf)
 	r.n += int64(n)
 	r.digester.Write(buf[:n])
 	if err == nil {
 		if r.n > r.desc.Size {
-			// Fail early when the blob is too big; we can do that even
-			// when we're not verifying for other use cases.
+			// Fail early when the blob is too big.
 			return n, fmt.Errorf("blob size exceeds content length %d: %w", r.desc.Size, ociregistry.ErrSizeInvalid)
 		}
 		return n, nil
@@ -196,9 +305,6 @@ func (r *blobReader) Read(buf []byte) (int, error) {
 	if err != io.EOF {
 		return n, err
 	}
-	if !r.verify {
-		return n, io.EOF
-	}
 	if r.n != r.desc.Size {
 		return n, fmt.Errorf("blob size mismatch (%d/%d): %w", r.n, r.desc.Size, ociregistry.ErrSizeInvalid)
 	}
@@ -209,21 +315,121 @@ func (r *blobReader) Read(buf []byte) (int, error) {
 	return n, io.EOF
 }
 
+// read reads from the underlying reader, reopening it
+// at the current offset when a transient error is encountered
+// and there are resumptions left. The digester and byte count
+// are maintained by the caller, so verification covers the
+// content of all the responses taken together.
+func (r *blobReader) read(buf []byte) (int, error) {
+	for {
+		n, err := r.r.Read(buf)
+		if err == nil || err == io.EOF || !r.canResume(err) {
+			return n, err
+		}
+		if n > 0 {
+			// Return the data we've got; the error
+			// will be encountered again on the next call.
+			return n, nil
+		}
+		r.resumesLeft--
+		r.r.Close()
+		rc, rerr := r.resume(r.n)
+		if rerr != nil {
+			r.r = errReadCloser{err}
+			return 0, fmt.Errorf("%w (cannot resume: %v)", err, rerr)
+		}
+		r.r = rc
+	}
+}
+
+// canResume reports whether a read that failed with
+// the given error may be resumed. Only errors that
+// indicate that the connection failed are transient:
+// retrying anything else is unlikely to help.
+func (r *blobReader) canResume(err error) bool {
+	if r.resume == nil || r.resumesLeft <= 0 {
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var netErr net.Error
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr)
+}
+
+// errReadCloser is an io.ReadCloser that always
+// fails with the given error.
+type errReadCloser struct {
+	err error
+}
+
+func (r errReadCloser) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+func (r errReadCloser) Close() error {
+	return nil
+}
+
 func (r *blobReader) Close() error {
 	return r.r.Close()
 }
 
-// TODO make this list configurable.
-var knownManifestMediaTypes = []string{
-	ocispec.MediaTypeImageManifest,
-	ocispec.MediaTypeImageIndex,
-	"application/vnd.oci.artifact.manifest.v1+json", // deprecated.
-	"application/vnd.docker.distribution.manifest.v1+json",
-	"application/vnd.docker.distribution.manifest.v2+json",
-	"application/vnd.docker.distribution.manifest.list.v2+json",
-	// Technically this wildcard should be sufficient, but it isn't
-	// recognized by some registries.
-	"*/*",
+// rangeReader is the BlobReader returned by GetBlobRange.
+// It yields exactly the requested number of bytes,
+// failing with io.ErrUnexpectedEOF if the response is short.
+type rangeReader struct {
+	r    io.ReadCloser
+	n    int64
+	desc ociregistry.Descriptor
+}
+
+func newRangeReader(r io.ReadCloser, desc ociregistry.Descriptor, n int64) *rangeReader {
+	return &rangeReader{
+		r:    r,
+		n:    n,
+		desc: desc,
+	}
+}
+
+func (r *rangeReader) Descriptor() ociregistry.Descriptor {
+	return r.desc
+}
+
+func (r *rangeReader) Read(buf []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(buf)) > r.n {
+		buf = buf[:r.n]
+	}
+	n, err := r.r.Read(buf)
+	r.n -= int64(n)
+	if err == io.EOF && r.n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *rangeReader) Close() error {
+	return r.r.Close()
+}
+
+// DefaultManifestMediaTypes returns the media types sent in the Accept header
+// when fetching manifests if [Options.ManifestMediaTypes] is empty.
+// It returns a new slice each time.
+func DefaultManifestMediaTypes() []string {
+	return []string{
+		ocispec.MediaTypeImageManifest,
+		ocispec.MediaTypeImageIndex,
+		"application/vnd.oci.artifact.manifest.v1+json", // deprecated.
+		"application/vnd.docker.distribution.manifest.v1+json",
+		"application/vnd.docker.distribution.manifest.v2+json",
+		"application/vnd.docker.distribution.manifest.list.v2+json",
+		// Technically this wildcard should be sufficient, but it isn't
+		// recognized by some registries.
+		"*/*",
+	}
 }
 
 // doRequest performs the given OCI request, sending it with the given body (which may be nil).
@@ -236,7 +442,11 @@ func (c *client) doRequest(ctx context.Context, rreq *ocirequest.Request, okStat
 		// When getting manifests, some servers won't return
 		// the content unless there's an Accept header, so
 		// add all the manifest kinds that we know about.
-		req.Header["Accept"] = knownManifestMediaTypes
+		mediaTypes := ManifestMediaTypesFromContext(ctx)
+		if len(mediaTypes) == 0 {
+			mediaTypes = c.manifestMediaTypes
+		}
+		req.Header["Accept"] = mediaTypes
 	}
 	resp, err := c.do(req, scopeForRequest(rreq), okStatuses...)
 	if err != nil {
@@ -365,7 +575,8 @@ func scopeForRequest(r *ocirequest.Request) ociauth.Scope {
 		ocirequest.ReqBlobUploadChunk,
 		ocirequest.ReqBlobCompleteUpload,
 		ocirequest.ReqManifestPut,
-		ocirequest.ReqManifestDelete:
+		ocirequest.ReqManifestDelete,
+		ocirequest.ReqRepositoryDelete:
 		return ociauth.NewScope(ociauth.ResourceScope{
 			ResourceType: ociauth.TypeRepository,
 			Resource:     r.Repo,
@@ -0,0 +1,36 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"context"
+)
+
+type manifestMediaTypesKey struct{}
+
+// ContextWithManifestMediaTypes returns a context annotated with
+// the given manifest media types. When the client fetches or resolves
+// a manifest with such a context, it will send these media types in
+// the Accept header instead of those in [Options.ManifestMediaTypes].
+func ContextWithManifestMediaTypes(ctx context.Context, mediaTypes []string) context.Context {
+	return context.WithValue(ctx, manifestMediaTypesKey{}, mediaTypes)
+}
+
+// ManifestMediaTypesFromContext returns any manifest media types
+// associated with the context by [ContextWithManifestMediaTypes].
+func ManifestMediaTypesFromContext(ctx context.Context) []string {
+	mediaTypes, _ := ctx.Value(manifestMediaTypesKey{}).([]string)
+	return mediaTypes
+}
@@ -0,0 +1,218 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/internal/mediatype"
+	"cuelabs.dev/go/oci/ociregistry/internal/ocirequest"
+)
+
+// isDockerManifestMediaType reports whether the media type
+// is that of a Docker schema2 manifest or manifest list.
+func isDockerManifestMediaType(mediaType string) bool {
+	return mediaType == mediatype.DockerManifest || mediaType == mediatype.DockerManifestList
+}
+
+// ConvertDockerManifest converts a Docker schema2 manifest or manifest
+// list with the given media type to an OCI image manifest or index
+// respectively, returning the converted data and its media type.
+// Docker media types in descriptors are replaced by their OCI
+// equivalents; other fields are preserved where OCI has an equivalent.
+//
+// When converting a manifest list, convertChild is called to find
+// the descriptor for each Docker manifest or manifest list that it refers
+// to, because converting those changes their digests. If convertChild
+// is nil, only the media types of such descriptors are changed, so
+// the resulting index will refer to the unconverted manifests.
+//
+// Content with any other media type is returned unchanged.
+func ConvertDockerManifest(mediaType string, data []byte, convertChild func(ociregistry.Descriptor) (ociregistry.Descriptor, error)) ([]byte, string, error) {
+	var v any
+	switch mediaType {
+	case mediatype.DockerManifest:
+		var m ocispec.Manifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, "", fmt.Errorf("cannot unmarshal Docker manifest: %v", err)
+		}
+		m.MediaType = ocispec.MediaTypeImageManifest
+		m.Config = convertDescriptor(m.Config)
+		for i := range m.Layers {
+			m.Layers[i] = convertDescriptor(m.Layers[i])
+		}
+		v = m
+	case mediatype.DockerManifestList:
+		var index ocispec.Index
+		if err := json.Unmarshal(data, &index); err != nil {
+			return nil, "", fmt.Errorf("cannot unmarshal Docker manifest list: %v", err)
+		}
+		index.MediaType = ocispec.MediaTypeImageIndex
+		for i, desc := range index.Manifests {
+			if !isDockerManifestMediaType(desc.MediaType) || convertChild == nil {
+				index.Manifests[i] = convertDescriptor(desc)
+				continue
+			}
+			child, err := convertChild(desc)
+			if err != nil {
+				return nil, "", fmt.Errorf("cannot convert manifest %s: %w", desc.Digest, err)
+			}
+			desc.MediaType = child.MediaType
+			desc.Digest = child.Digest
+			desc.Size = child.Size
+			index.Manifests[i] = desc
+		}
+		v = index
+	default:
+		return data, mediaType, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, mediatype.OCI(mediaType), nil
+}
+
+func convertDescriptor(desc ociregistry.Descriptor) ociregistry.Descriptor {
+	desc.MediaType = mediatype.OCI(desc.MediaType)
+	return desc
+}
+
+// MaxConvertedDigests holds the number of converted manifest digests
+// that a client remembers when [Options.ConvertDockerManifests] is set.
+const MaxConvertedDigests = 4096
+
+// readManifest is like read except that it converts Docker
+// manifests when c.convertDocker is set. A manifest requested
+// by its own digest is returned unchanged, so that its digest
+// is the one that was asked for; only manifests requested by
+// tag or by a converted digest are converted.
+func (c *client) readManifest(ctx context.Context, rreq *ocirequest.Request) (ociregistry.BlobReader, error) {
+	if !c.convertDocker {
+		return c.read(ctx, rreq)
+	}
+	if rreq.Digest != "" {
+		orig, ok := c.convertedDigests.Get(ociregistry.Digest(rreq.Digest))
+		if !ok {
+			return c.read(ctx, rreq)
+		}
+		rreq1 := *rreq
+		rreq1.Digest = string(orig)
+		rreq = &rreq1
+	}
+	return c.readConverted(ctx, rreq)
+}
+
+// readConverted reads the manifest requested by rreq and
+// converts it if it's a Docker manifest, remembering the
+// converted digest of it and of any manifests it refers to.
+func (c *client) readConverted(ctx context.Context, rreq *ocirequest.Request) (ociregistry.BlobReader, error) {
+	rd, err := c.read(ctx, rreq)
+	if err != nil {
+		return nil, err
+	}
+	origDesc := rd.Descriptor()
+	if !isDockerManifestMediaType(origDesc.MediaType) {
+		return rd, nil
+	}
+	defer rd.Close()
+	data, err := io.ReadAll(rd)
+	if err != nil {
+		return nil, err
+	}
+	data, mediaType, err := ConvertDockerManifest(origDesc.MediaType, data, func(desc ociregistry.Descriptor) (ociregistry.Descriptor, error) {
+		r, err := c.readConverted(ctx, &ocirequest.Request{
+			Kind:   ocirequest.ReqManifestGet,
+			Repo:   rreq.Repo,
+			Digest: string(desc.Digest),
+		})
+		if err != nil {
+			return ociregistry.Descriptor{}, err
+		}
+		r.Close()
+		return r.Descriptor(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	desc := ociregistry.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	c.convertedDigests.Add(desc.Digest, origDesc.Digest)
+	return &bytesReader{
+		Reader: bytes.NewReader(data),
+		desc:   desc,
+	}, nil
+}
+
+// resolveManifest is like resolve except that it converts Docker
+// manifests when c.convertDocker is set, in the same way as
+// readManifest.
+func (c *client) resolveManifest(ctx context.Context, rreq *ocirequest.Request) (ociregistry.Descriptor, error) {
+	if !c.convertDocker {
+		return c.resolve(ctx, rreq)
+	}
+	rreq1 := *rreq
+	rreq1.Kind = ocirequest.ReqManifestGet
+	if rreq.Digest != "" {
+		orig, ok := c.convertedDigests.Get(ociregistry.Digest(rreq.Digest))
+		if !ok {
+			return c.resolve(ctx, rreq)
+		}
+		rreq1.Digest = string(orig)
+	} else {
+		desc, err := c.resolve(ctx, rreq)
+		if err != nil || !isDockerManifestMediaType(desc.MediaType) {
+			return desc, err
+		}
+		// Make sure we get the same manifest even
+		// if the tag has changed in the meantime.
+		rreq1.Tag = ""
+		rreq1.Digest = string(desc.Digest)
+	}
+	// Conversion changes the digest, so we need
+	// to fetch the content to find out the new one.
+	r, err := c.readConverted(ctx, &rreq1)
+	if err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	r.Close()
+	return r.Descriptor(), nil
+}
+
+// bytesReader implements ociregistry.BlobReader for
+// content held in memory.
+type bytesReader struct {
+	*bytes.Reader
+	desc ociregistry.Descriptor
+}
+
+func (r *bytesReader) Descriptor() ociregistry.Descriptor {
+	return r.desc
+}
+
+func (r *bytesReader) Close() error {
+	return nil
+}
@@ -0,0 +1,236 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"cuelabs.dev/go/oci/ociregistry/internal/mediatype"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ociserver"
+)
+
+const dockerManifest = `{
+	"schemaVersion": 2,
+	"mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+	"config": {
+		"mediaType": "application/vnd.docker.container.image.v1+json",
+		"size": 2,
+		"digest": "sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"
+	},
+	"layers": [{
+		"mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip",
+		"size": 3,
+		"digest": "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+	}, {
+		"mediaType": "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip",
+		"size": 3,
+		"digest": "sha256:fcde2b2edba56bf408601fb721fe9b5c338d10ee429ea04fae5511b68fbf8fb9",
+		"urls": ["https://example.com/bar"]
+	}]
+}`
+
+func TestConvertDockerManifest(t *testing.T) {
+	data, mediaType, err := ConvertDockerManifest(mediatype.DockerManifest, []byte(dockerManifest), nil)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(mediaType, ocispec.MediaTypeImageManifest))
+	var m ocispec.Manifest
+	qt.Assert(t, qt.IsNil(json.Unmarshal(data, &m)))
+	qt.Check(t, qt.Equals(m.SchemaVersion, 2))
+	qt.Check(t, qt.Equals(m.MediaType, ocispec.MediaTypeImageManifest))
+	qt.Check(t, qt.Equals(m.Config.MediaType, ocispec.MediaTypeImageConfig))
+	qt.Check(t, qt.Equals(m.Config.Size, int64(2)))
+	qt.Assert(t, qt.HasLen(m.Layers, 2))
+	qt.Check(t, qt.Equals(m.Layers[0].MediaType, ocispec.MediaTypeImageLayerGzip))
+	qt.Check(t, qt.Equals(m.Layers[1].MediaType, "application/vnd.oci.image.layer.nondistributable.v1.tar+gzip"))
+	qt.Check(t, qt.DeepEquals(m.Layers[1].URLs, []string{"https://example.com/bar"}))
+
+	// Other media types are left alone.
+	data, mediaType, err = ConvertDockerManifest(ocispec.MediaTypeImageManifest, []byte("foo"), nil)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(string(data), "foo"))
+	qt.Check(t, qt.Equals(mediaType, ocispec.MediaTypeImageManifest))
+}
+
+func TestClientConvertsDockerManifests(t *testing.T) {
+	ctx := context.Background()
+	r := ocimem.New()
+	manifestDesc, err := r.PushManifest(ctx, "foo", "", []byte(dockerManifest), mediatype.DockerManifest)
+	qt.Assert(t, qt.IsNil(err))
+	list := `{
+	"schemaVersion": 2,
+	"mediaType": "application/vnd.docker.distribution.manifest.list.v2+json",
+	"manifests": [{
+		"mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+		"size": ` + jsonString(manifestDesc.Size) + `,
+		"digest": "` + string(manifestDesc.Digest) + `",
+		"platform": {"architecture": "amd64", "os": "linux"}
+	}]
+}`
+	listDesc, err := r.PushManifest(ctx, "foo", "latest", []byte(list), mediatype.DockerManifestList)
+	qt.Assert(t, qt.IsNil(err))
+
+	srv := httptest.NewServer(ociserver.New(r, nil))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+
+	// Without conversion, the content is returned unchanged.
+	client, err := New(srvURL.Host, &Options{
+		Insecure: true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	desc, err := client.ResolveTag(ctx, "foo", "latest")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(desc.Digest, listDesc.Digest))
+	qt.Check(t, qt.Equals(desc.MediaType, mediatype.DockerManifestList))
+
+	client, err = New(srvURL.Host, &Options{
+		Insecure:               true,
+		ConvertDockerManifests: true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	rd, err := client.GetTag(ctx, "foo", "latest")
+	qt.Assert(t, qt.IsNil(err))
+	data, err := io.ReadAll(rd)
+	qt.Assert(t, qt.IsNil(err))
+	rd.Close()
+	indexDesc := rd.Descriptor()
+	qt.Check(t, qt.Equals(indexDesc.MediaType, ocispec.MediaTypeImageIndex))
+	qt.Check(t, qt.Equals(indexDesc.Digest, digest.FromBytes(data)))
+	qt.Check(t, qt.Equals(indexDesc.Size, int64(len(data))))
+
+	var index ocispec.Index
+	qt.Assert(t, qt.IsNil(json.Unmarshal(data, &index)))
+	qt.Check(t, qt.Equals(index.MediaType, ocispec.MediaTypeImageIndex))
+	qt.Assert(t, qt.HasLen(index.Manifests, 1))
+	child := index.Manifests[0]
+	qt.Check(t, qt.Equals(child.MediaType, ocispec.MediaTypeImageManifest))
+	qt.Check(t, qt.Equals(child.Platform.Architecture, "amd64"))
+	qt.Check(t, qt.Not(qt.Equals(child.Digest, manifestDesc.Digest)))
+
+	// The converted child digest can be used to fetch the
+	// converted manifest.
+	rd, err = client.GetManifest(ctx, "foo", child.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	data, err = io.ReadAll(rd)
+	qt.Assert(t, qt.IsNil(err))
+	rd.Close()
+	qt.Check(t, qt.Equals(rd.Descriptor().Digest, child.Digest))
+	qt.Check(t, qt.Equals(digest.FromBytes(data), child.Digest))
+	qt.Check(t, qt.Equals(int64(len(data)), child.Size))
+	var m ocispec.Manifest
+	qt.Assert(t, qt.IsNil(json.Unmarshal(data, &m)))
+	qt.Check(t, qt.Equals(m.Config.MediaType, ocispec.MediaTypeImageConfig))
+
+	// Resolving gives consistent results.
+	desc, err = client.ResolveTag(ctx, "foo", "latest")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.DeepEquals(desc, indexDesc))
+	desc, err = client.ResolveManifest(ctx, "foo", child.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(desc.Digest, child.Digest))
+	qt.Check(t, qt.Equals(desc.MediaType, ocispec.MediaTypeImageManifest))
+
+	// A manifest fetched or resolved by its original
+	// digest is not converted.
+	desc, err = client.ResolveManifest(ctx, "foo", manifestDesc.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.DeepEquals(desc, manifestDesc))
+	rd, err = client.GetManifest(ctx, "foo", listDesc.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	data, err = io.ReadAll(rd)
+	qt.Assert(t, qt.IsNil(err))
+	rd.Close()
+	qt.Check(t, qt.DeepEquals(rd.Descriptor(), listDesc))
+	qt.Check(t, qt.Equals(string(data), list))
+}
+
+func TestManifestMediaTypes(t *testing.T) {
+	ctx := context.Background()
+	r := ocimem.New()
+	_, err := r.PushManifest(ctx, "foo", "latest", []byte(dockerManifest), mediatype.DockerManifest)
+	qt.Assert(t, qt.IsNil(err))
+	srv := httptest.NewServer(ociserver.New(r, nil))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+
+	doer := &acceptRecorder{}
+	client, err := New(srvURL.Host, &Options{
+		Insecure:   true,
+		HTTPClient: doer,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	_, err = client.ResolveTag(ctx, "foo", "latest")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(doer.get(), strings.Join(DefaultManifestMediaTypes(), ",")))
+
+	client, err = New(srvURL.Host, &Options{
+		Insecure:           true,
+		HTTPClient:         doer,
+		ManifestMediaTypes: []string{ocispec.MediaTypeImageManifest, mediatype.DockerManifest},
+	})
+	qt.Assert(t, qt.IsNil(err))
+	rd, err := client.GetTag(ctx, "foo", "latest")
+	qt.Assert(t, qt.IsNil(err))
+	rd.Close()
+	qt.Check(t, qt.Equals(doer.get(), ocispec.MediaTypeImageManifest+","+mediatype.DockerManifest))
+
+	ctx = ContextWithManifestMediaTypes(ctx, []string{ocispec.MediaTypeImageIndex})
+	_, err = client.ResolveTag(ctx, "foo", "latest")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(doer.get(), ocispec.MediaTypeImageIndex))
+}
+
+// acceptRecorder records the Accept header of the
+// last manifest request.
+type acceptRecorder struct {
+	mu     sync.Mutex
+	accept string
+}
+
+func (d *acceptRecorder) Do(req *http.Request) (*http.Response, error) {
+	if strings.Contains(req.URL.Path, "/manifests/") {
+		d.mu.Lock()
+		d.accept = strings.Join(req.Header["Accept"], ",")
+		d.mu.Unlock()
+	}
+	return http.DefaultClient.Do(req)
+}
+
+func (d *acceptRecorder) get() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.accept
+}
+
+func jsonString(x any) string {
+	data, err := json.Marshal(x)
+	if err != nil {
+		panic(err)
+	}
+	return string(data)
+}
@@ -15,7 +15,11 @@
 package ociclient
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 
 	"cuelabs.dev/go/oci/ociregistry"
@@ -46,6 +50,49 @@ func (c *client) DeleteTag(ctx context.Context, repoName string, tagName string)
 	})
 }
 
+// DeleteRepository implements [ociregistry.RepositoryDeleter.DeleteRepository].
+// There's no standard API for deleting a repository, so this uses
+// an extension endpoint that's understood by the ociserver package.
+// When the registry doesn't understand that endpoint, it returns an
+// error that satisfies errors.Is(err, ociregistry.ErrUnsupported) and
+// the [ociregistry.CapDeleteRepository] capability is removed.
+func (c *client) DeleteRepository(ctx context.Context, repoName string) error {
+	rreq := &ocirequest.Request{
+		Kind: ocirequest.ReqRepositoryDelete,
+		Repo: repoName,
+	}
+	req, err := newRequest(ctx, rreq, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req, scopeForRequest(rreq), http.StatusAccepted, http.StatusNotFound, http.StatusBadRequest, http.StatusMethodNotAllowed)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusAccepted {
+		return nil
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, errorBodySizeLimit+1))
+	if err != nil {
+		return fmt.Errorf("%s: cannot read error body: %v", resp.Status, err)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	err = makeError(resp)
+	switch {
+	case resp.StatusCode == http.StatusNotFound && errors.Is(err, ociregistry.ErrNameUnknown):
+		// The registry understands the request but
+		// the repository isn't there.
+		return err
+	case resp.StatusCode == http.StatusBadRequest && !errors.Is(err, ociregistry.ErrUnsupported):
+		// The registry understands the request but
+		// there's something wrong with it.
+		return err
+	}
+	c.removeCapability(ociregistry.CapDeleteRepository)
+	return fmt.Errorf("repository deletion not supported by registry (%v): %w", err, ociregistry.ErrUnsupported)
+}
+
 func (c *client) delete(ctx context.Context, rreq *ocirequest.Request) error {
 	resp, err := c.doRequest(ctx, rreq, http.StatusAccepted)
 	if err != nil {
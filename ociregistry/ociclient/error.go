@@ -27,6 +27,7 @@ import (
 	"unicode"
 
 	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/internal/ocirequest"
 )
 
 // errorBodySizeLimit holds the maximum number of response bytes aallowed in
@@ -133,7 +134,7 @@ func makeError(resp *http.Response) error {
 		var err error
 		switch resp.StatusCode {
 		case http.StatusNotFound:
-			err = ociregistry.ErrNameUnknown
+			err = notFoundErrorForRequest(resp.Request)
 		case http.StatusUnauthorized:
 			err = ociregistry.ErrUnauthorized
 		case http.StatusForbidden:
@@ -171,6 +172,25 @@ func makeError(resp *http.Response) error {
 	return &errs
 }
 
+// notFoundErrorForRequest returns the error to use when a HEAD request
+// results in a 404 response. There's no response body, so we
+// can't tell whether it's the repository or the item within
+// the repository that's missing; we choose the error for the
+// item because that's usually more useful.
+func notFoundErrorForRequest(req *http.Request) error {
+	rreq, err := ocirequest.Parse(req.Method, req.URL)
+	if err != nil {
+		return ociregistry.ErrNameUnknown
+	}
+	switch rreq.Kind {
+	case ocirequest.ReqBlobHead:
+		return ociregistry.ErrBlobUnknown
+	case ocirequest.ReqManifestHead:
+		return ociregistry.ErrManifestUnknown
+	}
+	return ociregistry.ErrNameUnknown
+}
+
 // isJSONMediaType reports whether the content type implies
 // that the content is JSON.
 func isJSONMediaType(contentType string) bool {
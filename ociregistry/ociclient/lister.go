@@ -78,12 +78,12 @@ func (c *client) Tags(ctx context.Context, repoName string) ociregistry.Iter[str
 
 func (c *client) Referrers(ctx context.Context, repoName string, digest ociregistry.Digest, artifactType string) ociregistry.Iter[ociregistry.Descriptor] {
 	// TODO paging
-	resp, err := c.doRequest(ctx, &ocirequest.Request{
+	resp, err := c.doReferrersRequest(ctx, &ocirequest.Request{
 		Kind:   ocirequest.ReqReferrersList,
 		Repo:   repoName,
 		Digest: string(digest),
 		ListN:  10000,
-	})
+	}, true)
 	if err != nil {
 		return ociregistry.ErrorIter[ociregistry.Descriptor](err)
 	}
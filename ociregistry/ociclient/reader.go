@@ -15,32 +15,64 @@
 package ociclient
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 
 	"cuelabs.dev/go/oci/ociregistry"
 	"cuelabs.dev/go/oci/ociregistry/internal/ocirequest"
+	"cuelabs.dev/go/oci/ociregistry/ocischema1"
 )
 
 func (c *client) GetBlob(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.BlobReader, error) {
-	return c.read(ctx, &ocirequest.Request{
+	rreq := &ocirequest.Request{
 		Kind:   ocirequest.ReqBlobGet,
 		Repo:   repo,
 		Digest: string(digest),
-	})
+	}
+	br, err := c.readBlob(ctx, rreq)
+	if err != nil {
+		return nil, err
+	}
+	if c.maxBlobResumes > 0 {
+		// Blobs can be large, so rather than failing when the
+		// connection is interrupted, continue reading from where
+		// we got to. The original blobReader continues to
+		// verify the digest of the whole content.
+		br.resumesLeft = c.maxBlobResumes
+		br.resume = func(offset int64) (io.ReadCloser, error) {
+			if offset == 0 {
+				return c.readBlob(ctx, rreq)
+			}
+			return c.GetBlobRange(ctx, repo, digest, offset, -1)
+		}
+	}
+	return br, nil
 }
 
 func (c *client) GetBlobRange(ctx context.Context, repo string, digest ociregistry.Digest, o0, o1 int64) (_ ociregistry.BlobReader, _err error) {
 	if o0 == 0 && o1 < 0 {
 		return c.GetBlob(ctx, repo, digest)
 	}
+	if o0 < 0 || (o1 >= 0 && o1 < o0) {
+		return nil, fmt.Errorf("invalid range [%d, %d]: %w", o0, o1, ociregistry.ErrRangeInvalid)
+	}
+	if o0 == o1 {
+		// An empty range can't be expressed in a Range header.
+		return c.emptyBlobRange(ctx, repo, digest, o0)
+	}
 	rreq := &ocirequest.Request{
 		Kind:   ocirequest.ReqBlobGet,
 		Repo:   repo,
 		Digest: string(digest),
 	}
 	req, err := newRequest(ctx, rreq, nil)
+	if err != nil {
+		return nil, err
+	}
 	if o1 < 0 {
 		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", o0))
 	} else {
@@ -48,17 +80,61 @@ func (c *client) GetBlobRange(ctx context.Context, repo string, digest ociregist
 	}
 	resp, err := c.do(req, scopeForRequest(rreq), http.StatusOK, http.StatusPartialContent)
 	if err != nil {
+		if errors.Is(err, ociregistry.ErrRangeInvalid) {
+			// Servers treat a range starting at the end of
+			// the blob as unsatisfiable, but we allow it.
+			if r, err1 := c.emptyBlobRange(ctx, repo, digest, o0); err1 == nil {
+				return r, nil
+			}
+		}
 		return nil, err
 	}
-	// TODO this is wrong when the server returns a 200 response.
-	// Fix that either by returning ErrUnsupported or by reading the whole
-	// blob and returning only the required portion.
 	defer closeOnError(&_err, resp.Body)
-	desc, err := descriptorFromResponse(resp, ociregistry.Digest(rreq.Digest), true)
+	desc, err := descriptorFromResponse(resp, digest, true)
 	if err != nil {
 		return nil, fmt.Errorf("invalid descriptor in response: %v", err)
 	}
-	return newBlobReaderUnverified(resp.Body, desc), nil
+	if o0 > desc.Size {
+		return nil, fmt.Errorf("range starts after end of blob (size %d): %w", desc.Size, ociregistry.ErrRangeInvalid)
+	}
+	end := desc.Size
+	if o1 >= 0 && o1 < end {
+		end = o1
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// The server has ignored the Range header and
+		// returned the whole blob, so skip to the start
+		// of the range.
+		if _, err := io.CopyN(io.Discard, resp.Body, o0); err != nil {
+			return nil, fmt.Errorf("cannot skip to start of range: %v", err)
+		}
+	case http.StatusPartialContent:
+		first, last, _, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return nil, err
+		}
+		if first != o0 || last+1 != end {
+			return nil, fmt.Errorf("server returned range [%d, %d] but [%d, %d] was requested", first, last+1, o0, end)
+		}
+		if resp.ContentLength >= 0 && resp.ContentLength != end-o0 {
+			return nil, fmt.Errorf("content length %d does not match range [%d, %d]", resp.ContentLength, o0, end)
+		}
+	}
+	return newRangeReader(resp.Body, desc, end-o0), nil
+}
+
+// emptyBlobRange returns an empty reader for the range starting at offset o0
+// when that is within the blob.
+func (c *client) emptyBlobRange(ctx context.Context, repo string, digest ociregistry.Digest, o0 int64) (ociregistry.BlobReader, error) {
+	desc, err := c.ResolveBlob(ctx, repo, digest)
+	if err != nil {
+		return nil, err
+	}
+	if o0 > desc.Size {
+		return nil, fmt.Errorf("range starts after end of blob (size %d): %w", desc.Size, ociregistry.ErrRangeInvalid)
+	}
+	return newRangeReader(http.NoBody, desc, 0), nil
 }
 
 func (c *client) ResolveBlob(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.Descriptor, error) {
@@ -70,7 +146,7 @@ func (c *client) ResolveBlob(ctx context.Context, repo string, digest ociregistr
 }
 
 func (c *client) ResolveManifest(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.Descriptor, error) {
-	return c.resolve(ctx, &ocirequest.Request{
+	return c.resolveManifest(ctx, &ocirequest.Request{
 		Kind:   ocirequest.ReqManifestHead,
 		Repo:   repo,
 		Digest: string(digest),
@@ -78,7 +154,7 @@ func (c *client) ResolveManifest(ctx context.Context, repo string, digest ocireg
 }
 
 func (c *client) ResolveTag(ctx context.Context, repo string, tag string) (ociregistry.Descriptor, error) {
-	return c.resolve(ctx, &ocirequest.Request{
+	return c.resolveManifest(ctx, &ocirequest.Request{
 		Kind: ocirequest.ReqManifestHead,
 		Repo: repo,
 		Tag:  tag,
@@ -99,7 +175,7 @@ func (c *client) resolve(ctx context.Context, rreq *ocirequest.Request) (ociregi
 }
 
 func (c *client) GetManifest(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.BlobReader, error) {
-	return c.read(ctx, &ocirequest.Request{
+	return c.readManifest(ctx, &ocirequest.Request{
 		Kind:   ocirequest.ReqManifestGet,
 		Repo:   repo,
 		Digest: string(digest),
@@ -107,14 +183,51 @@ func (c *client) GetManifest(ctx context.Context, repo string, digest ociregistr
 }
 
 func (c *client) GetTag(ctx context.Context, repo string, tagName string) (ociregistry.BlobReader, error) {
-	return c.read(ctx, &ocirequest.Request{
+	return c.readManifest(ctx, &ocirequest.Request{
 		Kind: ocirequest.ReqManifestGet,
 		Repo: repo,
 		Tag:  tagName,
 	})
 }
 
-func (c *client) read(ctx context.Context, rreq *ocirequest.Request) (_ ociregistry.BlobReader, _err error) {
+func (c *client) read(ctx context.Context, rreq *ocirequest.Request) (ociregistry.BlobReader, error) {
+	br, err := c.readBlob(ctx, rreq)
+	if err != nil {
+		return nil, err
+	}
+	if br.desc.MediaType == ocischema1.MediaTypeSignedManifest {
+		return readSignedSchema1(br)
+	}
+	return br, nil
+}
+
+// readSignedSchema1 reads a signed schema1 manifest from br.
+// The digest of such a manifest is the digest of its
+// payload without the signatures, so the usual
+// verification doesn't apply.
+func readSignedSchema1(br *blobReader) (ociregistry.BlobReader, error) {
+	defer br.Close()
+	data, err := io.ReadAll(io.LimitReader(br.r, br.desc.Size+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != br.desc.Size {
+		return nil, fmt.Errorf("manifest size mismatch (%d/%d): %w", len(data), br.desc.Size, ociregistry.ErrSizeInvalid)
+	}
+	dig, err := ocischema1.Digest(data)
+	if err != nil {
+		return nil, err
+	}
+	if dig != br.desc.Digest {
+		return nil, fmt.Errorf("digest mismatch when reading manifest")
+	}
+	return &bytesReader{
+		Reader: bytes.NewReader(data),
+		desc:   br.desc,
+	}, nil
+}
+
+func (c *client) readBlob(ctx context.Context, rreq *ocirequest.Request) (_ *blobReader, _err error) {
 	resp, err := c.doRequest(ctx, rreq)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,432 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ocischema1"
+	"cuelabs.dev/go/oci/ociregistry/ociserver"
+)
+
+var resumeTests = []struct {
+	testName       string
+	maxBlobResumes int
+	interruptions  int
+	err            error
+	wantErr        string
+	wantRequests   []string
+}{{
+	testName:      "NoInterruption",
+	interruptions: 0,
+	wantRequests:  []string{""},
+}, {
+	testName:      "OneInterruption",
+	interruptions: 1,
+	wantRequests:  []string{"", "bytes=10-"},
+}, {
+	testName:      "SeveralInterruptions",
+	interruptions: 3,
+	wantRequests:  []string{"", "bytes=10-", "bytes=20-", "bytes=30-"},
+}, {
+	testName:      "UnexpectedEOF",
+	interruptions: 1,
+	err:           io.ErrUnexpectedEOF,
+	wantRequests:  []string{"", "bytes=10-"},
+}, {
+	testName:       "TooManyInterruptions",
+	maxBlobResumes: 2,
+	interruptions:  3,
+	wantErr:        "connection reset",
+	wantRequests:   []string{"", "bytes=10-", "bytes=20-"},
+}, {
+	testName:       "ResumeDisabled",
+	maxBlobResumes: -1,
+	interruptions:  1,
+	wantErr:        "connection reset",
+	wantRequests:   []string{""},
+}, {
+	testName:      "NotTransient",
+	interruptions: 1,
+	err:           errors.New("some other error"),
+	wantErr:       "some other error",
+	wantRequests:  []string{""},
+}}
+
+func TestGetBlobResume(t *testing.T) {
+	ctx := context.Background()
+	content := []byte(strings.Repeat("0123456789", 10))
+	for _, test := range resumeTests {
+		t.Run(test.testName, func(t *testing.T) {
+			r := ocimem.New()
+			desc := ociregistry.Descriptor{
+				MediaType: "application/octet-stream",
+				Digest:    digest.FromBytes(content),
+				Size:      int64(len(content)),
+			}
+			_, err := r.PushBlob(ctx, "foo/bar", desc, bytes.NewReader(content))
+			qt.Assert(t, qt.IsNil(err))
+			srv := httptest.NewServer(ociserver.New(r, nil))
+			defer srv.Close()
+			srvURL, _ := url.Parse(srv.URL)
+
+			doer := &interruptingDoer{
+				interruptions: test.interruptions,
+				after:         10,
+				err:           test.err,
+			}
+			client, err := New(srvURL.Host, &Options{
+				Insecure:       true,
+				HTTPClient:     doer,
+				MaxBlobResumes: test.maxBlobResumes,
+			})
+			qt.Assert(t, qt.IsNil(err))
+			rd, err := client.GetBlob(ctx, "foo/bar", desc.Digest)
+			qt.Assert(t, qt.IsNil(err))
+			defer rd.Close()
+			got, err := io.ReadAll(rd)
+			if test.wantErr != "" {
+				qt.Assert(t, qt.ErrorMatches(err, ".*"+test.wantErr+".*"))
+			} else {
+				qt.Assert(t, qt.IsNil(err))
+				qt.Assert(t, qt.DeepEquals(got, content))
+			}
+			qt.Assert(t, qt.DeepEquals(doer.ranges, test.wantRequests))
+		})
+	}
+}
+
+func TestGetBlobResumeDetectsCorruption(t *testing.T) {
+	ctx := context.Background()
+	content := []byte(strings.Repeat("0123456789", 10))
+	r := ocimem.New()
+	desc := ociregistry.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    digest.FromBytes(content),
+		Size:      int64(len(content)),
+	}
+	_, err := r.PushBlob(ctx, "foo/bar", desc, bytes.NewReader(content))
+	qt.Assert(t, qt.IsNil(err))
+	srv := httptest.NewServer(ociserver.New(r, nil))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+
+	doer := &interruptingDoer{
+		interruptions: 1,
+		after:         10,
+		corrupt:       true,
+	}
+	client, err := New(srvURL.Host, &Options{
+		Insecure:   true,
+		HTTPClient: doer,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	rd, err := client.GetBlob(ctx, "foo/bar", desc.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	defer rd.Close()
+	_, err = io.ReadAll(rd)
+	qt.Assert(t, qt.ErrorMatches(err, "digest mismatch when reading blob"))
+}
+
+var getBlobRangeTests = []struct {
+	testName string
+	o0, o1   int64
+	// handler handles the blob GET request, given the
+	// requested range and the blob content.
+	handler func(w http.ResponseWriter, rangeHeader string, content string)
+	want    string
+	wantErr string
+}{{
+	testName: "PartialContent",
+	o0:       2,
+	o1:       5,
+	handler: func(w http.ResponseWriter, rangeHeader string, content string) {
+		w.Header().Set("Content-Range", "bytes 2-4/11")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte(content[2:5]))
+	},
+	want: "llo",
+}, {
+	testName: "RangeIgnored",
+	o0:       2,
+	o1:       5,
+	handler: func(w http.ResponseWriter, rangeHeader string, content string) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(content))
+	},
+	want: "llo",
+}, {
+	testName: "RangeIgnoredToEnd",
+	o0:       6,
+	o1:       -1,
+	handler: func(w http.ResponseWriter, rangeHeader string, content string) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(content))
+	},
+	want: "world",
+}, {
+	testName: "RangeIgnoredStartAfterEnd",
+	o0:       20,
+	o1:       -1,
+	handler: func(w http.ResponseWriter, rangeHeader string, content string) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(content))
+	},
+	wantErr: `range starts after end of blob \(size 11\): invalid content range`,
+}, {
+	testName: "WrongRange",
+	o0:       2,
+	o1:       5,
+	handler: func(w http.ResponseWriter, rangeHeader string, content string) {
+		w.Header().Set("Content-Range", "bytes 0-2/11")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte(content[0:3]))
+	},
+	wantErr: `server returned range \[0, 3\] but \[2, 5\] was requested`,
+}, {
+	testName: "ContentRangeOutOfBounds",
+	o0:       2,
+	o1:       5,
+	handler: func(w http.ResponseWriter, rangeHeader string, content string) {
+		w.Header().Set("Content-Range", "bytes 2-20/11")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte(content[2:]))
+	},
+	wantErr: `invalid descriptor in response: Content-Range "bytes 2-20/11" out of bounds`,
+}, {
+	testName: "MalformedContentRange",
+	o0:       2,
+	o1:       5,
+	handler: func(w http.ResponseWriter, rangeHeader string, content string) {
+		w.Header().Set("Content-Range", "bytes 2-4/*")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte(content[2:5]))
+	},
+	wantErr: `invalid descriptor in response: malformed Content-Range "bytes 2-4/\*"`,
+}, {
+	testName: "ShortContent",
+	o0:       2,
+	o1:       5,
+	handler: func(w http.ResponseWriter, rangeHeader string, content string) {
+		w.Header().Set("Content-Range", "bytes 2-4/11")
+		w.Header().Set("Content-Length", "2")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte(content[2:4]))
+	},
+	wantErr: `content length 2 does not match range \[2, 5\]`,
+}, {
+	testName: "EmptyRangeAtEnd",
+	o0:       11,
+	o1:       -1,
+	handler: func(w http.ResponseWriter, rangeHeader string, content string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		w.Write([]byte(`{"errors":[{"code":"RANGE_INVALID","message":"bad range"}]}`))
+	},
+	want: "",
+}, {
+	testName: "InvalidRange",
+	o0:       5,
+	o1:       2,
+	wantErr:  `invalid range \[5, 2\]: invalid content range`,
+}}
+
+func TestGetBlobRange(t *testing.T) {
+	ctx := context.Background()
+	content := "hello world"
+	dig := digest.FromString(content)
+	for _, test := range getBlobRangeTests {
+		t.Run(test.testName, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Docker-Content-Digest", string(dig))
+				if req.Method == "HEAD" {
+					w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+					return
+				}
+				if test.handler == nil {
+					t.Errorf("unexpected request %s %v", req.Method, req.URL)
+					return
+				}
+				test.handler(w, req.Header.Get("Range"), content)
+			}))
+			defer srv.Close()
+			srvURL, _ := url.Parse(srv.URL)
+			client, err := New(srvURL.Host, &Options{
+				Insecure: true,
+			})
+			qt.Assert(t, qt.IsNil(err))
+			rd, err := client.GetBlobRange(ctx, "foo/bar", dig, test.o0, test.o1)
+			if test.wantErr != "" {
+				qt.Assert(t, qt.ErrorMatches(err, test.wantErr))
+				return
+			}
+			qt.Assert(t, qt.IsNil(err))
+			defer rd.Close()
+			got, err := io.ReadAll(rd)
+			qt.Assert(t, qt.IsNil(err))
+			qt.Check(t, qt.Equals(string(got), test.want))
+			qt.Check(t, qt.Equals(rd.Descriptor().Digest, dig))
+			qt.Check(t, qt.Equals(rd.Descriptor().Size, int64(len(content))))
+		})
+	}
+}
+
+// interruptingDoer is an HTTPDoer that interrupts the
+// body of blob responses after a given number of bytes,
+// the given number of times.
+type interruptingDoer struct {
+	after int64
+
+	// err holds the error that an interrupted body fails with.
+	// If it's nil, the connection appears to have been reset.
+	err error
+
+	// corrupt causes the first byte of each resumed
+	// response to be changed.
+	corrupt bool
+
+	mu            sync.Mutex
+	interruptions int
+	ranges        []string
+}
+
+func (d *interruptingDoer) Do(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || req.Method != "GET" || !strings.Contains(req.URL.Path, "/blobs/") {
+		return resp, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	rangeHeader := req.Header.Get("Range")
+	d.ranges = append(d.ranges, rangeHeader)
+	if d.corrupt && rangeHeader != "" {
+		resp.Body = &corruptingReader{ReadCloser: resp.Body}
+	}
+	if d.interruptions > 0 {
+		d.interruptions--
+		err := d.err
+		if err == nil {
+			err = &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+		}
+		resp.Body = &interruptedReader{
+			r:   io.LimitReader(resp.Body, d.after),
+			c:   resp.Body,
+			err: err,
+		}
+	}
+	return resp, nil
+}
+
+type interruptedReader struct {
+	r   io.Reader
+	c   io.Closer
+	err error
+}
+
+func (r *interruptedReader) Read(buf []byte) (int, error) {
+	n, err := r.r.Read(buf)
+	if err == io.EOF {
+		return n, r.err
+	}
+	return n, err
+}
+
+func (r *interruptedReader) Close() error {
+	return r.c.Close()
+}
+
+type corruptingReader struct {
+	io.ReadCloser
+	done bool
+}
+
+func (r *corruptingReader) Read(buf []byte) (int, error) {
+	n, err := r.ReadCloser.Read(buf)
+	if n > 0 && !r.done {
+		buf[0] ^= 0xff
+		r.done = true
+	}
+	return n, err
+}
+
+func TestGetSignedSchema1Manifest(t *testing.T) {
+	ctx := context.Background()
+	payload := "{\n   \"schemaVersion\": 1,\n   \"name\": \"foo/bar\"\n}"
+	protected := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(
+		`{"formatLength":%d,"formatTail":%q}`,
+		len(payload)-2, base64.RawURLEncoding.EncodeToString([]byte("\n}")),
+	)))
+	signed := payload[:len(payload)-2] + `,
+   "signatures": [{"header": {"alg": "ES256"}, "signature": "c2ln", "protected": "` + protected + `"}]
+}`
+	dig := digest.FromString(payload)
+	for _, test := range []struct {
+		testName string
+		digest   ociregistry.Digest
+		wantErr  string
+	}{{
+		testName: "PayloadDigest",
+		digest:   dig,
+	}, {
+		testName: "WrongDigest",
+		digest:   digest.FromString(signed),
+		wantErr:  "digest mismatch when reading manifest",
+	}} {
+		t.Run(test.testName, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Docker-Content-Digest", string(test.digest))
+				w.Header().Set("Content-Type", ocischema1.MediaTypeSignedManifest)
+				w.Header().Set("Content-Length", fmt.Sprint(len(signed)))
+				w.Write([]byte(signed))
+			}))
+			defer srv.Close()
+			srvURL, _ := url.Parse(srv.URL)
+			client, err := New(srvURL.Host, &Options{
+				Insecure: true,
+			})
+			qt.Assert(t, qt.IsNil(err))
+			rd, err := client.GetTag(ctx, "foo/bar", "latest")
+			if test.wantErr != "" {
+				qt.Assert(t, qt.ErrorMatches(err, test.wantErr))
+				return
+			}
+			qt.Assert(t, qt.IsNil(err))
+			defer rd.Close()
+			got, err := io.ReadAll(rd)
+			qt.Assert(t, qt.IsNil(err))
+			qt.Check(t, qt.Equals(string(got), signed))
+			qt.Check(t, qt.Equals(rd.Descriptor().Digest, dig))
+			qt.Check(t, qt.Equals(rd.Descriptor().MediaType, ocischema1.MediaTypeSignedManifest))
+		})
+	}
+}
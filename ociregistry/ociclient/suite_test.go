@@ -0,0 +1,41 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociclient
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ociserver"
+	"cuelabs.dev/go/oci/ociregistry/ocitest"
+)
+
+func TestInterface(t *testing.T) {
+	ocitest.RunInterfaceTests(t, func(t *testing.T) ociregistry.Interface {
+		srv := httptest.NewServer(ociserver.New(ocimem.New(), nil))
+		t.Cleanup(srv.Close)
+		srvURL, _ := url.Parse(srv.URL)
+		r, err := New(srvURL.Host, &Options{
+			Insecure: true,
+		})
+		qt.Assert(t, qt.IsNil(err))
+		return r
+	})
+}
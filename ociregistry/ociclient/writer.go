@@ -108,7 +108,10 @@ func (c *client) PushBlob(ctx context.Context, repo string, desc ociregistry.Des
 
 	// Note: we can't use ocirequest.Request here because that's
 	// specific to the ociserver implementation in this case.
-	req, err = http.NewRequestWithContext(ctx, "PUT", "", r)
+	req, err = http.NewRequestWithContext(ctx, "PUT", "", &sizeCheckReader{
+		r:    r,
+		size: desc.Size,
+	})
 	if err != nil {
 		return ociregistry.Descriptor{}, err
 	}
@@ -126,6 +129,27 @@ func (c *client) PushBlob(ctx context.Context, repo string, desc ociregistry.Des
 	return desc, nil
 }
 
+// sizeCheckReader wraps a reader so that it returns an error
+// satisfying errors.Is(err, ociregistry.ErrSizeInvalid)
+// if the underlying reader returns less data than expected.
+// This means that a caller providing a descriptor
+// with an incorrect size gets a meaningful error rather
+// than an HTTP transport error.
+type sizeCheckReader struct {
+	r    io.Reader
+	n    int64
+	size int64
+}
+
+func (r *sizeCheckReader) Read(buf []byte) (int, error) {
+	n, err := r.r.Read(buf)
+	r.n += int64(n)
+	if err == io.EOF && r.n < r.size {
+		return n, fmt.Errorf("blob content shorter than descriptor size (%d/%d): %w", r.n, r.size, ociregistry.ErrSizeInvalid)
+	}
+	return n, err
+}
+
 // TODO is this a reasonable default? We have to
 // weigh up in-memory cost vs round-trip overhead.
 // TODO: make this default configurable.
@@ -374,7 +398,7 @@ func (w *blobWriter) Commit(digest ociregistry.Digest) (ociregistry.Descriptor,
 	w.mu.Lock()
 	defer w.mu.Unlock()
 	if err := w.flush(nil, digest); err != nil {
-		return ociregistry.Descriptor{}, fmt.Errorf("cannot flush data before commit: %v", err)
+		return ociregistry.Descriptor{}, fmt.Errorf("cannot flush data before commit: %w", err)
 	}
 	return ociregistry.Descriptor{
 		MediaType: "application/octet-stream",
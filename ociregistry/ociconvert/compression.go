@@ -0,0 +1,148 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociconvert
+
+import (
+	"compress/gzip"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"cuelabs.dev/go/oci/ociregistry/internal/mediatype"
+)
+
+// Compression describes a compression format for layers.
+type Compression struct {
+	// Name holds the name of the format as used in
+	// layer media type suffixes, for example "gzip" in
+	// "application/vnd.oci.image.layer.v1.tar+gzip".
+	// It's empty for uncompressed layers.
+	Name string
+
+	// NewReader returns a reader that decompresses
+	// the content of r.
+	NewReader func(r io.Reader) (io.ReadCloser, error)
+
+	// NewWriter returns a writer that compresses content
+	// written to it and writes it to w. The writer will
+	// be closed when all the content has been written.
+	NewWriter func(w io.Writer) (io.WriteCloser, error)
+}
+
+// Gzip holds the gzip compression format, as implemented
+// by [compress/gzip]. Compressing the same content with the
+// same Go release always produces the same output, but the
+// output, and so the digests of converted layers, may change
+// between Go releases.
+var Gzip = &Compression{
+	Name: "gzip",
+	NewReader: func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+	NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriter(w), nil
+	},
+}
+
+// Zstd holds the zstd compression format, as implemented by
+// [github.com/klauspost/compress/zstd]. Compressing the same
+// content with the same version of that module always produces
+// the same output, but the output may change when the module
+// is upgraded.
+var Zstd = &Compression{
+	Name: "zstd",
+	NewReader: func(r io.Reader) (io.ReadCloser, error) {
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	},
+	NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	},
+}
+
+// Uncompressed holds the format for uncompressed layers.
+var Uncompressed = &Compression{
+	Name: "",
+	NewReader: func(r io.Reader) (io.ReadCloser, error) {
+		return io.NopCloser(r), nil
+	},
+	NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+		return nopWriteCloser{w}, nil
+	},
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// OCIMediaType returns the OCI equivalent of the given Docker
+// schema2 media type. Any other media type is returned unchanged.
+func OCIMediaType(mediaType string) string {
+	return mediatype.OCI(mediaType)
+}
+
+// layerCompression returns the name of the compression format used
+// by a layer with the given media type. It reports false if the media
+// type is not that of a distributable tar layer.
+func layerCompression(mediaType string) (string, bool) {
+	switch mediaType {
+	case mediatype.DockerLayer:
+		return "", true
+	case mediatype.DockerLayerGzip:
+		return "gzip", true
+	}
+	rest, ok := strings.CutPrefix(mediaType, ocispec.MediaTypeImageLayer)
+	if !ok {
+		return "", false
+	}
+	if rest == "" {
+		return "", true
+	}
+	name, ok := strings.CutPrefix(rest, "+")
+	return name, ok && name != ""
+}
+
+// layerMediaType returns the media type for a layer compressed
+// with the given format. If docker is true, the Docker media type
+// is returned when there is one; otherwise the OCI media type is.
+func layerMediaType(c *Compression, docker bool) string {
+	if docker {
+		switch c.Name {
+		case "":
+			return mediatype.DockerLayer
+		case Gzip.Name:
+			return mediatype.DockerLayerGzip
+		}
+	}
+	if c.Name == "" {
+		return ocispec.MediaTypeImageLayer
+	}
+	return ocispec.MediaTypeImageLayer + "+" + c.Name
+}
+
+// isForeignLayer reports whether a layer with the given media
+// type might not be held in the registry.
+func isForeignLayer(mediaType string) bool {
+	return strings.Contains(mediaType, ".nondistributable.") || strings.Contains(mediaType, ".foreign.")
+}
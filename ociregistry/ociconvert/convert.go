@@ -0,0 +1,363 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ociconvert provides support for rewriting images, for
+// example to recompress their layers or to replace Docker media
+// types with OCI ones.
+//
+// The gzip and zstd compression formats are provided by this
+// package. Other formats can be used by defining a [Compression]
+// value for them.
+package ociconvert
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/internal/mediatype"
+)
+
+// Options holds options for [Convert].
+type Options struct {
+	// LayerCompression holds the compression format to use for
+	// image layers. Layers using any other format are
+	// recompressed. If it's nil, layers are left as they are.
+	LayerCompression *Compression
+
+	// Compressions holds additional compression formats that can
+	// be decompressed when recompressing layers. [Gzip], [Zstd]
+	// and [Uncompressed] are always available.
+	Compressions []*Compression
+
+	// OCIMediaTypes causes Docker schema2 media types to be
+	// replaced by their OCI equivalents.
+	OCIMediaTypes bool
+}
+
+// Convert converts the image manifest or index with the given
+// descriptor in the srcRepo repository in src, writing the converted
+// content to the dstRepo repository in dst. It returns the
+// descriptor of the converted manifest, which is pushed to dst
+// without a tag. The src and dst registries may be the same.
+//
+// Indexes are converted by converting each of the manifests that
+// they refer to. Content that isn't changed by the conversion,
+// including manifests with media types that aren't understood, is
+// copied unless dst already holds it. If nothing changes, the
+// returned descriptor refers to the original manifest.
+//
+// When a layer is recompressed, the digest of its uncompressed
+// content is checked against the corresponding entry in the image
+// configuration's rootfs.diff_ids field; Convert returns an error
+// wrapping [ociregistry.ErrDigestInvalid] if they don't match. The
+// configuration itself is unchanged, because recompression does not
+// change the uncompressed content.
+//
+// Recompressed layers in a Docker schema2 manifest that keeps its
+// media type use the Docker layer media types when the new format is
+// gzip or uncompressed. Otherwise they use OCI media types, because
+// Docker has no media types for other compression formats.
+func Convert(ctx context.Context, dst ociregistry.Interface, dstRepo string, src ociregistry.Interface, srcRepo string, desc ociregistry.Descriptor, opts *Options) (ociregistry.Descriptor, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	c := &converter{
+		dst:     dst,
+		dstRepo: dstRepo,
+		src:     src,
+		srcRepo: srcRepo,
+		opts:    opts,
+	}
+	return c.convert(ctx, desc)
+}
+
+type converter struct {
+	dst     ociregistry.Interface
+	dstRepo string
+	src     ociregistry.Interface
+	srcRepo string
+	opts    *Options
+}
+
+func (c *converter) convert(ctx context.Context, desc ociregistry.Descriptor) (ociregistry.Descriptor, error) {
+	rd, err := c.src.GetManifest(ctx, c.srcRepo, desc.Digest)
+	if err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	defer rd.Close()
+	data, err := io.ReadAll(rd)
+	if err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	rdesc := rd.Descriptor()
+	desc.MediaType = rdesc.MediaType
+	desc.Size = rdesc.Size
+	switch {
+	case mediatype.IsManifest(desc.MediaType):
+		return c.convertManifest(ctx, desc, data)
+	case mediatype.IsIndex(desc.MediaType):
+		return c.convertIndex(ctx, desc, data)
+	}
+	return desc, c.copyManifest(ctx, desc, data)
+}
+
+func (c *converter) convertManifest(ctx context.Context, desc ociregistry.Descriptor, data []byte) (ociregistry.Descriptor, error) {
+	var m ocispec.Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return ociregistry.Descriptor{}, fmt.Errorf("cannot unmarshal manifest %s: %v", desc.Digest, err)
+	}
+	var diffIDs []ociregistry.Digest
+	if c.opts.LayerCompression != nil && mediatype.IsImageConfig(m.Config.MediaType) {
+		var err error
+		diffIDs, err = c.diffIDs(ctx, m.Config)
+		if err != nil {
+			return ociregistry.Descriptor{}, err
+		}
+		if len(diffIDs) != len(m.Layers) {
+			return ociregistry.Descriptor{}, fmt.Errorf("manifest %s has %d layers but its configuration has %d diff_ids", desc.Digest, len(m.Layers), len(diffIDs))
+		}
+	}
+	// Recompressed layers use Docker media types when
+	// the manifest keeps its Docker media type.
+	docker := desc.MediaType == mediatype.DockerManifest && !c.opts.OCIMediaTypes
+	changed := false
+	for i, layer := range m.Layers {
+		name, ok := layerCompression(layer.MediaType)
+		if ok && c.opts.LayerCompression != nil && name != c.opts.LayerCompression.Name {
+			from, err := c.compression(name)
+			if err != nil {
+				return ociregistry.Descriptor{}, err
+			}
+			var diffID ociregistry.Digest
+			if diffIDs != nil {
+				diffID = diffIDs[i]
+			}
+			m.Layers[i], err = c.recompress(ctx, layer, from, c.opts.LayerCompression, diffID, docker)
+			if err != nil {
+				return ociregistry.Descriptor{}, fmt.Errorf("cannot recompress layer %s: %w", layer.Digest, err)
+			}
+			changed = true
+			continue
+		}
+		if !isForeignLayer(layer.MediaType) {
+			if err := c.copyBlob(ctx, layer); err != nil {
+				return ociregistry.Descriptor{}, err
+			}
+		}
+		changed = c.convertMediaType(&m.Layers[i].MediaType) || changed
+	}
+	if err := c.copyBlob(ctx, m.Config); err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	changed = c.convertMediaType(&m.Config.MediaType) || changed
+	mediaType := desc.MediaType
+	changed = c.convertMediaType(&mediaType) || changed
+	if !changed {
+		return desc, c.copyManifest(ctx, desc, data)
+	}
+	if m.MediaType != "" {
+		m.MediaType = mediaType
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	return c.pushManifest(ctx, data, mediaType)
+}
+
+func (c *converter) convertIndex(ctx context.Context, desc ociregistry.Descriptor, data []byte) (ociregistry.Descriptor, error) {
+	var index ocispec.Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		return ociregistry.Descriptor{}, fmt.Errorf("cannot unmarshal index %s: %v", desc.Digest, err)
+	}
+	changed := false
+	for i, child := range index.Manifests {
+		newChild, err := c.convert(ctx, child)
+		if err != nil {
+			return ociregistry.Descriptor{}, fmt.Errorf("cannot convert manifest %s: %w", child.Digest, err)
+		}
+		if newChild.Digest != child.Digest || newChild.MediaType != child.MediaType {
+			index.Manifests[i].MediaType = newChild.MediaType
+			index.Manifests[i].Digest = newChild.Digest
+			index.Manifests[i].Size = newChild.Size
+			changed = true
+		}
+	}
+	mediaType := desc.MediaType
+	changed = c.convertMediaType(&mediaType) || changed
+	if !changed {
+		return desc, c.copyManifest(ctx, desc, data)
+	}
+	if index.MediaType != "" {
+		index.MediaType = mediaType
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	return c.pushManifest(ctx, data, mediaType)
+}
+
+// convertMediaType converts *mediaType to its OCI equivalent if
+// c.opts.OCIMediaTypes is set and reports whether it has changed.
+func (c *converter) convertMediaType(mediaType *string) bool {
+	if !c.opts.OCIMediaTypes {
+		return false
+	}
+	t := OCIMediaType(*mediaType)
+	if t == *mediaType {
+		return false
+	}
+	*mediaType = t
+	return true
+}
+
+// diffIDs returns the rootfs.diff_ids field of the
+// image configuration with the given descriptor.
+func (c *converter) diffIDs(ctx context.Context, desc ociregistry.Descriptor) ([]ociregistry.Digest, error) {
+	rd, err := c.src.GetBlob(ctx, c.srcRepo, desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	data, err := io.ReadAll(rd)
+	if err != nil {
+		return nil, err
+	}
+	var config ocispec.Image
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal image configuration %s: %v", desc.Digest, err)
+	}
+	return config.RootFS.DiffIDs, nil
+}
+
+// recompress decompresses the given layer with the from format,
+// compresses it with the to format and pushes the result,
+// returning its descriptor. If diffID is non-empty, the
+// digest of the uncompressed content is checked against it.
+// If docker is true, a Docker media type is used if there is one.
+func (c *converter) recompress(ctx context.Context, layer ociregistry.Descriptor, from, to *Compression, diffID ociregistry.Digest, docker bool) (ociregistry.Descriptor, error) {
+	diffAlgorithm := digest.Canonical
+	if diffID != "" {
+		if err := diffID.Validate(); err != nil {
+			return ociregistry.Descriptor{}, fmt.Errorf("invalid diff ID %q: %w", diffID, ociregistry.ErrDigestInvalid)
+		}
+		diffAlgorithm = diffID.Algorithm()
+	}
+	rd, err := c.src.GetBlob(ctx, c.srcRepo, layer.Digest)
+	if err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	defer rd.Close()
+	zr, err := from.NewReader(rd)
+	if err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	defer zr.Close()
+
+	w, err := c.dst.PushBlobChunked(ctx, c.dstRepo, 0)
+	if err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	defer w.Cancel()
+	digester := digest.Canonical.Digester()
+	zw, err := to.NewWriter(io.MultiWriter(w, digester.Hash()))
+	if err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	diffDigester := diffAlgorithm.Digester()
+	if _, err := io.Copy(zw, io.TeeReader(zr, diffDigester.Hash())); err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	if err := zw.Close(); err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	// Read any remaining data so that the blob
+	// reader can verify the digest.
+	if _, err := io.Copy(io.Discard, rd); err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	if diffID != "" && diffDigester.Digest() != diffID {
+		return ociregistry.Descriptor{}, fmt.Errorf("uncompressed content has digest %s but configuration has diff ID %s: %w", diffDigester.Digest(), diffID, ociregistry.ErrDigestInvalid)
+	}
+	desc, err := w.Commit(digester.Digest())
+	if err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	layer.MediaType = layerMediaType(to, docker)
+	layer.Digest = desc.Digest
+	layer.Size = desc.Size
+	return layer, nil
+}
+
+// compression returns the compression format with the given name.
+func (c *converter) compression(name string) (*Compression, error) {
+	for _, comp := range c.opts.Compressions {
+		if comp.Name == name {
+			return comp, nil
+		}
+	}
+	switch name {
+	case Gzip.Name:
+		return Gzip, nil
+	case Zstd.Name:
+		return Zstd, nil
+	case Uncompressed.Name:
+		return Uncompressed, nil
+	}
+	return nil, fmt.Errorf("cannot decompress layers with %q compression: %w", name, ociregistry.ErrUnsupported)
+}
+
+// copyBlob copies the blob with the given descriptor
+// from src to dst unless it's already there.
+func (c *converter) copyBlob(ctx context.Context, desc ociregistry.Descriptor) error {
+	if _, err := c.dst.ResolveBlob(ctx, c.dstRepo, desc.Digest); err == nil {
+		return nil
+	}
+	rd, err := c.src.GetBlob(ctx, c.srcRepo, desc.Digest)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	_, err = c.dst.PushBlob(ctx, c.dstRepo, desc, rd)
+	return err
+}
+
+// copyManifest pushes the manifest with the given descriptor
+// and content to dst unless it's already there.
+func (c *converter) copyManifest(ctx context.Context, desc ociregistry.Descriptor, data []byte) error {
+	if _, err := c.dst.ResolveManifest(ctx, c.dstRepo, desc.Digest); err == nil {
+		return nil
+	}
+	_, err := c.dst.PushManifest(ctx, c.dstRepo, "", data, desc.MediaType)
+	return err
+}
+
+func (c *converter) pushManifest(ctx context.Context, data []byte, mediaType string) (ociregistry.Descriptor, error) {
+	desc, err := c.dst.PushManifest(ctx, c.dstRepo, "", data, mediaType)
+	if err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	return ociregistry.Descriptor{
+		MediaType: mediaType,
+		Digest:    desc.Digest,
+		Size:      desc.Size,
+	}, nil
+}
@@ -0,0 +1,314 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociconvert_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+	ocispecroot "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ociconvert"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ocitest"
+)
+
+// testFlate is a compression format used to stand in for
+// formats that aren't built in.
+var testFlate = &ociconvert.Compression{
+	Name: "flate",
+	NewReader: func(r io.Reader) (io.ReadCloser, error) {
+		return flate.NewReader(r), nil
+	},
+	NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(w, flate.DefaultCompression)
+	},
+}
+
+const (
+	dockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	dockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	dockerConfig       = "application/vnd.docker.container.image.v1+json"
+	dockerLayer        = "application/vnd.docker.image.rootfs.diff.tar"
+	dockerLayerGzip    = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+)
+
+var layerContents = []string{"first layer", "second layer"}
+
+func TestConvertRecompress(t *testing.T) {
+	ctx := context.Background()
+	r := ocimem.New()
+	reg := ocitest.NewRegistry(t, r)
+	desc := pushDockerIndex(t, r, "foo", layerContents, nil)
+
+	newDesc, err := ociconvert.Convert(ctx, r, "foo", r, "foo", desc, &ociconvert.Options{
+		LayerCompression: testFlate,
+		OCIMediaTypes:    true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(newDesc.MediaType, ocispec.MediaTypeImageIndex))
+	qt.Check(t, qt.Not(qt.Equals(newDesc.Digest, desc.Digest)))
+
+	var index ocispec.Index
+	reg.MustGetManifest("foo", newDesc, &index)
+	qt.Check(t, qt.Equals(index.MediaType, ocispec.MediaTypeImageIndex))
+	qt.Assert(t, qt.HasLen(index.Manifests, 1))
+	qt.Check(t, qt.Equals(index.Manifests[0].MediaType, ocispec.MediaTypeImageManifest))
+	qt.Check(t, qt.DeepEquals(index.Manifests[0].Platform, &ocispec.Platform{
+		OS:           "linux",
+		Architecture: "amd64",
+	}))
+
+	var m ocispec.Manifest
+	reg.MustGetManifest("foo", index.Manifests[0], &m)
+	qt.Check(t, qt.Equals(m.MediaType, ocispec.MediaTypeImageManifest))
+	qt.Check(t, qt.Equals(m.Config.MediaType, ocispec.MediaTypeImageConfig))
+	qt.Assert(t, qt.HasLen(m.Layers, len(layerContents)))
+	for i, layer := range m.Layers {
+		qt.Check(t, qt.Equals(layer.MediaType, "application/vnd.oci.image.layer.v1.tar+flate"))
+		data := reg.MustGetBlob("foo", layer.Digest)
+		qt.Check(t, qt.Equals(layer.Size, int64(len(data))))
+		zr := flate.NewReader(bytes.NewReader(data))
+		got, err := io.ReadAll(zr)
+		qt.Assert(t, qt.IsNil(err))
+		qt.Check(t, qt.Equals(string(got), layerContents[i]))
+	}
+
+	// Converting back again produces the original layers
+	// because gzip compression produces the same output for
+	// the same input with a given Go release.
+	newDesc, err = ociconvert.Convert(ctx, r, "foo", r, "foo", index.Manifests[0], &ociconvert.Options{
+		LayerCompression: ociconvert.Gzip,
+		Compressions:     []*ociconvert.Compression{testFlate},
+	})
+	qt.Assert(t, qt.IsNil(err))
+	var m1 ocispec.Manifest
+	reg.MustGetManifest("foo", newDesc, &m1)
+	qt.Assert(t, qt.HasLen(m1.Layers, len(layerContents)))
+	for i, layer := range m1.Layers {
+		qt.Check(t, qt.Equals(layer.MediaType, ocispec.MediaTypeImageLayerGzip))
+		qt.Check(t, qt.Equals(layer.Digest, digest.FromBytes(ocitest.Gzip([]byte(layerContents[i])))))
+	}
+}
+
+func TestConvertZstd(t *testing.T) {
+	ctx := context.Background()
+	r := ocimem.New()
+	reg := ocitest.NewRegistry(t, r)
+	desc := pushDockerImage(t, r, "foo", layerContents, nil)
+
+	zdesc, err := ociconvert.Convert(ctx, r, "foo", r, "foo", desc, &ociconvert.Options{
+		LayerCompression: ociconvert.Zstd,
+		OCIMediaTypes:    true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	var m ocispec.Manifest
+	reg.MustGetManifest("foo", zdesc, &m)
+	qt.Assert(t, qt.HasLen(m.Layers, len(layerContents)))
+	for i, layer := range m.Layers {
+		qt.Check(t, qt.Equals(layer.MediaType, "application/vnd.oci.image.layer.v1.tar+zstd"))
+		zr, err := ociconvert.Zstd.NewReader(bytes.NewReader(reg.MustGetBlob("foo", layer.Digest)))
+		qt.Assert(t, qt.IsNil(err))
+		got, err := io.ReadAll(zr)
+		qt.Assert(t, qt.IsNil(err))
+		qt.Check(t, qt.IsNil(zr.Close()))
+		qt.Check(t, qt.Equals(string(got), layerContents[i]))
+	}
+
+	// Zstd layers can be converted back to gzip
+	// without adding the format to Compressions.
+	gdesc, err := ociconvert.Convert(ctx, r, "foo", r, "foo", zdesc, &ociconvert.Options{
+		LayerCompression: ociconvert.Gzip,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	reg.MustGetManifest("foo", gdesc, &m)
+	for i, layer := range m.Layers {
+		qt.Check(t, qt.Equals(layer.MediaType, ocispec.MediaTypeImageLayerGzip))
+		qt.Check(t, qt.Equals(layer.Digest, digest.FromBytes(ocitest.Gzip([]byte(layerContents[i])))))
+	}
+}
+
+func TestConvertRecompressDockerMediaTypes(t *testing.T) {
+	ctx := context.Background()
+	r := ocimem.New()
+	reg := ocitest.NewRegistry(t, r)
+	desc := pushDockerImage(t, r, "foo", layerContents, nil)
+
+	// Without OCIMediaTypes, recompressed layers in a Docker
+	// manifest use the Docker media type when there is one.
+	newDesc, err := ociconvert.Convert(ctx, r, "foo", r, "foo", desc, &ociconvert.Options{
+		LayerCompression: ociconvert.Uncompressed,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(newDesc.MediaType, dockerManifest))
+	var m ocispec.Manifest
+	reg.MustGetManifest("foo", newDesc, &m)
+	for i, layer := range m.Layers {
+		qt.Check(t, qt.Equals(layer.MediaType, dockerLayer))
+		qt.Check(t, qt.Equals(string(reg.MustGetBlob("foo", layer.Digest)), layerContents[i]))
+	}
+
+	newDesc, err = ociconvert.Convert(ctx, r, "foo", r, "foo", newDesc, &ociconvert.Options{
+		LayerCompression: ociconvert.Gzip,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(newDesc.Digest, desc.Digest))
+
+	// Docker has no media type for other formats.
+	newDesc, err = ociconvert.Convert(ctx, r, "foo", r, "foo", desc, &ociconvert.Options{
+		LayerCompression: testFlate,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	reg.MustGetManifest("foo", newDesc, &m)
+	for _, layer := range m.Layers {
+		qt.Check(t, qt.Equals(layer.MediaType, "application/vnd.oci.image.layer.v1.tar+flate"))
+	}
+}
+
+func TestConvertMediaTypesOnly(t *testing.T) {
+	ctx := context.Background()
+	r := ocimem.New()
+	reg := ocitest.NewRegistry(t, r)
+	desc := pushDockerImage(t, r, "foo", layerContents, nil)
+
+	newDesc, err := ociconvert.Convert(ctx, r, "foo", r, "foo", desc, &ociconvert.Options{
+		OCIMediaTypes: true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	var m ocispec.Manifest
+	reg.MustGetManifest("foo", newDesc, &m)
+	qt.Check(t, qt.Equals(m.MediaType, ocispec.MediaTypeImageManifest))
+	qt.Check(t, qt.Equals(m.Config.MediaType, ocispec.MediaTypeImageConfig))
+	for i, layer := range m.Layers {
+		qt.Check(t, qt.Equals(layer.MediaType, ocispec.MediaTypeImageLayerGzip))
+		qt.Check(t, qt.Equals(layer.Digest, digest.FromBytes(ocitest.Gzip([]byte(layerContents[i])))))
+	}
+}
+
+func TestConvertUnchanged(t *testing.T) {
+	ctx := context.Background()
+	src := ocimem.New()
+	desc := pushDockerIndex(t, src, "foo", layerContents, nil)
+
+	// With no conversion to do, the content is copied as is.
+	dst := ocimem.New()
+	reg := ocitest.NewRegistry(t, dst)
+	newDesc, err := ociconvert.Convert(ctx, dst, "bar", src, "foo", desc, &ociconvert.Options{
+		LayerCompression: ociconvert.Gzip,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(newDesc.Digest, desc.Digest))
+	qt.Check(t, qt.Equals(newDesc.MediaType, dockerManifestList))
+
+	var index ocispec.Index
+	reg.MustGetManifest("bar", newDesc, &index)
+	var m ocispec.Manifest
+	reg.MustGetManifest("bar", index.Manifests[0], &m)
+	for _, layer := range m.Layers {
+		_, err := dst.ResolveBlob(ctx, "bar", layer.Digest)
+		qt.Check(t, qt.IsNil(err))
+	}
+	_, err = dst.ResolveBlob(ctx, "bar", m.Config.Digest)
+	qt.Check(t, qt.IsNil(err))
+}
+
+func TestConvertDiffIDMismatch(t *testing.T) {
+	ctx := context.Background()
+	r := ocimem.New()
+	desc := pushDockerImage(t, r, "foo", layerContents, []ociregistry.Digest{
+		digest.FromString("first layer"),
+		digest.FromString("something else"),
+	})
+	_, err := ociconvert.Convert(ctx, r, "foo", r, "foo", desc, &ociconvert.Options{
+		LayerCompression: ociconvert.Uncompressed,
+	})
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrDigestInvalid))
+	qt.Check(t, qt.ErrorMatches(err, `cannot recompress layer sha256:[0-9a-f]+: uncompressed content has digest sha256:[0-9a-f]+ but configuration has diff ID sha256:[0-9a-f]+: .*`))
+}
+
+func TestConvertUnknownCompression(t *testing.T) {
+	ctx := context.Background()
+	r := ocimem.New()
+	desc := pushDockerImage(t, r, "foo", layerContents, nil)
+	desc, err := ociconvert.Convert(ctx, r, "foo", r, "foo", desc, &ociconvert.Options{
+		LayerCompression: testFlate,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	_, err = ociconvert.Convert(ctx, r, "foo", r, "foo", desc, &ociconvert.Options{
+		LayerCompression: ociconvert.Gzip,
+	})
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrUnsupported))
+}
+
+func TestOCIMediaType(t *testing.T) {
+	qt.Check(t, qt.Equals(ociconvert.OCIMediaType(dockerManifest), ocispec.MediaTypeImageManifest))
+	qt.Check(t, qt.Equals(ociconvert.OCIMediaType(dockerLayerGzip), ocispec.MediaTypeImageLayerGzip))
+	qt.Check(t, qt.Equals(ociconvert.OCIMediaType("text/plain"), "text/plain"))
+}
+
+// pushDockerIndex pushes a Docker manifest list referring to an image
+// pushed with pushDockerImage and returns its descriptor.
+func pushDockerIndex(t *testing.T, r ociregistry.Interface, repo string, layers []string, diffIDs []ociregistry.Digest) ociregistry.Descriptor {
+	mdesc := pushDockerImage(t, r, repo, layers, diffIDs)
+	mdesc.Platform = &ocispec.Platform{
+		OS:           "linux",
+		Architecture: "amd64",
+	}
+	_, desc := ocitest.NewRegistry(t, r).MustPushManifest(repo, ocispec.Index{
+		Versioned: ocispecroot.Versioned{SchemaVersion: 2},
+		MediaType: dockerManifestList,
+		Manifests: []ociregistry.Descriptor{mdesc},
+	}, "")
+	return desc
+}
+
+// pushDockerImage pushes a Docker image with gzipped layers holding
+// the given content and returns the descriptor of its manifest. If
+// diffIDs is nil, the correct diff IDs are used.
+func pushDockerImage(t *testing.T, r ociregistry.Interface, repo string, layers []string, diffIDs []ociregistry.Digest) ociregistry.Descriptor {
+	reg := ocitest.NewRegistry(t, r)
+	var m ocispec.Manifest
+	m.SchemaVersion = 2
+	m.MediaType = dockerManifest
+	setDiffIDs := diffIDs == nil
+	for _, content := range layers {
+		m.Layers = append(m.Layers, reg.MustPushBlobWithMediaType(repo, ocitest.Gzip([]byte(content)), dockerLayerGzip))
+		if setDiffIDs {
+			diffIDs = append(diffIDs, digest.FromString(content))
+		}
+	}
+	config, err := json.Marshal(ocispec.Image{
+		Platform: ocispec.Platform{
+			OS:           "linux",
+			Architecture: "amd64",
+		},
+		RootFS: ocispec.RootFS{
+			Type:    "layers",
+			DiffIDs: diffIDs,
+		},
+	})
+	qt.Assert(t, qt.IsNil(err))
+	m.Config = reg.MustPushBlobWithMediaType(repo, config, dockerConfig)
+	_, desc := reg.MustPushManifest(repo, m, "")
+	return desc
+}
@@ -44,6 +44,12 @@ type logger struct {
 	*ociregistry.Funcs
 }
 
+func (r *logger) Capabilities(ctx context.Context) ociregistry.Capabilities {
+	caps := ociregistry.CapabilitiesOf(ctx, r.r)
+	r.logf("Capabilities -> %v", caps)
+	return caps
+}
+
 func (r *logger) DeleteBlob(ctx context.Context, repoName string, digest ociregistry.Digest) error {
 	r.logf("DeleteBlob %s %s {", repoName, digest)
 	err := r.r.DeleteBlob(ctx, repoName, digest)
@@ -65,6 +71,13 @@ func (r *logger) DeleteTag(ctx context.Context, repoName string, tagName string)
 	return err
 }
 
+func (r *logger) DeleteRepository(ctx context.Context, repoName string) error {
+	r.logf("DeleteRepository %s {", repoName)
+	err := ociregistry.DeleteRepository(ctx, r.r, repoName)
+	r.logf("} -> %v", err)
+	return err
+}
+
 func (r *logger) GetBlob(ctx context.Context, repoName string, dig ociregistry.Digest) (ociregistry.BlobReader, error) {
 	r.logf("GetBlob %s %s {", repoName, dig)
 	rd, err := r.r.GetBlob(ctx, repoName, dig)
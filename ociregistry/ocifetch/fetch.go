@@ -0,0 +1,277 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ocifetch provides support for downloading large blobs
+// from a registry using several concurrent range requests.
+//
+// It works with any [ociregistry.Interface] implementation,
+// although it's most useful when talking to a remote registry
+// with the ociclient package.
+package ocifetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+
+	"cuelabs.dev/go/oci/ociregistry"
+)
+
+const (
+	defaultConcurrency = 4
+	defaultChunkSize   = 16 * 1024 * 1024
+)
+
+// Options holds options for [Download] and [DownloadToTempFile].
+type Options struct {
+	// Concurrency holds the maximum number of concurrent
+	// range requests. If it's zero, 4 is used.
+	Concurrency int
+
+	// ChunkSize holds the size of each range request.
+	// If it's zero, 16MiB is used.
+	//
+	// Up to Concurrency*ChunkSize bytes of memory may
+	// be used by a download.
+	ChunkSize int64
+}
+
+// Download downloads the blob with the given descriptor from
+// the given repository in r, writing its content to w, which must
+// be at least desc.Size bytes long or be able to grow to that size.
+// The descriptor must have a valid digest and size, for example
+// as found in a manifest.
+//
+// When the blob is larger than the chunk size, it is fetched in
+// parts using concurrent calls to GetBlobRange. If r does not
+// support the [ociregistry.CapBlobRange] capability or a range
+// request fails with [ociregistry.ErrUnsupported], the blob is
+// fetched as a single stream with GetBlob instead.
+//
+// The digest of the content is checked regardless of how the
+// blob was fetched; if it doesn't match, Download returns an
+// error wrapping [ociregistry.ErrDigestInvalid]. Note that w
+// will have been written to even when Download returns an error.
+func Download(ctx context.Context, r ociregistry.Interface, repo string, desc ociregistry.Descriptor, w io.WriterAt, opts *Options) error {
+	if err := desc.Digest.Validate(); err != nil {
+		return fmt.Errorf("invalid digest %q: %w", desc.Digest, ociregistry.ErrDigestInvalid)
+	}
+	if desc.Size < 0 {
+		return fmt.Errorf("invalid size %d: %w", desc.Size, ociregistry.ErrSizeInvalid)
+	}
+	if opts == nil {
+		opts = &Options{}
+	}
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+	chunkSize := opts.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+	if concurrency > 1 && desc.Size > chunkSize && ociregistry.CapabilitiesOf(ctx, r).Has(ociregistry.CapBlobRange) {
+		err := downloadParallel(ctx, r, repo, desc, w, concurrency, chunkSize)
+		if !errors.Is(err, ociregistry.ErrUnsupported) {
+			return err
+		}
+	}
+	return downloadSingle(ctx, r, repo, desc, w)
+}
+
+// DownloadToTempFile is like [Download] except that it writes
+// the blob to a new temporary file in the given directory (see [os.CreateTemp]).
+// On success, it returns the file positioned at its start;
+// it's the caller's responsibility to close and remove the file.
+// On failure, the file is removed.
+func DownloadToTempFile(ctx context.Context, r ociregistry.Interface, repo string, desc ociregistry.Descriptor, dir string, opts *Options) (_ *os.File, _err error) {
+	f, err := os.CreateTemp(dir, "ocifetch-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if _err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if err := Download(ctx, r, repo, desc, f, opts); err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// downloadSingle downloads the blob with a single GetBlob call.
+func downloadSingle(ctx context.Context, r ociregistry.Interface, repo string, desc ociregistry.Descriptor, w io.WriterAt) error {
+	rd, err := r.GetBlob(ctx, repo, desc.Digest)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	digester := desc.Digest.Algorithm().Hash()
+	n, err := io.Copy(io.NewOffsetWriter(w, 0), io.TeeReader(io.LimitReader(rd, desc.Size+1), digester))
+	if err != nil {
+		return err
+	}
+	if n != desc.Size {
+		return fmt.Errorf("blob size mismatch (%d/%d): %w", n, desc.Size, ociregistry.ErrSizeInvalid)
+	}
+	return checkDigest(desc, digester)
+}
+
+// downloadParallel downloads the blob in chunks using concurrent
+// calls to GetBlobRange.
+//
+// The digest is calculated as the download proceeds: each chunk is
+// held in memory until all the chunks before it have been hashed.
+// Chunks are started in order and there are only as many chunk
+// buffers as concurrent requests, so the lowest chunk that has not
+// yet been hashed is always in progress.
+func downloadParallel(ctx context.Context, r ociregistry.Interface, repo string, desc ociregistry.Descriptor, w io.WriterAt, concurrency int, chunkSize int64) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	numChunks := int((desc.Size + chunkSize - 1) / chunkSize)
+	if concurrency > numChunks {
+		concurrency = numChunks
+	}
+	buffers := make(chan []byte, concurrency)
+	for i := 0; i < concurrency; i++ {
+		buffers <- nil
+	}
+	done := make(chan chunk)
+	hashErr := make(chan error, 1)
+	go func() {
+		hashErr <- hashChunks(ctx, desc, numChunks, done, buffers)
+	}()
+
+	var (
+		wg       sync.WaitGroup
+		errMu    sync.Mutex
+		firstErr error
+	)
+	setErr := func(err error) {
+		errMu.Lock()
+		defer errMu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+	for i := 0; i < numChunks; i++ {
+		var buf []byte
+		select {
+		case buf = <-buffers:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		o0 := int64(i) * chunkSize
+		o1 := min(o0+chunkSize, desc.Size)
+		if int64(cap(buf)) < o1-o0 {
+			buf = make([]byte, chunkSize)
+		}
+		buf = buf[:o1-o0]
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := fetchChunk(ctx, r, repo, desc, w, o0, buf); err != nil {
+				setErr(err)
+				return
+			}
+			select {
+			case done <- chunk{index: i, data: buf}:
+			case <-ctx.Done():
+			}
+		}(i)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return <-hashErr
+}
+
+// chunk holds the content of a chunk that has been
+// fetched and written.
+type chunk struct {
+	index int
+	data  []byte
+}
+
+// hashChunks calculates the digest of the chunks received on the done
+// channel, in index order, and checks it against desc.Digest.
+// Each buffer is sent on the buffers channel after it has been hashed
+// so that it can be used for a subsequent chunk.
+func hashChunks(ctx context.Context, desc ociregistry.Descriptor, numChunks int, done <-chan chunk, buffers chan<- []byte) error {
+	digester := desc.Digest.Algorithm().Hash()
+	pending := make(map[int][]byte)
+	for next := 0; next < numChunks; {
+		select {
+		case c := <-done:
+			pending[c.index] = c.data
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		for {
+			data, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			digester.Write(data)
+			buffers <- data
+			next++
+		}
+	}
+	return checkDigest(desc, digester)
+}
+
+// fetchChunk reads len(buf) bytes of the blob at offset o0
+// into buf and writes them to w.
+func fetchChunk(ctx context.Context, r ociregistry.Interface, repo string, desc ociregistry.Descriptor, w io.WriterAt, o0 int64, buf []byte) error {
+	o1 := o0 + int64(len(buf))
+	rd, err := r.GetBlobRange(ctx, repo, desc.Digest, o0, o1)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	if _, err := io.ReadFull(rd, buf); err != nil {
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			return fmt.Errorf("short read of blob range [%d, %d): %w", o0, o1, ociregistry.ErrSizeInvalid)
+		}
+		return err
+	}
+	if _, err := w.WriteAt(buf, o0); err != nil {
+		return err
+	}
+	return nil
+}
+
+func checkDigest(desc ociregistry.Descriptor, digester hash.Hash) error {
+	if got := digest.NewDigest(desc.Digest.Algorithm(), digester); got != desc.Digest {
+		return fmt.Errorf("digest mismatch when reading blob (got %s, want %s): %w", got, desc.Digest, ociregistry.ErrDigestInvalid)
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocifetch_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ociclient"
+	"cuelabs.dev/go/oci/ociregistry/ocifetch"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ociserver"
+	"cuelabs.dev/go/oci/ociregistry/ocitest"
+	"cuelabs.dev/go/oci/ociregistry/ociunify"
+)
+
+var downloadTests = []struct {
+	testName string
+	size     int
+	opts     *ocifetch.Options
+	// newRegistry returns the registry to download from, given
+	// a registry that holds the blob.
+	newRegistry    func(t *testing.T, r ociregistry.Interface) ociregistry.Interface
+	wantRangeCalls int
+	wantBlobCalls  int
+	wantErr        error
+}{{
+	testName:       "Parallel",
+	size:           1000,
+	opts:           &ocifetch.Options{ChunkSize: 100, Concurrency: 3},
+	wantRangeCalls: 10,
+}, {
+	testName:       "ParallelUnevenChunks",
+	size:           1001,
+	opts:           &ocifetch.Options{ChunkSize: 100, Concurrency: 3},
+	wantRangeCalls: 11,
+}, {
+	testName:       "ConcurrencyGreaterThanChunks",
+	size:           250,
+	opts:           &ocifetch.Options{ChunkSize: 100, Concurrency: 10},
+	wantRangeCalls: 3,
+}, {
+	testName:      "SmallBlob",
+	size:          50,
+	opts:          &ocifetch.Options{ChunkSize: 100},
+	wantBlobCalls: 1,
+}, {
+	testName:      "EmptyBlob",
+	size:          0,
+	opts:          &ocifetch.Options{ChunkSize: 100},
+	wantBlobCalls: 1,
+}, {
+	testName:      "NoConcurrency",
+	size:          1000,
+	opts:          &ocifetch.Options{ChunkSize: 100, Concurrency: 1},
+	wantBlobCalls: 1,
+}, {
+	testName: "NoRangeCapability",
+	size:     1000,
+	opts:     &ocifetch.Options{ChunkSize: 100},
+	newRegistry: func(t *testing.T, r ociregistry.Interface) ociregistry.Interface {
+		return &withCapabilities{
+			Interface: r,
+			caps:      ociregistry.AllCapabilities &^ ociregistry.CapBlobRange,
+		}
+	},
+	wantBlobCalls: 1,
+}, {
+	testName: "RangeUnsupported",
+	size:     1000,
+	opts:     &ocifetch.Options{ChunkSize: 100, Concurrency: 1000},
+	newRegistry: func(t *testing.T, r ociregistry.Interface) ociregistry.Interface {
+		return ocitest.NewFaultyRegistry(r, &ocitest.FaultConfig{
+			Faults: []ocitest.Fault{{
+				Methods: []string{"GetBlobRange"},
+				Err:     ociregistry.ErrUnsupported,
+			}},
+		})
+	},
+	wantBlobCalls: 1,
+}, {
+	testName: "Corrupt",
+	size:     1000,
+	opts:     &ocifetch.Options{ChunkSize: 100, Concurrency: 3},
+	newRegistry: func(t *testing.T, r ociregistry.Interface) ociregistry.Interface {
+		return ocitest.NewFaultyRegistry(r, &ocitest.FaultConfig{
+			Faults: []ocitest.Fault{{
+				Methods: []string{"GetBlobRange"},
+				Skip:    4,
+				Limit:   1,
+				Corrupt: true,
+			}},
+		})
+	},
+	wantRangeCalls: 10,
+	wantErr:        ociregistry.ErrDigestInvalid,
+}, {
+	testName: "Unify",
+	size:     1000,
+	opts:     &ocifetch.Options{ChunkSize: 100, Concurrency: 3},
+	newRegistry: func(t *testing.T, r ociregistry.Interface) ociregistry.Interface {
+		return ociunify.New(r, ocimem.New(), nil)
+	},
+	wantRangeCalls: 10,
+}, {
+	testName: "Client",
+	size:     1000,
+	opts:     &ocifetch.Options{ChunkSize: 100, Concurrency: 3},
+	newRegistry: func(t *testing.T, r ociregistry.Interface) ociregistry.Interface {
+		srv := httptest.NewServer(ociserver.New(r, nil))
+		t.Cleanup(srv.Close)
+		srvURL, _ := url.Parse(srv.URL)
+		client, err := ociclient.New(srvURL.Host, &ociclient.Options{
+			Insecure: true,
+		})
+		qt.Assert(t, qt.IsNil(err))
+		return client
+	},
+	wantRangeCalls: 10,
+}}
+
+func TestDownload(t *testing.T) {
+	ctx := context.Background()
+	for _, test := range downloadTests {
+		t.Run(test.testName, func(t *testing.T) {
+			content := testContent(test.size)
+			desc := pushBlob(t, content)
+			counter := &callCounter{}
+			r := counter.wrap(desc.r)
+			if test.newRegistry != nil {
+				r = test.newRegistry(t, r)
+			}
+			var buf writerAt
+			err := ocifetch.Download(ctx, r, "foo/bar", desc.Descriptor, &buf, test.opts)
+			qt.Check(t, qt.Equals(counter.rangeCalls.Load(), int32(test.wantRangeCalls)))
+			qt.Check(t, qt.Equals(counter.blobCalls.Load(), int32(test.wantBlobCalls)))
+			if test.wantErr != nil {
+				qt.Assert(t, qt.ErrorIs(err, test.wantErr))
+				return
+			}
+			qt.Assert(t, qt.IsNil(err))
+			qt.Assert(t, qt.DeepEquals(buf.data, content))
+		})
+	}
+}
+
+func TestDownloadToTempFile(t *testing.T) {
+	ctx := context.Background()
+	content := testContent(1000)
+	desc := pushBlob(t, content)
+	dir := t.TempDir()
+	f, err := ocifetch.DownloadToTempFile(ctx, desc.r, "foo/bar", desc.Descriptor, dir, &ocifetch.Options{
+		ChunkSize: 64,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	defer f.Close()
+	got, err := io.ReadAll(f)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.DeepEquals(got, content))
+
+	// Check that the file is removed on failure.
+	desc.Digest = digest.FromString("something else")
+	_, err = ocifetch.DownloadToTempFile(ctx, desc.r, "foo/bar", desc.Descriptor, dir, nil)
+	qt.Assert(t, qt.ErrorIs(err, ociregistry.ErrBlobUnknown))
+	entries, err := os.ReadDir(dir)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.HasLen(entries, 1))
+}
+
+type blob struct {
+	ociregistry.Descriptor
+	r ociregistry.Interface
+}
+
+func pushBlob(t *testing.T, content []byte) blob {
+	r := ocimem.New()
+	desc := ociregistry.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    digest.FromBytes(content),
+		Size:      int64(len(content)),
+	}
+	_, err := r.PushBlob(context.Background(), "foo/bar", desc, bytes.NewReader(content))
+	qt.Assert(t, qt.IsNil(err))
+	return blob{desc, r}
+}
+
+func testContent(n int) []byte {
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < n; i++ {
+		fmt.Fprintf(&buf, "%d ", i)
+	}
+	return buf.Bytes()[:n]
+}
+
+// writerAt implements io.WriterAt by writing to an
+// in-memory buffer.
+type writerAt struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+func (w *writerAt) WriteAt(buf []byte, off int64) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if end := off + int64(len(buf)); end > int64(len(w.data)) {
+		w.data = append(w.data, make([]byte, end-int64(len(w.data)))...)
+	}
+	copy(w.data[off:], buf)
+	return len(buf), nil
+}
+
+// callCounter counts calls to GetBlob and GetBlobRange.
+type callCounter struct {
+	blobCalls  atomic.Int32
+	rangeCalls atomic.Int32
+}
+
+func (c *callCounter) wrap(r ociregistry.Interface) ociregistry.Interface {
+	return &countingRegistry{
+		Interface: r,
+		c:         c,
+	}
+}
+
+type countingRegistry struct {
+	ociregistry.Interface
+	c *callCounter
+}
+
+func (r *countingRegistry) GetBlob(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.BlobReader, error) {
+	r.c.blobCalls.Add(1)
+	return r.Interface.GetBlob(ctx, repo, digest)
+}
+
+func (r *countingRegistry) GetBlobRange(ctx context.Context, repo string, digest ociregistry.Digest, o0, o1 int64) (ociregistry.BlobReader, error) {
+	r.c.rangeCalls.Add(1)
+	return r.Interface.GetBlobRange(ctx, repo, digest, o0, o1)
+}
+
+type withCapabilities struct {
+	ociregistry.Interface
+	caps ociregistry.Capabilities
+}
+
+func (r *withCapabilities) Capabilities(ctx context.Context) ociregistry.Capabilities {
+	return r.caps
+}
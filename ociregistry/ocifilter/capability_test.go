@@ -0,0 +1,76 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocifilter
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+)
+
+type capsRegistry struct {
+	ociregistry.Interface
+	caps ociregistry.Capabilities
+}
+
+func (r capsRegistry) Capabilities(ctx context.Context) ociregistry.Capabilities {
+	return r.caps
+}
+
+func TestCapabilities(t *testing.T) {
+	ctx := context.Background()
+	base := capsRegistry{ocimem.New(), ociregistry.AllCapabilities &^ ociregistry.CapMount}
+	// capsRegistry does not implement ociregistry.RepositoryDeleter,
+	// so it can't support repository deletion whatever it reports.
+	baseCaps := base.caps &^ ociregistry.CapDeleteRepository
+	tests := []struct {
+		testName string
+		r        ociregistry.Interface
+		want     ociregistry.Capabilities
+	}{{
+		testName: "ReadOnly",
+		r:        ReadOnly(base),
+		want:     ociregistry.CapReferrers | ociregistry.CapBlobRange,
+	}, {
+		testName: "Immutable",
+		r:        Immutable(base),
+		want:     ociregistry.AllCapabilities &^ (ociregistry.CapMount | ociregistry.CapDelete | ociregistry.CapDeleteRepository),
+	}, {
+		testName: "Select",
+		r:        Select(base, func(string) bool { return true }),
+		want:     baseCaps,
+	}, {
+		testName: "Sub",
+		r:        Sub(base, "foo"),
+		want:     baseCaps,
+	}, {
+		testName: "NoReporter",
+		r:        ReadOnly(ocimem.New()),
+		want:     ociregistry.AllCapabilities &^ ociregistry.WriteCapabilities,
+	}, {
+		testName: "SelectMem",
+		r:        Select(ocimem.New(), func(string) bool { return true }),
+		want:     ociregistry.AllCapabilities,
+	}}
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			qt.Check(t, qt.Equals(ociregistry.CapabilitiesOf(ctx, test.r), test.want))
+		})
+	}
+}
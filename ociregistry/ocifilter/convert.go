@@ -0,0 +1,207 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocifilter
+
+import (
+	"context"
+	"errors"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/internal/lru"
+	"cuelabs.dev/go/oci/ociregistry/ociconvert"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+)
+
+// ConvertImages returns a registry that wraps r, serving the image
+// manifests and indexes in r converted by [ociconvert.Convert] with
+// the given options. For example, it can be used to serve images
+// with their layers recompressed.
+//
+// The converted images are written to the same repository in store,
+// including any content that the conversion doesn't change, because
+// registries generally require the content that a manifest refers to
+// to be present. If store is nil, an in-memory registry is used
+// that holds at most 1GiB, discarding the least recently used
+// converted content to make room when it's full. The store can be
+// r itself, in which case only new content is written. A store that
+// discards content, such as an [ocimem.Registry] with
+// [ocimem.Config.Evict] set, should be large enough to hold the
+// images that are in use at any one time.
+// Conversion happens when a manifest is first read or resolved, and
+// the results of the most recent conversions are cached. A manifest
+// whose conversion has been dropped from the cache is converted
+// again when it's next read. That writes nothing new to store,
+// because the conversion produces the same content for the same
+// input within a given build of a program (see [ociconvert.Gzip]).
+// After the program is rebuilt, a conversion might produce
+// different layers, so converted digests must not be assumed to
+// be stable across builds.
+//
+// As with [ociconvert.Convert], the digest of a converted manifest
+// differs from the original, so getting or resolving a manifest
+// by its original digest returns a different digest. The converted
+// digest can be used to get the converted manifest once it has
+// been returned by the registry.
+//
+// Methods that write to the registry are passed through to r
+// unchanged.
+func ConvertImages(r ociregistry.Interface, store ociregistry.Interface, opts *ociconvert.Options) ociregistry.Interface {
+	if store == nil {
+		store = ocimem.NewWithConfig(&ocimem.Config{
+			MaxBytes: defaultConvertStoreBytes,
+			Evict:    true,
+		})
+	}
+	return newImageConverter(r, store, opts, convertCacheSize)
+}
+
+// defaultConvertStoreBytes holds the size limit of the store
+// used by ConvertImages when none is provided.
+const defaultConvertStoreBytes = 1 << 30
+
+// convertCacheSize holds the number of conversions
+// cached by a registry returned by ConvertImages.
+const convertCacheSize = 1000
+
+func newImageConverter(r ociregistry.Interface, store ociregistry.Interface, opts *ociconvert.Options, cacheSize int) *imageConverter {
+	return &imageConverter{
+		Interface: r,
+		store:     store,
+		opts:      opts,
+		converted: lru.New[repoDigest, ociregistry.Descriptor](cacheSize),
+	}
+}
+
+type imageConverter struct {
+	ociregistry.Interface
+	store ociregistry.Interface
+	opts  *ociconvert.Options
+
+	// converted maps from the digest of an original
+	// manifest to the descriptor of its converted form.
+	converted *lru.Cache[repoDigest, ociregistry.Descriptor]
+}
+
+func (r *imageConverter) Capabilities(ctx context.Context) ociregistry.Capabilities {
+	return ociregistry.CapabilitiesOf(ctx, r.Interface)
+}
+
+func (r *imageConverter) GetBlob(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.BlobReader, error) {
+	if rd, err := r.store.GetBlob(ctx, repo, digest); err == nil {
+		return rd, nil
+	}
+	return r.Interface.GetBlob(ctx, repo, digest)
+}
+
+func (r *imageConverter) GetBlobRange(ctx context.Context, repo string, digest ociregistry.Digest, o0, o1 int64) (ociregistry.BlobReader, error) {
+	if _, err := r.store.ResolveBlob(ctx, repo, digest); err == nil {
+		return r.store.GetBlobRange(ctx, repo, digest, o0, o1)
+	}
+	return r.Interface.GetBlobRange(ctx, repo, digest, o0, o1)
+}
+
+func (r *imageConverter) ResolveBlob(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.Descriptor, error) {
+	if desc, err := r.store.ResolveBlob(ctx, repo, digest); err == nil {
+		return desc, nil
+	}
+	return r.Interface.ResolveBlob(ctx, repo, digest)
+}
+
+func (r *imageConverter) GetManifest(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.BlobReader, error) {
+	desc, err := r.Interface.ResolveManifest(ctx, repo, digest)
+	if err != nil {
+		// The digest might be that of a converted manifest.
+		if rd, err := r.store.GetManifest(ctx, repo, digest); err == nil {
+			return rd, nil
+		}
+		return nil, err
+	}
+	return r.getManifest(ctx, repo, desc)
+}
+
+func (r *imageConverter) GetTag(ctx context.Context, repo string, tagName string) (ociregistry.BlobReader, error) {
+	desc, err := r.Interface.ResolveTag(ctx, repo, tagName)
+	if err != nil {
+		return nil, err
+	}
+	return r.getManifest(ctx, repo, desc)
+}
+
+func (r *imageConverter) ResolveManifest(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.Descriptor, error) {
+	desc, err := r.Interface.ResolveManifest(ctx, repo, digest)
+	if err != nil {
+		// The digest might be that of a converted manifest.
+		if desc, err := r.store.ResolveManifest(ctx, repo, digest); err == nil {
+			return desc, nil
+		}
+		return ociregistry.Descriptor{}, err
+	}
+	return r.convert(ctx, repo, desc)
+}
+
+func (r *imageConverter) ResolveTag(ctx context.Context, repo string, tagName string) (ociregistry.Descriptor, error) {
+	desc, err := r.Interface.ResolveTag(ctx, repo, tagName)
+	if err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	return r.convert(ctx, repo, desc)
+}
+
+// getManifest returns the converted form of the
+// manifest in r with the given descriptor.
+func (r *imageConverter) getManifest(ctx context.Context, repo string, desc ociregistry.Descriptor) (ociregistry.BlobReader, error) {
+	cdesc, err := r.convert(ctx, repo, desc)
+	if err != nil {
+		return nil, err
+	}
+	if cdesc.Digest == desc.Digest {
+		return r.Interface.GetManifest(ctx, repo, desc.Digest)
+	}
+	rd, err := r.store.GetManifest(ctx, repo, cdesc.Digest)
+	if errors.Is(err, ociregistry.ErrManifestUnknown) || errors.Is(err, ociregistry.ErrNameUnknown) {
+		// The store has discarded the converted manifest
+		// since it was cached, so convert it again.
+		cdesc, err = r.convert1(ctx, repo, desc)
+		if err != nil {
+			return nil, err
+		}
+		return r.store.GetManifest(ctx, repo, cdesc.Digest)
+	}
+	return rd, err
+}
+
+// convert returns the descriptor of the converted form
+// of the manifest in r with the given descriptor.
+func (r *imageConverter) convert(ctx context.Context, repo string, desc ociregistry.Descriptor) (ociregistry.Descriptor, error) {
+	key := repoDigest{repo, desc.Digest}
+	if cdesc, ok := r.converted.Get(key); ok {
+		return cdesc, nil
+	}
+	return r.convert1(ctx, repo, desc)
+}
+
+// convert1 is like convert but always does the
+// conversion, ignoring any cached result.
+func (r *imageConverter) convert1(ctx context.Context, repo string, desc ociregistry.Descriptor) (ociregistry.Descriptor, error) {
+	key := repoDigest{repo, desc.Digest}
+	cdesc, err := ociconvert.Convert(ctx, r.store, repo, r.Interface, repo, desc, r.opts)
+	if err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	r.converted.Add(key, cdesc)
+	// Converting a converted manifest doesn't change it.
+	r.converted.Add(repoDigest{repo, cdesc.Digest}, cdesc)
+	return cdesc, nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocifilter
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+	ocispecroot "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ociconvert"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ocitest"
+)
+
+func TestConvertImages(t *testing.T) {
+	for _, test := range []struct {
+		testName string
+		newStore func(base ociregistry.Interface) ociregistry.Interface
+	}{{
+		testName: "DefaultStore",
+		newStore: func(ociregistry.Interface) ociregistry.Interface { return nil },
+	}, {
+		testName: "SameStore",
+		newStore: func(base ociregistry.Interface) ociregistry.Interface { return base },
+	}} {
+		t.Run(test.testName, func(t *testing.T) {
+			ctx := context.Background()
+			base := ocimem.New()
+			reg := ocitest.NewRegistry(t, base)
+			layer := reg.MustPushBlobWithMediaType("foo", ocitest.Gzip([]byte("layer content")), ocispec.MediaTypeImageLayerGzip)
+			configData, err := json.Marshal(ocispec.Image{
+				RootFS: ocispec.RootFS{
+					Type:    "layers",
+					DiffIDs: []ociregistry.Digest{digest.FromString("layer content")},
+				},
+			})
+			qt.Assert(t, qt.IsNil(err))
+			config := reg.MustPushBlobWithMediaType("foo", configData, ocispec.MediaTypeImageConfig)
+			_, origDesc := reg.MustPushManifest("foo", ocispec.Manifest{
+				Versioned: ocispecroot.Versioned{SchemaVersion: 2},
+				MediaType: ocispec.MediaTypeImageManifest,
+				Config:    config,
+				Layers:    []ociregistry.Descriptor{layer},
+			}, "latest")
+
+			r := ConvertImages(base, test.newStore(base), &ociconvert.Options{
+				LayerCompression: ociconvert.Uncompressed,
+			})
+			rd, err := r.GetTag(ctx, "foo", "latest")
+			qt.Assert(t, qt.IsNil(err))
+			desc := rd.Descriptor()
+			data := readAll(t, rd)
+			qt.Check(t, qt.Equals(desc.Digest, digest.FromBytes(data)))
+			qt.Check(t, qt.Not(qt.Equals(desc.Digest, origDesc.Digest)))
+
+			var m ocispec.Manifest
+			qt.Assert(t, qt.IsNil(json.Unmarshal(data, &m)))
+			qt.Check(t, qt.DeepEquals(m.Config, config))
+			qt.Assert(t, qt.HasLen(m.Layers, 1))
+			qt.Check(t, qt.Equals(m.Layers[0].MediaType, ocispec.MediaTypeImageLayer))
+			qt.Check(t, qt.Equals(m.Layers[0].Digest, digest.FromString("layer content")))
+
+			// The converted content is available through the registry.
+			rd, err = r.GetBlob(ctx, "foo", m.Layers[0].Digest)
+			qt.Assert(t, qt.IsNil(err))
+			qt.Check(t, qt.Equals(string(readAll(t, rd)), "layer content"))
+			rd, err = r.GetBlobRange(ctx, "foo", m.Layers[0].Digest, 6, -1)
+			qt.Assert(t, qt.IsNil(err))
+			qt.Check(t, qt.Equals(string(readAll(t, rd)), "content"))
+			_, err = r.ResolveBlob(ctx, "foo", m.Config.Digest)
+			qt.Check(t, qt.IsNil(err))
+
+			for _, dig := range []ociregistry.Digest{origDesc.Digest, desc.Digest} {
+				rd, err = r.GetManifest(ctx, "foo", dig)
+				qt.Assert(t, qt.IsNil(err))
+				qt.Check(t, qt.DeepEquals(rd.Descriptor(), desc))
+				qt.Check(t, qt.Equals(string(readAll(t, rd)), string(data)))
+
+				gotDesc, err := r.ResolveManifest(ctx, "foo", dig)
+				qt.Assert(t, qt.IsNil(err))
+				qt.Check(t, qt.DeepEquals(gotDesc, desc))
+			}
+			gotDesc, err := r.ResolveTag(ctx, "foo", "latest")
+			qt.Assert(t, qt.IsNil(err))
+			qt.Check(t, qt.DeepEquals(gotDesc, desc))
+
+			// When the cache is full, conversions are dropped
+			// from it and done again when needed.
+			r1 := newImageConverter(base, ocimem.New(), &ociconvert.Options{
+				LayerCompression: ociconvert.Uncompressed,
+			}, 1)
+			for range 2 {
+				gotDesc, err := r1.ResolveManifest(ctx, "foo", origDesc.Digest)
+				qt.Assert(t, qt.IsNil(err))
+				qt.Check(t, qt.DeepEquals(gotDesc, desc))
+				qt.Check(t, qt.Equals(r1.converted.Len(), 1))
+			}
+
+			// When the store discards a converted manifest,
+			// it's converted again.
+			store := ocimem.New()
+			r2 := ConvertImages(base, store, &ociconvert.Options{
+				LayerCompression: ociconvert.Uncompressed,
+			})
+			_, err = r2.ResolveTag(ctx, "foo", "latest")
+			qt.Assert(t, qt.IsNil(err))
+			qt.Assert(t, qt.IsNil(store.DeleteManifest(ctx, "foo", desc.Digest)))
+			rd, err = r2.GetTag(ctx, "foo", "latest")
+			qt.Assert(t, qt.IsNil(err))
+			qt.Check(t, qt.DeepEquals(rd.Descriptor(), desc))
+			qt.Check(t, qt.Equals(string(readAll(t, rd)), string(data)))
+		})
+	}
+}
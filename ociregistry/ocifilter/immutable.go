@@ -66,6 +66,10 @@ func (r immutable) PushManifest(ctx context.Context, repo string, tag string, co
 	return desc, nil
 }
 
+func (r immutable) Capabilities(ctx context.Context) ociregistry.Capabilities {
+	return ociregistry.CapabilitiesOf(ctx, r.Interface) &^ (ociregistry.CapDelete | ociregistry.CapDeleteRepository)
+}
+
 func (r immutable) DeleteBlob(ctx context.Context, repo string, digest ociregistry.Digest) error {
 	return ociregistry.ErrDenied
 }
@@ -77,3 +81,7 @@ func (r immutable) DeleteManifest(ctx context.Context, repo string, digest ocire
 func (r immutable) DeleteTag(ctx context.Context, repo string, name string) error {
 	return ociregistry.ErrDenied
 }
+
+func (r immutable) DeleteRepository(ctx context.Context, repo string) error {
+	return ociregistry.ErrDenied
+}
@@ -14,23 +14,41 @@
 
 package ocifilter
 
-import "cuelabs.dev/go/oci/ociregistry"
+import (
+	"context"
+
+	"cuelabs.dev/go/oci/ociregistry"
+)
 
 // ReadOnly returns a registry implementation that returns
 // an "operation unsupported" error from all entry points that
-// mutate the registry.
+// mutate the registry, except for DeleteRepository,
+// which returns [ociregistry.ErrDenied].
 func ReadOnly(r ociregistry.Interface) ociregistry.Interface {
-	// One level deeper so the Reader and Lister values take precedence,
-	// following Go's shallower-method-wins rules.
-	type deeper struct {
-		*ociregistry.Funcs
-	}
-	return struct {
-		ociregistry.Reader
-		ociregistry.Lister
-		deeper
-	}{
+	return readOnly{
 		Reader: r,
 		Lister: r,
+		r:      r,
 	}
 }
+
+type readOnly struct {
+	ociregistry.Reader
+	ociregistry.Lister
+	// Put the Funcs one level deeper so the Reader and Lister values
+	// take precedence, following Go's shallower-method-wins rules.
+	deeper
+	r ociregistry.Interface
+}
+
+type deeper struct {
+	*ociregistry.Funcs
+}
+
+func (r readOnly) DeleteRepository(ctx context.Context, repo string) error {
+	return ociregistry.ErrDenied
+}
+
+func (r readOnly) Capabilities(ctx context.Context) ociregistry.Capabilities {
+	return ociregistry.CapabilitiesOf(ctx, r.r) &^ ociregistry.WriteCapabilities
+}
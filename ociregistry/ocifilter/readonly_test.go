@@ -0,0 +1,42 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocifilter
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+)
+
+func TestReadOnlyDeleteRepository(t *testing.T) {
+	ctx := context.Background()
+	m := ocimem.New()
+	_, err := m.PushBlob(ctx, "foo", ociregistry.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+		Size:      5,
+	}, strings.NewReader("hello"))
+	qt.Assert(t, qt.IsNil(err))
+
+	r := ReadOnly(m)
+	qt.Check(t, qt.ErrorIs(ociregistry.DeleteRepository(ctx, r, "foo"), ociregistry.ErrDenied))
+	_, err = m.ResolveBlob(ctx, "foo", "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824")
+	qt.Check(t, qt.IsNil(err))
+}
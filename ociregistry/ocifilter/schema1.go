@@ -0,0 +1,271 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocifilter
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/internal/lru"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ocischema1"
+)
+
+// ConvertSchema1 returns a registry that wraps r, serving any Docker
+// schema1 manifests in r as OCI image manifests, converted with
+// [ocischema1.Convert]. The image configuration generated by the
+// conversion is served as a blob in the same repository.
+//
+// Conversion requires the content of all the layers in an image
+// to be read, so the results of the most recent conversions are
+// cached. The size of the cache is fixed, so the registry is
+// suitable for long-lived use.
+//
+// Conversion changes the digest of a manifest, so the descriptor
+// returned when getting or resolving a schema1 manifest by its
+// original digest will have a different digest. The converted
+// digest, and the digest of the generated configuration, can be
+// used once the converted manifest has been returned by the registry.
+// When the conversion has been dropped from the cache, they can be
+// used again after the original manifest has been fetched or
+// resolved again, for example by its tag.
+func ConvertSchema1(r ociregistry.Interface) ociregistry.Interface {
+	return newSchema1Converter(r, schema1CacheSize)
+}
+
+// schema1CacheSize holds the number of conversions
+// cached by a registry returned by ConvertSchema1.
+const schema1CacheSize = 1000
+
+func newSchema1Converter(r ociregistry.Interface, cacheSize int) *schema1Converter {
+	return &schema1Converter{
+		Interface: r,
+		manifests: lru.New[repoDigest, *ocischema1.Converted](cacheSize),
+		converted: lru.New[repoDigest, *ocischema1.Converted](cacheSize),
+		configs:   lru.New[repoDigest, []byte](cacheSize),
+	}
+}
+
+type schema1Converter struct {
+	ociregistry.Interface
+
+	// manifests maps from the digest of an original schema1
+	// manifest to the result of converting it.
+	manifests *lru.Cache[repoDigest, *ocischema1.Converted]
+
+	// converted maps from the digest of a converted manifest
+	// to the result of the conversion.
+	converted *lru.Cache[repoDigest, *ocischema1.Converted]
+
+	// configs holds the generated configuration blobs.
+	configs *lru.Cache[repoDigest, []byte]
+}
+
+type repoDigest struct {
+	repo   string
+	digest ociregistry.Digest
+}
+
+func (r *schema1Converter) Capabilities(ctx context.Context) ociregistry.Capabilities {
+	return ociregistry.CapabilitiesOf(ctx, r.Interface)
+}
+
+func (r *schema1Converter) GetBlob(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.BlobReader, error) {
+	if data, ok := r.config(repo, digest); ok {
+		return ocimem.NewBytesReader(data, configDescriptor(data)), nil
+	}
+	return r.Interface.GetBlob(ctx, repo, digest)
+}
+
+func (r *schema1Converter) GetBlobRange(ctx context.Context, repo string, digest ociregistry.Digest, o0, o1 int64) (ociregistry.BlobReader, error) {
+	if data, ok := r.config(repo, digest); ok {
+		if o0 < 0 || o0 > int64(len(data)) || (o1 >= 0 && o1 < o0) {
+			return nil, fmt.Errorf("invalid range [%d, %d]: %w", o0, o1, ociregistry.ErrRangeInvalid)
+		}
+		if o1 < 0 || o1 > int64(len(data)) {
+			o1 = int64(len(data))
+		}
+		return ocimem.NewBytesReader(data[o0:o1], configDescriptor(data)), nil
+	}
+	return r.Interface.GetBlobRange(ctx, repo, digest, o0, o1)
+}
+
+func (r *schema1Converter) ResolveBlob(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.Descriptor, error) {
+	if data, ok := r.config(repo, digest); ok {
+		return configDescriptor(data), nil
+	}
+	return r.Interface.ResolveBlob(ctx, repo, digest)
+}
+
+func (r *schema1Converter) GetManifest(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.BlobReader, error) {
+	if c, ok := r.convertedManifest(repo, digest); ok {
+		return ocimem.NewBytesReader(c.Manifest, manifestDescriptor(c)), nil
+	}
+	rd, err := r.Interface.GetManifest(ctx, repo, digest)
+	if err != nil {
+		return nil, err
+	}
+	return r.convertReader(ctx, repo, rd)
+}
+
+func (r *schema1Converter) GetTag(ctx context.Context, repo string, tagName string) (ociregistry.BlobReader, error) {
+	rd, err := r.Interface.GetTag(ctx, repo, tagName)
+	if err != nil {
+		return nil, err
+	}
+	return r.convertReader(ctx, repo, rd)
+}
+
+func (r *schema1Converter) ResolveManifest(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.Descriptor, error) {
+	if c, ok := r.convertedManifest(repo, digest); ok {
+		return manifestDescriptor(c), nil
+	}
+	desc, err := r.Interface.ResolveManifest(ctx, repo, digest)
+	if err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	return r.convertDescriptor(ctx, repo, desc)
+}
+
+func (r *schema1Converter) ResolveTag(ctx context.Context, repo string, tagName string) (ociregistry.Descriptor, error) {
+	desc, err := r.Interface.ResolveTag(ctx, repo, tagName)
+	if err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	return r.convertDescriptor(ctx, repo, desc)
+}
+
+// convertDescriptor returns the descriptor of the converted
+// manifest if desc describes a schema1 manifest.
+func (r *schema1Converter) convertDescriptor(ctx context.Context, repo string, desc ociregistry.Descriptor) (ociregistry.Descriptor, error) {
+	if !ocischema1.IsSchema1MediaType(desc.MediaType) {
+		return desc, nil
+	}
+	rd, err := r.Interface.GetManifest(ctx, repo, desc.Digest)
+	if err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	rd, err = r.convertReader(ctx, repo, rd)
+	if err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	rd.Close()
+	return rd.Descriptor(), nil
+}
+
+// convertReader returns a reader for the converted manifest
+// if rd holds a schema1 manifest. It takes ownership of rd.
+func (r *schema1Converter) convertReader(ctx context.Context, repo string, rd ociregistry.BlobReader) (ociregistry.BlobReader, error) {
+	desc := rd.Descriptor()
+	if !ocischema1.IsSchema1MediaType(desc.MediaType) {
+		return rd, nil
+	}
+	defer rd.Close()
+	key := repoDigest{repo, desc.Digest}
+	c, ok := r.manifests.Get(key)
+	if !ok {
+		data, err := io.ReadAll(rd)
+		if err != nil {
+			return nil, err
+		}
+		m, _, err := ocischema1.Parse(data)
+		if err != nil {
+			return nil, err
+		}
+		c, err = ocischema1.Convert(m, func(blobSum ociregistry.Digest) (ocischema1.LayerInfo, error) {
+			return r.layerInfo(ctx, repo, blobSum)
+		})
+		if err != nil {
+			return nil, err
+		}
+		r.manifests.Add(key, c)
+	}
+	// Add the converted manifest and its configuration to the
+	// caches even when the conversion was cached, because they
+	// might have been dropped independently.
+	cdesc := manifestDescriptor(c)
+	r.converted.Add(repoDigest{repo, cdesc.Digest}, c)
+	r.configs.Add(repoDigest{repo, c.ConfigDescriptor.Digest}, c.Config)
+	return ocimem.NewBytesReader(c.Manifest, cdesc), nil
+}
+
+// layerInfo returns the information needed to convert
+// a schema1 manifest for the given layer.
+func (r *schema1Converter) layerInfo(ctx context.Context, repo string, blobSum ociregistry.Digest) (ocischema1.LayerInfo, error) {
+	rd, err := r.Interface.GetBlob(ctx, repo, blobSum)
+	if err != nil {
+		return ocischema1.LayerInfo{}, err
+	}
+	defer rd.Close()
+	counter := &countingReader{r: rd}
+	zr, err := gzip.NewReader(counter)
+	if err != nil {
+		return ocischema1.LayerInfo{}, fmt.Errorf("cannot decompress layer: %v", err)
+	}
+	digester := digest.Canonical.Digester()
+	if _, err := io.Copy(digester.Hash(), zr); err != nil {
+		return ocischema1.LayerInfo{}, fmt.Errorf("cannot decompress layer: %v", err)
+	}
+	// Read any remaining data so that we get the full
+	// size and the blob reader can verify the digest.
+	if _, err := io.Copy(io.Discard, counter); err != nil {
+		return ocischema1.LayerInfo{}, err
+	}
+	return ocischema1.LayerInfo{
+		Size:   counter.n,
+		DiffID: digester.Digest(),
+	}, nil
+}
+
+func (r *schema1Converter) convertedManifest(repo string, digest ociregistry.Digest) (*ocischema1.Converted, bool) {
+	return r.converted.Get(repoDigest{repo, digest})
+}
+
+func (r *schema1Converter) config(repo string, digest ociregistry.Digest) ([]byte, bool) {
+	return r.configs.Get(repoDigest{repo, digest})
+}
+
+func manifestDescriptor(c *ocischema1.Converted) ociregistry.Descriptor {
+	return ociregistry.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromBytes(c.Manifest),
+		Size:      int64(len(c.Manifest)),
+	}
+}
+
+func configDescriptor(data []byte) ociregistry.Descriptor {
+	return ociregistry.Descriptor{
+		MediaType: ocispec.MediaTypeImageConfig,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(buf []byte) (int, error) {
+	n, err := r.r.Read(buf)
+	r.n += int64(n)
+	return n, err
+}
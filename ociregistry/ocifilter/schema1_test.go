@@ -0,0 +1,189 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocifilter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ocischema1"
+	"cuelabs.dev/go/oci/ociregistry/ocitest"
+)
+
+func TestConvertSchema1(t *testing.T) {
+	ctx := context.Background()
+	base := ocimem.New()
+	var layers []ociregistry.Descriptor
+	for _, content := range []string{"layer one", "layer two"} {
+		layers = append(layers, ocitest.NewRegistry(t, base).MustPushBlob("foo", ocitest.Gzip([]byte(content))))
+	}
+	schema1Data := []byte(fmt.Sprintf(`{
+   "schemaVersion": 1,
+   "name": "foo",
+   "tag": "latest",
+   "architecture": "arm64",
+   "fsLayers": [
+      {"blobSum": %q},
+      {"blobSum": %q}
+   ],
+   "history": [
+      {"v1Compatibility": "{\"id\":\"l2\",\"parent\":\"l1\",\"config\":{\"Env\":[\"A=B\"]},\"created\":\"2023-01-02T00:00:00Z\"}"},
+      {"v1Compatibility": "{\"id\":\"l1\",\"created\":\"2023-01-01T00:00:00Z\"}"}
+   ]
+}`, layers[1].Digest, layers[0].Digest))
+	schema1Desc, err := base.PushManifest(ctx, "foo", "latest", schema1Data, ocischema1.MediaTypeManifest)
+	qt.Assert(t, qt.IsNil(err))
+
+	r := ConvertSchema1(base)
+
+	rd, err := r.GetTag(ctx, "foo", "latest")
+	qt.Assert(t, qt.IsNil(err))
+	desc := rd.Descriptor()
+	data := readAll(t, rd)
+	qt.Check(t, qt.Equals(desc.MediaType, ocispec.MediaTypeImageManifest))
+	qt.Check(t, qt.Equals(desc.Digest, digest.FromBytes(data)))
+	qt.Check(t, qt.Equals(desc.Size, int64(len(data))))
+
+	var m ocispec.Manifest
+	qt.Assert(t, qt.IsNil(json.Unmarshal(data, &m)))
+	qt.Assert(t, qt.HasLen(m.Layers, 2))
+	for i, layer := range m.Layers {
+		qt.Check(t, qt.Equals(layer.MediaType, ocispec.MediaTypeImageLayerGzip))
+		qt.Check(t, qt.Equals(layer.Digest, layers[i].Digest))
+		qt.Check(t, qt.Equals(layer.Size, layers[i].Size))
+	}
+
+	// The generated configuration is available as a blob.
+	configDesc, err := r.ResolveBlob(ctx, "foo", m.Config.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.DeepEquals(configDesc, m.Config))
+	rd, err = r.GetBlob(ctx, "foo", m.Config.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	var config ocispec.Image
+	qt.Assert(t, qt.IsNil(json.Unmarshal(readAll(t, rd), &config)))
+	qt.Check(t, qt.Equals(config.Architecture, "arm64"))
+	qt.Check(t, qt.DeepEquals(config.Config.Env, []string{"A=B"}))
+	qt.Check(t, qt.DeepEquals(config.RootFS.DiffIDs, []ociregistry.Digest{
+		digest.FromString("layer one"),
+		digest.FromString("layer two"),
+	}))
+	rd, err = r.GetBlobRange(ctx, "foo", m.Config.Digest, 1, 5)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(string(readAll(t, rd)), string(getBlob(t, r, "foo", m.Config.Digest)[1:5])))
+
+	// The converted manifest can be fetched by its digest.
+	rd, err = r.GetManifest(ctx, "foo", desc.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.DeepEquals(rd.Descriptor(), desc))
+	qt.Check(t, qt.Equals(string(readAll(t, rd)), string(data)))
+
+	gotDesc, err := r.ResolveManifest(ctx, "foo", desc.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.DeepEquals(gotDesc, desc))
+
+	// Resolving the original manifest or the tag
+	// returns the converted manifest.
+	gotDesc, err = r.ResolveManifest(ctx, "foo", schema1Desc.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.DeepEquals(gotDesc, desc))
+	gotDesc, err = r.ResolveTag(ctx, "foo", "latest")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.DeepEquals(gotDesc, desc))
+
+	// The converted content isn't visible in other repositories.
+	_, err = r.GetBlob(ctx, "bar", m.Config.Digest)
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrNameUnknown))
+}
+
+func TestConvertSchema1PassesThroughOtherManifests(t *testing.T) {
+	ctx := context.Background()
+	base := ocimem.New()
+	data := []byte(`{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.index.v1+json", "manifests": []}`)
+	desc, err := base.PushManifest(ctx, "foo", "latest", data, ocispec.MediaTypeImageIndex)
+	qt.Assert(t, qt.IsNil(err))
+
+	r := ConvertSchema1(base)
+	rd, err := r.GetTag(ctx, "foo", "latest")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.DeepEquals(rd.Descriptor(), desc))
+	qt.Check(t, qt.Equals(string(readAll(t, rd)), string(data)))
+
+	gotDesc, err := r.ResolveManifest(ctx, "foo", desc.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.DeepEquals(gotDesc, desc))
+}
+
+func TestConvertSchema1CacheEviction(t *testing.T) {
+	ctx := context.Background()
+	base := ocimem.New()
+	pushSchema1(t, base, "a", "layer a")
+	pushSchema1(t, base, "b", "layer b")
+
+	r := newSchema1Converter(base, 1)
+	descA, err := r.ResolveTag(ctx, "foo", "a")
+	qt.Assert(t, qt.IsNil(err))
+	_, err = r.ResolveManifest(ctx, "foo", descA.Digest)
+	qt.Assert(t, qt.IsNil(err))
+
+	// Converting another manifest drops the first conversion,
+	// so its converted digest is no longer known.
+	_, err = r.ResolveTag(ctx, "foo", "b")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(r.manifests.Len(), 1))
+	_, err = r.ResolveManifest(ctx, "foo", descA.Digest)
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrManifestUnknown))
+
+	// Fetching the original manifest again makes it available.
+	rd, err := r.GetTag(ctx, "foo", "a")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.DeepEquals(rd.Descriptor(), descA))
+	rd.Close()
+	rd, err = r.GetManifest(ctx, "foo", descA.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.DeepEquals(rd.Descriptor(), descA))
+	rd.Close()
+}
+
+// pushSchema1 pushes a schema1 manifest with a single layer
+// holding the given content to the foo repository in r.
+func pushSchema1(t *testing.T, r ociregistry.Interface, tag string, content string) {
+	layer := ocitest.NewRegistry(t, r).MustPushBlob("foo", ocitest.Gzip([]byte(content)))
+	manifest := []byte(fmt.Sprintf(`{
+   "schemaVersion": 1,
+   "name": "foo",
+   "tag": %q,
+   "architecture": "amd64",
+   "fsLayers": [{"blobSum": %q}],
+   "history": [{"v1Compatibility": "{\"id\":\"l1\"}"}]
+}`, tag, layer.Digest))
+	_, err := r.PushManifest(context.Background(), "foo", tag, manifest, ocischema1.MediaTypeManifest)
+	qt.Assert(t, qt.IsNil(err))
+}
+
+func readAll(t *testing.T, rd ociregistry.BlobReader) []byte {
+	defer rd.Close()
+	data, err := io.ReadAll(rd)
+	qt.Assert(t, qt.IsNil(err))
+	return data
+}
@@ -42,6 +42,10 @@ type selectRegistry struct {
 	r     ociregistry.Interface
 }
 
+func (r *selectRegistry) Capabilities(ctx context.Context) ociregistry.Capabilities {
+	return ociregistry.CapabilitiesOf(ctx, r.r)
+}
+
 func (r *selectRegistry) GetBlob(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.BlobReader, error) {
 	if !r.allow(repo) {
 		return nil, ociregistry.ErrNameUnknown
@@ -150,11 +154,15 @@ func (r *selectRegistry) DeleteTag(ctx context.Context, repo string, name string
 	return r.r.DeleteTag(ctx, repo, name)
 }
 
-func (r *selectRegistry) Repositories(ctx context.Context) ociregistry.Iter[string] {
-	return &filterIter[string]{
-		allow: r.allow,
-		iter:  r.r.Repositories(ctx),
+func (r *selectRegistry) DeleteRepository(ctx context.Context, repo string) error {
+	if !r.allow(repo) {
+		return ociregistry.ErrNameUnknown
 	}
+	return ociregistry.DeleteRepository(ctx, r.r, repo)
+}
+
+func (r *selectRegistry) Repositories(ctx context.Context) ociregistry.Iter[string] {
+	return ociregistry.Filter(r.r.Repositories(ctx), r.allow)
 }
 
 func (r *selectRegistry) Tags(ctx context.Context, repo string) ociregistry.Iter[string] {
@@ -170,28 +178,3 @@ func (r *selectRegistry) Referrers(ctx context.Context, repo string, digest ocir
 	}
 	return r.r.Referrers(ctx, repo, digest, artifactType)
 }
-
-type filterIter[T any] struct {
-	allow func(T) bool
-	iter  ociregistry.Iter[T]
-}
-
-func (it *filterIter[T]) Close() {
-	it.iter.Close()
-}
-
-func (it *filterIter[T]) Next() (T, bool) {
-	for {
-		x, ok := it.iter.Next()
-		if !ok {
-			return *new(T), false
-		}
-		if it.allow(x) {
-			return x, true
-		}
-	}
-}
-
-func (it *filterIter[T]) Error() error {
-	return it.iter.Error()
-}
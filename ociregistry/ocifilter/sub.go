@@ -61,6 +61,10 @@ type subRegistry struct {
 	r      ociregistry.Interface
 }
 
+func (r *subRegistry) Capabilities(ctx context.Context) ociregistry.Capabilities {
+	return ociregistry.CapabilitiesOf(ctx, r.r)
+}
+
 func (r *subRegistry) GetBlob(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.BlobReader, error) {
 	ctx = r.mapScopes(ctx)
 	return r.r.GetBlob(ctx, r.repo(repo), digest)
@@ -139,12 +143,22 @@ func (r *subRegistry) DeleteTag(ctx context.Context, repo string, name string) e
 	return r.r.DeleteTag(ctx, r.repo(repo), name)
 }
 
+func (r *subRegistry) DeleteRepository(ctx context.Context, repo string) error {
+	ctx = r.mapScopes(ctx)
+	return ociregistry.DeleteRepository(ctx, r.r, r.repo(repo))
+}
+
 func (r *subRegistry) Repositories(ctx context.Context) ociregistry.Iter[string] {
 	ctx = r.mapScopes(ctx)
-	return &subRegistryIter{
-		pr:   r,
-		iter: r.r.Repositories(ctx),
-	}
+	p := r.prefix + "/"
+	return ociregistry.Map(
+		ociregistry.Filter(r.r.Repositories(ctx), func(repo string) bool {
+			return strings.HasPrefix(repo, p)
+		}),
+		func(repo string) string {
+			return strings.TrimPrefix(repo, p)
+		},
+	)
 }
 
 func (r *subRegistry) Tags(ctx context.Context, repo string) ociregistry.Iter[string] {
@@ -168,13 +182,12 @@ func (r *subRegistry) mapScopes(ctx context.Context) context.Context {
 	// that took an iterator, which could avoid the intermediate
 	// slice allocation.
 	scopes := make([]ociauth.ResourceScope, 0, scope.Len())
-	scope.Iter()(func(rs ociauth.ResourceScope) bool {
+	for rs := range scope.Iter() {
 		if rs.ResourceType == ociauth.TypeRepository {
 			rs.Resource = r.repo(rs.Resource)
 		}
 		scopes = append(scopes, rs)
-		return true
-	})
+	}
 	return ociauth.ContextWithScope(ctx, ociauth.NewScope(scopes...))
 }
 
@@ -187,29 +200,3 @@ func (r *subRegistry) repo(name string) string {
 	}
 	return path.Join(r.prefix, name)
 }
-
-type subRegistryIter struct {
-	pr   *subRegistry
-	iter ociregistry.Iter[string]
-}
-
-func (it *subRegistryIter) Close() {
-	it.iter.Close()
-}
-
-func (it *subRegistryIter) Next() (string, bool) {
-	p := it.pr.prefix + "/"
-	for {
-		x, ok := it.iter.Next()
-		if !ok {
-			return "", false
-		}
-		if p, ok := strings.CutPrefix(x, p); ok {
-			return p, true
-		}
-	}
-}
-
-func (it *subRegistryIter) Error() error {
-	return it.iter.Error()
-}
@@ -0,0 +1,37 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocifilter
+
+import (
+	"testing"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ocitest"
+)
+
+func TestSelectInterface(t *testing.T) {
+	ocitest.RunInterfaceTests(t, func(t *testing.T) ociregistry.Interface {
+		return Select(ocimem.New(), func(repo string) bool {
+			return true
+		})
+	})
+}
+
+func TestSubInterface(t *testing.T) {
+	ocitest.RunInterfaceTests(t, func(t *testing.T) ociregistry.Interface {
+		return Sub(ocimem.New(), "some/prefix")
+	})
+}
@@ -64,6 +64,13 @@ type Buffer struct {
 	committed        bool
 	desc             ociregistry.Descriptor
 	commitErr        error
+
+	// onCancel is called when the upload is canceled.
+	onCancel func()
+
+	// onWrite is called after data has been written
+	// to the buffer.
+	onWrite func()
 }
 
 // NewBuffer returns a buffer that calls commit with the
@@ -82,8 +89,14 @@ func NewBuffer(commit func(b *Buffer) error, uuid string) *Buffer {
 
 func (b *Buffer) Cancel() error {
 	b.mu.Lock()
-	defer b.mu.Unlock()
-	b.commitErr = fmt.Errorf("upload canceled")
+	committed := b.committed
+	if !committed {
+		b.commitErr = fmt.Errorf("upload canceled")
+	}
+	b.mu.Unlock()
+	if !committed && b.onCancel != nil {
+		b.onCancel()
+	}
 	return nil
 }
 
@@ -101,6 +114,13 @@ func (b *Buffer) ChunkSize() int {
 	return 8 * 1024 // 8KiB; not really important
 }
 
+// content returns a copy of the data written so far.
+func (b *Buffer) content() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return bytes.Clone(b.buf)
+}
+
 // GetBlob returns any committed data and is descriptor. It returns an error
 // if the data hasn't been committed or there was an error doing so.
 func (b *Buffer) GetBlob() (ociregistry.Descriptor, []byte, error) {
@@ -117,6 +137,14 @@ func (b *Buffer) GetBlob() (ociregistry.Descriptor, []byte, error) {
 
 // Write implements io.Writer by writing some data to the blob.
 func (b *Buffer) Write(data []byte) (int, error) {
+	n, err := b.write(data)
+	if err == nil && b.onWrite != nil {
+		b.onWrite()
+	}
+	return n, err
+}
+
+func (b *Buffer) write(data []byte) (int, error) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 	if offset := b.checkStartOffset; offset != -1 {
@@ -19,12 +19,14 @@ import (
 	"fmt"
 
 	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ociwatch"
 )
 
 var (
 	errCannotDeleteTag            = fmt.Errorf("%w: tag deletion not permitted", ociregistry.ErrDenied)
 	errCannotDeleteTaggedBlob     = fmt.Errorf("%w: deletion of tagged blob not permitted", ociregistry.ErrDenied)
 	errCannotDeleteTaggedManifest = fmt.Errorf("%w: deletion of tagged manifest not permitted", ociregistry.ErrDenied)
+	errCannotDeleteTaggedRepo     = fmt.Errorf("%w: deletion of repository with tags not permitted", ociregistry.ErrDenied)
 )
 
 func (r *Registry) DeleteBlob(ctx context.Context, repoName string, digest ociregistry.Digest) error {
@@ -48,7 +50,9 @@ func (r *Registry) DeleteBlob(ctx context.Context, repoName string, digest ocire
 	}
 	// TODO if r.cfg.ImmutableTags, refuse to delete the blob
 	// if it's referred to, directly or indirectly, by a tag.
-	delete(r.repos[repoName].blobs, digest)
+	desc := contentDesc(digest, repo.blobs[digest])
+	r.store.remove(repo.blobs, digest)
+	r.notify(ociwatch.BlobDeleted, repoName, "", desc)
 	return nil
 }
 
@@ -69,7 +73,9 @@ func (r *Registry) DeleteManifest(ctx context.Context, repoName string, digest o
 		}
 	}
 	// TODO should this also delete any tags referring to this digest?
-	delete(repo.manifests, digest)
+	desc := contentDesc(digest, repo.manifests[digest])
+	r.store.remove(repo.manifests, digest)
+	r.notify(ociwatch.ManifestDeleted, repoName, "", desc)
 	return nil
 }
 
@@ -87,5 +93,26 @@ func (r *Registry) DeleteTag(ctx context.Context, repoName string, tagName strin
 		return errCannotDeleteTag
 	}
 	delete(repo.tags, tagName)
+	r.notify(ociwatch.TagDeleted, repoName, tagName, ociregistry.Descriptor{})
+	return nil
+}
+
+// DeleteRepository deletes the repository with the given name,
+// including all its tags, manifests, blobs and uploads in progress.
+// When tags are immutable, a repository that has any tags
+// cannot be deleted.
+func (r *Registry) DeleteRepository(ctx context.Context, repoName string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	repo, err := r.repo(repoName)
+	if err != nil {
+		return err
+	}
+	if r.cfg.ImmutableTags && len(repo.tags) > 0 {
+		return errCannotDeleteTaggedRepo
+	}
+	delete(r.repos, repoName)
+	r.store.removeRepo(repo)
+	r.notify(ociwatch.RepositoryDeleted, repoName, "", ociregistry.Descriptor{})
 	return nil
 }
@@ -0,0 +1,65 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocimem
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocitest"
+)
+
+func TestDeleteRepository(t *testing.T) {
+	ctx := context.Background()
+	r := New()
+	ocitest.NewRegistry(t, r).MustPushContent(statsTestContent)
+	qt.Assert(t, qt.IsNil(r.DeleteRepository(ctx, "foo")))
+	repos, err := ociregistry.All(r.Repositories(ctx))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.DeepEquals(repos, []string{"bar"}))
+	qt.Check(t, qt.ErrorIs(r.DeleteRepository(ctx, "foo"), ociregistry.ErrNameUnknown))
+
+	r = NewWithConfig(&Config{ImmutableTags: true})
+	ocitest.NewRegistry(t, r).MustPushContent(statsTestContent)
+	qt.Check(t, qt.ErrorIs(r.DeleteRepository(ctx, "foo"), ociregistry.ErrDenied))
+	qt.Check(t, qt.IsNil(r.DeleteRepository(ctx, "bar")))
+}
+
+func TestDeleteRepositoryWithUploadInProgress(t *testing.T) {
+	ctx := context.Background()
+	r := New()
+	w, err := r.PushBlobChunked(ctx, "foo", 0)
+	qt.Assert(t, qt.IsNil(err))
+	_, err = w.Write([]byte("hello"))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.IsNil(r.DeleteRepository(ctx, "foo")))
+
+	// Committing the upload must not bring the
+	// deleted repository back to life.
+	_, err = w.Commit(testBlobDesc("hello").Digest)
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrNameUnknown))
+	repos, err := ociregistry.All(r.Repositories(ctx))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.HasLen(repos, 0))
+
+	// A new repository with the same name is unaffected.
+	reg := ocitest.NewRegistry(t, r)
+	reg.MustPushBlob("foo", []byte("other"))
+	_, err = r.ResolveBlob(ctx, "foo", testBlobDesc("hello").Digest)
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrBlobUnknown))
+}
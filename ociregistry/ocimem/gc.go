@@ -0,0 +1,129 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocimem
+
+import (
+	"encoding/json"
+	"time"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ociwatch"
+)
+
+// GCStats holds the result of [Registry.GC].
+type GCStats struct {
+	// Blobs holds the number of blobs removed
+	// and Bytes holds their total size.
+	Blobs int
+	Bytes int64
+}
+
+// GC removes all blobs that aren't referred to by any manifest
+// in the same repository and that were added to it at least
+// minAge ago, and returns the number of blobs removed. Restoring
+// a snapshot counts as adding all the blobs in it.
+//
+// Clients usually push the blobs that a manifest refers to before
+// pushing the manifest itself, so when pushes might be in progress,
+// minAge should be longer than any push is expected to take.
+//
+// A manifest with a media type that's not understood is assumed to
+// refer to blobs in the same way as an OCI image manifest. If its
+// references can't be determined that way, no blobs are removed
+// from its repository.
+func (r *Registry) GC(minAge time.Duration) GCStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	var stats GCStats
+	for repoName, repo := range r.repos {
+		used, ok := usedBlobs(repo)
+		if !ok {
+			continue
+		}
+		for dig, b := range repo.blobs {
+			if !used[dig] && now.Sub(b.added) >= minAge {
+				r.store.remove(repo.blobs, dig)
+				r.notify(ociwatch.BlobDeleted, repoName, "", contentDesc(dig, b))
+				stats.Blobs++
+				stats.Bytes += int64(len(b.data))
+			}
+		}
+	}
+	return stats
+}
+
+// usedBlobs returns the set of blobs referred to by manifests
+// in the repository. It reports false if that can't be determined.
+func usedBlobs(repo *repository) (map[ociregistry.Digest]bool, bool) {
+	used := make(map[ociregistry.Digest]bool)
+	for _, m := range repo.manifests {
+		if _, ok := manifestIterators[m.mediaType]; !ok {
+			if !addGenericReferences(used, m.data) {
+				return nil, false
+			}
+			continue
+		}
+		iter, err := manifestReferences(m.mediaType, m.data)
+		if err != nil {
+			return nil, false
+		}
+		iter(func(info descInfo) bool {
+			if info.kind == kindBlob {
+				used[info.desc.Digest] = true
+			}
+			return true
+		})
+	}
+	return used, true
+}
+
+// addGenericReferences adds the blobs referred to by a manifest with
+// an unknown media type to used, assuming that it has the same shape
+// as an OCI image manifest, which is true of Docker schema2 manifests
+// and OCI artifact manifests among others; the blobSum fields of Docker
+// schema1 manifests and the manifests field of indexes such as Docker
+// manifest lists are also taken into account.
+// It reports whether the manifest could be parsed.
+func addGenericReferences(used map[ociregistry.Digest]bool, data []byte) bool {
+	var m struct {
+		Config    *ociregistry.Descriptor  `json:"config"`
+		Layers    []ociregistry.Descriptor `json:"layers"`
+		Blobs     []ociregistry.Descriptor `json:"blobs"`
+		Manifests []ociregistry.Descriptor `json:"manifests"`
+		FSLayers  []struct {
+			BlobSum ociregistry.Digest `json:"blobSum"`
+		} `json:"fsLayers"`
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return false
+	}
+	if m.Config != nil {
+		used[m.Config.Digest] = true
+	}
+	for _, desc := range m.Layers {
+		used[desc.Digest] = true
+	}
+	for _, desc := range m.Blobs {
+		used[desc.Digest] = true
+	}
+	for _, desc := range m.Manifests {
+		used[desc.Digest] = true
+	}
+	for _, l := range m.FSLayers {
+		used[l.BlobSum] = true
+	}
+	return true
+}
@@ -0,0 +1,227 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocimem
+
+import (
+	"container/heap"
+	"fmt"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ociwatch"
+)
+
+// reserve checks that there's room in the registry for content
+// with the given digest and size, which is about to be added to a
+// repository. When r.cfg.Evict is set, it evicts content to make room
+// if needed, except for any content in keep.
+// It must be called with r.mu held.
+func (r *Registry) reserve(dig ociregistry.Digest, size int64, keep map[ociregistry.Digest]bool) error {
+	max := r.cfg.MaxBytes
+	if max <= 0 || r.store.items[dig] != nil {
+		// There's no limit or the content is already stored.
+		return nil
+	}
+	if r.store.size+size <= max {
+		return nil
+	}
+	if r.cfg.Evict && size <= max && r.evict(r.store.size+size-max, keep) {
+		return nil
+	}
+	return fmt.Errorf("%w: storing %d bytes would exceed the registry size limit of %d bytes (%d bytes in use)", ociregistry.ErrDenied, size, max, r.store.size)
+}
+
+// evict removes at least need bytes of content from the registry,
+// least recently used first. Only content that nothing refers to can
+// be removed: content that's tagged, that's in keep or that's referred
+// to by a manifest that remains in the registry is not removed, but
+// it can become a candidate once all the manifests that refer to it
+// have been removed. If not enough content can be removed, it removes
+// nothing and returns false.
+// It must be called with r.mu held.
+func (r *Registry) evict(need int64, keep map[ociregistry.Digest]bool) bool {
+	refs := r.contentReferences()
+	// users holds the number of manifests that refer to each item.
+	users := make(map[ociregistry.Digest]int)
+	for _, deps := range refs {
+		for dig := range deps {
+			users[dig]++
+		}
+	}
+	tagged := make(map[ociregistry.Digest]bool)
+	for _, repo := range r.repos {
+		for _, desc := range repo.tags {
+			tagged[desc.Digest] = true
+		}
+	}
+	candidates := &lruHeap{items: r.store.items}
+	addCandidate := func(dig ociregistry.Digest) {
+		if users[dig] == 0 && !tagged[dig] && !keep[dig] && r.store.items[dig] != nil {
+			heap.Push(candidates, dig)
+		}
+	}
+	for dig := range r.store.items {
+		addCandidate(dig)
+	}
+	var evicted []ociregistry.Digest
+	var freed int64
+	for freed < need {
+		if candidates.Len() == 0 {
+			return false
+		}
+		dig := heap.Pop(candidates).(ociregistry.Digest)
+		evicted = append(evicted, dig)
+		freed += int64(len(r.store.items[dig].data))
+		for dep := range refs[dig] {
+			users[dep]--
+			addCandidate(dep)
+		}
+	}
+	for _, dig := range evicted {
+		for repoName, repo := range r.repos {
+			if b := repo.manifests[dig]; b != nil {
+				r.store.remove(repo.manifests, dig)
+				r.notify(ociwatch.ManifestDeleted, repoName, "", contentDesc(dig, b))
+			}
+			if b := repo.blobs[dig]; b != nil {
+				r.store.remove(repo.blobs, dig)
+				r.notify(ociwatch.BlobDeleted, repoName, "", contentDesc(dig, b))
+			}
+		}
+		r.evictions++
+	}
+	r.evictedBytes += freed
+	return true
+}
+
+// contentReferences returns the set of content that each manifest
+// in the registry refers to directly, not including its subject.
+// When the references of a manifest can't be determined, it's
+// treated as referring to all the other content in its repository.
+// It must be called with r.mu held.
+func (r *Registry) contentReferences() map[ociregistry.Digest]map[ociregistry.Digest]bool {
+	refs := make(map[ociregistry.Digest]map[ociregistry.Digest]bool)
+	for _, repo := range r.repos {
+		for dig, m := range repo.manifests {
+			set := refs[dig]
+			if set == nil {
+				set = make(map[ociregistry.Digest]bool)
+				refs[dig] = set
+			}
+			if addDirectReferences(m.mediaType, m.data, set) {
+				continue
+			}
+			for dig1 := range repo.manifests {
+				if dig1 != dig {
+					set[dig1] = true
+				}
+			}
+			for dig1 := range repo.blobs {
+				set[dig1] = true
+			}
+		}
+	}
+	return refs
+}
+
+// addDirectReferences adds the blobs and manifests that the given
+// manifest refers to directly, except for its subject, to set.
+// It reports whether the references could be determined.
+func addDirectReferences(mediaType string, data []byte, set map[ociregistry.Digest]bool) bool {
+	if _, ok := manifestIterators[mediaType]; !ok {
+		return addGenericReferences(set, data)
+	}
+	iter, err := manifestReferences(mediaType, data)
+	if err != nil {
+		return false
+	}
+	iter(func(info descInfo) bool {
+		if info.kind != kindSubjectManifest {
+			set[info.desc.Digest] = true
+		}
+		return true
+	})
+	return true
+}
+
+// lruHeap implements [heap.Interface] for a set of digests of
+// content in items, least recently used first.
+type lruHeap struct {
+	items   map[ociregistry.Digest]*storedContent
+	digests []ociregistry.Digest
+}
+
+func (h *lruHeap) Len() int {
+	return len(h.digests)
+}
+
+func (h *lruHeap) Less(i, j int) bool {
+	return h.items[h.digests[i]].lastUsed < h.items[h.digests[j]].lastUsed
+}
+
+func (h *lruHeap) Swap(i, j int) {
+	h.digests[i], h.digests[j] = h.digests[j], h.digests[i]
+}
+
+func (h *lruHeap) Push(x any) {
+	h.digests = append(h.digests, x.(ociregistry.Digest))
+}
+
+func (h *lruHeap) Pop() any {
+	n := len(h.digests)
+	dig := h.digests[n-1]
+	h.digests = h.digests[:n-1]
+	return dig
+}
+
+// addReachable adds the manifest with the given digest in repo
+// and everything that it refers to, directly or indirectly, to set.
+// It reports whether the references could be determined.
+func addReachable(repo *repository, dig ociregistry.Digest, set map[ociregistry.Digest]bool) bool {
+	if set[dig] {
+		return true
+	}
+	set[dig] = true
+	m := repo.manifests[dig]
+	if m == nil {
+		return true
+	}
+	return addManifestReferences(repo, m.mediaType, m.data, set)
+}
+
+// addManifestReferences adds everything that the given manifest
+// refers to, directly or indirectly, within repo to set, except
+// for its subject. A manifest with a media type that's not understood
+// is treated as described in [addGenericReferences].
+// It reports whether the references could be determined.
+func addManifestReferences(repo *repository, mediaType string, data []byte, set map[ociregistry.Digest]bool) bool {
+	if _, ok := manifestIterators[mediaType]; !ok {
+		return addGenericReferences(set, data)
+	}
+	iter, err := manifestReferences(mediaType, data)
+	if err != nil {
+		return false
+	}
+	ok := true
+	iter(func(info descInfo) bool {
+		switch info.kind {
+		case kindBlob:
+			set[info.desc.Digest] = true
+		case kindManifest:
+			ok = addReachable(repo, info.desc.Digest, set)
+		}
+		return ok
+	})
+	return ok
+}
@@ -0,0 +1,199 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocimem
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocitest"
+)
+
+func TestMaxBytesRejectsWrites(t *testing.T) {
+	ctx := context.Background()
+	r := NewWithConfig(&Config{MaxBytes: 25})
+	reg := ocitest.NewRegistry(t, r)
+	reg.MustPushBlob("foo", []byte(strings.Repeat("a", 15)))
+
+	_, err := r.PushBlob(ctx, "foo", testBlobDesc(strings.Repeat("b", 11)), strings.NewReader(strings.Repeat("b", 11)))
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrDenied))
+	qt.Check(t, qt.ErrorMatches(err, `.*storing 11 bytes would exceed the registry size limit of 25 bytes \(15 bytes in use\)`))
+
+	// Content that's already stored takes no more space.
+	reg.MustPushBlob("bar", []byte(strings.Repeat("a", 15)))
+
+	// Chunked uploads are checked when they're committed.
+	w, err := r.PushBlobChunked(ctx, "foo", 0)
+	qt.Assert(t, qt.IsNil(err))
+	_, err = w.Write([]byte(strings.Repeat("c", 11)))
+	qt.Assert(t, qt.IsNil(err))
+	_, err = w.Commit(digest.FromString(strings.Repeat("c", 11)))
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrDenied))
+
+	// Content that fits is still accepted.
+	reg.MustPushBlob("foo", []byte(strings.Repeat("d", 10)))
+
+	stats := r.Stats()
+	qt.Check(t, qt.Equals(stats.ContentBytes, int64(25)))
+	qt.Check(t, qt.Equals(stats.MaxBytes, int64(25)))
+	qt.Check(t, qt.Equals(stats.Evictions, 0))
+}
+
+func TestMaxBytesEvictsLeastRecentlyUsed(t *testing.T) {
+	ctx := context.Background()
+	r := NewWithConfig(&Config{MaxBytes: 30, Evict: true})
+	reg := ocitest.NewRegistry(t, r)
+	a := reg.MustPushBlob("foo", []byte(strings.Repeat("a", 10)))
+	b := reg.MustPushBlob("foo", []byte(strings.Repeat("b", 10)))
+	c := reg.MustPushBlob("bar", []byte(strings.Repeat("c", 10)))
+
+	// Reading a blob counts as using it.
+	rd, err := r.GetBlob(ctx, "foo", a.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	rd.Close()
+
+	d := reg.MustPushBlob("bar", []byte(strings.Repeat("d", 10)))
+	for _, desc := range []ociregistry.Descriptor{a, c, d} {
+		qt.Check(t, qt.IsTrue(r.store.items[desc.Digest] != nil))
+	}
+	_, err = r.ResolveBlob(ctx, "foo", b.Digest)
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrBlobUnknown))
+
+	// Content larger than the limit is never accepted.
+	_, err = r.PushBlob(ctx, "foo", testBlobDesc(strings.Repeat("e", 31)), strings.NewReader(strings.Repeat("e", 31)))
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrDenied))
+
+	stats := r.Stats()
+	qt.Check(t, qt.Equals(stats.ContentBytes, int64(30)))
+	qt.Check(t, qt.Equals(stats.Evictions, 1))
+	qt.Check(t, qt.Equals(stats.EvictedBytes, int64(10)))
+}
+
+func TestMaxBytesDoesNotEvictTaggedContent(t *testing.T) {
+	ctx := context.Background()
+	config, layer, manifest := testImage(t)
+	max := config.Size + layer.Size + int64(len(manifest)) + 20
+	r := NewWithConfig(&Config{MaxBytes: max, Evict: true})
+	reg := ocitest.NewRegistry(t, r)
+	reg.MustPushBlob("foo", []byte("{}"))
+	reg.MustPushBlob("foo", []byte("some layer"))
+	image, err := r.PushManifest(ctx, "foo", "latest", manifest, ocispec.MediaTypeImageManifest)
+	qt.Assert(t, qt.IsNil(err))
+	x := reg.MustPushBlob("bar", []byte(strings.Repeat("x", 10)))
+	y := reg.MustPushBlob("bar", []byte(strings.Repeat("y", 10)))
+	z := reg.MustPushBlob("bar", []byte(strings.Repeat("z", 10)))
+
+	// The tagged content is older but it's not evicted.
+	for _, dig := range []ociregistry.Digest{config.Digest, layer.Digest, image.Digest, y.Digest, z.Digest} {
+		qt.Check(t, qt.IsTrue(r.store.items[dig] != nil))
+	}
+	qt.Check(t, qt.IsNil(r.store.items[x.Digest]))
+
+	// Nothing is evicted when not enough space can be freed.
+	_, err = r.PushBlob(ctx, "bar", testBlobDesc(strings.Repeat("w", 21)), strings.NewReader(strings.Repeat("w", 21)))
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrDenied))
+	qt.Check(t, qt.Equals(r.Stats().ContentBytes, max))
+
+	// Once the tag is removed, the image can be evicted.
+	qt.Assert(t, qt.IsNil(r.DeleteTag(ctx, "foo", "latest")))
+	reg.MustPushBlob("bar", []byte(strings.Repeat("w", 21)))
+	// The manifest is evicted first, in addition to x. That frees
+	// enough space, so the config and layer that it referred to
+	// remain, but they can now be evicted too.
+	qt.Check(t, qt.IsNil(r.store.items[image.Digest]))
+	for _, dig := range []ociregistry.Digest{config.Digest, layer.Digest, y.Digest} {
+		qt.Check(t, qt.IsTrue(r.store.items[dig] != nil))
+	}
+	qt.Check(t, qt.Equals(r.Stats().Evictions, 2))
+}
+
+func TestMaxBytesDoesNotEvictReferencedContent(t *testing.T) {
+	ctx := context.Background()
+	config, layer, manifest := testImage(t)
+	r := NewWithConfig(&Config{MaxBytes: 1000, Evict: true})
+	reg := ocitest.NewRegistry(t, r)
+	reg.MustPushBlob("foo", []byte("{}"))
+	reg.MustPushBlob("foo", []byte("some layer"))
+	image, err := r.PushManifest(ctx, "foo", "", manifest, ocispec.MediaTypeImageManifest)
+	qt.Assert(t, qt.IsNil(err))
+	image.MediaType = ocispec.MediaTypeImageManifest
+	index, err := json.Marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ociregistry.Descriptor{image},
+	})
+	qt.Assert(t, qt.IsNil(err))
+	indexDesc, err := r.PushManifest(ctx, "foo", "", index, ocispec.MediaTypeImageIndex)
+	qt.Assert(t, qt.IsNil(err))
+	x := reg.MustPushBlob("foo", []byte(strings.Repeat("x", 10)))
+
+	// Using the untagged index makes x the least recently used
+	// content that nothing refers to, so it's evicted rather than
+	// the older layer, config and manifest that the index refers to.
+	_, err = r.ResolveManifest(ctx, "foo", indexDesc.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	r.cfg.MaxBytes = r.store.size
+	reg.MustPushBlob("foo", []byte(strings.Repeat("y", 10)))
+	qt.Check(t, qt.IsNil(r.store.items[x.Digest]))
+	for _, dig := range []ociregistry.Digest{config.Digest, layer.Digest, image.Digest, indexDesc.Digest} {
+		qt.Check(t, qt.IsTrue(r.store.items[dig] != nil))
+	}
+	rd, err := r.GetBlob(ctx, "foo", layer.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	rd.Close()
+}
+
+func TestMaxBytesKeepsManifestReferences(t *testing.T) {
+	ctx := context.Background()
+	config, layer, manifest := testImage(t)
+	r := NewWithConfig(&Config{
+		MaxBytes: config.Size + layer.Size + int64(len(manifest)) + 10 - 1,
+		Evict:    true,
+	})
+	reg := ocitest.NewRegistry(t, r)
+	reg.MustPushBlob("foo", []byte("{}"))
+	reg.MustPushBlob("foo", []byte("some layer"))
+	x := reg.MustPushBlob("foo", []byte(strings.Repeat("x", 10)))
+
+	// The blobs that the manifest refers to are least recently
+	// used but they can't be evicted to make room for it.
+	_, err := r.PushManifest(ctx, "foo", "", manifest, ocispec.MediaTypeImageManifest)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.IsTrue(r.store.items[config.Digest] != nil))
+	qt.Check(t, qt.IsTrue(r.store.items[layer.Digest] != nil))
+	qt.Check(t, qt.IsNil(r.store.items[x.Digest]))
+}
+
+func TestRestoreExceedsMaxBytes(t *testing.T) {
+	r := New()
+	ocitest.NewRegistry(t, r).MustPushContent(snapshotTestContent)
+	var buf bytes.Buffer
+	err := r.Snapshot(&buf, nil)
+	qt.Assert(t, qt.IsNil(err))
+
+	r1 := NewWithConfig(&Config{MaxBytes: r.Stats().ContentBytes - 1})
+	err = r1.Restore(&buf)
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrDenied))
+	qt.Check(t, qt.Equals(r1.Stats().Repos, 0))
+}
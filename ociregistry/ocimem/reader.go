@@ -40,12 +40,12 @@ func (r *Registry) GetBlobRange(ctx context.Context, repoName string, dig ocireg
 	if err != nil {
 		return nil, err
 	}
+	if o0 < 0 || o0 > int64(len(b.data)) || (o1 >= 0 && o1 < o0) {
+		return nil, fmt.Errorf("invalid range [%d, %d]; have [%d, %d]: %w", o0, o1, 0, len(b.data), ociregistry.ErrRangeInvalid)
+	}
 	if o1 < 0 || o1 > int64(len(b.data)) {
 		o1 = int64(len(b.data))
 	}
-	if o0 < 0 || o0 > o1 {
-		return nil, fmt.Errorf("invalid range [%d, %d]; have [%d, %d]", o0, o1, 0, len(b.data))
-	}
 	return NewBytesReader(b.data[o0:o1], b.descriptor()), nil
 }
 
@@ -19,8 +19,10 @@ package ocimem
 import (
 	"fmt"
 	"sync"
+	"time"
 
 	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ociwatch"
 	"github.com/opencontainers/go-digest"
 )
 
@@ -31,19 +33,53 @@ type Registry struct {
 	cfg   Config
 	mu    sync.Mutex
 	repos map[string]*repository
+
+	// store holds the content of all the manifests and
+	// blobs in repos.
+	store contentStore
+
+	// nextSweep holds the earliest time that
+	// expired uploads will next be removed.
+	nextSweep time.Time
+
+	// clock is used to find the current time.
+	// If it's nil, time.Now is used.
+	clock func() time.Time
+
+	// evictions and evictedBytes hold the number of items
+	// and bytes evicted because of Config.MaxBytes.
+	evictions    int
+	evictedBytes int64
+
+	// events records the changes to the registry.
+	// It's created on first use by eventLog.
+	events *ociwatch.Log
 }
 
 type repository struct {
 	tags      map[string]ociregistry.Descriptor
 	manifests map[ociregistry.Digest]*blob
 	blobs     map[ociregistry.Digest]*blob
-	uploads   map[string]*Buffer
+	uploads   map[string]*upload
+}
+
+// upload holds a chunked upload that's in progress.
+type upload struct {
+	buf *Buffer
+
+	// lastUsed holds when the upload was
+	// last started, resumed or written to.
+	lastUsed time.Time
 }
 
 type blob struct {
 	mediaType string
 	data      []byte
 	subject   digest.Digest
+
+	// added holds when a blob was last added to its
+	// repository. It's not set for manifests.
+	added time.Time
 }
 
 func (b *blob) descriptor() ociregistry.Descriptor {
@@ -86,8 +122,48 @@ type Config struct {
 	// - no deletion of any blob or manifest that a tagged manifest
 	// refers to (TODO: not implemented yet)
 	ImmutableTags bool
+
+	// UploadTimeout specifies how long a chunked upload can go
+	// without being resumed before it's discarded, after which
+	// attempts to resume it fail with [ociregistry.ErrBlobUploadUnknown].
+	// If it's zero, [DefaultUploadTimeout] is used.
+	// If it's negative, uploads never expire.
+	UploadTimeout time.Duration
+
+	// MaxUploadsPerRepo specifies the maximum number of chunked
+	// uploads that can be in progress in a repository at once.
+	// Starting any more fails with [ociregistry.ErrTooManyRequests].
+	// If it's zero, there is no limit.
+	MaxUploadsPerRepo int
+
+	// MaxBytes specifies the maximum total size of the content
+	// stored in the registry, as reported by [Stats.ContentBytes].
+	// Data in chunked uploads is not counted until the upload is
+	// committed. Writes that would take the total over the limit fail
+	// with [ociregistry.ErrDenied], unless Evict is set.
+	// If it's zero, there is no limit.
+	MaxBytes int64
+
+	// Evict specifies that, rather than rejecting writes that would
+	// take the registry over MaxBytes, the registry should make room by
+	// removing the least recently used blobs and manifests that are not
+	// reachable from any tag. This is useful when the registry
+	// is used as a cache.
+	Evict bool
+
+	// MaxEvents specifies how many of the most recent changes
+	// are retained for [Registry.Watch].
+	// If it's zero, [ociwatch.DefaultMaxEvents] is used.
+	MaxEvents int
 }
 
+// DefaultUploadTimeout holds the default value of [Config.UploadTimeout].
+const DefaultUploadTimeout = time.Hour
+
+// sweepsPerTimeout holds how many times expired uploads are removed
+// during an upload timeout period, when the registry is in use.
+const sweepsPerTimeout = 4
+
 func (r *Registry) repo(repoName string) (*repository, error) {
 	if repo, ok := r.repos[repoName]; ok {
 		return repo, nil
@@ -104,6 +180,7 @@ func (r *Registry) manifestForDigest(repoName string, dig ociregistry.Digest) (*
 	if b == nil {
 		return nil, ociregistry.ErrManifestUnknown
 	}
+	r.store.touch(dig)
 	return b, nil
 }
 
@@ -116,6 +193,7 @@ func (r *Registry) blobForDigest(repoName string, dig ociregistry.Digest) (*blob
 	if b == nil {
 		return nil, ociregistry.ErrBlobUnknown
 	}
+	r.store.touch(dig)
 	return b, nil
 }
 
@@ -129,14 +207,18 @@ func (r *Registry) makeRepo(repoName string) (*repository, error) {
 	if repo := r.repos[repoName]; repo != nil {
 		return repo, nil
 	}
-	repo := &repository{
+	repo := newRepository()
+	r.repos[repoName] = repo
+	return repo, nil
+}
+
+func newRepository() *repository {
+	return &repository{
 		tags:      make(map[string]ociregistry.Descriptor),
 		manifests: make(map[digest.Digest]*blob),
 		blobs:     make(map[digest.Digest]*blob),
-		uploads:   make(map[string]*Buffer),
+		uploads:   make(map[string]*upload),
 	}
-	r.repos[repoName] = repo
-	return repo, nil
 }
 
 // SHA256("")
@@ -150,10 +232,10 @@ func CheckDescriptor(desc ociregistry.Descriptor, data []byte) error {
 	}
 	if data != nil {
 		if digest.FromBytes(data) != desc.Digest {
-			return fmt.Errorf("digest mismatch")
+			return fmt.Errorf("digest mismatch: %w", ociregistry.ErrDigestInvalid)
 		}
 		if desc.Size != int64(len(data)) {
-			return fmt.Errorf("size mismatch")
+			return fmt.Errorf("size mismatch: %w", ociregistry.ErrSizeInvalid)
 		}
 	} else {
 		if desc.Size == 0 && desc.Digest != emptyHash {
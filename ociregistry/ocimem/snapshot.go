@@ -0,0 +1,423 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocimem
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispecroot "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ociwatch"
+)
+
+// A snapshot is a tar archive in the OCI image layout format
+// (see https://github.com/opencontainers/image-spec/blob/v1.1.0/image-layout.md),
+// so tools that understand that format can read the tagged manifests
+// in it. Each entry in index.json is annotated with its repository
+// and tag. The layout holds one extra file, ocimem.json, which
+// holds the full content of each repository (see snapshotState).
+// The content of in-progress uploads is stored as blobs too.
+
+const (
+	snapshotStateFile = "ocimem.json"
+	snapshotIndexFile = "index.json"
+	snapshotBlobsDir  = "blobs"
+
+	// annotationRepository holds the name of the repository
+	// that a manifest in a snapshot's index.json belongs to.
+	annotationRepository = "dev.cuelabs.ocimem.repository"
+)
+
+// snapshotState holds the content of ocimem.json in a snapshot.
+type snapshotState struct {
+	Repositories map[string]*snapshotRepo `json:"repositories"`
+}
+
+type snapshotRepo struct {
+	Tags      map[string]ociregistry.Descriptor `json:"tags,omitempty"`
+	Manifests []ociregistry.Descriptor          `json:"manifests,omitempty"`
+	Blobs     []ociregistry.Descriptor          `json:"blobs,omitempty"`
+	Uploads   []snapshotUpload                  `json:"uploads,omitempty"`
+}
+
+// snapshotUpload holds an in-progress upload. Its content so
+// far is stored as the blob with the given digest.
+type snapshotUpload struct {
+	ID     string             `json:"id"`
+	Digest ociregistry.Digest `json:"digest"`
+	Size   int64              `json:"size"`
+}
+
+// SnapshotOptions holds options for [Registry.Snapshot].
+type SnapshotOptions struct {
+	// IncludeUploads specifies that chunked uploads
+	// in progress are included in the snapshot.
+	IncludeUploads bool
+}
+
+// Snapshot writes the entire content of the registry to w.
+// The snapshot is a tar archive in the OCI image layout format,
+// and its content depends only on the content of the registry,
+// so two registries with the same content produce identical snapshots.
+// Content that's present in several repositories is stored once.
+//
+// If opts is nil, it's treated the same as a pointer to the zero
+// [SnapshotOptions] value.
+//
+// Use [Registry.Restore] to read the snapshot.
+func (r *Registry) Snapshot(w io.Writer, opts *SnapshotOptions) error {
+	if opts == nil {
+		opts = &SnapshotOptions{}
+	}
+	state, index, blobs := r.snapshot(opts.IncludeUploads)
+	tw := tar.NewWriter(w)
+	layout, err := json.Marshal(ocispec.ImageLayout{
+		Version: ocispec.ImageLayoutVersion,
+	})
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, ocispec.ImageLayoutFile, layout); err != nil {
+		return err
+	}
+	indexData, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, snapshotIndexFile, indexData); err != nil {
+		return err
+	}
+	stateData, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, snapshotStateFile, stateData); err != nil {
+		return err
+	}
+	for _, dig := range slices.Sorted(maps.Keys(blobs)) {
+		if err := writeTarFile(tw, blobPath(dig), blobs[dig]); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// snapshot returns the state, index and blobs that make up a
+// snapshot of the registry. It holds r.mu only while gathering
+// the content, so that writing the snapshot doesn't block other
+// operations.
+func (r *Registry) snapshot(includeUploads bool) (*snapshotState, *ocispec.Index, map[ociregistry.Digest][]byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	state := &snapshotState{
+		Repositories: make(map[string]*snapshotRepo),
+	}
+	index := &ocispec.Index{
+		Versioned: ocispecroot.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ociregistry.Descriptor{},
+	}
+	blobs := make(map[ociregistry.Digest][]byte)
+	now := r.now()
+	timeout := r.uploadTimeout()
+	for _, repoName := range slices.Sorted(maps.Keys(r.repos)) {
+		repo := r.repos[repoName]
+		srepo := &snapshotRepo{
+			Tags: maps.Clone(repo.tags),
+		}
+		for _, tag := range slices.Sorted(maps.Keys(repo.tags)) {
+			desc := repo.tags[tag]
+			desc.Annotations = map[string]string{
+				annotationRepository:      repoName,
+				ocispec.AnnotationRefName: tag,
+			}
+			index.Manifests = append(index.Manifests, desc)
+		}
+		for _, dig := range slices.Sorted(maps.Keys(repo.manifests)) {
+			b := repo.manifests[dig]
+			srepo.Manifests = append(srepo.Manifests, snapshotDescriptor(dig, b))
+			blobs[dig] = b.data
+		}
+		for _, dig := range slices.Sorted(maps.Keys(repo.blobs)) {
+			b := repo.blobs[dig]
+			srepo.Blobs = append(srepo.Blobs, snapshotDescriptor(dig, b))
+			blobs[dig] = b.data
+		}
+		if includeUploads {
+			for _, id := range slices.Sorted(maps.Keys(repo.uploads)) {
+				u := repo.uploads[id]
+				if timeout >= 0 && now.Sub(u.lastUsed) >= timeout {
+					continue
+				}
+				data := u.buf.content()
+				dig := digest.FromBytes(data)
+				srepo.Uploads = append(srepo.Uploads, snapshotUpload{
+					ID:     id,
+					Digest: dig,
+					Size:   int64(len(data)),
+				})
+				blobs[dig] = data
+			}
+		}
+		state.Repositories[repoName] = srepo
+	}
+	return state, index, blobs
+}
+
+func snapshotDescriptor(dig ociregistry.Digest, b *blob) ociregistry.Descriptor {
+	return ociregistry.Descriptor{
+		MediaType: b.mediaType,
+		Digest:    dig,
+		Size:      int64(len(b.data)),
+	}
+}
+
+// Restore replaces the entire content of the registry with the
+// content of a snapshot written by [Registry.Snapshot]. Any uploads
+// in the snapshot are treated as if they were last used at
+// the time of the restore. If the snapshot is invalid or its content
+// doesn't fit within [Config.MaxBytes], Restore returns an error
+// and the registry is left unchanged.
+func (r *Registry) Restore(rd io.Reader) error {
+	state, blobs, err := readSnapshot(rd)
+	if err != nil {
+		return fmt.Errorf("invalid snapshot: %v", err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	repos, store, err := r.restoreRepos(state, blobs)
+	if err != nil {
+		return fmt.Errorf("invalid snapshot: %v", err)
+	}
+	if max := r.cfg.MaxBytes; max > 0 && store.size > max {
+		return fmt.Errorf("%w: snapshot content of %d bytes exceeds the registry size limit of %d bytes", ociregistry.ErrDenied, store.size, max)
+	}
+	r.repos, r.store = repos, store
+	r.notify(ociwatch.Reset, "", "", ociregistry.Descriptor{})
+	return nil
+}
+
+// readSnapshot reads the state and all the blobs from a snapshot,
+// checking that each blob matches its digest.
+func readSnapshot(rd io.Reader) (*snapshotState, map[ociregistry.Digest][]byte, error) {
+	var state *snapshotState
+	blobs := make(map[ociregistry.Digest][]byte)
+	tr := tar.NewReader(rd)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := path.Clean(hdr.Name)
+		switch {
+		case name == snapshotStateFile:
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				return nil, nil, err
+			}
+			if err := json.Unmarshal(data, &state); err != nil {
+				return nil, nil, fmt.Errorf("cannot unmarshal %s: %v", snapshotStateFile, err)
+			}
+		case strings.HasPrefix(name, snapshotBlobsDir+"/"):
+			alg, encoded, ok := strings.Cut(strings.TrimPrefix(name, snapshotBlobsDir+"/"), "/")
+			if !ok {
+				return nil, nil, fmt.Errorf("unexpected file %q", name)
+			}
+			dig := digest.NewDigestFromEncoded(digest.Algorithm(alg), encoded)
+			if err := dig.Validate(); err != nil {
+				return nil, nil, fmt.Errorf("invalid blob file %q: %v", name, err)
+			}
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				return nil, nil, err
+			}
+			if dig.Algorithm().FromBytes(data) != dig {
+				return nil, nil, fmt.Errorf("content of blob file %q does not match its digest", name)
+			}
+			blobs[dig] = data
+		}
+	}
+	if state == nil {
+		return nil, nil, fmt.Errorf("no %s file found", snapshotStateFile)
+	}
+	return state, blobs, nil
+}
+
+// restoreRepos returns the repositories described by state
+// and the store holding their content.
+// It must be called with r.mu held.
+func (r *Registry) restoreRepos(state *snapshotState, blobs map[ociregistry.Digest][]byte) (map[string]*repository, contentStore, error) {
+	content := func(desc ociregistry.Descriptor) ([]byte, error) {
+		data, ok := blobs[desc.Digest]
+		if !ok {
+			return nil, fmt.Errorf("no content found for %s", desc.Digest)
+		}
+		if int64(len(data)) != desc.Size {
+			return nil, fmt.Errorf("size mismatch for %s", desc.Digest)
+		}
+		return data, nil
+	}
+	now := r.now()
+	repos := make(map[string]*repository)
+	var store contentStore
+	for repoName, srepo := range state.Repositories {
+		if !ociregistry.IsValidRepoName(repoName) {
+			return nil, contentStore{}, fmt.Errorf("invalid repository name %q", repoName)
+		}
+		repo := newRepository()
+		for _, desc := range srepo.Blobs {
+			data, err := content(desc)
+			if err != nil {
+				return nil, contentStore{}, err
+			}
+			store.add(repo.blobs, desc.Digest, &blob{
+				mediaType: desc.MediaType,
+				data:      data,
+				added:     now,
+			})
+		}
+		for _, desc := range srepo.Manifests {
+			data, err := content(desc)
+			if err != nil {
+				return nil, contentStore{}, err
+			}
+			subject, err := manifestSubject(desc.MediaType, data)
+			if err != nil {
+				return nil, contentStore{}, fmt.Errorf("invalid manifest %s: %v", desc.Digest, err)
+			}
+			store.add(repo.manifests, desc.Digest, &blob{
+				mediaType: desc.MediaType,
+				data:      data,
+				subject:   subject,
+			})
+		}
+		for tag, desc := range srepo.Tags {
+			if !ociregistry.IsValidTag(tag) {
+				return nil, contentStore{}, fmt.Errorf("invalid tag %q", tag)
+			}
+			if repo.manifests[desc.Digest] == nil {
+				return nil, contentStore{}, fmt.Errorf("tag %q refers to unknown manifest %s", tag, desc.Digest)
+			}
+			repo.tags[tag] = desc
+		}
+		for _, su := range srepo.Uploads {
+			if su.ID == "" || repo.uploads[su.ID] != nil {
+				return nil, contentStore{}, fmt.Errorf("invalid or duplicate upload ID %q", su.ID)
+			}
+			data, err := content(ociregistry.Descriptor{
+				Digest: su.Digest,
+				Size:   su.Size,
+			})
+			if err != nil {
+				return nil, contentStore{}, err
+			}
+			// Copy the data because the upload will append to it.
+			r.newUpload(repoName, repo, su.ID, slices.Clone(data), now)
+		}
+		repos[repoName] = repo
+	}
+	return repos, store, nil
+}
+
+// manifestSubject returns the subject of the given manifest, if any.
+func manifestSubject(mediaType string, data []byte) (subject ociregistry.Digest, _ error) {
+	iter, err := manifestReferences(mediaType, data)
+	if err != nil {
+		return "", err
+	}
+	iter(func(info descInfo) bool {
+		if info.kind == kindSubjectManifest {
+			subject = info.desc.Digest
+			return false
+		}
+		return true
+	})
+	return subject, nil
+}
+
+// Clone returns a copy of the registry with the same configuration
+// and content. Changes to either registry don't affect the other.
+//
+// Content is never modified once it's in a registry, so it's shared
+// between the two registries rather than copied: the cost of cloning
+// is proportional to the number of tags, manifests and blobs rather
+// than their size. The content of chunked uploads in progress is copied.
+func (r *Registry) Clone() *Registry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r1 := &Registry{
+		cfg:       r.cfg,
+		store:     r.store.clone(),
+		nextSweep: r.nextSweep,
+		clock:     r.clock,
+	}
+	if r.repos == nil {
+		return r1
+	}
+	r1.repos = make(map[string]*repository, len(r.repos))
+	for repoName, repo := range r.repos {
+		repo1 := &repository{
+			tags:      maps.Clone(repo.tags),
+			manifests: maps.Clone(repo.manifests),
+			blobs:     maps.Clone(repo.blobs),
+			uploads:   make(map[string]*upload, len(repo.uploads)),
+		}
+		for id, u := range repo.uploads {
+			r1.newUpload(repoName, repo1, id, u.buf.content(), u.lastUsed)
+		}
+		r1.repos[repoName] = repo1
+	}
+	return r1
+}
+
+func blobPath(dig ociregistry.Digest) string {
+	return path.Join(snapshotBlobsDir, string(dig.Algorithm()), dig.Encoded())
+}
+
+// snapshotTime holds the modification time of all files in a snapshot,
+// so that snapshots don't depend on when they were made.
+var snapshotTime = time.Unix(0, 0)
+
+func writeTarFile(tw *tar.Writer, name string, data []byte) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0o644,
+		Size:     int64(len(data)),
+		ModTime:  snapshotTime,
+		Format:   tar.FormatPAX,
+	}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
@@ -0,0 +1,233 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocimem
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocitest"
+)
+
+var snapshotTestContent = ocitest.RegistryContent{
+	"foo": {
+		Blobs: map[string]string{
+			"config": "{}",
+			"layer":  "some layer",
+		},
+		Manifests: map[string]ociregistry.Manifest{
+			"image": {
+				Config: ociregistry.Descriptor{Digest: "config"},
+				Layers: []ociregistry.Descriptor{{Digest: "layer"}},
+			},
+			"sig": {
+				ArtifactType: "application/x-sig",
+				Config:       ociregistry.Descriptor{Digest: "config"},
+				Subject:      &ociregistry.Descriptor{Digest: "image"},
+			},
+		},
+		Tags: map[string]string{
+			"latest": "image",
+		},
+	},
+	"bar": {
+		Blobs: map[string]string{
+			"layer": "some layer",
+		},
+	},
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	ctx := context.Background()
+	r := New()
+	pushed := ocitest.NewRegistry(t, r).MustPushContent(snapshotTestContent)
+	w, err := r.PushBlobChunked(ctx, "bar", 0)
+	qt.Assert(t, qt.IsNil(err))
+	_, err = w.Write([]byte("hello"))
+	qt.Assert(t, qt.IsNil(err))
+
+	var buf bytes.Buffer
+	err = r.Snapshot(&buf, &SnapshotOptions{IncludeUploads: true})
+	qt.Assert(t, qt.IsNil(err))
+	data := buf.Bytes()
+
+	// Snapshots are stable.
+	var buf1 bytes.Buffer
+	err = r.Snapshot(&buf1, &SnapshotOptions{IncludeUploads: true})
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.IsTrue(bytes.Equal(buf1.Bytes(), data)))
+
+	r1 := New()
+	err = r1.Restore(bytes.NewReader(data))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(r1.Stats(), r.Stats()))
+	buf1.Reset()
+	err = r1.Snapshot(&buf1, &SnapshotOptions{IncludeUploads: true})
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.IsTrue(bytes.Equal(buf1.Bytes(), data)))
+
+	image := pushed["foo"].Manifests["image"]
+	desc, err := r1.ResolveTag(ctx, "foo", "latest")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(desc.Digest, image.Digest))
+	referrers, err := ociregistry.All(r1.Referrers(ctx, "foo", image.Digest, ""))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.HasLen(referrers, 1))
+	qt.Check(t, qt.Equals(referrers[0].Digest, pushed["foo"].Manifests["sig"].Digest))
+
+	// The upload can be resumed and completed.
+	w, err = r1.PushBlobChunkedResume(ctx, "bar", w.ID(), 5, 0)
+	qt.Assert(t, qt.IsNil(err))
+	_, err = w.Write([]byte(" world"))
+	qt.Assert(t, qt.IsNil(err))
+	_, err = w.Commit(digest.FromString("hello world"))
+	qt.Assert(t, qt.IsNil(err))
+	_, err = r1.ResolveBlob(ctx, "bar", digest.FromString("hello world"))
+	qt.Check(t, qt.IsNil(err))
+
+	// The original upload is unaffected.
+	uploads := r.Uploads()
+	qt.Assert(t, qt.HasLen(uploads, 1))
+	qt.Check(t, qt.Equals(uploads[0].Size, int64(5)))
+
+	// Without IncludeUploads, uploads are omitted.
+	buf.Reset()
+	err = r.Snapshot(&buf, nil)
+	qt.Assert(t, qt.IsNil(err))
+	r1 = New()
+	err = r1.Restore(&buf)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.HasLen(r1.Uploads(), 0))
+	qt.Check(t, qt.Equals(r1.Stats().Blobs, r.Stats().Blobs))
+}
+
+func TestSnapshotLayout(t *testing.T) {
+	r := New()
+	pushed := ocitest.NewRegistry(t, r).MustPushContent(snapshotTestContent)
+	var buf bytes.Buffer
+	err := r.Snapshot(&buf, nil)
+	qt.Assert(t, qt.IsNil(err))
+
+	files := make(map[string][]byte)
+	var names []string
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		qt.Assert(t, qt.IsNil(err))
+		data, err := io.ReadAll(tr)
+		qt.Assert(t, qt.IsNil(err))
+		files[hdr.Name] = data
+		names = append(names, hdr.Name)
+	}
+	// Content that's in both repositories is stored once:
+	// two manifests and two blobs.
+	qt.Assert(t, qt.HasLen(names, 7))
+	qt.Check(t, qt.DeepEquals(names[:3], []string{"oci-layout", "index.json", "ocimem.json"}))
+	for _, name := range names[3:] {
+		qt.Check(t, qt.IsTrue(strings.HasPrefix(name, "blobs/sha256/")))
+	}
+	qt.Check(t, qt.JSONEquals(files["oci-layout"], ocispec.ImageLayout{Version: "1.0.0"}))
+
+	var index ocispec.Index
+	err = json.Unmarshal(files["index.json"], &index)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.HasLen(index.Manifests, 1))
+	qt.Check(t, qt.Equals(index.Manifests[0].Digest, pushed["foo"].Manifests["image"].Digest))
+	qt.Check(t, qt.DeepEquals(index.Manifests[0].Annotations, map[string]string{
+		"dev.cuelabs.ocimem.repository": "foo",
+		ocispec.AnnotationRefName:       "latest",
+	}))
+}
+
+func TestRestoreInvalid(t *testing.T) {
+	r := New()
+	ocitest.NewRegistry(t, r).MustPushContent(snapshotTestContent)
+	var buf bytes.Buffer
+	err := r.Snapshot(&buf, nil)
+	qt.Assert(t, qt.IsNil(err))
+	stats := r.Stats()
+
+	// Corrupt the content of the last blob.
+	data := bytes.Clone(buf.Bytes())
+	i := bytes.LastIndex(data, []byte("some layer"))
+	qt.Assert(t, qt.Not(qt.Equals(i, -1)))
+	data[i] = 'S'
+	err = r.Restore(bytes.NewReader(data))
+	qt.Check(t, qt.ErrorMatches(err, `invalid snapshot: content of blob file "blobs/sha256/.*" does not match its digest`))
+
+	err = r.Restore(strings.NewReader(""))
+	qt.Check(t, qt.ErrorMatches(err, `invalid snapshot: no ocimem.json file found`))
+
+	// The registry is unchanged.
+	qt.Check(t, qt.Equals(r.Stats(), stats))
+}
+
+func TestClone(t *testing.T) {
+	ctx := context.Background()
+	r := New()
+	pushed := ocitest.NewRegistry(t, r).MustPushContent(snapshotTestContent)
+	w, err := r.PushBlobChunked(ctx, "bar", 0)
+	qt.Assert(t, qt.IsNil(err))
+	_, err = w.Write([]byte("hello"))
+	qt.Assert(t, qt.IsNil(err))
+
+	r1 := r.Clone()
+	qt.Check(t, qt.Equals(r1.Stats(), r.Stats()))
+
+	// Changes to the clone don't affect the original.
+	_, err = r1.PushManifest(ctx, "foo", "other", pushed["foo"].ManifestData["image"], ocispec.MediaTypeImageManifest)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.IsNil(r1.DeleteRepository(ctx, "bar")))
+	_, err = r.ResolveTag(ctx, "foo", "other")
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrManifestUnknown))
+	_, err = r.ResolveBlob(ctx, "bar", pushed["bar"].Blobs["layer"].Digest)
+	qt.Check(t, qt.IsNil(err))
+
+	// Changes to the original don't affect the clone.
+	qt.Assert(t, qt.IsNil(r.DeleteTag(ctx, "foo", "latest")))
+	_, err = r1.ResolveTag(ctx, "foo", "latest")
+	qt.Check(t, qt.IsNil(err))
+
+	// Uploads are copied.
+	r2 := r.Clone()
+	_, err = w.Write([]byte(" world"))
+	qt.Assert(t, qt.IsNil(err))
+	uploads := r2.Uploads()
+	qt.Assert(t, qt.HasLen(uploads, 1))
+	qt.Check(t, qt.Equals(uploads[0].Size, int64(5)))
+	w2, err := r2.PushBlobChunkedResume(ctx, "bar", w.ID(), 5, 0)
+	qt.Assert(t, qt.IsNil(err))
+	_, err = w2.Write([]byte(" there"))
+	qt.Assert(t, qt.IsNil(err))
+	_, err = w2.Commit(digest.FromString("hello there"))
+	qt.Assert(t, qt.IsNil(err))
+	_, err = r2.ResolveBlob(ctx, "bar", digest.FromString("hello there"))
+	qt.Check(t, qt.IsNil(err))
+	_, err = r.ResolveBlob(ctx, "bar", digest.FromString("hello there"))
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrBlobUnknown))
+}
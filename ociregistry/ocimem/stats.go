@@ -0,0 +1,134 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocimem
+
+import (
+	"sort"
+	"time"
+)
+
+// Stats holds statistics about the content of a [Registry].
+type Stats struct {
+	// Repos holds the number of repositories.
+	Repos int
+
+	// Tags, Manifests and Blobs hold the total
+	// number of each in all repositories.
+	Tags      int
+	Manifests int
+	Blobs     int
+
+	// Bytes holds the total size of all the manifests
+	// and blobs. Content that's present in several
+	// repositories is counted once for each.
+	Bytes int64
+
+	// Content holds the number of distinct manifests and blobs
+	// and ContentBytes holds their total size. Content that's
+	// present in several repositories is stored once,
+	// so this reflects the memory used by the registry.
+	Content      int
+	ContentBytes int64
+
+	// MaxBytes holds the limit on ContentBytes
+	// from [Config.MaxBytes], or zero if there is none.
+	MaxBytes int64
+
+	// Evictions holds the number of manifests and blobs
+	// that have been evicted to keep the registry within
+	// MaxBytes, and EvictedBytes holds their total size.
+	Evictions    int
+	EvictedBytes int64
+
+	// Uploads holds the number of chunked uploads
+	// in progress, and UploadBytes holds the total
+	// amount of data written to them so far.
+	Uploads     int
+	UploadBytes int64
+}
+
+// Stats returns statistics about the current content of the registry.
+func (r *Registry) Stats() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var s Stats
+	s.Content = len(r.store.items)
+	s.ContentBytes = r.store.size
+	s.MaxBytes = max(r.cfg.MaxBytes, 0)
+	s.Evictions = r.evictions
+	s.EvictedBytes = r.evictedBytes
+	for _, repo := range r.repos {
+		s.Repos++
+		s.Tags += len(repo.tags)
+		s.Manifests += len(repo.manifests)
+		s.Blobs += len(repo.blobs)
+		for _, b := range repo.manifests {
+			s.Bytes += int64(len(b.data))
+		}
+		for _, b := range repo.blobs {
+			s.Bytes += int64(len(b.data))
+		}
+		s.Uploads += len(repo.uploads)
+		for _, u := range repo.uploads {
+			s.UploadBytes += u.buf.Size()
+		}
+	}
+	return s
+}
+
+// UploadInfo holds information about a chunked upload in progress.
+type UploadInfo struct {
+	Repo string
+	ID   string
+
+	// Size holds the amount of data written so far.
+	Size int64
+
+	// LastUsed holds when the upload was last
+	// started or resumed.
+	LastUsed time.Time
+}
+
+// Uploads returns information about all the chunked uploads in
+// progress, ordered by repository and then ID. Expired uploads
+// that haven't yet been removed are not included.
+func (r *Registry) Uploads() []UploadInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	timeout := r.uploadTimeout()
+	var uploads []UploadInfo
+	for repoName, repo := range r.repos {
+		for id, u := range repo.uploads {
+			if timeout >= 0 && now.Sub(u.lastUsed) >= timeout {
+				continue
+			}
+			uploads = append(uploads, UploadInfo{
+				Repo:     repoName,
+				ID:       id,
+				Size:     u.buf.Size(),
+				LastUsed: u.lastUsed,
+			})
+		}
+	}
+	sort.Slice(uploads, func(i, j int) bool {
+		u1, u2 := uploads[i], uploads[j]
+		if u1.Repo != u2.Repo {
+			return u1.Repo < u2.Repo
+		}
+		return u1.ID < u2.ID
+	})
+	return uploads
+}
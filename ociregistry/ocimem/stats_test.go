@@ -0,0 +1,174 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocimem
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocitest"
+)
+
+var statsTestContent = ocitest.RegistryContent{
+	"foo": {
+		Blobs: map[string]string{
+			"config":  "{}",
+			"layer":   "some layer",
+			"unused":  "unused blob",
+			"dconfig": "{ }",
+		},
+		Manifests: map[string]ociregistry.Manifest{
+			"image": {
+				Config: ociregistry.Descriptor{Digest: "config"},
+				Layers: []ociregistry.Descriptor{{Digest: "layer"}},
+			},
+			"docker": {
+				MediaType: "application/vnd.docker.distribution.manifest.v2+json",
+				Config:    ociregistry.Descriptor{Digest: "dconfig"},
+			},
+		},
+		Tags: map[string]string{
+			"latest": "image",
+		},
+	},
+	"bar": {
+		Blobs: map[string]string{
+			"b": "other",
+		},
+	},
+}
+
+func TestStats(t *testing.T) {
+	ctx := context.Background()
+	r := New()
+	ocitest.NewRegistry(t, r).MustPushContent(statsTestContent)
+	w, err := r.PushBlobChunked(ctx, "bar", 0)
+	qt.Assert(t, qt.IsNil(err))
+	_, err = w.Write([]byte("hello"))
+	qt.Assert(t, qt.IsNil(err))
+
+	stats := r.Stats()
+	qt.Check(t, qt.Equals(stats.Repos, 2))
+	qt.Check(t, qt.Equals(stats.Tags, 1))
+	qt.Check(t, qt.Equals(stats.Manifests, 2))
+	qt.Check(t, qt.Equals(stats.Blobs, 5))
+	qt.Check(t, qt.Equals(stats.Uploads, 1))
+	qt.Check(t, qt.Equals(stats.UploadBytes, int64(5)))
+	wantBytes := int64(len("{}") + len("some layer") + len("unused blob") + len("{ }") + len("other"))
+	for _, m := range r.repos["foo"].manifests {
+		wantBytes += int64(len(m.data))
+	}
+	qt.Check(t, qt.Equals(stats.Bytes, wantBytes))
+	// No content is shared between repositories.
+	qt.Check(t, qt.Equals(stats.Content, 7))
+	qt.Check(t, qt.Equals(stats.ContentBytes, wantBytes))
+
+	uploads := r.Uploads()
+	qt.Assert(t, qt.HasLen(uploads, 1))
+	qt.Check(t, qt.Equals(uploads[0].Repo, "bar"))
+	qt.Check(t, qt.Equals(uploads[0].ID, w.ID()))
+	qt.Check(t, qt.Equals(uploads[0].Size, int64(5)))
+}
+
+func TestGC(t *testing.T) {
+	ctx := context.Background()
+	r := New()
+	pushed := ocitest.NewRegistry(t, r).MustPushContent(statsTestContent)
+
+	stats := r.GC(0)
+	qt.Check(t, qt.Equals(stats, GCStats{
+		Blobs: 2,
+		Bytes: int64(len("unused blob") + len("other")),
+	}))
+	_, err := r.ResolveBlob(ctx, "foo", pushed["foo"].Blobs["unused"].Digest)
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrBlobUnknown))
+	_, err = r.ResolveBlob(ctx, "bar", pushed["bar"].Blobs["b"].Digest)
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrBlobUnknown))
+
+	// Blobs referred to by manifests remain, including
+	// those with media types that aren't understood.
+	for _, id := range []string{"config", "layer", "dconfig"} {
+		_, err := r.ResolveBlob(ctx, "foo", pushed["foo"].Blobs[id].Digest)
+		qt.Check(t, qt.IsNil(err), qt.Commentf("blob %s", id))
+	}
+	qt.Check(t, qt.Equals(r.GC(0), GCStats{}))
+}
+
+func TestGCMinAge(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := New()
+	r.clock = func() time.Time {
+		return now
+	}
+	config, layer, manifest := testImage(t)
+	reg := ocitest.NewRegistry(t, r)
+	reg.MustPushBlob("foo", []byte("{}"))
+	reg.MustPushBlob("foo", []byte("some layer"))
+	unused := reg.MustPushBlob("foo", []byte("unused"))
+
+	// Collecting garbage between pushing the blobs and
+	// pushing the manifest that refers to them leaves
+	// recently added blobs in place.
+	now = now.Add(30 * time.Second)
+	qt.Check(t, qt.Equals(r.GC(time.Minute), GCStats{}))
+	_, err := r.PushManifest(ctx, "foo", "latest", manifest, ocispec.MediaTypeImageManifest)
+	qt.Assert(t, qt.IsNil(err))
+	for _, desc := range []ociregistry.Descriptor{config, layer, unused} {
+		_, err := r.ResolveBlob(ctx, "foo", desc.Digest)
+		qt.Check(t, qt.IsNil(err))
+	}
+
+	// Pushing a blob again makes it recent again.
+	now = now.Add(time.Minute)
+	reg.MustPushBlob("foo", []byte("unused"))
+	qt.Check(t, qt.Equals(r.GC(time.Minute), GCStats{}))
+	now = now.Add(time.Minute)
+	qt.Check(t, qt.Equals(r.GC(time.Minute), GCStats{Blobs: 1, Bytes: unused.Size}))
+	_, err = r.ResolveBlob(ctx, "foo", unused.Digest)
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrBlobUnknown))
+}
+
+// testImage returns the descriptors of the config and layer blobs of a
+// small image, with content "{}" and "some layer", and the data of
+// an image manifest that refers to them.
+func testImage(t *testing.T) (config, layer ociregistry.Descriptor, manifest []byte) {
+	config = testBlobDesc("{}")
+	layer = testBlobDesc("some layer")
+	manifest, err := json.Marshal(ociregistry.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ociregistry.Descriptor{layer},
+	})
+	qt.Assert(t, qt.IsNil(err))
+	return config, layer, manifest
+}
+
+func testBlobDesc(content string) ociregistry.Descriptor {
+	return ociregistry.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    digest.FromString(content),
+		Size:      int64(len(content)),
+	}
+}
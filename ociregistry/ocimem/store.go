@@ -0,0 +1,129 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocimem
+
+import (
+	"cuelabs.dev/go/oci/ociregistry"
+)
+
+// contentStore holds the content of all the manifests and blobs
+// in a registry, indexed by digest, so that content that's present
+// in several repositories is only stored once.
+//
+// Each repository holds its own *blob values, because the media
+// type can vary between repositories, but the data in each refers
+// to the data in the store. All additions and removals of blobs and
+// manifests in a repository must go through the add and remove
+// methods so that the reference counts are kept up to date.
+type contentStore struct {
+	items map[ociregistry.Digest]*storedContent
+
+	// size holds the total size of all the items.
+	size int64
+
+	// uses is incremented every time an item is used.
+	uses uint64
+}
+
+type storedContent struct {
+	data []byte
+
+	// refs holds the number of repository blob and manifest
+	// entries that refer to the content.
+	refs int
+
+	// lastUsed holds the value of contentStore.uses
+	// when the content was last added or read.
+	lastUsed uint64
+}
+
+// add adds b to m, which holds the blobs or manifests
+// of a repository, with the given digest. The data in b is
+// replaced with the data in the store if it's already there.
+func (s *contentStore) add(m map[ociregistry.Digest]*blob, dig ociregistry.Digest, b *blob) {
+	if old := m[dig]; old != nil {
+		// The repository already refers to the content.
+		b.data = old.data
+		m[dig] = b
+		s.touch(dig)
+		return
+	}
+	if s.items == nil {
+		s.items = make(map[ociregistry.Digest]*storedContent)
+	}
+	c := s.items[dig]
+	if c == nil {
+		c = &storedContent{
+			data: b.data,
+		}
+		s.items[dig] = c
+		s.size += int64(len(c.data))
+	}
+	c.refs++
+	b.data = c.data
+	m[dig] = b
+	s.touch(dig)
+}
+
+// touch records that the content with the given digest has been used.
+func (s *contentStore) touch(dig ociregistry.Digest) {
+	if c := s.items[dig]; c != nil {
+		s.uses++
+		c.lastUsed = s.uses
+	}
+}
+
+// remove removes the entry with the given digest from m,
+// which holds the blobs or manifests of a repository,
+// removing the content from the store when nothing else
+// refers to it.
+func (s *contentStore) remove(m map[ociregistry.Digest]*blob, dig ociregistry.Digest) {
+	if m[dig] == nil {
+		return
+	}
+	delete(m, dig)
+	c := s.items[dig]
+	if c == nil {
+		return
+	}
+	if c.refs--; c.refs <= 0 {
+		delete(s.items, dig)
+		s.size -= int64(len(c.data))
+	}
+}
+
+// removeRepo removes all the content in repo from the store.
+func (s *contentStore) removeRepo(repo *repository) {
+	for dig := range repo.manifests {
+		s.remove(repo.manifests, dig)
+	}
+	for dig := range repo.blobs {
+		s.remove(repo.blobs, dig)
+	}
+}
+
+// clone returns a copy of s. The content itself is shared.
+func (s *contentStore) clone() contentStore {
+	s1 := *s
+	if s.items == nil {
+		return s1
+	}
+	s1.items = make(map[ociregistry.Digest]*storedContent, len(s.items))
+	for dig, c := range s.items {
+		c1 := *c
+		s1.items[dig] = &c1
+	}
+	return s1
+}
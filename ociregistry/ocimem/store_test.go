@@ -0,0 +1,112 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocimem
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocitest"
+)
+
+func TestContentIsShared(t *testing.T) {
+	ctx := context.Background()
+	r := New()
+	data := []byte("some layer")
+	desc := ociregistry.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	for _, repo := range []string{"a", "b"} {
+		_, err := r.PushBlob(ctx, repo, desc, bytes.NewReader(data))
+		qt.Assert(t, qt.IsNil(err))
+	}
+	w, err := r.PushBlobChunked(ctx, "c", 0)
+	qt.Assert(t, qt.IsNil(err))
+	_, err = w.Write(data)
+	qt.Assert(t, qt.IsNil(err))
+	_, err = w.Commit(desc.Digest)
+	qt.Assert(t, qt.IsNil(err))
+
+	stats := r.Stats()
+	qt.Check(t, qt.Equals(stats.Blobs, 3))
+	qt.Check(t, qt.Equals(stats.Bytes, 3*desc.Size))
+	qt.Check(t, qt.Equals(stats.Content, 1))
+	qt.Check(t, qt.Equals(stats.ContentBytes, desc.Size))
+	stored := &r.store.items[desc.Digest].data[0]
+	for _, repo := range []string{"a", "b", "c"} {
+		qt.Check(t, qt.Equals(&r.repos[repo].blobs[desc.Digest].data[0], stored), qt.Commentf("repo %s", repo))
+	}
+
+	// The content remains until nothing refers to it.
+	qt.Assert(t, qt.IsNil(r.DeleteBlob(ctx, "a", desc.Digest)))
+	qt.Assert(t, qt.IsNil(r.DeleteRepository(ctx, "b")))
+	qt.Check(t, qt.Equals(r.Stats().Content, 1))
+	qt.Check(t, qt.Equals(r.GC(0), GCStats{Blobs: 1, Bytes: desc.Size}))
+	qt.Check(t, qt.Equals(r.Stats().Content, 0))
+	qt.Check(t, qt.HasLen(r.store.items, 0))
+}
+
+func TestContentRefCounts(t *testing.T) {
+	ctx := context.Background()
+	r := New()
+	pushed := ocitest.NewRegistry(t, r).MustPushContent(snapshotTestContent)
+	wantContent := r.Stats().Content
+
+	// Pushing content that's already present doesn't change anything.
+	ocitest.NewRegistry(t, r).MustPushContent(snapshotTestContent)
+	qt.Check(t, qt.Equals(r.Stats().Content, wantContent))
+	layer := pushed["foo"].Blobs["layer"].Digest
+	qt.Check(t, qt.Equals(r.store.items[layer].refs, 2))
+
+	// Mounting adds a reference.
+	_, err := r.MountBlob(ctx, "foo", "baz", layer)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(r.store.items[layer].refs, 3))
+
+	// Clones have their own reference counts.
+	r1 := r.Clone()
+	qt.Assert(t, qt.IsNil(r1.DeleteRepository(ctx, "baz")))
+	qt.Check(t, qt.Equals(r1.store.items[layer].refs, 2))
+	qt.Check(t, qt.Equals(r.store.items[layer].refs, 3))
+
+	// So do restored registries.
+	var buf bytes.Buffer
+	qt.Assert(t, qt.IsNil(r.Snapshot(&buf, nil)))
+	r2 := New()
+	qt.Assert(t, qt.IsNil(r2.Restore(&buf)))
+	qt.Check(t, qt.Equals(r2.store.items[layer].refs, 3))
+	qt.Check(t, qt.Equals(r2.Stats().Content, wantContent))
+}
+
+func TestUploadToDeletedRepositoryAddsNoContent(t *testing.T) {
+	ctx := context.Background()
+	r := New()
+	w, err := r.PushBlobChunked(ctx, "foo", 0)
+	qt.Assert(t, qt.IsNil(err))
+	_, err = w.Write([]byte("hello"))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.IsNil(r.DeleteRepository(ctx, "foo")))
+	_, err = w.Commit(digest.FromString("hello"))
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrNameUnknown))
+	// The failed commit must not leave its data in the store.
+	qt.Check(t, qt.HasLen(r.store.items, 0))
+}
@@ -0,0 +1,165 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocimem
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+
+	"cuelabs.dev/go/oci/ociregistry"
+)
+
+func TestUploadExpiry(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := NewWithConfig(&Config{
+		UploadTimeout: time.Minute,
+	})
+	r.clock = func() time.Time {
+		return now
+	}
+	w1, err := r.PushBlobChunked(ctx, "foo", 0)
+	qt.Assert(t, qt.IsNil(err))
+	w2, err := r.PushBlobChunked(ctx, "foo", 0)
+	qt.Assert(t, qt.IsNil(err))
+
+	// Resuming an upload keeps it alive.
+	now = now.Add(50 * time.Second)
+	_, err = r.PushBlobChunkedResume(ctx, "foo", w2.ID(), -1, 0)
+	qt.Assert(t, qt.IsNil(err))
+
+	now = now.Add(20 * time.Second)
+	_, err = r.PushBlobChunkedResume(ctx, "foo", w1.ID(), -1, 0)
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrBlobUploadUnknown))
+	_, err = r.PushBlobChunkedResume(ctx, "foo", w2.ID(), -1, 0)
+	qt.Check(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(numUploads(r, "foo"), 1))
+
+	now = now.Add(time.Minute)
+	_, err = r.PushBlobChunkedResume(ctx, "foo", w2.ID(), -1, 0)
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrBlobUploadUnknown))
+	qt.Check(t, qt.Equals(numUploads(r, "foo"), 0))
+}
+
+func TestUploadWriteKeepsAlive(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := NewWithConfig(&Config{
+		UploadTimeout: time.Minute,
+	})
+	r.clock = func() time.Time {
+		return now
+	}
+	w, err := r.PushBlobChunked(ctx, "foo", 0)
+	qt.Assert(t, qt.IsNil(err))
+
+	// A long-running upload that keeps writing
+	// shouldn't expire.
+	for range 3 {
+		now = now.Add(50 * time.Second)
+		_, err = w.Write([]byte("x"))
+		qt.Assert(t, qt.IsNil(err))
+	}
+	now = now.Add(50 * time.Second)
+	_, err = r.PushBlobChunkedResume(ctx, "foo", w.ID(), -1, 0)
+	qt.Check(t, qt.IsNil(err))
+}
+
+func TestUploadNoExpiry(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := NewWithConfig(&Config{
+		UploadTimeout: -1,
+	})
+	r.clock = func() time.Time {
+		return now
+	}
+	w, err := r.PushBlobChunked(ctx, "foo", 0)
+	qt.Assert(t, qt.IsNil(err))
+	now = now.Add(1000 * time.Hour)
+	_, err = r.PushBlobChunkedResume(ctx, "foo", w.ID(), -1, 0)
+	qt.Check(t, qt.IsNil(err))
+}
+
+func TestMaxUploadsPerRepo(t *testing.T) {
+	ctx := context.Background()
+	r := NewWithConfig(&Config{
+		MaxUploadsPerRepo: 2,
+	})
+	w1, err := r.PushBlobChunked(ctx, "foo", 0)
+	qt.Assert(t, qt.IsNil(err))
+	_, err = r.PushBlobChunked(ctx, "foo", 0)
+	qt.Assert(t, qt.IsNil(err))
+	_, err = r.PushBlobChunked(ctx, "foo", 0)
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrTooManyRequests))
+
+	// The limit is per repository.
+	_, err = r.PushBlobChunked(ctx, "bar", 0)
+	qt.Check(t, qt.IsNil(err))
+
+	// Canceling an upload makes room for another.
+	qt.Assert(t, qt.IsNil(w1.Cancel()))
+	_, err = r.PushBlobChunked(ctx, "foo", 0)
+	qt.Check(t, qt.IsNil(err))
+}
+
+func TestUploadRemovedWhenDone(t *testing.T) {
+	ctx := context.Background()
+	r := New()
+	w, err := r.PushBlobChunked(ctx, "foo", 0)
+	qt.Assert(t, qt.IsNil(err))
+	_, err = w.Write([]byte("hello"))
+	qt.Assert(t, qt.IsNil(err))
+	_, err = w.Commit(digest.FromString("hello"))
+	qt.Assert(t, qt.IsNil(err))
+	// Cancel after commit is a no-op.
+	qt.Assert(t, qt.IsNil(w.Cancel()))
+	_, err = r.PushBlobChunkedResume(ctx, "foo", w.ID(), -1, 0)
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrBlobUploadUnknown))
+	_, err = r.ResolveBlob(ctx, "foo", digest.FromString("hello"))
+	qt.Check(t, qt.IsNil(err))
+
+	w, err = r.PushBlobChunked(ctx, "foo", 0)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.IsNil(w.Cancel()))
+	_, err = r.PushBlobChunkedResume(ctx, "foo", w.ID(), -1, 0)
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrBlobUploadUnknown))
+	qt.Check(t, qt.Equals(numUploads(r, "foo"), 0))
+}
+
+func TestPushBlobChunkedResumeUnknownID(t *testing.T) {
+	ctx := context.Background()
+	r := New()
+	_, err := r.PushBlobChunkedResume(ctx, "foo", "myid", 0, 0)
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrNameUnknown))
+	w, err := r.PushBlobChunked(ctx, "foo", 0)
+	qt.Assert(t, qt.IsNil(err))
+	_, err = r.PushBlobChunkedResume(ctx, "foo", "myid", 0, 0)
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrBlobUploadUnknown))
+	w1, err := r.PushBlobChunkedResume(ctx, "foo", w.ID(), 0, 0)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(w1.ID(), w.ID()))
+	qt.Check(t, qt.Equals(numUploads(r, "foo"), 1))
+}
+
+func numUploads(r *Registry, repo string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.repos[repo].uploads)
+}
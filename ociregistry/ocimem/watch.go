@@ -0,0 +1,85 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocimem
+
+import (
+	"context"
+	"iter"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ociwatch"
+)
+
+var _ ociwatch.Watcher = (*Registry)(nil)
+
+// Cursor returns the cursor of the most recent change
+// to the registry.
+func (r *Registry) Cursor() ociwatch.Cursor {
+	r.mu.Lock()
+	events := r.eventLog()
+	r.mu.Unlock()
+	return events.Cursor()
+}
+
+// Watch returns a sequence of the changes made to the registry after
+// the event with the given cursor, as described in [ociwatch.Log.Watch].
+//
+// Unlike [ociwatch.New], the registry records only changes that
+// actually happen: pushing content that's already in a repository
+// or a tag that's unchanged is not recorded. Content that's removed
+// by [Registry.GC] or evicted because of [Config.MaxBytes] is recorded
+// as deleted, and [Registry.Restore] is recorded as a reset. The
+// expiry of uploads is not recorded.
+//
+// A registry returned by [Registry.Clone] has its own events,
+// so cursors can't be used across clones.
+func (r *Registry) Watch(ctx context.Context, after ociwatch.Cursor) iter.Seq2[ociwatch.Event, error] {
+	r.mu.Lock()
+	events := r.eventLog()
+	r.mu.Unlock()
+	return events.Watch(ctx, after)
+}
+
+// eventLog returns the log of changes to the registry,
+// creating it if necessary so that the zero Registry
+// is usable. It must be called with r.mu held.
+func (r *Registry) eventLog() *ociwatch.Log {
+	if r.events == nil {
+		r.events = ociwatch.NewLog(r.cfg.MaxEvents)
+	}
+	return r.events
+}
+
+// notify records a change to the registry.
+// It must be called with r.mu held so that
+// the events are in the same order as the changes.
+func (r *Registry) notify(kind ociwatch.Kind, repoName, tag string, desc ociregistry.Descriptor) {
+	r.eventLog().Add(ociwatch.Event{
+		Kind: kind,
+		Repo: repoName,
+		Tag:  tag,
+		Desc: desc,
+	})
+}
+
+// contentDesc returns the descriptor for b, which has the given digest.
+// Unlike b.descriptor, it doesn't need to compute the digest.
+func contentDesc(dig ociregistry.Digest, b *blob) ociregistry.Descriptor {
+	return ociregistry.Descriptor{
+		MediaType: b.mediaType,
+		Digest:    dig,
+		Size:      int64(len(b.data)),
+	}
+}
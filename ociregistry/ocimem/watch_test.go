@@ -0,0 +1,144 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocimem
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-quicktest/qt"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocitest"
+	"cuelabs.dev/go/oci/ociregistry/ociwatch"
+)
+
+func TestWatch(t *testing.T) {
+	ctx := context.Background()
+	r := New()
+	config, layer, manifest := testImage(t)
+	reg := ocitest.NewRegistry(t, r)
+	reg.MustPushBlob("foo", []byte("{}"))
+	reg.MustPushBlob("foo", []byte("some layer"))
+	reg.MustPushBlob("foo", []byte("unused"))
+	image, err := r.PushManifest(ctx, "foo", "latest", manifest, ocispec.MediaTypeImageManifest)
+	qt.Assert(t, qt.IsNil(err))
+
+	// Pushing the same content again changes nothing.
+	cursor := r.Cursor()
+	reg.MustPushBlob("foo", []byte("{}"))
+	_, err = r.PushManifest(ctx, "foo", "latest", manifest, ocispec.MediaTypeImageManifest)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(r.Cursor(), cursor))
+
+	_, err = r.PushManifest(ctx, "foo", "other", manifest, ocispec.MediaTypeImageManifest)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.IsNil(r.DeleteTag(ctx, "foo", "latest")))
+	qt.Check(t, qt.Equals(r.GC(0), GCStats{Blobs: 1, Bytes: 6}))
+	qt.Assert(t, qt.IsNil(r.DeleteTag(ctx, "foo", "other")))
+	qt.Assert(t, qt.IsNil(r.DeleteManifest(ctx, "foo", image.Digest)))
+	qt.Assert(t, qt.IsNil(r.DeleteBlob(ctx, "foo", layer.Digest)))
+	qt.Assert(t, qt.IsNil(r.DeleteRepository(ctx, "foo")))
+
+	events := ocitest.MustWatch(t, r, 0, 12)
+	qt.Check(t, qt.DeepEquals(events, []ociwatch.Event{
+		{Cursor: 1, Kind: ociwatch.BlobAdded, Repo: "foo", Desc: config},
+		{Cursor: 2, Kind: ociwatch.BlobAdded, Repo: "foo", Desc: layer},
+		{Cursor: 3, Kind: ociwatch.BlobAdded, Repo: "foo", Desc: testBlobDesc("unused")},
+		{Cursor: 4, Kind: ociwatch.ManifestAdded, Repo: "foo", Desc: image},
+		{Cursor: 5, Kind: ociwatch.TagMoved, Repo: "foo", Tag: "latest", Desc: image},
+		{Cursor: 6, Kind: ociwatch.TagMoved, Repo: "foo", Tag: "other", Desc: image},
+		{Cursor: 7, Kind: ociwatch.TagDeleted, Repo: "foo", Tag: "latest"},
+		{Cursor: 8, Kind: ociwatch.BlobDeleted, Repo: "foo", Desc: testBlobDesc("unused")},
+		{Cursor: 9, Kind: ociwatch.TagDeleted, Repo: "foo", Tag: "other"},
+		{Cursor: 10, Kind: ociwatch.ManifestDeleted, Repo: "foo", Desc: image},
+		{Cursor: 11, Kind: ociwatch.BlobDeleted, Repo: "foo", Desc: layer},
+		{Cursor: 12, Kind: ociwatch.RepositoryDeleted, Repo: "foo"},
+	}))
+}
+
+func TestWatchWaitForTag(t *testing.T) {
+	ctx := context.Background()
+	r := New()
+	_, _, manifest := testImage(t)
+	reg := ocitest.NewRegistry(t, r)
+	reg.MustPushBlob("foo", []byte("{}"))
+	reg.MustPushBlob("foo", []byte("some layer"))
+
+	// Find the cursor before checking for the tag so
+	// that no change can be missed.
+	cursor := r.Cursor()
+	_, err := r.ResolveTag(ctx, "foo", "latest")
+	qt.Assert(t, qt.ErrorIs(err, ociregistry.ErrManifestUnknown))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		time.Sleep(10 * time.Millisecond)
+		_, err := r.PushManifest(context.Background(), "foo", "latest", manifest, ocispec.MediaTypeImageManifest)
+		qt.Check(t, qt.IsNil(err))
+	}()
+	defer func() { <-done }()
+	watchCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	for e, err := range r.Watch(watchCtx, cursor) {
+		qt.Assert(t, qt.IsNil(err))
+		if e.Kind == ociwatch.TagMoved && e.Tag == "latest" {
+			break
+		}
+	}
+	_, err = r.ResolveTag(ctx, "foo", "latest")
+	qt.Check(t, qt.IsNil(err))
+}
+
+func TestWatchEvictionRestoreAndClone(t *testing.T) {
+	ctx := context.Background()
+	r := NewWithConfig(&Config{MaxBytes: 20, Evict: true})
+	reg := ocitest.NewRegistry(t, r)
+	a := reg.MustPushBlob("foo", []byte("aaaaaaaaaa"))
+	reg.MustPushBlob("foo", []byte("bbbbbbbbbb"))
+	cursor := r.Cursor()
+	reg.MustPushBlob("foo", []byte("cccccccccc"))
+	events := ocitest.MustWatch(t, r, cursor, 2)
+	qt.Check(t, qt.DeepEquals(events[0], ociwatch.Event{Cursor: 3, Kind: ociwatch.BlobDeleted, Repo: "foo", Desc: a}))
+	qt.Check(t, qt.Equals(events[1].Kind, ociwatch.BlobAdded))
+
+	var buf bytes.Buffer
+	qt.Assert(t, qt.IsNil(r.Snapshot(&buf, nil)))
+	qt.Assert(t, qt.IsNil(r.Restore(&buf)))
+	events = ocitest.MustWatch(t, r, 4, 1)
+	qt.Check(t, qt.DeepEquals(events[0], ociwatch.Event{Cursor: 5, Kind: ociwatch.Reset}))
+
+	// A clone has its own events.
+	r1 := r.Clone()
+	qt.Check(t, qt.Equals(r1.Cursor(), 0))
+	qt.Assert(t, qt.IsNil(r1.DeleteRepository(ctx, "foo")))
+	qt.Check(t, qt.Equals(r1.Cursor(), 1))
+	qt.Check(t, qt.Equals(r.Cursor(), 5))
+}
+
+func TestWatchZeroRegistry(t *testing.T) {
+	// The zero Registry is usable, so it must
+	// record changes without being constructed.
+	var r Registry
+	qt.Check(t, qt.Equals(r.Cursor(), 0))
+	desc := ocitest.NewRegistry(t, &r).MustPushBlob("foo", []byte("hello"))
+	events := ocitest.MustWatch(t, &r, 0, 1)
+	qt.Check(t, qt.DeepEquals(events, []ociwatch.Event{
+		{Cursor: 1, Kind: ociwatch.BlobAdded, Repo: "foo", Desc: desc},
+	}))
+}
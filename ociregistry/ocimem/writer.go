@@ -18,8 +18,10 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"time"
 
 	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ociwatch"
 	"github.com/opencontainers/go-digest"
 )
 
@@ -31,7 +33,7 @@ func (r *Registry) PushBlob(ctx context.Context, repoName string, desc ociregist
 		return ociregistry.Descriptor{}, fmt.Errorf("cannot read content: %v", err)
 	}
 	if err := CheckDescriptor(desc, data); err != nil {
-		return ociregistry.Descriptor{}, fmt.Errorf("invalid descriptor: %v", err)
+		return ociregistry.Descriptor{}, fmt.Errorf("invalid descriptor: %w", err)
 	}
 
 	r.mu.Lock()
@@ -40,40 +42,125 @@ func (r *Registry) PushBlob(ctx context.Context, repoName string, desc ociregist
 	if err != nil {
 		return ociregistry.Descriptor{}, err
 	}
-	repo.blobs[desc.Digest] = &blob{mediaType: desc.MediaType, data: data}
+	if err := r.reserve(desc.Digest, int64(len(data)), nil); err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	r.addBlob(repoName, repo, desc.Digest, &blob{mediaType: desc.MediaType, data: data})
 	return desc, nil
 }
 
 func (r *Registry) PushBlobChunked(ctx context.Context, repoName string, chunkSize int) (ociregistry.BlobWriter, error) {
-	// TODO(mvdan): Why does the ocimem implementation allow a PATCH on an upload ID which doesn't exist?
-	// The tests in ociserver make this assumption, so they break without this bit of code.
-	//
-	// Ideally they should start a new chunked upload to get a new ID, then use that for PATCH/PUT.
-	// Alternatively, add a new method to ocimem outside of the interface to start a chunked upload with a predefined ID.
-	// Either way, this case should be an error, per the spec.
-	return r.PushBlobChunkedResume(ctx, repoName, "", 0, chunkSize)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	repo, err := r.makeRepo(repoName)
+	if err != nil {
+		return nil, err
+	}
+	now := r.now()
+	r.sweepUploads(now)
+	if max := r.cfg.MaxUploadsPerRepo; max > 0 && len(repo.uploads) >= max {
+		return nil, fmt.Errorf("too many uploads in progress in repository %q: %w", repoName, ociregistry.ErrTooManyRequests)
+	}
+	return r.newUpload(repoName, repo, "", nil, now).buf, nil
+}
+
+// newUpload adds a new upload to the given repository, with the given
+// ID and initial content. If id is empty, a random ID is allocated.
+// It must be called with r.mu held.
+func (r *Registry) newUpload(repoName string, repo *repository, id string, content []byte, now time.Time) *upload {
+	b := NewBuffer(func(b *Buffer) error {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.repos[repoName] != repo {
+			return fmt.Errorf("repository %q has been deleted: %w", repoName, ociregistry.ErrNameUnknown)
+		}
+		desc, data, _ := b.GetBlob()
+		if err := r.reserve(desc.Digest, int64(len(data)), nil); err != nil {
+			return err
+		}
+		r.addBlob(repoName, repo, desc.Digest, &blob{mediaType: desc.MediaType, data: data})
+		delete(repo.uploads, b.ID())
+		return nil
+	}, id)
+	b.onCancel = func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(repo.uploads, b.ID())
+	}
+	if content != nil {
+		// Writes can only happen after the upload has been
+		// resumed, which sets the offset to check.
+		b.buf = content
+		b.checkStartOffset = -1
+	}
+	u := &upload{
+		buf:      b,
+		lastUsed: now,
+	}
+	b.onWrite = func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		u.lastUsed = r.now()
+	}
+	repo.uploads[b.ID()] = u
+	return u
 }
 
 func (r *Registry) PushBlobChunkedResume(ctx context.Context, repoName, id string, offset int64, chunkSize int) (ociregistry.BlobWriter, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	repo, err := r.makeRepo(repoName)
+	repo, err := r.repo(repoName)
 	if err != nil {
 		return nil, err
 	}
-	b := repo.uploads[id]
-	if b == nil {
-		b = NewBuffer(func(b *Buffer) error {
-			r.mu.Lock()
-			defer r.mu.Unlock()
-			desc, data, _ := b.GetBlob()
-			repo.blobs[desc.Digest] = &blob{mediaType: desc.MediaType, data: data}
-			return nil
-		}, id)
-		repo.uploads[b.ID()] = b
-	}
-	b.checkStartOffset = offset
-	return b, nil
+	now := r.now()
+	r.sweepUploads(now)
+	u := repo.uploads[id]
+	if u == nil {
+		return nil, ociregistry.ErrBlobUploadUnknown
+	}
+	if timeout := r.uploadTimeout(); timeout >= 0 && now.Sub(u.lastUsed) >= timeout {
+		// It's expired but hasn't been swept yet.
+		delete(repo.uploads, id)
+		return nil, ociregistry.ErrBlobUploadUnknown
+	}
+	u.lastUsed = now
+	u.buf.mu.Lock()
+	defer u.buf.mu.Unlock()
+	u.buf.checkStartOffset = offset
+	return u.buf, nil
+}
+
+// sweepUploads removes any uploads that have expired. To avoid
+// iterating over all the uploads each time, it does nothing if it
+// has run recently. It must be called with r.mu held.
+func (r *Registry) sweepUploads(now time.Time) {
+	timeout := r.uploadTimeout()
+	if timeout < 0 || now.Before(r.nextSweep) {
+		return
+	}
+	for _, repo := range r.repos {
+		for id, u := range repo.uploads {
+			if now.Sub(u.lastUsed) >= timeout {
+				delete(repo.uploads, id)
+			}
+		}
+	}
+	r.nextSweep = now.Add(timeout / sweepsPerTimeout)
+}
+
+func (r *Registry) uploadTimeout() time.Duration {
+	if r.cfg.UploadTimeout == 0 {
+		return DefaultUploadTimeout
+	}
+	return r.cfg.UploadTimeout
+}
+
+func (r *Registry) now() time.Time {
+	if r.clock != nil {
+		return r.clock()
+	}
+	return time.Now()
 }
 
 func (r *Registry) MountBlob(ctx context.Context, fromRepo, toRepo string, dig ociregistry.Digest) (ociregistry.Descriptor, error) {
@@ -87,10 +174,21 @@ func (r *Registry) MountBlob(ctx context.Context, fromRepo, toRepo string, dig o
 	if err != nil {
 		return ociregistry.Descriptor{}, err
 	}
-	rto.blobs[dig] = b
+	r.addBlob(toRepo, rto, dig, &blob{mediaType: b.mediaType, data: b.data})
 	return b.descriptor(), nil
 }
 
+// addBlob adds b to the blobs in repo, recording
+// the change if the blob wasn't already there.
+func (r *Registry) addBlob(repoName string, repo *repository, dig ociregistry.Digest, b *blob) {
+	b.added = r.now()
+	added := repo.blobs[dig] == nil
+	r.store.add(repo.blobs, dig, b)
+	if added {
+		r.notify(ociwatch.BlobAdded, repoName, "", contentDesc(dig, b))
+	}
+}
+
 var errCannotOverwriteTag = fmt.Errorf("%w: cannot overwrite tag", ociregistry.ErrDenied)
 
 func (r *Registry) PushManifest(ctx context.Context, repoName string, tag string, data []byte, mediaType string) (ociregistry.Descriptor, error) {
@@ -127,20 +225,35 @@ func (r *Registry) PushManifest(ctx context.Context, repoName string, tag string
 	// make a copy of the data to avoid potential corruption.
 	data = append([]byte(nil), data...)
 	if err := CheckDescriptor(desc, data); err != nil {
-		return ociregistry.Descriptor{}, fmt.Errorf("invalid descriptor: %v", err)
+		return ociregistry.Descriptor{}, fmt.Errorf("invalid descriptor: %w", err)
 	}
 	subject, err := r.checkManifest(repoName, desc.MediaType, data)
 	if err != nil {
 		return ociregistry.Descriptor{}, fmt.Errorf("invalid manifest: %v", err)
 	}
-
-	repo.manifests[dig] = &blob{
+	if r.cfg.MaxBytes > 0 {
+		// Don't evict anything that the new manifest refers to.
+		keep := make(map[ociregistry.Digest]bool)
+		addManifestReferences(repo, mediaType, data, keep)
+		if err := r.reserve(dig, int64(len(data)), keep); err != nil {
+			return ociregistry.Descriptor{}, err
+		}
+	}
+	added := repo.manifests[dig] == nil
+	r.store.add(repo.manifests, dig, &blob{
 		mediaType: mediaType,
 		data:      data,
 		subject:   subject,
+	})
+	if added {
+		r.notify(ociwatch.ManifestAdded, repoName, "", desc)
 	}
 	if tag != "" {
+		old, ok := repo.tags[tag]
 		repo.tags[tag] = desc
+		if !ok || old.Digest != desc.Digest || old.MediaType != desc.MediaType {
+			r.notify(ociwatch.TagMoved, repoName, tag, desc)
+		}
 	}
 	return desc, nil
 }
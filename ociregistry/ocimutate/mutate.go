@@ -0,0 +1,442 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ocimutate provides support for making simple changes
+// to images in a registry, such as adding a layer or changing
+// the environment, and pushing the results.
+package ocimutate
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/internal/mediatype"
+)
+
+const (
+	annotationDockerReferenceType   = "vnd.docker.reference.type"
+	annotationDockerReferenceDigest = "vnd.docker.reference.digest"
+)
+
+// configFields holds the top level fields of the
+// image configuration that are represented in [ocispec.Image].
+var configFields = []string{
+	"created",
+	"author",
+	"architecture",
+	"os",
+	"os.version",
+	"os.features",
+	"variant",
+	"config",
+	"rootfs",
+	"history",
+}
+
+// imageConfigFields holds the fields of the "config" object
+// in the image configuration that are represented in
+// [ocispec.ImageConfig]. Docker adds others, such as
+// Healthcheck and OnBuild.
+var imageConfigFields = []string{
+	"User",
+	"ExposedPorts",
+	"Env",
+	"Entrypoint",
+	"Cmd",
+	"Volumes",
+	"WorkingDir",
+	"Labels",
+	"StopSignal",
+	"ArgsEscaped",
+}
+
+// Image holds an image that's being modified. Its fields may
+// be changed directly; the methods provide help for common
+// changes.
+type Image struct {
+	// Manifest holds the image manifest.
+	Manifest ocispec.Manifest
+
+	// Config holds the image configuration. Any top level
+	// fields in the original configuration that aren't
+	// represented here are preserved when the image is
+	// pushed.
+	Config ocispec.Image
+
+	// Platform holds the platform from the index entry that
+	// refers to the image when it was found through an index,
+	// as by [Mutate]. It's nil otherwise.
+	Platform *ocispec.Platform
+
+	mediaType string
+	rawConfig map[string]json.RawMessage
+
+	// origManifest and origConfig hold the original content
+	// of the manifest and configuration, so that they can be
+	// pushed unchanged when they haven't been modified.
+	origManifest []byte
+	origConfig   []byte
+
+	// blobs holds the content of layers that have been
+	// added but not yet pushed.
+	blobs map[ociregistry.Digest][]byte
+}
+
+// Load loads the image with the given manifest digest from
+// the given repository in r.
+func Load(ctx context.Context, r ociregistry.Interface, repo string, dig ociregistry.Digest) (*Image, error) {
+	rd, err := r.GetManifest(ctx, repo, dig)
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	data, err := io.ReadAll(rd)
+	if err != nil {
+		return nil, err
+	}
+	return load(ctx, r, repo, rd.Descriptor(), data)
+}
+
+func load(ctx context.Context, r ociregistry.Interface, repo string, desc ociregistry.Descriptor, data []byte) (*Image, error) {
+	if !mediatype.IsManifest(desc.MediaType) {
+		return nil, fmt.Errorf("manifest %s has media type %q which is not an image manifest", desc.Digest, desc.MediaType)
+	}
+	img := &Image{
+		mediaType:    desc.MediaType,
+		origManifest: data,
+	}
+	if err := json.Unmarshal(data, &img.Manifest); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal manifest %s: %v", desc.Digest, err)
+	}
+	rd, err := r.GetBlob(ctx, repo, img.Manifest.Config.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get image configuration: %w", err)
+	}
+	defer rd.Close()
+	configData, err := io.ReadAll(rd)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read image configuration: %w", err)
+	}
+	if err := json.Unmarshal(configData, &img.Config); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal image configuration: %v", err)
+	}
+	if err := json.Unmarshal(configData, &img.rawConfig); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal image configuration: %v", err)
+	}
+	img.origConfig = configData
+	return img, nil
+}
+
+// AppendLayer adds a layer holding the given uncompressed tar
+// archive content to the top of the image. The layer is compressed
+// with gzip, and the image configuration's rootfs.diff_ids field is
+// updated accordingly.
+//
+// The history entry h is added to the configuration unless the
+// configuration has no history for the existing layers, as it
+// wouldn't then correspond to the layers.
+func (img *Image) AppendLayer(tarContent io.Reader, h ocispec.History) error {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	diffDigester := digest.Canonical.Digester()
+	if _, err := io.Copy(zw, io.TeeReader(tarContent, diffDigester.Hash())); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	data := buf.Bytes()
+	mediaType := ocispec.MediaTypeImageLayerGzip
+	if img.mediaType == mediatype.DockerManifest {
+		mediaType = mediatype.DockerLayerGzip
+	}
+	desc := ociregistry.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	if img.blobs == nil {
+		img.blobs = make(map[ociregistry.Digest][]byte)
+	}
+	img.blobs[desc.Digest] = data
+	if len(img.Config.History) > 0 || len(img.Manifest.Layers) == 0 {
+		h.EmptyLayer = false
+		img.Config.History = append(img.Config.History, h)
+	}
+	img.Manifest.Layers = append(img.Manifest.Layers, desc)
+	if img.Config.RootFS.Type == "" {
+		img.Config.RootFS.Type = "layers"
+	}
+	img.Config.RootFS.DiffIDs = append(img.Config.RootFS.DiffIDs, diffDigester.Digest())
+	return nil
+}
+
+// SetEnv sets the environment variable with the given name,
+// replacing any existing value.
+func (img *Image) SetEnv(name, value string) {
+	entry := name + "=" + value
+	for i, e := range img.Config.Config.Env {
+		if n, _, _ := strings.Cut(e, "="); n == name {
+			img.Config.Config.Env[i] = entry
+			return
+		}
+	}
+	img.Config.Config.Env = append(img.Config.Config.Env, entry)
+}
+
+// SetEntrypoint sets the command that's executed
+// when a container is started from the image.
+func (img *Image) SetEntrypoint(entrypoint ...string) {
+	img.Config.Config.Entrypoint = entrypoint
+}
+
+// SetCmd sets the default arguments to the entrypoint.
+func (img *Image) SetCmd(cmd ...string) {
+	img.Config.Config.Cmd = cmd
+}
+
+// SetLabel sets the label with the given name.
+func (img *Image) SetLabel(name, value string) {
+	if img.Config.Config.Labels == nil {
+		img.Config.Config.Labels = make(map[string]string)
+	}
+	img.Config.Config.Labels[name] = value
+}
+
+// SetCreated sets the creation time of the image.
+func (img *Image) SetCreated(t time.Time) {
+	t = t.UTC()
+	img.Config.Created = &t
+}
+
+// Push pushes the image to the given repository in r, tagging it
+// with the given tag if it's non-empty, and returns the
+// descriptor of its manifest.
+//
+// Any added layers are pushed along with the image configuration.
+// The image's other layers must already be present in the
+// repository.
+func (img *Image) Push(ctx context.Context, r ociregistry.Interface, repo string, tag string) (ociregistry.Descriptor, error) {
+	for _, layer := range img.Manifest.Layers {
+		data, ok := img.blobs[layer.Digest]
+		if !ok {
+			continue
+		}
+		if _, err := r.PushBlob(ctx, repo, layer, bytes.NewReader(data)); err != nil {
+			return ociregistry.Descriptor{}, fmt.Errorf("cannot push layer: %w", err)
+		}
+	}
+	configData, err := img.marshalConfig()
+	if err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	img.Manifest.Config.Digest = digest.FromBytes(configData)
+	img.Manifest.Config.Size = int64(len(configData))
+	if _, err := r.PushBlob(ctx, repo, img.Manifest.Config, bytes.NewReader(configData)); err != nil {
+		return ociregistry.Descriptor{}, fmt.Errorf("cannot push image configuration: %w", err)
+	}
+	data, err := img.marshalManifest()
+	if err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	desc, err := r.PushManifest(ctx, repo, tag, data, img.mediaType)
+	if err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	img.blobs = nil
+	return ociregistry.Descriptor{
+		MediaType: img.mediaType,
+		Digest:    desc.Digest,
+		Size:      desc.Size,
+	}, nil
+}
+
+// marshalManifest returns the JSON encoding of img.Manifest,
+// which is the original content if it hasn't changed.
+func (img *Image) marshalManifest() ([]byte, error) {
+	if img.origManifest != nil {
+		var orig ocispec.Manifest
+		if err := json.Unmarshal(img.origManifest, &orig); err == nil && reflect.DeepEqual(orig, img.Manifest) {
+			return img.origManifest, nil
+		}
+	}
+	return json.Marshal(img.Manifest)
+}
+
+// marshalConfig returns the JSON encoding of img.Config
+// including any fields in the original configuration
+// that it doesn't represent, both at the top level and
+// in the "config" object. If the configuration
+// hasn't changed, it returns the original content.
+func (img *Image) marshalConfig() ([]byte, error) {
+	if img.origConfig != nil {
+		var orig ocispec.Image
+		if err := json.Unmarshal(img.origConfig, &orig); err == nil && reflect.DeepEqual(orig, img.Config) {
+			return img.origConfig, nil
+		}
+	}
+	data, err := json.Marshal(img.Config)
+	if err != nil {
+		return nil, err
+	}
+	if len(img.rawConfig) == 0 {
+		return data, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	if rawImageConfig, ok := img.rawConfig["config"]; ok {
+		var raw map[string]json.RawMessage
+		if err := json.Unmarshal(rawImageConfig, &raw); err == nil && raw != nil {
+			var imageFields map[string]json.RawMessage
+			if err := json.Unmarshal(fields["config"], &imageFields); err != nil {
+				return nil, err
+			}
+			imageConfig, err := json.Marshal(mergeFields(raw, imageConfigFields, imageFields))
+			if err != nil {
+				return nil, err
+			}
+			fields["config"] = imageConfig
+		}
+	}
+	return json.Marshal(mergeFields(img.rawConfig, configFields, fields))
+}
+
+// mergeFields returns the fields in raw, without those named
+// in known, overlaid with the fields in fields.
+func mergeFields(raw map[string]json.RawMessage, known []string, fields map[string]json.RawMessage) map[string]json.RawMessage {
+	merged := make(map[string]json.RawMessage)
+	for name, v := range raw {
+		merged[name] = v
+	}
+	for _, name := range known {
+		delete(merged, name)
+	}
+	for name, v := range fields {
+		merged[name] = v
+	}
+	return merged
+}
+
+// Mutate calls f on the image with the given tag in the given
+// repository in r, pushes the result and tags it with newTag, or
+// with the original tag if newTag is empty. It returns the
+// descriptor of the pushed manifest.
+//
+// If the tag refers to an index, such as a multi-platform image,
+// f is called on each image manifest in the index, with the image's
+// Platform field set from its index entry, and a new index
+// referring to the updated images is pushed. Entries in the index
+// that aren't image manifests are left unchanged, as are attestation
+// manifests such as the build provenance added by BuildKit, which
+// have the platform unknown/unknown or the
+// "vnd.docker.reference.type" annotation. An attestation describes
+// the image named by its "vnd.docker.reference.digest" annotation,
+// so it is removed from the index when that image changes.
+// To change only the image for some platform, f can return
+// without making changes to images for other platforms.
+func Mutate(ctx context.Context, r ociregistry.Interface, repo string, tag string, newTag string, f func(img *Image) error) (ociregistry.Descriptor, error) {
+	desc, err := r.ResolveTag(ctx, repo, tag)
+	if err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	if newTag == "" {
+		newTag = tag
+	}
+	return mutate(ctx, r, repo, desc.Digest, nil, newTag, f)
+}
+
+func mutate(ctx context.Context, r ociregistry.Interface, repo string, dig ociregistry.Digest, platform *ocispec.Platform, tag string, f func(img *Image) error) (ociregistry.Descriptor, error) {
+	rd, err := r.GetManifest(ctx, repo, dig)
+	if err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	defer rd.Close()
+	data, err := io.ReadAll(rd)
+	if err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	desc := rd.Descriptor()
+	if !mediatype.IsIndex(desc.MediaType) {
+		img, err := load(ctx, r, repo, desc, data)
+		if err != nil {
+			return ociregistry.Descriptor{}, err
+		}
+		img.Platform = platform
+		if err := f(img); err != nil {
+			return ociregistry.Descriptor{}, err
+		}
+		return img.Push(ctx, r, repo, tag)
+	}
+	var index ocispec.Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		return ociregistry.Descriptor{}, fmt.Errorf("cannot unmarshal index %s: %v", desc.Digest, err)
+	}
+	rewritten := make(map[ociregistry.Digest]bool)
+	for i, m := range index.Manifests {
+		if !mediatype.IsManifest(m.MediaType) || isAttestation(m) {
+			continue
+		}
+		newDesc, err := mutate(ctx, r, repo, m.Digest, m.Platform, "", f)
+		if err != nil {
+			return ociregistry.Descriptor{}, fmt.Errorf("cannot update manifest %s: %w", m.Digest, err)
+		}
+		if newDesc.Digest != m.Digest {
+			index.Manifests[i].Digest = newDesc.Digest
+			index.Manifests[i].Size = newDesc.Size
+			rewritten[m.Digest] = true
+		}
+	}
+	if len(rewritten) > 0 {
+		index.Manifests = slices.DeleteFunc(index.Manifests, func(m ociregistry.Descriptor) bool {
+			return isAttestation(m) && rewritten[ociregistry.Digest(m.Annotations[annotationDockerReferenceDigest])]
+		})
+		data, err = json.Marshal(index)
+		if err != nil {
+			return ociregistry.Descriptor{}, err
+		}
+	}
+	newDesc, err := r.PushManifest(ctx, repo, tag, data, desc.MediaType)
+	if err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	return ociregistry.Descriptor{
+		MediaType: desc.MediaType,
+		Digest:    newDesc.Digest,
+		Size:      newDesc.Size,
+	}, nil
+}
+
+// isAttestation reports whether the index entry with
+// the given descriptor refers to an attestation manifest
+// rather than an image for some platform.
+func isAttestation(desc ociregistry.Descriptor) bool {
+	if _, ok := desc.Annotations[annotationDockerReferenceType]; ok {
+		return true
+	}
+	return desc.Platform != nil && desc.Platform.OS == "unknown" && desc.Platform.Architecture == "unknown"
+}
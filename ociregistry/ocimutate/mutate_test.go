@@ -0,0 +1,332 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocimutate_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+	ocispecroot "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ocimutate"
+	"cuelabs.dev/go/oci/ociregistry/ocitest"
+)
+
+func TestMutate(t *testing.T) {
+	ctx := context.Background()
+	r := ocimem.New()
+	reg := ocitest.NewRegistry(t, r)
+	baseLayer := tarData(t, "etc/os-release", "base")
+	origDesc := pushImage(t, r, "foo", "latest", ocispec.Platform{OS: "linux", Architecture: "amd64"}, baseLayer)
+
+	layer := tarData(t, "etc/ssl/certs/ca.pem", "certificate")
+	created := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	desc, err := ocimutate.Mutate(ctx, r, "foo", "latest", "with-ca", func(img *ocimutate.Image) error {
+		qt.Check(t, qt.IsNil(img.Platform))
+		if err := img.AppendLayer(bytes.NewReader(layer), ocispec.History{
+			CreatedBy: "add CA certificate",
+		}); err != nil {
+			return err
+		}
+		img.SetEnv("PATH", "/bin")
+		img.SetEnv("SSL_CERT_FILE", "/etc/ssl/certs/ca.pem")
+		img.SetEntrypoint("/bin/server")
+		img.SetCmd("--port", "80")
+		img.SetLabel("org.example.ca", "true")
+		img.SetCreated(created)
+		return nil
+	})
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(desc.MediaType, ocispec.MediaTypeImageManifest))
+
+	// The original tag is unchanged.
+	tagDesc, err := r.ResolveTag(ctx, "foo", "latest")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(tagDesc.Digest, origDesc.Digest))
+	tagDesc, err = r.ResolveTag(ctx, "foo", "with-ca")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(tagDesc.Digest, desc.Digest))
+
+	var m ocispec.Manifest
+	reg.MustGetManifest("foo", desc, &m)
+	qt.Assert(t, qt.HasLen(m.Layers, 2))
+	qt.Check(t, qt.Equals(m.Layers[1].MediaType, ocispec.MediaTypeImageLayerGzip))
+	layerData := reg.MustGetBlob("foo", m.Layers[1].Digest)
+	qt.Check(t, qt.Equals(m.Layers[1].Size, int64(len(layerData))))
+	zr, err := gzip.NewReader(bytes.NewReader(layerData))
+	qt.Assert(t, qt.IsNil(err))
+	got, err := io.ReadAll(zr)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.DeepEquals(got, layer))
+
+	var config ocispec.Image
+	qt.Assert(t, qt.IsNil(json.Unmarshal(reg.MustGetBlob("foo", m.Config.Digest), &config)))
+	qt.Check(t, qt.DeepEquals(config.RootFS.DiffIDs, []ociregistry.Digest{
+		digest.FromBytes(baseLayer),
+		digest.FromBytes(layer),
+	}))
+	qt.Check(t, qt.DeepEquals(config.Config.Env, []string{"PATH=/bin", "SSL_CERT_FILE=/etc/ssl/certs/ca.pem"}))
+	qt.Check(t, qt.DeepEquals(config.Config.Entrypoint, []string{"/bin/server"}))
+	qt.Check(t, qt.DeepEquals(config.Config.Cmd, []string{"--port", "80"}))
+	qt.Check(t, qt.DeepEquals(config.Config.Labels, map[string]string{"org.example.ca": "true"}))
+	qt.Check(t, qt.Equals(config.Created.Equal(created), true))
+	qt.Assert(t, qt.HasLen(config.History, 2))
+	qt.Check(t, qt.Equals(config.History[1].CreatedBy, "add CA certificate"))
+
+	// Fields that the image configuration type doesn't know about are preserved.
+	var fields map[string]any
+	qt.Assert(t, qt.IsNil(json.Unmarshal(reg.MustGetBlob("foo", m.Config.Digest), &fields)))
+	qt.Check(t, qt.Equals(fields["docker_version"], any("20.10.0")))
+}
+
+func TestMutatePreservesDockerImageConfigFields(t *testing.T) {
+	ctx := context.Background()
+	r := ocimem.New()
+	reg := ocitest.NewRegistry(t, r)
+	config, err := json.Marshal(map[string]any{
+		"architecture": "amd64",
+		"os":           "linux",
+		"config": map[string]any{
+			"Env": []string{"PATH=/bin"},
+			"Healthcheck": map[string]any{
+				"Test": []string{"CMD", "/bin/check"},
+			},
+			"OnBuild": []string{"RUN make"},
+		},
+		"rootfs": ocispec.RootFS{
+			Type: "layers",
+		},
+	})
+	qt.Assert(t, qt.IsNil(err))
+	reg.MustPushManifest("foo", ocispec.Manifest{
+		Versioned: ocispecroot.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    reg.MustPushBlobWithMediaType("foo", config, ocispec.MediaTypeImageConfig),
+		Layers:    []ociregistry.Descriptor{},
+	}, "latest")
+
+	desc, err := ocimutate.Mutate(ctx, r, "foo", "latest", "", func(img *ocimutate.Image) error {
+		img.SetEnv("SSL_CERT_FILE", "/etc/ssl/certs/ca.pem")
+		return nil
+	})
+	qt.Assert(t, qt.IsNil(err))
+	var m ocispec.Manifest
+	reg.MustGetManifest("foo", desc, &m)
+	var fields struct {
+		Config map[string]any `json:"config"`
+	}
+	qt.Assert(t, qt.IsNil(json.Unmarshal(reg.MustGetBlob("foo", m.Config.Digest), &fields)))
+	qt.Check(t, qt.DeepEquals(fields.Config, map[string]any{
+		"Env": []any{"PATH=/bin", "SSL_CERT_FILE=/etc/ssl/certs/ca.pem"},
+		"Healthcheck": map[string]any{
+			"Test": []any{"CMD", "/bin/check"},
+		},
+		"OnBuild": []any{"RUN make"},
+	}))
+}
+
+func TestMutateIndex(t *testing.T) {
+	ctx := context.Background()
+	r := ocimem.New()
+	reg := ocitest.NewRegistry(t, r)
+	platforms := []ocispec.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64"},
+	}
+	var manifests []ociregistry.Descriptor
+	for _, p := range platforms {
+		desc := pushImage(t, r, "foo", "", p, tarData(t, "file", p.Architecture))
+		desc.Platform = &p
+		manifests = append(manifests, desc)
+	}
+	_, indexDesc := reg.MustPushManifest("foo", ocispec.Index{
+		Versioned: ocispecroot.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: manifests,
+		Annotations: map[string]string{
+			"a": "b",
+		},
+	}, "latest")
+
+	var platformsSeen []string
+	desc, err := ocimutate.Mutate(ctx, r, "foo", "latest", "", func(img *ocimutate.Image) error {
+		qt.Assert(t, qt.IsNotNil(img.Platform))
+		platformsSeen = append(platformsSeen, img.Platform.Architecture)
+		if img.Platform.Architecture != "arm64" {
+			return nil
+		}
+		img.SetLabel("arch", "arm")
+		return nil
+	})
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.DeepEquals(platformsSeen, []string{"amd64", "arm64"}))
+	qt.Check(t, qt.Not(qt.Equals(desc.Digest, indexDesc.Digest)))
+	qt.Check(t, qt.Equals(desc.MediaType, ocispec.MediaTypeImageIndex))
+
+	// The tag has been updated.
+	tagDesc, err := r.ResolveTag(ctx, "foo", "latest")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(tagDesc.Digest, desc.Digest))
+
+	var index ocispec.Index
+	reg.MustGetManifest("foo", desc, &index)
+	qt.Check(t, qt.DeepEquals(index.Annotations, map[string]string{"a": "b"}))
+	qt.Assert(t, qt.HasLen(index.Manifests, 2))
+	// Only the arm64 image has changed.
+	qt.Check(t, qt.DeepEquals(index.Manifests[0], manifests[0]))
+	qt.Check(t, qt.Not(qt.Equals(index.Manifests[1].Digest, manifests[1].Digest)))
+	qt.Check(t, qt.DeepEquals(index.Manifests[1].Platform, manifests[1].Platform))
+
+	img, err := ocimutate.Load(ctx, r, "foo", index.Manifests[1].Digest)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.DeepEquals(img.Config.Config.Labels, map[string]string{"arch": "arm"}))
+	qt.Check(t, qt.Equals(img.Config.Architecture, "arm64"))
+}
+
+func TestMutateIndexSkipsAttestations(t *testing.T) {
+	ctx := context.Background()
+	r := ocimem.New()
+	reg := ocitest.NewRegistry(t, r)
+	platform := ocispec.Platform{OS: "linux", Architecture: "amd64"}
+	image := pushImage(t, r, "foo", "", platform, tarData(t, "file", "x"))
+	image.Platform = &platform
+	armPlatform := ocispec.Platform{OS: "linux", Architecture: "arm64"}
+	armImage := pushImage(t, r, "foo", "", armPlatform, tarData(t, "file", "y"))
+	armImage.Platform = &armPlatform
+	unknown := ocispec.Platform{OS: "unknown", Architecture: "unknown"}
+	attestation := pushImage(t, r, "foo", "", unknown, tarData(t, "file", "attestation"))
+	attestation.Platform = &unknown
+	attestation.Annotations = map[string]string{
+		"vnd.docker.reference.digest": string(image.Digest),
+		"vnd.docker.reference.type":   "attestation-manifest",
+	}
+	armAttestation := pushImage(t, r, "foo", "", unknown, tarData(t, "file", "arm attestation"))
+	armAttestation.Platform = &unknown
+	armAttestation.Annotations = map[string]string{
+		"vnd.docker.reference.digest": string(armImage.Digest),
+		"vnd.docker.reference.type":   "attestation-manifest",
+	}
+	// An attestation is recognized by its annotation alone.
+	annotated := pushImage(t, r, "foo", "", platform, tarData(t, "file", "other attestation"))
+	annotated.Platform = &platform
+	annotated.Annotations = armAttestation.Annotations
+	manifests := []ociregistry.Descriptor{image, armImage, attestation, armAttestation, annotated}
+	reg.MustPushManifest("foo", ocispec.Index{
+		Versioned: ocispecroot.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: manifests,
+	}, "latest")
+
+	calls := 0
+	desc, err := ocimutate.Mutate(ctx, r, "foo", "latest", "", func(img *ocimutate.Image) error {
+		calls++
+		if img.Platform.Architecture == "amd64" {
+			img.SetLabel("a", "b")
+		}
+		return nil
+	})
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(calls, 2))
+
+	// The attestation for the changed image no longer applies,
+	// so it's removed, but the others are left unchanged.
+	var index ocispec.Index
+	reg.MustGetManifest("foo", desc, &index)
+	qt.Assert(t, qt.HasLen(index.Manifests, 4))
+	qt.Check(t, qt.Not(qt.Equals(index.Manifests[0].Digest, image.Digest)))
+	qt.Check(t, qt.DeepEquals(index.Manifests[1], armImage))
+	qt.Check(t, qt.DeepEquals(index.Manifests[2], armAttestation))
+	qt.Check(t, qt.DeepEquals(index.Manifests[3], annotated))
+}
+
+func TestMutateUnchanged(t *testing.T) {
+	ctx := context.Background()
+	r := ocimem.New()
+	desc := pushImage(t, r, "foo", "latest", ocispec.Platform{OS: "linux", Architecture: "amd64"}, tarData(t, "file", "x"))
+	newDesc, err := ocimutate.Mutate(ctx, r, "foo", "latest", "other", func(img *ocimutate.Image) error {
+		return nil
+	})
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(newDesc.Digest, desc.Digest))
+	tagDesc, err := r.ResolveTag(ctx, "foo", "other")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(tagDesc.Digest, desc.Digest))
+}
+
+func TestLoadNotImage(t *testing.T) {
+	ctx := context.Background()
+	r := ocimem.New()
+	reg := ocitest.NewRegistry(t, r)
+	_, desc := reg.MustPushManifest("foo", ocispec.Index{
+		Versioned: ocispecroot.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ociregistry.Descriptor{},
+	}, "")
+	_, err := ocimutate.Load(ctx, r, "foo", desc.Digest)
+	qt.Check(t, qt.ErrorMatches(err, `manifest sha256:.* has media type "application/vnd.oci.image.index.v1\+json" which is not an image manifest`))
+}
+
+// pushImage pushes an image with a single gzipped layer
+// holding the given uncompressed content.
+func pushImage(t *testing.T, r ociregistry.Interface, repo, tag string, platform ocispec.Platform, layerContent []byte) ociregistry.Descriptor {
+	reg := ocitest.NewRegistry(t, r)
+	layer := reg.MustPushBlobWithMediaType(repo, ocitest.Gzip(layerContent), ocispec.MediaTypeImageLayerGzip)
+	config, err := json.Marshal(map[string]any{
+		"architecture":   platform.Architecture,
+		"os":             platform.OS,
+		"docker_version": "20.10.0",
+		"rootfs": ocispec.RootFS{
+			Type:    "layers",
+			DiffIDs: []ociregistry.Digest{digest.FromBytes(layerContent)},
+		},
+		"history": []ocispec.History{{
+			CreatedBy: "base",
+		}},
+	})
+	qt.Assert(t, qt.IsNil(err))
+	_, desc := reg.MustPushManifest(repo, ocispec.Manifest{
+		Versioned: ocispecroot.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    reg.MustPushBlobWithMediaType(repo, config, ocispec.MediaTypeImageConfig),
+		Layers:    []ociregistry.Descriptor{layer},
+	}, tag)
+	return desc
+}
+
+func tarData(t *testing.T, name, content string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	err := tw.WriteHeader(&tar.Header{
+		Name: name,
+		Mode: 0o644,
+		Size: int64(len(content)),
+	})
+	qt.Assert(t, qt.IsNil(err))
+	_, err = tw.Write([]byte(content))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.IsNil(tw.Close()))
+	return buf.Bytes()
+}
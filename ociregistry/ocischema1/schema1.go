@@ -0,0 +1,337 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ocischema1 provides support for reading legacy Docker
+// image manifests in schema version 1 and converting them to
+// OCI image manifests.
+//
+// See https://github.com/distribution/distribution/blob/v2.8.3/docs/spec/manifest-v2-1.md
+// for the schema1 specification.
+package ocischema1
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispecroot "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"cuelabs.dev/go/oci/ociregistry"
+)
+
+const (
+	// MediaTypeSignedManifest is the media type of a signed schema1 manifest.
+	MediaTypeSignedManifest = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+
+	// MediaTypeManifest is the media type of an unsigned schema1 manifest.
+	MediaTypeManifest = "application/vnd.docker.distribution.manifest.v1+json"
+)
+
+// emptyLayerDigest holds the digest of the gzipped empty tar
+// archive that schema1 manifests use for layers that don't
+// change the filesystem.
+const emptyLayerDigest = "sha256:a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4"
+
+// IsSchema1MediaType reports whether the media type is
+// that of a schema1 manifest.
+func IsSchema1MediaType(mediaType string) bool {
+	return mediaType == MediaTypeSignedManifest || mediaType == MediaTypeManifest
+}
+
+// Manifest represents a schema1 manifest.
+type Manifest struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	Name          string `json:"name"`
+	Tag           string `json:"tag"`
+	Architecture  string `json:"architecture"`
+
+	// FSLayers holds the layers of the image, most recent first.
+	FSLayers []FSLayer `json:"fsLayers"`
+
+	// History holds an entry for each element of FSLayers.
+	History []History `json:"history"`
+}
+
+// FSLayer holds a layer in a schema1 manifest.
+type FSLayer struct {
+	BlobSum ociregistry.Digest `json:"blobSum"`
+}
+
+// History holds the history for a layer in a schema1 manifest.
+type History struct {
+	// V1Compatibility holds the JSON-encoded legacy
+	// image configuration for the layer.
+	V1Compatibility string `json:"v1Compatibility"`
+}
+
+// v1Compatibility holds the fields that we need
+// from History.V1Compatibility.
+type v1Compatibility struct {
+	Created         time.Time `json:"created"`
+	Author          string    `json:"author,omitempty"`
+	Comment         string    `json:"comment,omitempty"`
+	ThrowAway       bool      `json:"throwaway,omitempty"`
+	Size            *int64    `json:"Size,omitempty"`
+	ContainerConfig struct {
+		Cmd []string `json:"Cmd"`
+	} `json:"container_config"`
+}
+
+// jwsSignature holds the parts of a JWS signature that
+// we need to find the signed payload.
+type jwsSignature struct {
+	Protected string `json:"protected"`
+}
+
+// jwsProtectedHeader holds the fields in the protected header that
+// describe how to reconstruct the payload from the signed
+// manifest.
+type jwsProtectedHeader struct {
+	FormatLength int    `json:"formatLength"`
+	FormatTail   string `json:"formatTail"`
+}
+
+// Parse parses the given schema1 manifest, which may be signed or
+// unsigned. It also returns the manifest payload, as returned by [Payload].
+func Parse(data []byte) (*Manifest, []byte, error) {
+	payload, err := Payload(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(payload, &m); err != nil {
+		return nil, nil, fmt.Errorf("cannot unmarshal schema1 manifest: %v", err)
+	}
+	if m.SchemaVersion != 1 {
+		return nil, nil, fmt.Errorf("unexpected schema version %d in schema1 manifest", m.SchemaVersion)
+	}
+	if len(m.FSLayers) != len(m.History) {
+		return nil, nil, fmt.Errorf("schema1 manifest has %d layers but %d history entries", len(m.FSLayers), len(m.History))
+	}
+	if len(m.FSLayers) == 0 {
+		return nil, nil, fmt.Errorf("schema1 manifest has no layers")
+	}
+	for _, l := range m.FSLayers {
+		if err := l.BlobSum.Validate(); err != nil {
+			return nil, nil, fmt.Errorf("invalid blob digest %q in schema1 manifest: %v", l.BlobSum, err)
+		}
+	}
+	return &m, payload, nil
+}
+
+// Payload returns the payload of a schema1 manifest, which is the
+// manifest with any JWS signatures stripped. The payload is the
+// content that's signed, and its digest is the canonical digest of
+// the manifest (see [Digest]). For an unsigned manifest, the
+// payload is the data itself.
+func Payload(data []byte) ([]byte, error) {
+	var m struct {
+		Signatures []jwsSignature `json:"signatures"`
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal schema1 manifest: %v", err)
+	}
+	if len(m.Signatures) == 0 {
+		return data, nil
+	}
+	var payload []byte
+	for i, sig := range m.Signatures {
+		headerData, err := decodeBase64URL(sig.Protected)
+		if err != nil {
+			return nil, fmt.Errorf("invalid protected header in signature %d: %v", i, err)
+		}
+		var header jwsProtectedHeader
+		if err := json.Unmarshal(headerData, &header); err != nil {
+			return nil, fmt.Errorf("invalid protected header in signature %d: %v", i, err)
+		}
+		if header.FormatLength <= 0 || header.FormatLength > len(data) {
+			return nil, fmt.Errorf("invalid format length %d in signature %d", header.FormatLength, i)
+		}
+		tail, err := decodeBase64URL(header.FormatTail)
+		if err != nil {
+			return nil, fmt.Errorf("invalid format tail in signature %d: %v", i, err)
+		}
+		p := make([]byte, 0, header.FormatLength+len(tail))
+		p = append(p, data[:header.FormatLength]...)
+		p = append(p, tail...)
+		if payload == nil {
+			payload = p
+		} else if !bytes.Equal(payload, p) {
+			return nil, fmt.Errorf("signatures refer to different payloads")
+		}
+	}
+	return payload, nil
+}
+
+// Digest returns the canonical digest of a schema1 manifest,
+// which is the digest of its payload.
+func Digest(data []byte) (ociregistry.Digest, error) {
+	payload, err := Payload(data)
+	if err != nil {
+		return "", err
+	}
+	return digest.FromBytes(payload), nil
+}
+
+// LayerInfo holds information about a layer that's
+// needed to convert a schema1 manifest but
+// isn't present in it.
+type LayerInfo struct {
+	// Size holds the size of the layer blob.
+	Size int64
+
+	// DiffID holds the digest of the uncompressed layer content.
+	DiffID ociregistry.Digest
+}
+
+// Converted holds the result of converting a schema1 manifest.
+type Converted struct {
+	// Manifest holds the JSON-encoded OCI image manifest.
+	Manifest []byte
+
+	// Config holds the JSON-encoded OCI image configuration,
+	// generated from the manifest's history.
+	// The manifest refers to it by ConfigDescriptor.
+	Config           []byte
+	ConfigDescriptor ociregistry.Descriptor
+}
+
+// Convert converts m to an OCI image manifest. Schema1 manifests
+// contain neither the sizes of their layers nor the digests of the
+// uncompressed layer content, both of which are needed for an OCI
+// manifest and configuration, so layerInfo is called to find them
+// for each non-empty layer.
+//
+// The configuration is derived from the most recent
+// v1Compatibility entry, with the root filesystem and history
+// fields filled in from all the entries.
+func Convert(m *Manifest, layerInfo func(blobSum ociregistry.Digest) (LayerInfo, error)) (*Converted, error) {
+	if len(m.FSLayers) != len(m.History) || len(m.History) == 0 {
+		return nil, fmt.Errorf("schema1 manifest has %d layers and %d history entries", len(m.FSLayers), len(m.History))
+	}
+	var (
+		layers  []ociregistry.Descriptor
+		diffIDs []ociregistry.Digest
+		history []ocispec.History
+	)
+	// Schema1 manifests hold the most recent layer first,
+	// but OCI holds it last.
+	for i := len(m.History) - 1; i >= 0; i-- {
+		var compat v1Compatibility
+		if err := json.Unmarshal([]byte(m.History[i].V1Compatibility), &compat); err != nil {
+			return nil, fmt.Errorf("invalid v1Compatibility in history entry %d: %v", i, err)
+		}
+		empty := isEmptyLayer(compat, m.FSLayers[i].BlobSum)
+		created := compat.Created
+		history = append(history, ocispec.History{
+			Created:    &created,
+			CreatedBy:  strings.Join(compat.ContainerConfig.Cmd, " "),
+			Author:     compat.Author,
+			Comment:    compat.Comment,
+			EmptyLayer: empty,
+		})
+		if empty {
+			continue
+		}
+		blobSum := m.FSLayers[i].BlobSum
+		info, err := layerInfo(blobSum)
+		if err != nil {
+			return nil, fmt.Errorf("cannot get information on layer %s: %w", blobSum, err)
+		}
+		layers = append(layers, ociregistry.Descriptor{
+			MediaType: ocispec.MediaTypeImageLayerGzip,
+			Digest:    blobSum,
+			Size:      info.Size,
+		})
+		diffIDs = append(diffIDs, info.DiffID)
+	}
+
+	// Start from the most recent legacy configuration,
+	// removing the fields that are specific to v1 layers.
+	var config map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(m.History[0].V1Compatibility), &config); err != nil {
+		return nil, fmt.Errorf("invalid v1Compatibility in history entry 0: %v", err)
+	}
+	for _, field := range []string{"id", "parent", "Size", "parent_id", "layer_id", "throwaway"} {
+		delete(config, field)
+	}
+	if _, ok := config["architecture"]; !ok && m.Architecture != "" {
+		config["architecture"] = mustMarshal(m.Architecture)
+	}
+	if _, ok := config["os"]; !ok {
+		config["os"] = mustMarshal("linux")
+	}
+	if diffIDs == nil {
+		diffIDs = []ociregistry.Digest{}
+	}
+	config["rootfs"] = mustMarshal(ocispec.RootFS{
+		Type:    "layers",
+		DiffIDs: diffIDs,
+	})
+	config["history"] = mustMarshal(history)
+	configData, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	configDesc := ociregistry.Descriptor{
+		MediaType: ocispec.MediaTypeImageConfig,
+		Digest:    digest.FromBytes(configData),
+		Size:      int64(len(configData)),
+	}
+	if layers == nil {
+		layers = []ociregistry.Descriptor{}
+	}
+	manifestData, err := json.Marshal(ocispec.Manifest{
+		Versioned: ocispecroot.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    configDesc,
+		Layers:    layers,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Converted{
+		Manifest:         manifestData,
+		Config:           configData,
+		ConfigDescriptor: configDesc,
+	}, nil
+}
+
+// isEmptyLayer reports whether the layer with the given v1 compatibility
+// information and blob digest doesn't change the filesystem.
+func isEmptyLayer(compat v1Compatibility, blobSum ociregistry.Digest) bool {
+	if compat.ThrowAway {
+		return true
+	}
+	// Older manifests don't have the throwaway field,
+	// but record the size of the uncompressed layer.
+	return compat.Size != nil && *compat.Size == 0 && blobSum == emptyLayerDigest
+}
+
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func mustMarshal(x any) json.RawMessage {
+	data, err := json.Marshal(x)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
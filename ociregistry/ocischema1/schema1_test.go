@@ -0,0 +1,182 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocischema1_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocischema1"
+)
+
+const testManifest = `{
+   "schemaVersion": 1,
+   "name": "library/hello",
+   "tag": "latest",
+   "architecture": "amd64",
+   "fsLayers": [
+      {
+         "blobSum": "sha256:a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4"
+      },
+      {
+         "blobSum": "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+      },
+      {
+         "blobSum": "sha256:fcde2b2edba56bf408601fb721fe9b5c338d10ee429ea04fae5511b68fbf8fb9"
+      }
+   ],
+   "history": [
+      {
+         "v1Compatibility": "{\"architecture\":\"amd64\",\"config\":{\"Cmd\":[\"/hello\"]},\"container_config\":{\"Cmd\":[\"/bin/sh\",\"-c\",\"#(nop) CMD [\\\"/hello\\\"]\"]},\"created\":\"2023-01-03T00:00:00Z\",\"id\":\"c3\",\"os\":\"linux\",\"parent\":\"c2\",\"throwaway\":true}"
+      },
+      {
+         "v1Compatibility": "{\"container_config\":{\"Cmd\":[\"/bin/sh\",\"-c\",\"#(nop) COPY file:abc in /\"]},\"created\":\"2023-01-02T00:00:00Z\",\"id\":\"c2\",\"parent\":\"c1\"}"
+      },
+      {
+         "v1Compatibility": "{\"container_config\":{\"Cmd\":[\"/bin/sh\",\"-c\",\"#(nop) ADD file:def in /\"]},\"created\":\"2023-01-01T00:00:00Z\",\"author\":\"someone\",\"id\":\"c1\"}"
+      }
+   ]
+}`
+
+// sign returns a signed version of the given pretty-printed
+// manifest, in the form produced by the Docker registry.
+func sign(t *testing.T, manifest string) []byte {
+	formatLength := len(manifest) - len("\n}")
+	protected, err := json.Marshal(map[string]any{
+		"formatLength": formatLength,
+		"formatTail":   base64.RawURLEncoding.EncodeToString([]byte("\n}")),
+		"time":         "2023-01-03T00:00:00Z",
+	})
+	qt.Assert(t, qt.IsNil(err))
+	return []byte(manifest[:formatLength] + fmt.Sprintf(`,
+   "signatures": [
+      {
+         "header": {
+            "alg": "ES256"
+         },
+         "signature": "c2lnbmF0dXJl",
+         "protected": %q
+      }
+   ]
+}`, base64.RawURLEncoding.EncodeToString(protected)))
+}
+
+func TestPayload(t *testing.T) {
+	payload, err := ocischema1.Payload([]byte(testManifest))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(string(payload), testManifest))
+
+	signed := sign(t, testManifest)
+	payload, err = ocischema1.Payload(signed)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(string(payload), testManifest))
+
+	dig, err := ocischema1.Digest(signed)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(dig, digest.FromString(testManifest)))
+}
+
+func TestPayloadInvalidSignature(t *testing.T) {
+	_, err := ocischema1.Payload([]byte(`{"signatures": [{"protected": "!!!"}]}`))
+	qt.Check(t, qt.ErrorMatches(err, `invalid protected header in signature 0: .*`))
+
+	protected := base64.RawURLEncoding.EncodeToString([]byte(`{"formatLength": 1000, "formatTail": ""}`))
+	_, err = ocischema1.Payload([]byte(`{"signatures": [{"protected": "` + protected + `"}]}`))
+	qt.Check(t, qt.ErrorMatches(err, `invalid format length 1000 in signature 0`))
+}
+
+func TestParse(t *testing.T) {
+	m, _, err := ocischema1.Parse(sign(t, testManifest))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(m.Name, "library/hello"))
+	qt.Check(t, qt.Equals(m.Architecture, "amd64"))
+	qt.Check(t, qt.HasLen(m.FSLayers, 3))
+	qt.Check(t, qt.HasLen(m.History, 3))
+
+	_, _, err = ocischema1.Parse([]byte(`{"schemaVersion": 2}`))
+	qt.Check(t, qt.ErrorMatches(err, `unexpected schema version 2 in schema1 manifest`))
+	_, _, err = ocischema1.Parse([]byte(`{"schemaVersion": 1, "fsLayers": [{"blobSum": "x"}]}`))
+	qt.Check(t, qt.ErrorMatches(err, `schema1 manifest has 1 layers but 0 history entries`))
+}
+
+func TestConvert(t *testing.T) {
+	m, _, err := ocischema1.Parse([]byte(testManifest))
+	qt.Assert(t, qt.IsNil(err))
+	var called []ociregistry.Digest
+	c, err := ocischema1.Convert(m, func(blobSum ociregistry.Digest) (ocischema1.LayerInfo, error) {
+		called = append(called, blobSum)
+		return ocischema1.LayerInfo{
+			Size:   int64(len(called) * 100),
+			DiffID: digest.FromString(fmt.Sprint("diff", len(called))),
+		}, nil
+	})
+	qt.Assert(t, qt.IsNil(err))
+	// The empty layer is omitted and the layers are in oldest-first order.
+	qt.Check(t, qt.DeepEquals(called, []ociregistry.Digest{
+		"sha256:fcde2b2edba56bf408601fb721fe9b5c338d10ee429ea04fae5511b68fbf8fb9",
+		"sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+	}))
+
+	var manifest ocispec.Manifest
+	qt.Assert(t, qt.IsNil(json.Unmarshal(c.Manifest, &manifest)))
+	qt.Check(t, qt.Equals(manifest.SchemaVersion, 2))
+	qt.Check(t, qt.Equals(manifest.MediaType, ocispec.MediaTypeImageManifest))
+	qt.Check(t, qt.DeepEquals(manifest.Config, c.ConfigDescriptor))
+	qt.Check(t, qt.Equals(c.ConfigDescriptor.Digest, digest.FromBytes(c.Config)))
+	qt.Check(t, qt.DeepEquals(manifest.Layers, []ociregistry.Descriptor{{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    "sha256:fcde2b2edba56bf408601fb721fe9b5c338d10ee429ea04fae5511b68fbf8fb9",
+		Size:      100,
+	}, {
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+		Size:      200,
+	}}))
+
+	var config ocispec.Image
+	qt.Assert(t, qt.IsNil(json.Unmarshal(c.Config, &config)))
+	qt.Check(t, qt.Equals(config.Architecture, "amd64"))
+	qt.Check(t, qt.Equals(config.OS, "linux"))
+	qt.Check(t, qt.DeepEquals(config.Config.Cmd, []string{"/hello"}))
+	qt.Check(t, qt.DeepEquals(config.RootFS, ocispec.RootFS{
+		Type: "layers",
+		DiffIDs: []ociregistry.Digest{
+			digest.FromString("diff1"),
+			digest.FromString("diff2"),
+		},
+	}))
+	qt.Assert(t, qt.HasLen(config.History, 3))
+	qt.Check(t, qt.Equals(config.History[0].Author, "someone"))
+	qt.Check(t, qt.Equals(config.History[0].CreatedBy, "/bin/sh -c #(nop) ADD file:def in /"))
+	qt.Check(t, qt.IsFalse(config.History[0].EmptyLayer))
+	qt.Check(t, qt.IsFalse(config.History[1].EmptyLayer))
+	qt.Check(t, qt.IsTrue(config.History[2].EmptyLayer))
+	qt.Check(t, qt.Equals(config.History[2].Created.Format("2006-01-02"), "2023-01-03"))
+
+	// The legacy layer fields are removed.
+	var fields map[string]any
+	qt.Assert(t, qt.IsNil(json.Unmarshal(c.Config, &fields)))
+	for _, field := range []string{"id", "parent", "throwaway"} {
+		_, ok := fields[field]
+		qt.Check(t, qt.IsFalse(ok), qt.Commentf("field %q", field))
+	}
+}
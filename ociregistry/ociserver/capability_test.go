@@ -0,0 +1,96 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociserver_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ociserver"
+	"cuelabs.dev/go/oci/ociregistry/ocitest"
+)
+
+type capsRegistry struct {
+	ociregistry.Interface
+	caps ociregistry.Capabilities
+}
+
+func (r capsRegistry) Capabilities(ctx context.Context) ociregistry.Capabilities {
+	return r.caps
+}
+
+func TestCapabilities(t *testing.T) {
+	mem := ocimem.New()
+	desc := ocitest.NewRegistry(t, mem).MustPushBlob("foo", []byte("hello world"))
+	blobURL := "/v2/foo/blobs/" + string(desc.Digest)
+	referrersURL := "/v2/foo/referrers/" + string(desc.Digest)
+
+	tests := []struct {
+		testName        string
+		caps            ociregistry.Capabilities
+		wantAcceptRange string
+		wantRangeCode   int
+		wantRangeBody   string
+		wantReferrers   int
+	}{{
+		testName:        "All",
+		caps:            ociregistry.AllCapabilities,
+		wantAcceptRange: "bytes",
+		wantRangeCode:   http.StatusPartialContent,
+		wantRangeBody:   "hello",
+		wantReferrers:   http.StatusOK,
+	}, {
+		testName:        "NoRangeOrReferrers",
+		caps:            ociregistry.AllCapabilities &^ (ociregistry.CapBlobRange | ociregistry.CapReferrers),
+		wantAcceptRange: "none",
+		wantRangeCode:   http.StatusOK,
+		wantRangeBody:   "hello world",
+		wantReferrers:   http.StatusNotFound,
+	}}
+	for _, test := range tests {
+		t.Run(test.testName, func(t *testing.T) {
+			srv := httptest.NewServer(ociserver.New(capsRegistry{mem, test.caps}, nil))
+			defer srv.Close()
+
+			resp, err := http.Head(srv.URL + blobURL)
+			qt.Assert(t, qt.IsNil(err))
+			resp.Body.Close()
+			qt.Check(t, qt.Equals(resp.Header.Get("Accept-Ranges"), test.wantAcceptRange))
+
+			req, err := http.NewRequest("GET", srv.URL+blobURL, nil)
+			qt.Assert(t, qt.IsNil(err))
+			req.Header.Set("Range", "bytes=0-4")
+			resp, err = http.DefaultClient.Do(req)
+			qt.Assert(t, qt.IsNil(err))
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			qt.Assert(t, qt.IsNil(err))
+			qt.Check(t, qt.Equals(resp.StatusCode, test.wantRangeCode))
+			qt.Check(t, qt.Equals(string(body), test.wantRangeBody))
+
+			resp, err = http.Get(srv.URL + referrersURL)
+			qt.Assert(t, qt.IsNil(err))
+			resp.Body.Close()
+			qt.Check(t, qt.Equals(resp.StatusCode, test.wantReferrers))
+		})
+	}
+}
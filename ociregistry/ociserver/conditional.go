@@ -0,0 +1,99 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociserver
+
+import (
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"cuelabs.dev/go/oci/ociregistry"
+)
+
+// Support for conditional requests as defined in RFC 9110 section 13.
+//
+// The entity tag for a blob or manifest is its digest, so it's
+// a strong validator. We don't know when content was last
+// modified, so we don't send Last-Modified, but content
+// addressed by digest can never change, so any valid
+// If-Modified-Since date is taken to be satisfied for such
+// content. Content addressed by tag can change, so
+// If-Modified-Since is ignored for that.
+
+// etag returns the entity tag for content with the given digest.
+func etag(dig ociregistry.Digest) string {
+	return `"` + string(dig) + `"`
+}
+
+// hasCacheConditions reports whether the request contains any
+// conditions that might result in a 304 (Not Modified) response.
+func hasCacheConditions(req *http.Request) bool {
+	return req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != ""
+}
+
+// isNotModified reports whether the conditions in a GET or HEAD
+// request mean that a 304 (Not Modified) response should be sent for
+// content with the given digest. The immutable parameter reports
+// whether the content was addressed by digest.
+func isNotModified(req *http.Request, dig ociregistry.Digest, immutable bool) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		// If-None-Match takes precedence over If-Modified-Since.
+		return etagListMatches(inm, dig)
+	}
+	if !immutable {
+		return false
+	}
+	ims := req.Header.Get("If-Modified-Since")
+	if ims == "" {
+		return false
+	}
+	_, err := http.ParseTime(ims)
+	return err == nil
+}
+
+// etagListMatches reports whether the list of entity tags
+// in an If-None-Match header matches the given digest
+// using the weak comparison function.
+func etagListMatches(list string, dig ociregistry.Digest) bool {
+	want := etag(dig)
+	for _, tag := range strings.Split(list, ",") {
+		tag = textproto.TrimString(tag)
+		if tag == "*" {
+			return true
+		}
+		if strings.TrimPrefix(tag, "W/") == want {
+			return true
+		}
+	}
+	return false
+}
+
+// ifRangeMatches reports whether the If-Range header in the request,
+// if any, allows a Range header to be honored for content with
+// the given digest. Only the strong comparison of entity
+// tags is supported: because we have no modification time,
+// a date in If-Range always causes the whole content to be sent.
+func ifRangeMatches(req *http.Request, dig ociregistry.Digest) bool {
+	ir := textproto.TrimString(req.Header.Get("If-Range"))
+	return ir == "" || ir == etag(dig)
+}
+
+// writeNotModified writes a 304 (Not Modified) response
+// for content with the given digest.
+func writeNotModified(resp http.ResponseWriter, dig ociregistry.Digest) {
+	resp.Header().Set("ETag", etag(dig))
+	resp.Header().Set("Docker-Content-Digest", string(dig))
+	resp.WriteHeader(http.StatusNotModified)
+}
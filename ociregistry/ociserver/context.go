@@ -0,0 +1,50 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociserver
+
+import (
+	"context"
+	"crypto/x509"
+	"net/http"
+)
+
+type clientCertificateKey struct{}
+
+// ContextWithClientCertificate returns a context annotated with
+// the given verified TLS client certificate. The server does this
+// for every request that arrives over a TLS connection with a
+// verified client certificate, so that the backend can find out
+// the identity of the client with [ClientCertificateFromContext].
+func ContextWithClientCertificate(ctx context.Context, cert *x509.Certificate) context.Context {
+	return context.WithValue(ctx, clientCertificateKey{}, cert)
+}
+
+// ClientCertificateFromContext returns any client certificate
+// associated with the context by [ContextWithClientCertificate],
+// or nil if there is none.
+func ClientCertificateFromContext(ctx context.Context) *x509.Certificate {
+	cert, _ := ctx.Value(clientCertificateKey{}).(*x509.Certificate)
+	return cert
+}
+
+// requestContext returns the context to pass to the backend
+// when serving req.
+func requestContext(req *http.Request) context.Context {
+	ctx := req.Context()
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 && len(req.TLS.VerifiedChains[0]) > 0 {
+		ctx = ContextWithClientCertificate(ctx, req.TLS.VerifiedChains[0][0])
+	}
+	return ctx
+}
@@ -0,0 +1,78 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociserver_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ociserver"
+	"cuelabs.dev/go/oci/ociregistry/ocitest"
+)
+
+type certRecordingRegistry struct {
+	ociregistry.Interface
+	cert *x509.Certificate
+}
+
+func (r *certRecordingRegistry) ResolveBlob(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.Descriptor, error) {
+	r.cert = ociserver.ClientCertificateFromContext(ctx)
+	return r.Interface.ResolveBlob(ctx, repo, digest)
+}
+
+func TestClientCertificateInContext(t *testing.T) {
+	mem := ocimem.New()
+	desc := ocitest.NewRegistry(t, mem).MustPushBlob("foo", []byte("hello world"))
+	blobURL := "/v2/foo/blobs/" + string(desc.Digest)
+
+	ca, err := ocitest.NewCertAuthority()
+	qt.Assert(t, qt.IsNil(err))
+	clientCert, err := ca.ClientCert("someone")
+	qt.Assert(t, qt.IsNil(err))
+
+	backend := &certRecordingRegistry{Interface: mem}
+	srv := httptest.NewUnstartedServer(ociserver.New(backend, nil))
+	srv.TLS = &tls.Config{
+		ClientCAs:  ca.CertPool(),
+		ClientAuth: tls.VerifyClientCertIfGiven,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	// Without a client certificate, there's nothing in the context.
+	resp, err := srv.Client().Head(srv.URL + blobURL)
+	qt.Assert(t, qt.IsNil(err))
+	resp.Body.Close()
+	qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusOK))
+	qt.Check(t, qt.IsNil(backend.cert))
+
+	transport := srv.Client().Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.Certificates = []tls.Certificate{clientCert}
+	client := &http.Client{Transport: transport}
+	resp, err = client.Head(srv.URL + blobURL)
+	qt.Assert(t, qt.IsNil(err))
+	resp.Body.Close()
+	qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusOK))
+	qt.Assert(t, qt.IsNotNil(backend.cert))
+	qt.Check(t, qt.Equals(backend.cert.Subject.CommonName, "someone"))
+}
@@ -16,6 +16,7 @@ package ociserver
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 
 	"cuelabs.dev/go/oci/ociregistry"
@@ -43,3 +44,17 @@ func (r *registry) handleManifestDelete(ctx context.Context, resp http.ResponseW
 	resp.WriteHeader(http.StatusAccepted)
 	return nil
 }
+
+// handleRepositoryDelete handles the repository deletion extension
+// endpoint. When the backend doesn't support repository deletion,
+// the registry behaves as if it doesn't know about the endpoint.
+func (r *registry) handleRepositoryDelete(ctx context.Context, resp http.ResponseWriter, req *http.Request, rreq *ocirequest.Request) error {
+	if !ociregistry.CapabilitiesOf(ctx, r.backend).Has(ociregistry.CapDeleteRepository) {
+		return withHTTPCode(http.StatusNotFound, fmt.Errorf("repository deletion is not supported"))
+	}
+	if err := ociregistry.DeleteRepository(ctx, r.backend, rreq.Repo); err != nil {
+		return err
+	}
+	resp.WriteHeader(http.StatusAccepted)
+	return nil
+}
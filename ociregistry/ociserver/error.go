@@ -19,6 +19,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"time"
 
 	"cuelabs.dev/go/oci/ociregistry"
 )
@@ -53,6 +54,16 @@ func writeError(resp http.ResponseWriter, err error) {
 	} else if status, ok := errorStatuses[e.Code]; ok {
 		httpStatus = status
 	}
+	var retryErr interface {
+		RetryAfter() time.Duration
+	}
+	if errors.As(err, &retryErr) {
+		// The error knows when the request can be retried
+		// (for example a rate-limit error), so tell the client.
+		if d := retryErr.RetryAfter(); d > 0 {
+			resp.Header().Set("Retry-After", fmt.Sprint(int64((d+time.Second-1)/time.Second)))
+		}
+	}
 	resp.Header().Set("Content-Type", "application/json")
 	resp.WriteHeader(httpStatus)
 
@@ -108,7 +108,7 @@ func (r *registry) handleCatalogList(ctx context.Context, resp http.ResponseWrit
 
 // TODO: implement handling of artifactType querystring
 func (r *registry) handleReferrersList(ctx context.Context, resp http.ResponseWriter, req *http.Request, rreq *ocirequest.Request) error {
-	if r.opts.DisableReferrersAPI {
+	if !r.capabilities(ctx).Has(ociregistry.CapReferrers) {
 		return withHTTPCode(http.StatusNotFound, fmt.Errorf("referrers API has been disabled"))
 	}
 
@@ -119,6 +119,7 @@ func (r *registry) handleReferrersList(ctx context.Context, resp http.ResponseWr
 
 	// TODO support artifactType filtering
 	it := r.backend.Referrers(ctx, rreq.Repo, ociregistry.Digest(rreq.Digest), "")
+	defer it.Close()
 	for {
 		desc, ok := it.Next()
 		if !ok {
@@ -27,6 +27,10 @@ import (
 // (because otherwise we'd have to make an extra round trip
 // to fetch the size before making the actual request).
 
+// maxRanges holds the maximum number of ranges that
+// will be served in a single multipart/byteranges response.
+const maxRanges = 100
+
 // httpRange specifies a byte range as requested by a client.
 // If end is negative, it represents the end of the file.
 type httpRange struct {
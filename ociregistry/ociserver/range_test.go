@@ -0,0 +1,170 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociserver_test
+
+import (
+	"context"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ociserver"
+)
+
+func TestMultipleRanges(t *testing.T) {
+	ctx := context.Background()
+	content := "hello world"
+	desc := ociregistry.Descriptor{
+		MediaType: "text/plain",
+		Digest:    digest.FromString(content),
+		Size:      int64(len(content)),
+	}
+	r := ocimem.New()
+	_, err := r.PushBlob(ctx, "foo", desc, strings.NewReader(content))
+	qt.Assert(t, qt.IsNil(err))
+	srv := httptest.NewServer(ociserver.New(r, nil))
+	defer srv.Close()
+
+	req, err := http.NewRequest("GET", srv.URL+"/v2/foo/blobs/"+string(desc.Digest), nil)
+	qt.Assert(t, qt.IsNil(err))
+	// The last range is unsatisfiable so should be omitted.
+	req.Header.Set("Range", "bytes=0-1, 6-, 4-6, 20-")
+	resp, err := http.DefaultClient.Do(req)
+	qt.Assert(t, qt.IsNil(err))
+	defer resp.Body.Close()
+	qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusPartialContent))
+	qt.Check(t, qt.Equals(resp.Header.Get("ETag"), `"`+string(desc.Digest)+`"`))
+
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(mediaType, "multipart/byteranges"))
+	type part struct {
+		ContentType  string
+		ContentRange string
+		Body         string
+	}
+	var parts []part
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		qt.Assert(t, qt.IsNil(err))
+		body, err := io.ReadAll(p)
+		qt.Assert(t, qt.IsNil(err))
+		parts = append(parts, part{
+			ContentType:  p.Header.Get("Content-Type"),
+			ContentRange: p.Header.Get("Content-Range"),
+			Body:         string(body),
+		})
+	}
+	qt.Assert(t, qt.DeepEquals(parts, []part{{
+		ContentType:  "text/plain",
+		ContentRange: "bytes 0-1/11",
+		Body:         "he",
+	}, {
+		ContentType:  "text/plain",
+		ContentRange: "bytes 6-10/11",
+		Body:         "world",
+	}, {
+		ContentType:  "text/plain",
+		ContentRange: "bytes 4-6/11",
+		Body:         "o w",
+	}}))
+}
+
+func TestMultipleRangesLargerThanBlob(t *testing.T) {
+	ctx := context.Background()
+	content := "hello world"
+	desc := ociregistry.Descriptor{
+		MediaType: "text/plain",
+		Digest:    digest.FromString(content),
+		Size:      int64(len(content)),
+	}
+	r := ocimem.New()
+	_, err := r.PushBlob(ctx, "foo", desc, strings.NewReader(content))
+	qt.Assert(t, qt.IsNil(err))
+	srv := httptest.NewServer(ociserver.New(r, nil))
+	defer srv.Close()
+
+	req, err := http.NewRequest("GET", srv.URL+"/v2/foo/blobs/"+string(desc.Digest), nil)
+	qt.Assert(t, qt.IsNil(err))
+	// The ranges add up to more than the size of the blob,
+	// so the whole blob should be returned.
+	req.Header.Set("Range", "bytes=0-, 1-, 2-")
+	resp, err := http.DefaultClient.Do(req)
+	qt.Assert(t, qt.IsNil(err))
+	defer resp.Body.Close()
+	qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusOK))
+	body, err := io.ReadAll(resp.Body)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(string(body), content))
+}
+
+func TestMultipleRangesAbortOnError(t *testing.T) {
+	ctx := context.Background()
+	content := "hello world"
+	desc := ociregistry.Descriptor{
+		MediaType: "text/plain",
+		Digest:    digest.FromString(content),
+		Size:      int64(len(content)),
+	}
+	r := ocimem.New()
+	_, err := r.PushBlob(ctx, "foo", desc, strings.NewReader(content))
+	qt.Assert(t, qt.IsNil(err))
+	srv := httptest.NewServer(ociserver.New(&failingRangeRegistry{Interface: r}, nil))
+	defer srv.Close()
+
+	req, err := http.NewRequest("GET", srv.URL+"/v2/foo/blobs/"+string(desc.Digest), nil)
+	qt.Assert(t, qt.IsNil(err))
+	req.Header.Set("Range", "bytes=0-1, 6-")
+	// The second part fails after the response header has
+	// been written, so the response should be aborted rather
+	// than appearing to be complete. Depending on how much was
+	// buffered, the failure might be seen before the header
+	// arrives or while reading the body.
+	resp, err := http.DefaultClient.Do(req)
+	if err == nil {
+		defer resp.Body.Close()
+		qt.Check(t, qt.Equals(resp.StatusCode, http.StatusPartialContent))
+		_, err = io.ReadAll(resp.Body)
+	}
+	qt.Check(t, qt.IsNotNil(err))
+}
+
+// failingRangeRegistry fails all calls to GetBlobRange
+// after the first.
+type failingRangeRegistry struct {
+	ociregistry.Interface
+	calls int
+}
+
+func (r *failingRangeRegistry) GetBlobRange(ctx context.Context, repo string, digest ociregistry.Digest, offset0, offset1 int64) (ociregistry.BlobReader, error) {
+	r.calls++
+	if r.calls > 1 {
+		return nil, ociregistry.ErrBlobUnknown
+	}
+	return r.Interface.GetBlobRange(ctx, repo, digest, offset0, offset1)
+}
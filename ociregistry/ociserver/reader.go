@@ -18,7 +18,9 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
 
 	"cuelabs.dev/go/oci/ociregistry"
 	"cuelabs.dev/go/oci/ociregistry/internal/ocirequest"
@@ -29,10 +31,18 @@ func (r *registry) handleBlobHead(ctx context.Context, resp http.ResponseWriter,
 	if err != nil {
 		return err
 	}
+	if isNotModified(req, desc.Digest, true) {
+		writeNotModified(resp, desc.Digest)
+		return nil
+	}
 	resp.Header().Set("Content-Length", fmt.Sprint(desc.Size))
 	resp.Header().Set("Docker-Content-Digest", string(desc.Digest))
-	// TODO this is true in theory, but what if the backend doesn't support GetBlobRange ?
-	resp.Header().Set("Accept-Ranges", "bytes")
+	resp.Header().Set("ETag", etag(desc.Digest))
+	if ociregistry.CapabilitiesOf(ctx, r.backend).Has(ociregistry.CapBlobRange) {
+		resp.Header().Set("Accept-Ranges", "bytes")
+	} else {
+		resp.Header().Set("Accept-Ranges", "none")
+	}
 	resp.WriteHeader(http.StatusOK)
 	return nil
 }
@@ -62,55 +72,169 @@ func (r *registry) handleBlobGet(ctx context.Context, resp http.ResponseWriter,
 			return nil
 		}
 	}
+	dig := ociregistry.Digest(rreq.Digest)
+	if hasCacheConditions(req) {
+		// Resolve the blob first so that we don't
+		// send a 304 response for a blob that isn't there.
+		desc, err := r.backend.ResolveBlob(ctx, rreq.Repo, dig)
+		if err != nil {
+			return err
+		}
+		if isNotModified(req, desc.Digest, true) {
+			writeNotModified(resp, desc.Digest)
+			return nil
+		}
+	}
 	ranges, err := parseRange(req.Header.Get("Range"))
 	if err != nil {
 		return withHTTPCode(http.StatusRequestedRangeNotSatisfiable, err)
 	}
+	if len(ranges) > 0 && !ociregistry.CapabilitiesOf(ctx, r.backend).Has(ociregistry.CapBlobRange) {
+		// The backend can't serve ranges, so ignore the Range
+		// header and return the whole blob, as permitted
+		// by RFC 9110.
+		ranges = nil
+	}
+	if len(ranges) > 0 && !ifRangeMatches(req, dig) {
+		// The client's copy is out of date, so
+		// send the whole blob instead.
+		ranges = nil
+	}
 	switch len(ranges) {
 	case 0:
-		blob, err := r.backend.GetBlob(ctx, rreq.Repo, ociregistry.Digest(rreq.Digest))
-		if err != nil {
-			return err
-		}
-		defer blob.Close()
-		desc := blob.Descriptor()
-		resp.Header().Set("Content-Type", desc.MediaType)
-		resp.Header().Set("Content-Length", fmt.Sprint(desc.Size))
-		resp.Header().Set("Docker-Content-Digest", rreq.Digest)
-		resp.WriteHeader(http.StatusOK)
-
-		io.Copy(resp, blob)
-		return nil
+		return r.serveBlob(ctx, resp, rreq)
 	case 1:
-		rng := ranges[0]
-		blob, err := r.backend.GetBlobRange(ctx, rreq.Repo, ociregistry.Digest(rreq.Digest), rng.start, rng.end)
-		if err != nil {
-			// TODO fall back to using GetBlob if err is ErrUnsupported?
-			return err
+		return r.serveBlobRange(ctx, resp, rreq, ranges[0])
+	default:
+		return r.serveBlobRanges(ctx, resp, rreq, ranges)
+	}
+}
+
+// serveBlob serves the whole of a blob.
+func (r *registry) serveBlob(ctx context.Context, resp http.ResponseWriter, rreq *ocirequest.Request) error {
+	dig := ociregistry.Digest(rreq.Digest)
+	blob, err := r.backend.GetBlob(ctx, rreq.Repo, dig)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	desc := blob.Descriptor()
+	resp.Header().Set("Content-Type", desc.MediaType)
+	resp.Header().Set("Content-Length", fmt.Sprint(desc.Size))
+	resp.Header().Set("Docker-Content-Digest", rreq.Digest)
+	resp.Header().Set("ETag", etag(dig))
+	resp.WriteHeader(http.StatusOK)
+
+	io.Copy(resp, blob)
+	return nil
+}
+
+// serveBlobRange serves a single range of a blob.
+func (r *registry) serveBlobRange(ctx context.Context, resp http.ResponseWriter, rreq *ocirequest.Request, rng httpRange) error {
+	dig := ociregistry.Digest(rreq.Digest)
+	blob, err := r.backend.GetBlobRange(ctx, rreq.Repo, dig, rng.start, rng.end)
+	if err != nil {
+		// TODO fall back to using GetBlob if err is ErrUnsupported?
+		return err
+	}
+	defer blob.Close()
+	desc := blob.Descriptor()
+	if rng.end == -1 || rng.end > desc.Size {
+		rng.end = desc.Size
+	}
+	if rng.start >= desc.Size {
+		// Note: RFC 9110 treats a range starting at the end
+		// of the content as unsatisfiable, even though
+		// GetBlobRange allows it.
+		return withHTTPCode(http.StatusRequestedRangeNotSatisfiable, fmt.Errorf("range starts at or after end of blob"))
+	}
+	if rng.end < rng.start {
+		return withHTTPCode(http.StatusRequestedRangeNotSatisfiable, fmt.Errorf("range end is before start"))
+	}
+	resp.Header().Set("Content-Type", desc.MediaType)
+	resp.Header().Set("Content-Length", fmt.Sprint(rng.end-rng.start))
+	resp.Header().Set("Docker-Content-Digest", rreq.Digest)
+	resp.Header().Set("ETag", etag(dig))
+	resp.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", rng.start, rng.end-1, desc.Size))
+	resp.WriteHeader(http.StatusPartialContent)
+
+	io.Copy(resp, blob)
+	return nil
+}
+
+// serveBlobRanges serves several ranges of a blob
+// as a multipart/byteranges response (see RFC 9110 section 14.6).
+func (r *registry) serveBlobRanges(ctx context.Context, resp http.ResponseWriter, rreq *ocirequest.Request, ranges []httpRange) error {
+	if len(ranges) > maxRanges {
+		return withHTTPCode(http.StatusRequestedRangeNotSatisfiable, fmt.Errorf("too many ranges"))
+	}
+	dig := ociregistry.Digest(rreq.Digest)
+	desc, err := r.backend.ResolveBlob(ctx, rreq.Repo, dig)
+	if err != nil {
+		return err
+	}
+	// Ignore any unsatisfiable ranges, as recommended by RFC 9110.
+	satisfiable := ranges[:0]
+	total := int64(0)
+	for _, rng := range ranges {
+		if rng.start >= desc.Size {
+			continue
 		}
-		defer blob.Close()
-		desc := blob.Descriptor()
 		if rng.end == -1 || rng.end > desc.Size {
 			rng.end = desc.Size
 		}
-		if rng.start > desc.Size {
-			return withHTTPCode(http.StatusRequestedRangeNotSatisfiable, fmt.Errorf("range starts after end of blob"))
+		satisfiable = append(satisfiable, rng)
+		total += rng.end - rng.start
+	}
+	if total > desc.Size {
+		// The ranges add up to more than the blob itself,
+		// so they must overlap a lot. That's probably an attack
+		// or a dumb client, so send the whole blob instead,
+		// as net/http does.
+		return r.serveBlob(ctx, resp, rreq)
+	}
+	switch len(satisfiable) {
+	case 0:
+		resp.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", desc.Size))
+		return withHTTPCode(http.StatusRequestedRangeNotSatisfiable, fmt.Errorf("no satisfiable ranges"))
+	case 1:
+		return r.serveBlobRange(ctx, resp, rreq, satisfiable[0])
+	}
+	// Fetch the first part before writing the response header
+	// so that we can return an error if the backend fails.
+	blob, err := r.backend.GetBlobRange(ctx, rreq.Repo, dig, satisfiable[0].start, satisfiable[0].end)
+	if err != nil {
+		return err
+	}
+	mw := multipart.NewWriter(resp)
+	resp.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	resp.Header().Set("Docker-Content-Digest", rreq.Digest)
+	resp.Header().Set("ETag", etag(dig))
+	resp.WriteHeader(http.StatusPartialContent)
+	for i, rng := range satisfiable {
+		if i > 0 {
+			blob, err = r.backend.GetBlobRange(ctx, rreq.Repo, dig, rng.start, rng.end)
+			if err != nil {
+				// It's too late to return an error, so abort the
+				// response so that the client doesn't mistake
+				// the truncated body for a complete one.
+				panic(http.ErrAbortHandler)
+			}
 		}
-		if rng.end < rng.start {
-			return withHTTPCode(http.StatusRequestedRangeNotSatisfiable, fmt.Errorf("range end is before start"))
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":  {desc.MediaType},
+			"Content-Range": {fmt.Sprintf("bytes %d-%d/%d", rng.start, rng.end-1, desc.Size)},
+		})
+		if err == nil {
+			_, err = io.Copy(w, blob)
+		}
+		blob.Close()
+		if err != nil {
+			panic(http.ErrAbortHandler)
 		}
-		resp.Header().Set("Content-Type", desc.MediaType)
-		resp.Header().Set("Content-Length", fmt.Sprint(rng.end-rng.start))
-		resp.Header().Set("Docker-Content-Digest", rreq.Digest)
-		resp.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", rng.start, rng.end-1, desc.Size))
-		resp.WriteHeader(http.StatusPartialContent)
-
-		io.Copy(resp, blob)
-		return nil
-
-	default:
-		return withHTTPCode(http.StatusRequestedRangeNotSatisfiable, fmt.Errorf("only a single range is supported"))
 	}
+	mw.Close()
+	return nil
 }
 
 func (r *registry) handleManifestGet(ctx context.Context, resp http.ResponseWriter, req *http.Request, rreq *ocirequest.Request) error {
@@ -125,10 +249,16 @@ func (r *registry) handleManifestGet(ctx context.Context, resp http.ResponseWrit
 	if err != nil {
 		return err
 	}
+	defer mr.Close()
 	desc := mr.Descriptor()
+	if isNotModified(req, desc.Digest, rreq.Tag == "") {
+		writeNotModified(resp, desc.Digest)
+		return nil
+	}
 	resp.Header().Set("Docker-Content-Digest", string(desc.Digest))
 	resp.Header().Set("Content-Type", desc.MediaType)
 	resp.Header().Set("Content-Length", fmt.Sprint(desc.Size))
+	resp.Header().Set("ETag", etag(desc.Digest))
 	resp.WriteHeader(http.StatusOK)
 	io.Copy(resp, mr)
 	return nil
@@ -145,9 +275,14 @@ func (r *registry) handleManifestHead(ctx context.Context, resp http.ResponseWri
 	if err != nil {
 		return err
 	}
+	if isNotModified(req, desc.Digest, rreq.Tag == "") {
+		writeNotModified(resp, desc.Digest)
+		return nil
+	}
 	resp.Header().Set("Docker-Content-Digest", string(desc.Digest))
 	resp.Header().Set("Content-Type", desc.MediaType)
 	resp.Header().Set("Content-Length", fmt.Sprint(desc.Size))
+	resp.Header().Set("ETag", etag(desc.Digest))
 	resp.WriteHeader(http.StatusOK)
 	return nil
 }
@@ -47,6 +47,9 @@ var v2 = ocispecroot.Versioned{
 type Options struct {
 	// DisableReferrersAPI, when true, causes the registry to behave as if
 	// it does not understand the referrers API.
+	// The referrers API is also disabled when the backend
+	// does not report [ociregistry.CapReferrers]
+	// (see [ociregistry.CapabilitiesOf]).
 	DisableReferrersAPI bool
 
 	// DisableSinglePostUpload, when true, causes the registry
@@ -140,6 +143,7 @@ var handlers = []func(r *registry, ctx context.Context, w http.ResponseWriter, r
 	ocirequest.ReqTagsList:           (*registry).handleTagsList,
 	ocirequest.ReqReferrersList:      (*registry).handleReferrersList,
 	ocirequest.ReqCatalogList:        (*registry).handleCatalogList,
+	ocirequest.ReqRepositoryDelete:   (*registry).handleRepositoryDelete,
 }
 
 func (r *registry) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
@@ -169,14 +173,27 @@ func (r *registry) v2(resp http.ResponseWriter, req *http.Request) (_err error)
 		return handlerErrorForRequestParseError(err)
 	}
 	handle := handlers[rreq.Kind]
-	return handle(r, req.Context(), resp, req, rreq)
+	return handle(r, requestContext(req), resp, req, rreq)
 }
 
 func (r *registry) handlePing(ctx context.Context, resp http.ResponseWriter, req *http.Request, rreq *ocirequest.Request) error {
 	resp.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	// Report the capabilities of the registry so that
+	// clients don't need to probe for them.
+	resp.Header().Set("Cuelabs-Capabilities", r.capabilities(ctx).String())
 	return nil
 }
 
+// capabilities returns the capabilities of the registry
+// as served, taking the options into account.
+func (r *registry) capabilities(ctx context.Context) ociregistry.Capabilities {
+	caps := ociregistry.CapabilitiesOf(ctx, r.backend)
+	if r.opts.DisableReferrersAPI {
+		caps &^= ociregistry.CapReferrers
+	}
+	return caps
+}
+
 func (r *registry) setLocationHeader(resp http.ResponseWriter, isManifest bool, desc ociregistry.Descriptor, defaultLocation string) error {
 	loc := defaultLocation
 	if r.opts.LocationsForDescriptor != nil {
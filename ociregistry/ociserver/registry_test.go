@@ -15,6 +15,8 @@
 package ociserver_test
 
 import (
+	"context"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"net/http"
@@ -23,6 +25,7 @@ import (
 	"strings"
 	"testing"
 
+	"cuelabs.dev/go/oci/ociregistry"
 	"cuelabs.dev/go/oci/ociregistry/ocimem"
 	"cuelabs.dev/go/oci/ociregistry/ociserver"
 	"github.com/opencontainers/go-digest"
@@ -60,6 +63,7 @@ func TestCalls(t *testing.T) {
 		URL           string
 		Digests       map[string]string
 		Manifests     map[string]string
+		Uploads       []string // upload IDs in URL form to start in foo
 		BlobStream    map[string]string
 		RequestHeader map[string]string
 
@@ -182,10 +186,8 @@ func TestCalls(t *testing.T) {
 			RequestHeader: map[string]string{
 				"Range": "bytes=20-30",
 			},
-			URL: "/v2/foo/blobs/sha256:b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9",
-			// TODO change the error interface to make it possible for ocimem
-			// to return an error that results in a 416 status.
-			WantCode: http.StatusInternalServerError,
+			URL:      "/v2/foo/blobs/sha256:b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9",
+			WantCode: http.StatusRequestedRangeNotSatisfiable,
 		},
 		{
 			Description: "HEAD_blob",
@@ -198,6 +200,148 @@ func TestCalls(t *testing.T) {
 				"Docker-Content-Digest": "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
 			},
 		},
+		{
+			Description: "GET_blob_etag",
+			Digests:     map[string]string{"sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae": "foo"},
+			Method:      "GET",
+			URL:         "/v2/foo/blobs/sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+			WantCode:    http.StatusOK,
+			WantHeader: map[string]string{
+				"ETag": `"sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"`,
+			},
+			WantBody: "foo",
+		},
+		{
+			Description: "GET_blob_if_none_match",
+			Digests:     map[string]string{"sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae": "foo"},
+			Method:      "GET",
+			URL:         "/v2/foo/blobs/sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+			RequestHeader: map[string]string{
+				"If-None-Match": `"sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", W/"sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"`,
+			},
+			WantCode: http.StatusNotModified,
+			WantHeader: map[string]string{
+				"ETag":                  `"sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"`,
+				"Docker-Content-Digest": "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+			},
+		},
+		{
+			Description: "GET_blob_if_none_match_no_match",
+			Digests:     map[string]string{"sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae": "foo"},
+			Method:      "GET",
+			URL:         "/v2/foo/blobs/sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+			RequestHeader: map[string]string{
+				"If-None-Match": `"sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"`,
+			},
+			WantCode: http.StatusOK,
+			WantBody: "foo",
+		},
+		{
+			Description: "GET_non_existent_blob_if_none_match",
+			Method:      "GET",
+			URL:         "/v2/foo/blobs/sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+			RequestHeader: map[string]string{
+				"If-None-Match": "*",
+			},
+			WantCode: http.StatusNotFound,
+		},
+		{
+			Description: "HEAD_blob_if_none_match",
+			Digests:     map[string]string{"sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae": "foo"},
+			Method:      "HEAD",
+			URL:         "/v2/foo/blobs/sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+			RequestHeader: map[string]string{
+				"If-None-Match": `"sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"`,
+			},
+			WantCode: http.StatusNotModified,
+		},
+		{
+			Description: "GET_blob_if_modified_since",
+			Digests:     map[string]string{"sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae": "foo"},
+			Method:      "GET",
+			URL:         "/v2/foo/blobs/sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+			RequestHeader: map[string]string{
+				"If-Modified-Since": "Sun, 06 Nov 1994 08:49:37 GMT",
+			},
+			WantCode: http.StatusNotModified,
+		},
+		{
+			Description: "GET_blob_if_modified_since_invalid_date",
+			Digests:     map[string]string{"sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae": "foo"},
+			Method:      "GET",
+			URL:         "/v2/foo/blobs/sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+			RequestHeader: map[string]string{
+				"If-Modified-Since": "yesterday",
+			},
+			WantCode: http.StatusOK,
+			WantBody: "foo",
+		},
+		{
+			Description: "GET_blob_range_if_range_match",
+			Digests:     map[string]string{"sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae": "foo"},
+			Method:      "GET",
+			URL:         "/v2/foo/blobs/sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+			RequestHeader: map[string]string{
+				"Range":    "bytes=1-",
+				"If-Range": `"sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"`,
+			},
+			WantCode: http.StatusPartialContent,
+			WantHeader: map[string]string{
+				"Content-Range": "bytes 1-2/3",
+			},
+			WantBody: "oo",
+		},
+		{
+			Description: "GET_blob_range_if_range_no_match",
+			Digests:     map[string]string{"sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae": "foo"},
+			Method:      "GET",
+			URL:         "/v2/foo/blobs/sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+			RequestHeader: map[string]string{
+				"Range":    "bytes=1-",
+				"If-Range": `"sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"`,
+			},
+			WantCode: http.StatusOK,
+			WantBody: "foo",
+		},
+		{
+			Description: "GET_blob_range_if_range_date",
+			Digests:     map[string]string{"sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae": "foo"},
+			Method:      "GET",
+			URL:         "/v2/foo/blobs/sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+			RequestHeader: map[string]string{
+				"Range":    "bytes=1-",
+				"If-Range": "Sun, 06 Nov 1994 08:49:37 GMT",
+			},
+			WantCode: http.StatusOK,
+			WantBody: "foo",
+		},
+		{
+			Description: "GET_blob_multiple_ranges_unsatisfiable",
+			Digests:     map[string]string{"sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae": "foo"},
+			Method:      "GET",
+			URL:         "/v2/foo/blobs/sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+			RequestHeader: map[string]string{
+				"Range": "bytes=5-6,10-",
+			},
+			WantCode: http.StatusRequestedRangeNotSatisfiable,
+			WantHeader: map[string]string{
+				"Content-Range": "bytes */3",
+			},
+		},
+		{
+			Description: "GET_blob_multiple_ranges_one_satisfiable",
+			Digests:     map[string]string{"sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae": "foo"},
+			Method:      "GET",
+			URL:         "/v2/foo/blobs/sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+			RequestHeader: map[string]string{
+				"Range": "bytes=1-1,10-",
+			},
+			WantCode: http.StatusPartialContent,
+			WantHeader: map[string]string{
+				"Content-Range": "bytes 1-1/3",
+			},
+			WantBody: "o",
+		},
 		{
 			Description: "DELETE_blob",
 			Digests:     map[string]string{"sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae": "foo"},
@@ -250,6 +394,7 @@ func TestCalls(t *testing.T) {
 			Description: "upload_good_digest",
 			Method:      "PUT",
 			URL:         "/v2/foo/blobs/uploads/MQ?digest=sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+			Uploads:     []string{"MQ"},
 			WantCode:    http.StatusCreated,
 			Body:        "foo",
 			WantHeader:  map[string]string{"Docker-Content-Digest": "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"},
@@ -265,6 +410,7 @@ func TestCalls(t *testing.T) {
 			Description: "stream_upload",
 			Method:      "PATCH",
 			URL:         "/v2/foo/blobs/uploads/MQ",
+			Uploads:     []string{"MQ"},
 			WantCode:    http.StatusAccepted,
 			Body:        "foo",
 			RequestHeader: map[string]string{
@@ -341,6 +487,50 @@ func TestCalls(t *testing.T) {
 			URL:         "/v2/foo/manifests/latest",
 			WantCode:    http.StatusOK,
 		},
+		{
+			Description: "get_manifest_by_tag_if_none_match",
+			Manifests:   map[string]string{"foo/manifests/latest": "foo"},
+			Method:      "GET",
+			URL:         "/v2/foo/manifests/latest",
+			RequestHeader: map[string]string{
+				"If-None-Match": `"sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"`,
+			},
+			WantCode: http.StatusNotModified,
+		},
+		{
+			Description: "get_manifest_by_tag_if_modified_since",
+			Manifests:   map[string]string{"foo/manifests/latest": "foo"},
+			Method:      "GET",
+			URL:         "/v2/foo/manifests/latest",
+			RequestHeader: map[string]string{
+				"If-Modified-Since": "Sun, 06 Nov 1994 08:49:37 GMT",
+			},
+			WantCode: http.StatusOK,
+			WantHeader: map[string]string{
+				"ETag": `"sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"`,
+			},
+			WantBody: "foo",
+		},
+		{
+			Description: "get_manifest_by_digest_if_modified_since",
+			Manifests:   map[string]string{"foo/manifests/latest": "foo"},
+			Method:      "GET",
+			URL:         "/v2/foo/manifests/sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+			RequestHeader: map[string]string{
+				"If-Modified-Since": "Sun, 06 Nov 1994 08:49:37 GMT",
+			},
+			WantCode: http.StatusNotModified,
+		},
+		{
+			Description: "head_manifest_if_none_match",
+			Manifests:   map[string]string{"foo/manifests/latest": "foo"},
+			Method:      "HEAD",
+			URL:         "/v2/foo/manifests/latest",
+			RequestHeader: map[string]string{
+				"If-None-Match": `"sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"`,
+			},
+			WantCode: http.StatusNotModified,
+		},
 		{
 			Description: "create_manifest",
 			Method:      "PUT",
@@ -391,6 +581,7 @@ func TestCalls(t *testing.T) {
 			Description:   "Chunk_upload_start",
 			Method:        "PATCH",
 			URL:           "/v2/foo/blobs/uploads/MQ",
+			Uploads:       []string{"MQ"},
 			RequestHeader: map[string]string{"Content-Range": "0-2"},
 			WantCode:      http.StatusAccepted,
 			Body:          "foo",
@@ -399,6 +590,16 @@ func TestCalls(t *testing.T) {
 				"Location": "/v2/foo/blobs/uploads/MQ",
 			},
 		},
+		{
+			Description:   "Chunk_upload_unknown_id",
+			Method:        "PATCH",
+			URL:           "/v2/foo/blobs/uploads/MQ",
+			Digests:       map[string]string{"sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae": "foo"},
+			RequestHeader: map[string]string{"Content-Range": "0-2"},
+			WantCode:      http.StatusNotFound,
+			Body:          "foo",
+			WantBody:      `{"errors":[{"code":"BLOB_UPLOAD_UNKNOWN","message":"blob upload unknown to registry"}]}`,
+		},
 		{
 			Description:   "Chunk_upload_bad_content_range",
 			Method:        "PATCH",
@@ -550,7 +751,11 @@ func TestCalls(t *testing.T) {
 			if tc.skip {
 				t.Skip("skipping")
 			}
-			r := ociserver.New(ocimem.New(), nil)
+			mem := &fixedIDRegistry{
+				Registry: ocimem.New(),
+				ids:      make(map[string]string),
+			}
+			r := ociserver.New(mem, nil)
 			s := httptest.NewServer(r)
 			defer s.Close()
 
@@ -587,7 +792,22 @@ func TestCalls(t *testing.T) {
 				}
 			}
 
+			startUpload := func(upload string) {
+				id, err := base64.RawURLEncoding.DecodeString(upload)
+				if err != nil {
+					t.Fatal(err)
+				}
+				w, err := mem.PushBlobChunked(context.Background(), "foo", 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				mem.ids[string(id)] = w.ID()
+			}
+			for _, upload := range tc.Uploads {
+				startUpload(upload)
+			}
 			for upload, contents := range tc.BlobStream {
+				startUpload(upload)
 				req, err := http.NewRequest(
 					"PATCH",
 					fmt.Sprintf("%s/v2/foo/blobs/uploads/%s", s.URL, upload),
@@ -655,3 +875,34 @@ func TestCalls(t *testing.T) {
 func digestOf(s string) string {
 	return string(digest.FromString(s))
 }
+
+// fixedIDRegistry wraps an ocimem registry so that uploads
+// can be resumed with IDs chosen by the test cases
+// rather than the randomly allocated ones.
+type fixedIDRegistry struct {
+	*ocimem.Registry
+
+	// ids maps from fixed ID to actual upload ID.
+	ids map[string]string
+}
+
+func (r *fixedIDRegistry) PushBlobChunkedResume(ctx context.Context, repo, id string, offset int64, chunkSize int) (ociregistry.BlobWriter, error) {
+	actualID, ok := r.ids[id]
+	if !ok {
+		return r.Registry.PushBlobChunkedResume(ctx, repo, id, offset, chunkSize)
+	}
+	w, err := r.Registry.PushBlobChunkedResume(ctx, repo, actualID, offset, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+	return fixedIDWriter{w, id}, nil
+}
+
+type fixedIDWriter struct {
+	ociregistry.BlobWriter
+	id string
+}
+
+func (w fixedIDWriter) ID() string {
+	return w.id
+}
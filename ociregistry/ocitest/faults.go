@@ -0,0 +1,508 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocitest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"cuelabs.dev/go/oci/ociregistry"
+)
+
+// Fault describes a fault to be injected by [NewFaultyRegistry].
+//
+// A fault applies to a call when its method and repository
+// match, it has some effect on that kind of call, and the
+// call is selected according to the Skip, Limit and Probability
+// fields. For example, a fault with only Truncate set has no
+// effect on ResolveBlob, so calls to ResolveBlob are not counted
+// by Skip or Limit. When a fault applies, the Latency delay
+// is incurred first and then any of the other faults
+// are applied.
+type Fault struct {
+	// Methods holds the names of the methods that the fault
+	// applies to, for example "GetBlob" or "PushManifest".
+	// Calls to [ociregistry.BlobWriter] methods are named with
+	// a "BlobWriter." prefix, for example "BlobWriter.Write".
+	// If this is empty, the fault applies to all methods.
+	Methods []string
+
+	// Repos holds the repositories that the fault applies to.
+	// For MountBlob, the destination repository is used.
+	// If this is empty, the fault applies to all repositories.
+	// Note that a non-empty Repos never matches the Repositories
+	// method, which has no associated repository.
+	Repos []string
+
+	// Skip holds the number of matching calls to let through
+	// before the fault is first applied.
+	Skip int
+
+	// Limit holds the maximum number of times the fault is
+	// applied. If it's zero, there is no limit.
+	Limit int
+
+	// Probability holds the probability that the fault is applied
+	// to any given matching call. If it's zero, the fault is
+	// always applied.
+	Probability float64
+
+	// Latency holds a delay to add before the call is made.
+	// The delay is cut short if the context is canceled.
+	Latency time.Duration
+
+	// Err holds an error to return from the call. Use an
+	// [ociregistry.Error] such as [ociregistry.ErrNameUnknown]
+	// to simulate a specific registry error response.
+	Err error
+
+	// RateLimit causes the call to fail with an error wrapping
+	// [ociregistry.ErrTooManyRequests], as if the registry were
+	// rate limiting requests. The error has a RetryAfter method
+	// that returns RetryAfter; when it's served by
+	// ociserver, the response has status 429 and,
+	// if RetryAfter is non-zero, a Retry-After header.
+	// Err takes precedence over RateLimit.
+	RateLimit  bool
+	RetryAfter time.Duration
+
+	// Truncate causes a returned [ociregistry.BlobReader] to fail
+	// with [io.ErrUnexpectedEOF] after TruncateAt bytes
+	// have been read.
+	Truncate   bool
+	TruncateAt int64
+
+	// Corrupt causes the byte at offset CorruptAt of a
+	// returned [ociregistry.BlobReader] to be changed.
+	Corrupt   bool
+	CorruptAt int64
+
+	// ShortWrite causes [ociregistry.BlobWriter.Write] to write only
+	// half of the data it's given and return [io.ErrShortWrite].
+	ShortWrite bool
+}
+
+// FaultConfig holds the configuration for [NewFaultyRegistry].
+type FaultConfig struct {
+	// Faults holds the faults to inject. For each call, the first
+	// fault that applies is used.
+	Faults []Fault
+
+	// Seed holds the seed used to make the random choices
+	// when a fault has a non-zero Probability. The same seed
+	// with the same sequence of calls produces the same
+	// sequence of faults.
+	Seed int64
+}
+
+// NewFaultyRegistry returns a wrapper for r that injects faults
+// into calls as described by cfg. It's intended for testing
+// the error and retry paths of registry clients.
+func NewFaultyRegistry(r ociregistry.Interface, cfg *FaultConfig) ociregistry.Interface {
+	if cfg == nil {
+		cfg = new(FaultConfig)
+	}
+	faults := make([]*faultState, len(cfg.Faults))
+	for i := range cfg.Faults {
+		faults[i] = &faultState{
+			Fault: cfg.Faults[i],
+		}
+	}
+	return &faultyRegistry{
+		r:      r,
+		faults: faults,
+		rand:   rand.New(rand.NewSource(cfg.Seed)),
+	}
+}
+
+type faultyRegistry struct {
+	// Embed Funcs rather than the interface directly so that
+	// if new methods are added and faultyRegistry isn't updated,
+	// we fall back to returning an error rather than passing through the method.
+	*ociregistry.Funcs
+	r ociregistry.Interface
+
+	mu     sync.Mutex
+	rand   *rand.Rand
+	faults []*faultState
+}
+
+type faultState struct {
+	Fault
+	matched int
+	applied int
+}
+
+func (f *faultState) matches(method, repo string) bool {
+	return (len(f.Methods) == 0 || contains(f.Methods, method)) &&
+		(len(f.Repos) == 0 || contains(f.Repos, repo))
+}
+
+// readerMethods holds the methods that return
+// an [ociregistry.BlobReader].
+var readerMethods = map[string]bool{
+	"GetBlob":      true,
+	"GetBlobRange": true,
+	"GetManifest":  true,
+	"GetTag":       true,
+}
+
+// affects reports whether f has any effect on
+// a call to the given method.
+func (f *Fault) affects(method string) bool {
+	switch {
+	case f.Latency > 0 || f.Err != nil || f.RateLimit:
+		return true
+	case readerMethods[method]:
+		return f.Truncate || f.Corrupt
+	case method == "BlobWriter.Write":
+		return f.ShortWrite
+	}
+	return false
+}
+
+// fault returns the fault that applies to a call of the given
+// method on the given repository, or nil if there is none.
+// It incurs any latency associated with the fault and returns
+// an error if the context is canceled while doing so.
+func (r *faultyRegistry) fault(ctx context.Context, method, repo string) (*Fault, error) {
+	f := r.selectFault(method, repo)
+	if f == nil {
+		return nil, nil
+	}
+	if f.Latency > 0 {
+		t := time.NewTimer(f.Latency)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return f, nil
+}
+
+func (r *faultyRegistry) selectFault(method, repo string) *Fault {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, f := range r.faults {
+		if !f.matches(method, repo) || !f.affects(method) {
+			continue
+		}
+		f.matched++
+		if f.matched <= f.Skip {
+			continue
+		}
+		if f.Limit > 0 && f.applied >= f.Limit {
+			continue
+		}
+		if f.Probability > 0 && r.rand.Float64() >= f.Probability {
+			continue
+		}
+		f.applied++
+		fault := f.Fault
+		return &fault
+	}
+	return nil
+}
+
+// callError returns any error to be returned directly
+// from a call.
+func (r *faultyRegistry) callError(ctx context.Context, method, repo string) (*Fault, error) {
+	f, err := r.fault(ctx, method, repo)
+	if err != nil {
+		return nil, err
+	}
+	if f != nil && f.Err != nil {
+		return nil, f.Err
+	}
+	if f != nil && f.RateLimit {
+		return nil, &rateLimitError{
+			retryAfter: f.RetryAfter,
+		}
+	}
+	return f, nil
+}
+
+// rateLimitError is the error returned for a RateLimit fault.
+type rateLimitError struct {
+	retryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	return fmt.Sprintf("%v (retry after %v)", ociregistry.ErrTooManyRequests, e.retryAfter)
+}
+
+func (e *rateLimitError) Unwrap() error {
+	return ociregistry.ErrTooManyRequests
+}
+
+// RetryAfter returns how long the client
+// should wait before retrying.
+func (e *rateLimitError) RetryAfter() time.Duration {
+	return e.retryAfter
+}
+
+func (r *faultyRegistry) Capabilities(ctx context.Context) ociregistry.Capabilities {
+	return ociregistry.CapabilitiesOf(ctx, r.r)
+}
+
+func (r *faultyRegistry) GetBlob(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.BlobReader, error) {
+	f, err := r.callError(ctx, "GetBlob", repo)
+	if err != nil {
+		return nil, err
+	}
+	return faultyReader(f)(r.r.GetBlob(ctx, repo, digest))
+}
+
+func (r *faultyRegistry) GetBlobRange(ctx context.Context, repo string, digest ociregistry.Digest, offset0, offset1 int64) (ociregistry.BlobReader, error) {
+	f, err := r.callError(ctx, "GetBlobRange", repo)
+	if err != nil {
+		return nil, err
+	}
+	return faultyReader(f)(r.r.GetBlobRange(ctx, repo, digest, offset0, offset1))
+}
+
+func (r *faultyRegistry) GetManifest(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.BlobReader, error) {
+	f, err := r.callError(ctx, "GetManifest", repo)
+	if err != nil {
+		return nil, err
+	}
+	return faultyReader(f)(r.r.GetManifest(ctx, repo, digest))
+}
+
+func (r *faultyRegistry) GetTag(ctx context.Context, repo string, tagName string) (ociregistry.BlobReader, error) {
+	f, err := r.callError(ctx, "GetTag", repo)
+	if err != nil {
+		return nil, err
+	}
+	return faultyReader(f)(r.r.GetTag(ctx, repo, tagName))
+}
+
+func (r *faultyRegistry) ResolveBlob(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.Descriptor, error) {
+	if _, err := r.callError(ctx, "ResolveBlob", repo); err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	return r.r.ResolveBlob(ctx, repo, digest)
+}
+
+func (r *faultyRegistry) ResolveManifest(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.Descriptor, error) {
+	if _, err := r.callError(ctx, "ResolveManifest", repo); err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	return r.r.ResolveManifest(ctx, repo, digest)
+}
+
+func (r *faultyRegistry) ResolveTag(ctx context.Context, repo string, tagName string) (ociregistry.Descriptor, error) {
+	if _, err := r.callError(ctx, "ResolveTag", repo); err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	return r.r.ResolveTag(ctx, repo, tagName)
+}
+
+func (r *faultyRegistry) PushBlob(ctx context.Context, repo string, desc ociregistry.Descriptor, rd io.Reader) (ociregistry.Descriptor, error) {
+	if _, err := r.callError(ctx, "PushBlob", repo); err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	return r.r.PushBlob(ctx, repo, desc, rd)
+}
+
+func (r *faultyRegistry) PushBlobChunked(ctx context.Context, repo string, chunkSize int) (ociregistry.BlobWriter, error) {
+	if _, err := r.callError(ctx, "PushBlobChunked", repo); err != nil {
+		return nil, err
+	}
+	return r.faultyWriter(ctx, repo)(r.r.PushBlobChunked(ctx, repo, chunkSize))
+}
+
+func (r *faultyRegistry) PushBlobChunkedResume(ctx context.Context, repo, id string, offset int64, chunkSize int) (ociregistry.BlobWriter, error) {
+	if _, err := r.callError(ctx, "PushBlobChunkedResume", repo); err != nil {
+		return nil, err
+	}
+	return r.faultyWriter(ctx, repo)(r.r.PushBlobChunkedResume(ctx, repo, id, offset, chunkSize))
+}
+
+func (r *faultyRegistry) MountBlob(ctx context.Context, fromRepo, toRepo string, digest ociregistry.Digest) (ociregistry.Descriptor, error) {
+	if _, err := r.callError(ctx, "MountBlob", toRepo); err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	return r.r.MountBlob(ctx, fromRepo, toRepo, digest)
+}
+
+func (r *faultyRegistry) PushManifest(ctx context.Context, repo string, tag string, contents []byte, mediaType string) (ociregistry.Descriptor, error) {
+	if _, err := r.callError(ctx, "PushManifest", repo); err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	return r.r.PushManifest(ctx, repo, tag, contents, mediaType)
+}
+
+func (r *faultyRegistry) DeleteBlob(ctx context.Context, repo string, digest ociregistry.Digest) error {
+	if _, err := r.callError(ctx, "DeleteBlob", repo); err != nil {
+		return err
+	}
+	return r.r.DeleteBlob(ctx, repo, digest)
+}
+
+func (r *faultyRegistry) DeleteManifest(ctx context.Context, repo string, digest ociregistry.Digest) error {
+	if _, err := r.callError(ctx, "DeleteManifest", repo); err != nil {
+		return err
+	}
+	return r.r.DeleteManifest(ctx, repo, digest)
+}
+
+func (r *faultyRegistry) DeleteTag(ctx context.Context, repo string, name string) error {
+	if _, err := r.callError(ctx, "DeleteTag", repo); err != nil {
+		return err
+	}
+	return r.r.DeleteTag(ctx, repo, name)
+}
+
+func (r *faultyRegistry) DeleteRepository(ctx context.Context, repo string) error {
+	if _, err := r.callError(ctx, "DeleteRepository", repo); err != nil {
+		return err
+	}
+	return ociregistry.DeleteRepository(ctx, r.r, repo)
+}
+
+func (r *faultyRegistry) Repositories(ctx context.Context) ociregistry.Iter[string] {
+	if _, err := r.callError(ctx, "Repositories", ""); err != nil {
+		return ociregistry.ErrorIter[string](err)
+	}
+	return r.r.Repositories(ctx)
+}
+
+func (r *faultyRegistry) Tags(ctx context.Context, repo string) ociregistry.Iter[string] {
+	if _, err := r.callError(ctx, "Tags", repo); err != nil {
+		return ociregistry.ErrorIter[string](err)
+	}
+	return r.r.Tags(ctx, repo)
+}
+
+func (r *faultyRegistry) Referrers(ctx context.Context, repo string, digest ociregistry.Digest, artifactType string) ociregistry.Iter[ociregistry.Descriptor] {
+	if _, err := r.callError(ctx, "Referrers", repo); err != nil {
+		return ociregistry.ErrorIter[ociregistry.Descriptor](err)
+	}
+	return r.r.Referrers(ctx, repo, digest, artifactType)
+}
+
+// faultyReader returns a function that wraps the result of
+// a call returning a BlobReader so that it applies
+// any reader faults in f.
+func faultyReader(f *Fault) func(ociregistry.BlobReader, error) (ociregistry.BlobReader, error) {
+	return func(rd ociregistry.BlobReader, err error) (ociregistry.BlobReader, error) {
+		if err != nil || f == nil || (!f.Truncate && !f.Corrupt) {
+			return rd, err
+		}
+		return &faultyBlobReader{
+			BlobReader: rd,
+			fault:      f,
+		}, nil
+	}
+}
+
+type faultyBlobReader struct {
+	ociregistry.BlobReader
+	fault *Fault
+	n     int64
+}
+
+func (r *faultyBlobReader) Read(buf []byte) (int, error) {
+	if r.fault.Truncate {
+		if r.n >= r.fault.TruncateAt {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if avail := r.fault.TruncateAt - r.n; int64(len(buf)) > avail {
+			buf = buf[:avail]
+		}
+	}
+	n, err := r.BlobReader.Read(buf)
+	if r.fault.Corrupt && r.fault.CorruptAt >= r.n && r.fault.CorruptAt < r.n+int64(n) {
+		buf[r.fault.CorruptAt-r.n] ^= 0xff
+	}
+	r.n += int64(n)
+	return n, err
+}
+
+// faultyWriter returns a function that wraps the result of
+// a call returning a BlobWriter so that its methods are
+// subject to faults too.
+func (r *faultyRegistry) faultyWriter(ctx context.Context, repo string) func(ociregistry.BlobWriter, error) (ociregistry.BlobWriter, error) {
+	return func(w ociregistry.BlobWriter, err error) (ociregistry.BlobWriter, error) {
+		if err != nil {
+			return nil, err
+		}
+		return &faultyBlobWriter{
+			BlobWriter: w,
+			r:          r,
+			ctx:        ctx,
+			repo:       repo,
+		}, nil
+	}
+}
+
+type faultyBlobWriter struct {
+	ociregistry.BlobWriter
+	r    *faultyRegistry
+	ctx  context.Context
+	repo string
+}
+
+func (w *faultyBlobWriter) Write(buf []byte) (int, error) {
+	f, err := w.r.callError(w.ctx, "BlobWriter.Write", w.repo)
+	if err != nil {
+		return 0, err
+	}
+	if f != nil && f.ShortWrite && len(buf) > 0 {
+		n, err := w.BlobWriter.Write(buf[:len(buf)/2])
+		if err != nil {
+			return n, err
+		}
+		return n, io.ErrShortWrite
+	}
+	return w.BlobWriter.Write(buf)
+}
+
+func (w *faultyBlobWriter) Close() error {
+	if _, err := w.r.callError(w.ctx, "BlobWriter.Close", w.repo); err != nil {
+		return err
+	}
+	return w.BlobWriter.Close()
+}
+
+func (w *faultyBlobWriter) Cancel() error {
+	if _, err := w.r.callError(w.ctx, "BlobWriter.Cancel", w.repo); err != nil {
+		return err
+	}
+	return w.BlobWriter.Cancel()
+}
+
+func (w *faultyBlobWriter) Commit(digest ociregistry.Digest) (ociregistry.Descriptor, error) {
+	if _, err := w.r.callError(w.ctx, "BlobWriter.Commit", w.repo); err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	return w.BlobWriter.Commit(digest)
+}
+
+func contains(xs []string, x string) bool {
+	for _, y := range xs {
+		if y == x {
+			return true
+		}
+	}
+	return false
+}
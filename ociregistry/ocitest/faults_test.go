@@ -0,0 +1,221 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocitest_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/go-quicktest/qt"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ociclient"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ociserver"
+	"cuelabs.dev/go/oci/ociregistry/ocitest"
+)
+
+func TestFaultyRegistryNoFaults(t *testing.T) {
+	ocitest.RunInterfaceTests(t, func(t *testing.T) ociregistry.Interface {
+		return ocitest.NewFaultyRegistry(ocimem.New(), nil)
+	})
+}
+
+func TestFaultyRegistryError(t *testing.T) {
+	ctx := context.Background()
+	r := ocitest.NewFaultyRegistry(ocimem.New(), &ocitest.FaultConfig{
+		Faults: []ocitest.Fault{{
+			Methods: []string{"GetBlob"},
+			Repos:   []string{"foo"},
+			Skip:    1,
+			Limit:   2,
+			Err:     ociregistry.ErrTooManyRequests,
+		}},
+	})
+	desc := ocitest.NewRegistry(t, r).MustPushBlob("foo", []byte("hello"))
+	ocitest.NewRegistry(t, r).MustPushBlob("bar", []byte("hello"))
+
+	var errs []error
+	for i := 0; i < 5; i++ {
+		rd, err := r.GetBlob(ctx, "foo", desc.Digest)
+		if err == nil {
+			rd.Close()
+		}
+		errs = append(errs, err)
+	}
+	qt.Check(t, qt.IsNil(errs[0]))
+	qt.Check(t, qt.ErrorIs(errs[1], ociregistry.ErrTooManyRequests))
+	qt.Check(t, qt.ErrorIs(errs[2], ociregistry.ErrTooManyRequests))
+	qt.Check(t, qt.IsNil(errs[3]))
+	qt.Check(t, qt.IsNil(errs[4]))
+
+	// Other repositories and methods are unaffected.
+	rd, err := r.GetBlob(ctx, "bar", desc.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	rd.Close()
+	_, err = r.ResolveBlob(ctx, "foo", desc.Digest)
+	qt.Assert(t, qt.IsNil(err))
+}
+
+func TestFaultyRegistryProbability(t *testing.T) {
+	ctx := context.Background()
+	run := func(seed int64) []bool {
+		r := ocitest.NewFaultyRegistry(ocimem.New(), &ocitest.FaultConfig{
+			Seed: seed,
+			Faults: []ocitest.Fault{{
+				Probability: 0.5,
+				Err:         ociregistry.ErrTooManyRequests,
+			}},
+		})
+		var failed []bool
+		for i := 0; i < 50; i++ {
+			_, err := r.ResolveTag(ctx, "foo", "latest")
+			failed = append(failed, err == ociregistry.ErrTooManyRequests)
+		}
+		return failed
+	}
+	failed := run(1)
+	qt.Check(t, qt.DeepEquals(run(1), failed))
+	qt.Check(t, qt.SliceContains(failed, true))
+	qt.Check(t, qt.SliceContains(failed, false))
+}
+
+func TestFaultyRegistryLatency(t *testing.T) {
+	r := ocitest.NewFaultyRegistry(ocimem.New(), &ocitest.FaultConfig{
+		Faults: []ocitest.Fault{{
+			Latency: time.Hour,
+		}},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := r.ResolveTag(ctx, "foo", "latest")
+	qt.Check(t, qt.ErrorIs(err, context.DeadlineExceeded))
+}
+
+func TestFaultyRegistryTruncate(t *testing.T) {
+	ctx := context.Background()
+	r := ocitest.NewFaultyRegistry(ocimem.New(), &ocitest.FaultConfig{
+		Faults: []ocitest.Fault{{
+			Methods:    []string{"GetBlob"},
+			Truncate:   true,
+			TruncateAt: 3,
+		}},
+	})
+	desc := ocitest.NewRegistry(t, r).MustPushBlob("foo", []byte("hello"))
+	rd, err := r.GetBlob(ctx, "foo", desc.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	defer rd.Close()
+	data, err := io.ReadAll(rd)
+	qt.Check(t, qt.ErrorIs(err, io.ErrUnexpectedEOF))
+	qt.Check(t, qt.Equals(string(data), "hel"))
+}
+
+func TestFaultyRegistryCountsOnlyAffectedCalls(t *testing.T) {
+	ctx := context.Background()
+	r := ocitest.NewFaultyRegistry(ocimem.New(), &ocitest.FaultConfig{
+		Faults: []ocitest.Fault{{
+			Limit:      1,
+			Truncate:   true,
+			TruncateAt: 3,
+		}},
+	})
+	desc := ocitest.NewRegistry(t, r).MustPushBlob("foo", []byte("hello"))
+	// ResolveBlob doesn't return a reader, so it isn't
+	// affected and doesn't use up the fault's limit.
+	_, err := r.ResolveBlob(ctx, "foo", desc.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	for _, want := range []string{"hel", "hello"} {
+		rd, err := r.GetBlob(ctx, "foo", desc.Digest)
+		qt.Assert(t, qt.IsNil(err))
+		data, _ := io.ReadAll(rd)
+		rd.Close()
+		qt.Check(t, qt.Equals(string(data), want))
+	}
+}
+
+func TestFaultyRegistryRateLimit(t *testing.T) {
+	backend := ocimem.New()
+	desc := ocitest.NewRegistry(t, backend).MustPushBlob("foo", []byte("hello"))
+	srv := httptest.NewServer(ociserver.New(ocitest.NewFaultyRegistry(backend, &ocitest.FaultConfig{
+		Faults: []ocitest.Fault{{
+			Methods:    []string{"GetBlob"},
+			RateLimit:  true,
+			RetryAfter: 1500 * time.Millisecond,
+		}},
+	}), nil))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/v2/foo/blobs/" + string(desc.Digest))
+	qt.Assert(t, qt.IsNil(err))
+	resp.Body.Close()
+	qt.Check(t, qt.Equals(resp.StatusCode, http.StatusTooManyRequests))
+	qt.Check(t, qt.Equals(resp.Header.Get("Retry-After"), "2"))
+
+	// The client sees the usual error.
+	srvURL, _ := url.Parse(srv.URL)
+	client, err := ociclient.New(srvURL.Host, &ociclient.Options{
+		Insecure: true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	_, err = client.GetBlob(context.Background(), "foo", desc.Digest)
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrTooManyRequests))
+}
+
+func TestFaultyRegistryShortWrite(t *testing.T) {
+	ctx := context.Background()
+	r := ocitest.NewFaultyRegistry(ocimem.New(), &ocitest.FaultConfig{
+		Faults: []ocitest.Fault{{
+			Methods:    []string{"BlobWriter.Write"},
+			ShortWrite: true,
+		}},
+	})
+	w, err := r.PushBlobChunked(ctx, "foo", 0)
+	qt.Assert(t, qt.IsNil(err))
+	defer w.Cancel()
+	n, err := w.Write([]byte("hello"))
+	qt.Check(t, qt.ErrorIs(err, io.ErrShortWrite))
+	qt.Check(t, qt.Equals(n, 2))
+	qt.Check(t, qt.Equals(w.Size(), int64(2)))
+}
+
+func TestFaultyRegistryCorruptThroughClient(t *testing.T) {
+	// Check that a client talking to a server that
+	// serves corrupted content detects the corruption.
+	ctx := context.Background()
+	backend := ocimem.New()
+	desc := ocitest.NewRegistry(t, backend).MustPushBlob("foo", []byte("hello world"))
+	srv := httptest.NewServer(ociserver.New(ocitest.NewFaultyRegistry(backend, &ocitest.FaultConfig{
+		Faults: []ocitest.Fault{{
+			Methods:   []string{"GetBlob"},
+			Corrupt:   true,
+			CorruptAt: 4,
+		}},
+	}), nil))
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+	client, err := ociclient.New(srvURL.Host, &ociclient.Options{
+		Insecure: true,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	rd, err := client.GetBlob(ctx, "foo", desc.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	defer rd.Close()
+	_, err = io.ReadAll(rd)
+	qt.Check(t, qt.ErrorMatches(err, "digest mismatch when reading blob"))
+}
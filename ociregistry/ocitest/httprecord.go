@@ -0,0 +1,362 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocitest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// redacted is used in place of secret values in recorded interactions.
+const redacted = "REDACTED"
+
+// Cassette holds a sequence of recorded HTTP interactions, as
+// recorded by [HTTPRecorder] and replayed by [HTTPReplayer].
+// It's designed to be stored as JSON.
+type Cassette struct {
+	Interactions []HTTPInteraction `json:"interactions"`
+}
+
+// HTTPInteraction holds a single recorded HTTP request
+// and its response.
+type HTTPInteraction struct {
+	Request  RecordedRequest  `json:"request"`
+	Response RecordedResponse `json:"response"`
+}
+
+// RecordedRequest holds a recorded HTTP request.
+type RecordedRequest struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header,omitempty"`
+
+	// BodyDigest holds the digest of the request body,
+	// used to distinguish between requests with the same
+	// method and URL. It's empty when there's no body.
+	BodyDigest digest.Digest `json:"bodyDigest,omitempty"`
+}
+
+// RecordedResponse holds a recorded HTTP response.
+type RecordedResponse struct {
+	StatusCode int         `json:"statusCode"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       []byte      `json:"body,omitempty"`
+}
+
+// ReadCassette reads a cassette from the JSON file
+// at the given path.
+func ReadCassette(path string) (*Cassette, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c Cassette
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal cassette %q: %v", path, err)
+	}
+	return &c, nil
+}
+
+// WriteFile writes the cassette as JSON to the file at the given path.
+func (c *Cassette) WriteFile(path string) error {
+	data, err := json.MarshalIndent(c, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o666)
+}
+
+// HTTPRecorder implements [ociclient.HTTPDoer] by
+// forwarding requests to another HTTPDoer and
+// recording the interactions.
+//
+// Credentials are scrubbed from the recorded
+// interactions: this includes the Authorization and Cookie
+// headers, user information and signature or token query
+// parameters in request URLs and Location headers,
+// passwords and refresh tokens in token request bodies
+// and tokens in JSON response bodies.
+type HTTPRecorder struct {
+	doer interface {
+		Do(*http.Request) (*http.Response, error)
+	}
+
+	mu       sync.Mutex
+	cassette Cassette
+}
+
+// NewHTTPRecorder returns a recorder that sends requests to doer.
+// If doer is nil, [http.DefaultClient] is used.
+func NewHTTPRecorder(doer interface {
+	Do(*http.Request) (*http.Response, error)
+}) *HTTPRecorder {
+	if doer == nil {
+		doer = http.DefaultClient
+	}
+	return &HTTPRecorder{
+		doer: doer,
+	}
+}
+
+// Do implements [ociclient.HTTPDoer.Do].
+func (r *HTTPRecorder) Do(req *http.Request) (*http.Response, error) {
+	bodyDigest, err := requestBodyDigest(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.doer.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read response body: %v", err)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cassette.Interactions = append(r.cassette.Interactions, HTTPInteraction{
+		Request: RecordedRequest{
+			Method:     req.Method,
+			URL:        scrubURL(req.URL),
+			Header:     scrubHeader(req.Header),
+			BodyDigest: bodyDigest,
+		},
+		Response: RecordedResponse{
+			StatusCode: resp.StatusCode,
+			Header:     scrubHeader(resp.Header),
+			Body:       scrubResponseBody(resp.Header, body),
+		},
+	})
+	return resp, nil
+}
+
+// Cassette returns a copy of all the interactions recorded so far.
+func (r *HTTPRecorder) Cassette() *Cassette {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return &Cassette{
+		Interactions: append([]HTTPInteraction(nil), r.cassette.Interactions...),
+	}
+}
+
+// HTTPReplayer implements [ociclient.HTTPDoer] by
+// replaying interactions from a [Cassette].
+//
+// A request matches a recorded interaction when it has the same
+// method, URL and request body digest; headers are ignored.
+// Each recorded interaction is used at most once; when several
+// interactions match, they're used in the order they were recorded.
+type HTTPReplayer struct {
+	mu       sync.Mutex
+	cassette *Cassette
+	used     []bool
+}
+
+// NewHTTPReplayer returns a replayer that replays
+// the interactions in c.
+func NewHTTPReplayer(c *Cassette) *HTTPReplayer {
+	return &HTTPReplayer{
+		cassette: c,
+		used:     make([]bool, len(c.Interactions)),
+	}
+}
+
+// Do implements [ociclient.HTTPDoer.Do].
+func (r *HTTPReplayer) Do(req *http.Request) (*http.Response, error) {
+	bodyDigest, err := requestBodyDigest(req)
+	if err != nil {
+		return nil, err
+	}
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	u := scrubURL(req.URL)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, ia := range r.cassette.Interactions {
+		if r.used[i] {
+			continue
+		}
+		if ia.Request.Method != req.Method || ia.Request.URL != u || ia.Request.BodyDigest != bodyDigest {
+			continue
+		}
+		r.used[i] = true
+		header := ia.Response.Header.Clone()
+		if header == nil {
+			header = make(http.Header)
+		}
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", ia.Response.StatusCode, http.StatusText(ia.Response.StatusCode)),
+			StatusCode:    ia.Response.StatusCode,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        header,
+			Body:          io.NopCloser(bytes.NewReader(ia.Response.Body)),
+			ContentLength: int64(len(ia.Response.Body)),
+			Request:       req,
+		}, nil
+	}
+	return nil, fmt.Errorf("no recorded interaction for %s %s", req.Method, u)
+}
+
+// Unused returns the interactions that have not yet been replayed.
+func (r *HTTPReplayer) Unused() []HTTPInteraction {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var unused []HTTPInteraction
+	for i, ia := range r.cassette.Interactions {
+		if !r.used[i] {
+			unused = append(unused, ia)
+		}
+	}
+	return unused
+}
+
+// requestBodyDigest returns the digest of the request body after
+// scrubbing any credentials from it, and leaves req.Body
+// so that it can be read again. It returns the empty
+// digest if there is no body.
+func requestBodyDigest(req *http.Request) (digest.Digest, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return "", nil
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return "", fmt.Errorf("cannot read request body: %v", err)
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	if len(body) == 0 {
+		return "", nil
+	}
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		if form, err := url.ParseQuery(string(body)); err == nil {
+			for _, key := range []string{"password", "refresh_token"} {
+				if form.Has(key) {
+					form.Set(key, redacted)
+				}
+			}
+			body = []byte(form.Encode())
+		}
+	}
+	return digest.FromBytes(body), nil
+}
+
+// secretQueryParams holds the lower case names of query
+// parameters that can hold credentials, such as those
+// used in pre-signed blob storage URLs.
+var secretQueryParams = map[string]bool{
+	"access_token":         true,
+	"refresh_token":        true,
+	"token":                true,
+	"password":             true,
+	"signature":            true,
+	"sig":                  true,
+	"x-amz-credential":     true,
+	"x-amz-security-token": true,
+	"x-amz-signature":      true,
+	"x-goog-credential":    true,
+	"x-goog-signature":     true,
+}
+
+// scrubURL returns u as a string with any user information
+// and credentials in query parameters redacted.
+func scrubURL(u *url.URL) string {
+	u1 := *u
+	u1.User = nil
+	if u.RawQuery != "" {
+		query := u.Query()
+		changed := false
+		for key := range query {
+			if secretQueryParams[strings.ToLower(key)] {
+				query.Set(key, redacted)
+				changed = true
+			}
+		}
+		if changed {
+			u1.RawQuery = query.Encode()
+		}
+	}
+	return u1.String()
+}
+
+var secretHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+}
+
+func scrubHeader(h http.Header) http.Header {
+	h = h.Clone()
+	for _, key := range secretHeaders {
+		if _, ok := h[key]; ok {
+			h.Set(key, redacted)
+		}
+	}
+	// Redirects to blob storage often contain
+	// credentials in the URL.
+	if loc := h.Get("Location"); loc != "" {
+		if u, err := url.Parse(loc); err == nil {
+			h.Set("Location", scrubURL(u))
+		}
+	}
+	return h
+}
+
+// scrubResponseBody removes any tokens from a response
+// body with the given header. Only JSON bodies, such as
+// those returned by token servers, are changed.
+func scrubResponseBody(h http.Header, body []byte) []byte {
+	if len(body) == 0 {
+		return body
+	}
+	if mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type")); mediaType != "application/json" {
+		return body
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return body
+	}
+	changed := false
+	for _, key := range []string{"token", "access_token", "refresh_token"} {
+		if _, ok := fields[key]; ok {
+			fields[key] = json.RawMessage(`"` + redacted + `"`)
+			changed = true
+		}
+	}
+	if !changed {
+		return body
+	}
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return body
+	}
+	return data
+}
@@ -0,0 +1,167 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocitest_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ociclient"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ociserver"
+	"cuelabs.dev/go/oci/ociregistry/ocitest"
+)
+
+func TestHTTPRecordReplay(t *testing.T) {
+	ctx := context.Background()
+	srv := httptest.NewServer(ociserver.New(ocimem.New(), nil))
+	srvURL, _ := url.Parse(srv.URL)
+
+	recorder := ocitest.NewHTTPRecorder(nil)
+	client, err := ociclient.New(srvURL.Host, &ociclient.Options{
+		Insecure:   true,
+		HTTPClient: recorder,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	exercise := func(r ociregistry.Interface) (ociregistry.Descriptor, []string) {
+		desc := ocitest.NewRegistry(t, r).MustPushBlob("foo/bar", []byte("hello"))
+		ocitest.NewRegistry(t, r).MustPushBlob("foo/bar", []byte("goodbye"))
+		rd, err := r.GetBlob(ctx, "foo/bar", desc.Digest)
+		qt.Assert(t, qt.IsNil(err))
+		defer rd.Close()
+		data, err := io.ReadAll(rd)
+		qt.Assert(t, qt.IsNil(err))
+		qt.Assert(t, qt.Equals(string(data), "hello"))
+		repos, err := ociregistry.All(r.Repositories(ctx))
+		qt.Assert(t, qt.IsNil(err))
+		return rd.Descriptor(), repos
+	}
+	wantDesc, wantRepos := exercise(client)
+	srv.Close()
+
+	cassetteFile := filepath.Join(t.TempDir(), "cassette.json")
+	err = recorder.Cassette().WriteFile(cassetteFile)
+	qt.Assert(t, qt.IsNil(err))
+
+	cassette, err := ocitest.ReadCassette(cassetteFile)
+	qt.Assert(t, qt.IsNil(err))
+	replayer := ocitest.NewHTTPReplayer(cassette)
+	client, err = ociclient.New(srvURL.Host, &ociclient.Options{
+		Insecure:   true,
+		HTTPClient: replayer,
+	})
+	qt.Assert(t, qt.IsNil(err))
+	gotDesc, gotRepos := exercise(client)
+	qt.Check(t, qt.DeepEquals(gotDesc, wantDesc))
+	qt.Check(t, qt.DeepEquals(gotRepos, wantRepos))
+	qt.Check(t, qt.HasLen(replayer.Unused(), 0))
+
+	// An unrecorded request fails.
+	_, err = client.GetBlob(ctx, "other", wantDesc.Digest)
+	qt.Check(t, qt.ErrorMatches(err, `cannot do HTTP request: no recorded interaction for GET http://.*/v2/other/blobs/sha256:.*`))
+}
+
+func TestHTTPRecorderScrubsCredentials(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "secret"})
+		io.WriteString(w, `{"token":"secret","expires_in":300}`)
+	}))
+	defer srv.Close()
+
+	recorder := ocitest.NewHTTPRecorder(nil)
+	req, err := http.NewRequest("POST", srv.URL+"/token", strings.NewReader("grant_type=password&username=u&password=secret"))
+	qt.Assert(t, qt.IsNil(err))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Basic secret")
+	resp, err := recorder.Do(req)
+	qt.Assert(t, qt.IsNil(err))
+	body, err := io.ReadAll(resp.Body)
+	qt.Assert(t, qt.IsNil(err))
+	// The caller sees the original response.
+	qt.Check(t, qt.Equals(string(body), `{"token":"secret","expires_in":300}`))
+
+	cassette := recorder.Cassette()
+	qt.Assert(t, qt.HasLen(cassette.Interactions, 1))
+	ia := cassette.Interactions[0]
+	qt.Check(t, qt.Equals(ia.Request.Header.Get("Authorization"), "REDACTED"))
+	qt.Check(t, qt.Equals(ia.Response.Header.Get("Set-Cookie"), "REDACTED"))
+	qt.Check(t, qt.JSONEquals(ia.Response.Body, map[string]any{
+		"token":      "REDACTED",
+		"expires_in": 300,
+	}))
+
+	// The request matches on replay even when the password is different.
+	replayer := ocitest.NewHTTPReplayer(cassette)
+	req, err = http.NewRequest("POST", srv.URL+"/token", strings.NewReader("grant_type=password&username=u&password=other"))
+	qt.Assert(t, qt.IsNil(err))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err = replayer.Do(req)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(resp.StatusCode, http.StatusOK))
+}
+
+func TestHTTPRecorderScrubsURLs(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/v2/foo/blobs/sha256:abc" {
+			http.Redirect(w, req, "/storage/abc?X-Amz-Expires=300&X-Amz-Signature=secret", http.StatusTemporaryRedirect)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		io.WriteString(w, `{"token":"not a secret"}`)
+	}))
+	defer srv.Close()
+
+	recorder := ocitest.NewHTTPRecorder(&http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	})
+	resp, err := recorder.Do(mustNewRequest(t, "GET", srv.URL+"/v2/foo/blobs/sha256:abc"))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(resp.StatusCode, http.StatusTemporaryRedirect))
+	// The caller sees the original Location.
+	qt.Check(t, qt.Equals(resp.Header.Get("Location"), "/storage/abc?X-Amz-Expires=300&X-Amz-Signature=secret"))
+	_, err = recorder.Do(mustNewRequest(t, "GET", srv.URL+"/storage/abc?X-Amz-Expires=300&X-Amz-Signature=secret"))
+	qt.Assert(t, qt.IsNil(err))
+
+	cassette := recorder.Cassette()
+	qt.Assert(t, qt.HasLen(cassette.Interactions, 2))
+	qt.Check(t, qt.Equals(cassette.Interactions[0].Response.Header.Get("Location"), "/storage/abc?X-Amz-Expires=300&X-Amz-Signature=REDACTED"))
+	qt.Check(t, qt.Equals(cassette.Interactions[1].Request.URL, srv.URL+"/storage/abc?X-Amz-Expires=300&X-Amz-Signature=REDACTED"))
+	// Only JSON bodies are scrubbed.
+	qt.Check(t, qt.Equals(string(cassette.Interactions[1].Response.Body), `{"token":"not a secret"}`))
+
+	// The request matches on replay even when the signature is different.
+	replayer := ocitest.NewHTTPReplayer(cassette)
+	resp, err = replayer.Do(mustNewRequest(t, "GET", srv.URL+"/storage/abc?X-Amz-Expires=300&X-Amz-Signature=other"))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(resp.StatusCode, http.StatusOK))
+}
+
+func mustNewRequest(t *testing.T, method, url string) *http.Request {
+	req, err := http.NewRequest(method, url, nil)
+	qt.Assert(t, qt.IsNil(err))
+	return req
+}
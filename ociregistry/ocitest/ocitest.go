@@ -20,6 +20,7 @@ package ocitest
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -30,6 +31,7 @@ import (
 
 	"github.com/go-quicktest/qt"
 	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 
 	"cuelabs.dev/go/oci/ociregistry"
 )
@@ -60,16 +62,27 @@ type RegistryContent map[string]RepoContent
 // Digest strings inside manifests that are not valid digests
 // will be replaced by the calculated digest of the manifest or
 // blob with that identifier; the size and media type fields will also be
-// filled in.
+// filled in. Config and layer descriptors refer to blobs; subject
+// descriptors and index entries refer to manifests or indexes.
+// Valid digests are left unchanged, so it's possible to
+// refer to content that isn't in the repository.
 type RepoContent struct {
 	// Manifests maps from manifest identifier to the contents of the manifest.
-	// TODO support manifest indexes too.
+	// If the media type is empty, [ocispec.MediaTypeImageManifest]
+	// is used. Other media types, including artifact types,
+	// are pushed as is.
 	Manifests map[string]ociregistry.Manifest
 
+	// Indexes maps from index identifier to the contents of the index.
+	// Index identifiers share the same namespace as manifest identifiers.
+	// If the media type is empty, [ocispec.MediaTypeImageIndex]
+	// is used.
+	Indexes map[string]ocispec.Index
+
 	// Blobs maps from blob identifer to the contents of the blob.
 	Blobs map[string]string
 
-	// Tags maps from tag name to manifest identifier.
+	// Tags maps from tag name to manifest or index identifier.
 	Tags map[string]string
 }
 
@@ -77,7 +90,7 @@ type RepoContent struct {
 // of describing content that is to be pushed, describes the
 // content that has been pushed.
 type PushedRepoContent struct {
-	// Manifests holds an entry for each manifest identifier
+	// Manifests holds an entry for each manifest and index identifier
 	// with the descriptor for that manifest.
 	Manifests map[string]ociregistry.Descriptor
 
@@ -111,15 +124,7 @@ func PushRepoContent(r ociregistry.Interface, repo string, repoc RepoContent) (P
 	prc := PushedRepoContent{
 		Manifests:    make(map[string]ociregistry.Descriptor),
 		ManifestData: make(map[string][]byte),
-		Blobs:        make(map[string]ociregistry.Descriptor),
-	}
-
-	for id, blob := range repoc.Blobs {
-		prc.Blobs[id] = ociregistry.Descriptor{
-			Digest:    digest.FromString(blob),
-			Size:      int64(len(blob)),
-			MediaType: "application/binary",
-		}
+		Blobs:        blobDescriptors(repoc),
 	}
 	manifests, manifestSeq, err := completedManifests(repoc, prc.Blobs)
 	if err != nil {
@@ -167,53 +172,65 @@ func (r Registry) MustPushContent(rc RegistryContent) map[string]PushedRepoConte
 	return prc
 }
 
+// blobDescriptors returns the descriptors for all the blobs
+// in repoc, keyed by blob identifier.
+func blobDescriptors(repoc RepoContent) map[string]ociregistry.Descriptor {
+	blobs := make(map[string]ociregistry.Descriptor)
+	for id, blob := range repoc.Blobs {
+		blobs[id] = ociregistry.Descriptor{
+			Digest:    digest.FromString(blob),
+			Size:      int64(len(blob)),
+			MediaType: "application/binary",
+		}
+	}
+	return blobs
+}
+
 type manifestContent struct {
 	id   string
 	data []byte
 	desc ociregistry.Descriptor
 }
 
-// completedManifests calculates the content of all the manifests and returns
-// them all, keyed by id, and a partially ordered sequence suitable
+// completedManifests calculates the content of all the manifests and indexes
+// and returns them all, keyed by id, and a partially ordered sequence suitable
 // for pushing to a registry in bottom-up order.
 func completedManifests(repoc RepoContent, blobs map[string]ociregistry.Descriptor) (map[string]manifestContent, []manifestContent, error) {
+	for id := range repoc.Indexes {
+		if _, ok := repoc.Manifests[id]; ok {
+			return nil, nil, fmt.Errorf("id %q used for both a manifest and an index", id)
+		}
+	}
 	manifests := make(map[string]manifestContent)
-	manifestSeq := make([]manifestContent, 0, len(repoc.Manifests))
-	// subject relationships can be arbitrarily deep, so continue iterating until
-	// all the levels are completed. If at any point we can't make progress, we
-	// know there's a problem and panic.
+	manifestSeq := make([]manifestContent, 0, len(repoc.Manifests)+len(repoc.Indexes))
+	// Subject and index relationships can be arbitrarily deep, so continue
+	// iterating until all the levels are completed. If at any point we can't
+	// make progress, we know there's a problem and return an error.
 	required := make(map[string]bool)
 	for {
 		madeProgress := false
 		needMore := false
-		need := func(digest ociregistry.Digest) {
-			needMore = true
-			if !required[string(digest)] {
-				required[string(digest)] = true
-				madeProgress = true
-			}
-		}
-		for id, m := range repoc.Manifests {
-			if _, ok := manifests[id]; ok {
-				continue
-			}
-			m1 := m
-			if m1.Subject != nil {
-				mc, ok := manifests[string(m1.Subject.Digest)]
-				if !ok {
-					need(m1.Subject.Digest)
-					continue
+		// resolve returns the descriptor for the manifest with the
+		// given id, reporting whether it's available yet.
+		// Valid digests that don't correspond to an id are
+		// left alone.
+		resolve := func(desc ociregistry.Descriptor) (ociregistry.Descriptor, bool) {
+			mc, ok := manifests[string(desc.Digest)]
+			if !ok {
+				if desc.Digest.Validate() == nil {
+					return desc, true
 				}
-				m1.Subject = ref(*m1.Subject)
-				*m1.Subject = mc.desc
-				madeProgress = true
-			}
-			m1.Config = fillBlobDescriptor(m.Config, blobs)
-			m1.Layers = make([]ociregistry.Descriptor, len(m.Layers))
-			for i, desc := range m.Layers {
-				m1.Layers[i] = fillBlobDescriptor(desc, blobs)
+				needMore = true
+				if !required[string(desc.Digest)] {
+					required[string(desc.Digest)] = true
+					madeProgress = true
+				}
+				return ociregistry.Descriptor{}, false
 			}
-			data, err := json.Marshal(m1)
+			return fillDescriptor(desc, mc.desc), true
+		}
+		add := func(id string, mediaType string, m any) {
+			data, err := json.Marshal(m)
 			if err != nil {
 				panic(err)
 			}
@@ -223,13 +240,68 @@ func completedManifests(repoc RepoContent, blobs map[string]ociregistry.Descript
 				desc: ociregistry.Descriptor{
 					Digest:    digest.FromBytes(data),
 					Size:      int64(len(data)),
-					MediaType: m.MediaType,
+					MediaType: mediaType,
 				},
 			}
 			manifests[id] = mc
 			madeProgress = true
 			manifestSeq = append(manifestSeq, mc)
 		}
+		for _, id := range mapKeys(repoc.Manifests) {
+			if _, ok := manifests[id]; ok {
+				continue
+			}
+			m := repoc.Manifests[id]
+			if m.MediaType == "" {
+				m.MediaType = ocispec.MediaTypeImageManifest
+			}
+			if m.Subject != nil {
+				subject, ok := resolve(*m.Subject)
+				if !ok {
+					continue
+				}
+				m.Subject = &subject
+			}
+			var err error
+			if m.Config, err = fillBlobDescriptor(m.Config, blobs); err != nil {
+				return nil, nil, fmt.Errorf("manifest %q: %v", id, err)
+			}
+			layers := make([]ociregistry.Descriptor, len(m.Layers))
+			for i, desc := range m.Layers {
+				if layers[i], err = fillBlobDescriptor(desc, blobs); err != nil {
+					return nil, nil, fmt.Errorf("manifest %q: %v", id, err)
+				}
+			}
+			m.Layers = layers
+			add(id, m.MediaType, m)
+		}
+	indexLoop:
+		for _, id := range mapKeys(repoc.Indexes) {
+			if _, ok := manifests[id]; ok {
+				continue
+			}
+			index := repoc.Indexes[id]
+			if index.MediaType == "" {
+				index.MediaType = ocispec.MediaTypeImageIndex
+			}
+			if index.Subject != nil {
+				subject, ok := resolve(*index.Subject)
+				if !ok {
+					continue
+				}
+				index.Subject = &subject
+			}
+			entries := make([]ociregistry.Descriptor, len(index.Manifests))
+			for i, desc := range index.Manifests {
+				desc, ok := resolve(desc)
+				if !ok {
+					continue indexLoop
+				}
+				entries[i] = desc
+			}
+			index.Manifests = entries
+			add(id, index.MediaType, index)
+		}
 		if !needMore {
 			return manifests, manifestSeq, nil
 		}
@@ -244,24 +316,28 @@ func completedManifests(repoc RepoContent, blobs map[string]ociregistry.Descript
 	}
 }
 
-func fillManifestDescriptors(m ociregistry.Manifest, blobs map[string]ociregistry.Descriptor) ociregistry.Manifest {
-	m.Config = fillBlobDescriptor(m.Config, blobs)
-	m.Layers = append([]ociregistry.Descriptor(nil), m.Layers...)
-	for i, desc := range m.Layers {
-		m.Layers[i] = fillBlobDescriptor(desc, blobs)
-	}
-	return m
-}
-
-func fillBlobDescriptor(d ociregistry.Descriptor, blobs map[string]ociregistry.Descriptor) ociregistry.Descriptor {
+// fillBlobDescriptor fills in the digest, size and media type
+// of d from the blob with the identifier held in d.Digest.
+// Valid digests that don't correspond to a blob identifier
+// are left alone.
+func fillBlobDescriptor(d ociregistry.Descriptor, blobs map[string]ociregistry.Descriptor) (ociregistry.Descriptor, error) {
 	blobDesc, ok := blobs[string(d.Digest)]
 	if !ok {
-		panic(fmt.Errorf("no blob found with id %q", d.Digest))
+		if d.Digest.Validate() == nil {
+			return d, nil
+		}
+		return ociregistry.Descriptor{}, fmt.Errorf("no blob found with id %q", d.Digest)
 	}
-	d.Digest = blobDesc.Digest
-	d.Size = blobDesc.Size
+	return fillDescriptor(d, blobDesc), nil
+}
+
+// fillDescriptor returns d with the digest and size from desc.
+// The media type is also filled in if it's not already set.
+func fillDescriptor(d, desc ociregistry.Descriptor) ociregistry.Descriptor {
+	d.Digest = desc.Digest
+	d.Size = desc.Size
 	if d.MediaType == "" {
-		d.MediaType = blobDesc.MediaType
+		d.MediaType = desc.MediaType
 	}
 	return d
 }
@@ -299,6 +375,59 @@ func (r Registry) MustPushManifest(repo string, jsonObject any, tag string) ([]b
 	return data, desc1
 }
 
+// MustPushBlobWithMediaType is like MustPushBlob except that the
+// blob is pushed with the given media type, which is also set in
+// the returned descriptor.
+func (r Registry) MustPushBlobWithMediaType(repo string, data []byte, mediaType string) ociregistry.Descriptor {
+	desc := ociregistry.Descriptor{
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+		MediaType: mediaType,
+	}
+	desc1, err := r.R.PushBlob(context.Background(), repo, desc, bytes.NewReader(data))
+	qt.Assert(r.T, qt.IsNil(err))
+	desc1.MediaType = mediaType
+	return desc1
+}
+
+// MustGetBlob returns the content of the blob
+// with the given digest in repo.
+func (r Registry) MustGetBlob(repo string, dig ociregistry.Digest) []byte {
+	rd, err := r.R.GetBlob(context.Background(), repo, dig)
+	qt.Assert(r.T, qt.IsNil(err))
+	defer rd.Close()
+	data, err := io.ReadAll(rd)
+	qt.Assert(r.T, qt.IsNil(err))
+	return data
+}
+
+// MustGetManifest gets the manifest described by desc from repo
+// and unmarshals it into jsonObject. It checks that the manifest
+// has the media type in desc, if that's not empty.
+func (r Registry) MustGetManifest(repo string, desc ociregistry.Descriptor, jsonObject any) {
+	rd, err := r.R.GetManifest(context.Background(), repo, desc.Digest)
+	qt.Assert(r.T, qt.IsNil(err))
+	defer rd.Close()
+	if desc.MediaType != "" {
+		qt.Check(r.T, qt.Equals(rd.Descriptor().MediaType, desc.MediaType))
+	}
+	data, err := io.ReadAll(rd)
+	qt.Assert(r.T, qt.IsNil(err))
+	qt.Assert(r.T, qt.IsNil(json.Unmarshal(data, jsonObject)))
+}
+
+// Gzip returns data compressed with gzip at the default
+// compression level, as used for image layers.
+func Gzip(data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(data)
+	if err := w.Close(); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
 type Repo struct {
 	T    *testing.T
 	Name string
@@ -375,3 +504,128 @@ func mapKeys[V any](m map[string]V) []string {
 	sort.Strings(keys)
 	return keys
 }
+
+// HasRegistryContent returns a checker that checks that the
+// contents of r match want: r must hold exactly the repositories
+// and tags in want, and all the blobs and manifests
+// in want must be present with the expected content.
+//
+// Note: blobs and manifests in r that are not
+// mentioned in want are not detected, because the registry
+// interface provides no way to list them.
+func HasRegistryContent(r ociregistry.Interface, want RegistryContent) qt.Checker {
+	return registryContentChecker{
+		r:    r,
+		want: want,
+	}
+}
+
+type registryContentChecker struct {
+	r    ociregistry.Interface
+	want RegistryContent
+}
+
+func (c registryContentChecker) Args() []qt.Arg {
+	return []qt.Arg{{
+		Name:  "registry",
+		Value: c.r,
+	}, {
+		Name:  "content",
+		Value: c.want,
+	}}
+}
+
+func (c registryContentChecker) Check(note func(key string, value any)) error {
+	ctx := context.Background()
+	var problems []string
+	addProblem := func(f string, a ...any) {
+		problems = append(problems, fmt.Sprintf(f, a...))
+	}
+	repos, err := ociregistry.All(c.r.Repositories(ctx))
+	if err != nil {
+		return qt.BadCheckf("cannot list repositories: %v", err)
+	}
+	sort.Strings(repos)
+	if wantRepos := mapKeys(c.want); !equalStrings(repos, wantRepos) {
+		note("actual repositories", repos)
+		addProblem("repositories mismatch (got %q want %q)", repos, wantRepos)
+	}
+	for _, repo := range mapKeys(c.want) {
+		repoc := c.want[repo]
+		blobs := blobDescriptors(repoc)
+		manifests, _, err := completedManifests(repoc, blobs)
+		if err != nil {
+			return qt.BadCheckf("invalid content for repository %q: %v", repo, err)
+		}
+		for _, id := range mapKeys(repoc.Blobs) {
+			if err := checkBlobContent(c.r.GetBlob(ctx, repo, blobs[id].Digest))([]byte(repoc.Blobs[id])); err != nil {
+				addProblem("repo %q, blob %q: %v", repo, id, err)
+			}
+		}
+		for _, id := range mapKeys(manifests) {
+			mc := manifests[id]
+			if err := checkBlobContent(c.r.GetManifest(ctx, repo, mc.desc.Digest))(mc.data); err != nil {
+				addProblem("repo %q, manifest %q: %v", repo, id, err)
+			}
+		}
+		tags, err := ociregistry.All(c.r.Tags(ctx, repo))
+		if err != nil {
+			addProblem("repo %q: cannot list tags: %v", repo, err)
+			continue
+		}
+		sort.Strings(tags)
+		if wantTags := mapKeys(repoc.Tags); !equalStrings(tags, wantTags) {
+			addProblem("repo %q: tags mismatch (got %q want %q)", repo, tags, wantTags)
+		}
+		for _, tag := range mapKeys(repoc.Tags) {
+			mc, ok := manifests[repoc.Tags[tag]]
+			if !ok {
+				return qt.BadCheckf("tag %q in repository %q refers to unknown manifest id %q", tag, repo, repoc.Tags[tag])
+			}
+			desc, err := c.r.ResolveTag(ctx, repo, tag)
+			if err != nil {
+				addProblem("repo %q, tag %q: %v", repo, tag, err)
+				continue
+			}
+			if desc.Digest != mc.desc.Digest {
+				addProblem("repo %q, tag %q: got digest %v want %v (manifest %q)", repo, tag, desc.Digest, mc.desc.Digest, repoc.Tags[tag])
+			}
+		}
+	}
+	if len(problems) > 0 {
+		note("problems", problems)
+		return fmt.Errorf("registry content mismatch")
+	}
+	return nil
+}
+
+// checkBlobContent returns a function that checks that the
+// result of a GetBlob or GetManifest call holds the given data.
+func checkBlobContent(r ociregistry.BlobReader, err error) func(want []byte) error {
+	return func(want []byte) error {
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		got, err := io.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("cannot read content: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			return fmt.Errorf("content mismatch (got %q want %q)", got, want)
+		}
+		return nil
+	}
+}
+
+func equalStrings(xs, ys []string) bool {
+	if len(xs) != len(ys) {
+		return false
+	}
+	for i := range xs {
+		if xs[i] != ys[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,201 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocitest_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ocitest"
+)
+
+var indexContent = ocitest.RegistryContent{
+	"foo": {
+		Blobs: map[string]string{
+			"config": "{}",
+			"amd64":  "amd64 layer",
+			"arm64":  "arm64 layer",
+			"sbom":   "some sbom",
+		},
+		Manifests: map[string]ociregistry.Manifest{
+			"m-amd64": {
+				Versioned: specs.Versioned{SchemaVersion: 2},
+				Config: ociregistry.Descriptor{
+					MediaType: ocispec.MediaTypeImageConfig,
+					Digest:    "config",
+				},
+				Layers: []ociregistry.Descriptor{{
+					MediaType: ocispec.MediaTypeImageLayer,
+					Digest:    "amd64",
+				}},
+			},
+			"m-arm64": {
+				Versioned: specs.Versioned{SchemaVersion: 2},
+				Config: ociregistry.Descriptor{
+					MediaType: ocispec.MediaTypeImageConfig,
+					Digest:    "config",
+				},
+				Layers: []ociregistry.Descriptor{{
+					MediaType: ocispec.MediaTypeImageLayer,
+					Digest:    "arm64",
+				}},
+			},
+			"sbom": {
+				Versioned:    specs.Versioned{SchemaVersion: 2},
+				ArtifactType: "application/x-sbom",
+				Config: ociregistry.Descriptor{
+					MediaType: "application/x-sbom-config",
+					Digest:    "config",
+				},
+				Layers: []ociregistry.Descriptor{{
+					Digest: "sbom",
+				}},
+				// The subject refers to the top level index.
+				Subject: &ociregistry.Descriptor{
+					Digest: "top",
+				},
+			},
+			"custom": {
+				MediaType: "application/x-custom+json",
+				Config: ociregistry.Descriptor{
+					MediaType: "application/x-custom-config",
+					Digest:    "config",
+				},
+				// The subject doesn't exist in the registry.
+				Subject: &ociregistry.Descriptor{
+					MediaType: ocispec.MediaTypeImageManifest,
+					Digest:    digest.FromString("something else"),
+					Size:      100,
+				},
+			},
+		},
+		Indexes: map[string]ocispec.Index{
+			"linux": {
+				Versioned: specs.Versioned{SchemaVersion: 2},
+				Manifests: []ociregistry.Descriptor{{
+					Digest: "m-amd64",
+					Platform: &ocispec.Platform{
+						OS:           "linux",
+						Architecture: "amd64",
+					},
+				}, {
+					Digest: "m-arm64",
+					Platform: &ocispec.Platform{
+						OS:           "linux",
+						Architecture: "arm64",
+					},
+				}},
+			},
+			"top": {
+				Versioned: specs.Versioned{SchemaVersion: 2},
+				Manifests: []ociregistry.Descriptor{{
+					Digest: "linux",
+				}},
+			},
+		},
+		Tags: map[string]string{
+			"latest": "top",
+			"amd64":  "m-amd64",
+			"custom": "custom",
+		},
+	},
+}
+
+func TestPushContentWithIndexes(t *testing.T) {
+	ctx := context.Background()
+	r := ocimem.New()
+	pushed := ocitest.NewRegistry(t, r).MustPushContent(indexContent)["foo"]
+
+	desc, err := r.ResolveTag(ctx, "foo", "latest")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.DeepEquals(desc, pushed.Manifests["top"]))
+	qt.Check(t, qt.Equals(desc.MediaType, ocispec.MediaTypeImageIndex))
+
+	var top ocispec.Index
+	readJSON(t, r, pushed.Manifests["top"].Digest, &top)
+	qt.Assert(t, qt.HasLen(top.Manifests, 1))
+	qt.Check(t, qt.DeepEquals(top.Manifests[0], pushed.Manifests["linux"]))
+
+	var linux ocispec.Index
+	readJSON(t, r, pushed.Manifests["linux"].Digest, &linux)
+	qt.Assert(t, qt.HasLen(linux.Manifests, 2))
+	qt.Check(t, qt.Equals(linux.Manifests[0].Digest, pushed.Manifests["m-amd64"].Digest))
+	qt.Check(t, qt.Equals(linux.Manifests[0].MediaType, ocispec.MediaTypeImageManifest))
+	qt.Check(t, qt.Equals(linux.Manifests[1].Platform.Architecture, "arm64"))
+
+	referrers, err := ociregistry.All(r.Referrers(ctx, "foo", pushed.Manifests["top"].Digest, ""))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.HasLen(referrers, 1))
+	qt.Check(t, qt.Equals(referrers[0].Digest, pushed.Manifests["sbom"].Digest))
+
+	desc, err = r.ResolveTag(ctx, "foo", "custom")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(desc.MediaType, "application/x-custom+json"))
+	var custom ociregistry.Manifest
+	readJSON(t, r, desc.Digest, &custom)
+	qt.Check(t, qt.Equals(custom.Subject.Digest, digest.FromString("something else")))
+
+	qt.Check(t, ocitest.HasRegistryContent(r, indexContent))
+}
+
+func TestPushContentMissingID(t *testing.T) {
+	_, err := ocitest.PushContent(ocimem.New(), ocitest.RegistryContent{
+		"foo": {
+			Indexes: map[string]ocispec.Index{
+				"i1": {
+					Manifests: []ociregistry.Descriptor{{
+						Digest: "nope",
+					}},
+				},
+			},
+		},
+	})
+	qt.Check(t, qt.ErrorMatches(err, `cannot push content for repository "foo": no manifest found for ids nope`))
+}
+
+func TestHasRegistryContentMismatch(t *testing.T) {
+	ctx := context.Background()
+	r := ocimem.New()
+	pushed := ocitest.NewRegistry(t, r).MustPushContent(indexContent)["foo"]
+
+	err := r.DeleteTag(ctx, "foo", "custom")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Not(ocitest.HasRegistryContent(r, indexContent)))
+
+	_, err = r.PushManifest(ctx, "foo", "custom", pushed.ManifestData["custom"], "application/x-custom+json")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, ocitest.HasRegistryContent(r, indexContent))
+
+	ocitest.NewRegistry(t, r).MustPushBlob("other", []byte("x"))
+	qt.Check(t, qt.Not(ocitest.HasRegistryContent(r, indexContent)))
+}
+
+func readJSON(t *testing.T, r ociregistry.Interface, dig ociregistry.Digest, x any) {
+	rd, err := r.GetManifest(context.Background(), "foo", dig)
+	qt.Assert(t, qt.IsNil(err))
+	defer rd.Close()
+	data, err := io.ReadAll(rd)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.IsNil(json.Unmarshal(data, x)))
+}
@@ -0,0 +1,717 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocitest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"cuelabs.dev/go/oci/ociregistry"
+)
+
+// RunInterfaceTests runs a suite of tests that check that the registries
+// returned by newRegistry conform to the contracts documented
+// on [ociregistry.Interface].
+//
+// Each subtest calls newRegistry to obtain a new registry, which
+// should be empty and should accept writes to any valid repository name.
+//
+// Operations that return an error satisfying
+// errors.Is(err, ociregistry.ErrUnsupported) cause the
+// relevant subtest to be skipped rather than failed, so
+// registries that don't implement some methods (for example
+// deletion) can still be checked.
+func RunInterfaceTests(t *testing.T, newRegistry func(t *testing.T) ociregistry.Interface) {
+	for _, test := range interfaceTests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.run(t, newRegistry(t))
+		})
+	}
+}
+
+var interfaceTests = []struct {
+	name string
+	run  func(t *testing.T, r ociregistry.Interface)
+}{
+	{"GetBlob", testGetBlob},
+	{"GetBlobRange", testGetBlobRange},
+	{"GetManifest", testGetManifest},
+	{"GetTag", testGetTag},
+	{"ResolveBlob", testResolveBlob},
+	{"ResolveManifest", testResolveManifest},
+	{"ResolveTag", testResolveTag},
+	{"PushBlob", testPushBlob},
+	{"PushBlobChunked", testPushBlobChunked},
+	{"PushBlobChunkedResume", testPushBlobChunkedResume},
+	{"PushBlobChunkedBadOffset", testPushBlobChunkedBadOffset},
+	{"PushBlobChunkedBadDigest", testPushBlobChunkedBadDigest},
+	{"MountBlob", testMountBlob},
+	{"PushManifest", testPushManifest},
+	{"DeleteBlob", testDeleteBlob},
+	{"DeleteManifest", testDeleteManifest},
+	{"DeleteTag", testDeleteTag},
+	{"DeleteRepository", testDeleteRepository},
+	{"Repositories", testRepositories},
+	{"Tags", testTags},
+	{"Referrers", testReferrers},
+	{"IterClose", testIterClose},
+}
+
+// suiteContent holds the content pushed by most of the interface tests.
+var suiteContent = RegistryContent{
+	"foo/bar": {
+		Blobs: map[string]string{
+			"b1":      "hello world",
+			"scratch": "{}",
+		},
+		Manifests: map[string]ociregistry.Manifest{
+			"m1": {
+				MediaType: ocispec.MediaTypeImageManifest,
+				Config: ociregistry.Descriptor{
+					MediaType: ocispec.MediaTypeImageConfig,
+					Digest:    "scratch",
+				},
+				Layers: []ociregistry.Descriptor{{
+					MediaType: ocispec.MediaTypeImageLayer,
+					Digest:    "b1",
+				}},
+			},
+			"m2": {
+				MediaType:    ocispec.MediaTypeImageManifest,
+				ArtifactType: "application/x-test",
+				Config: ociregistry.Descriptor{
+					MediaType: ocispec.MediaTypeImageConfig,
+					Digest:    "scratch",
+				},
+				Subject: &ociregistry.Descriptor{
+					Digest: "m1",
+				},
+			},
+		},
+		Tags: map[string]string{
+			"t1": "m1",
+			"t2": "m1",
+		},
+	},
+	"other": {
+		Blobs: map[string]string{
+			"scratch": "{}",
+		},
+		Manifests: map[string]ociregistry.Manifest{
+			"m1": {
+				MediaType: ocispec.MediaTypeImageManifest,
+				Config: ociregistry.Descriptor{
+					MediaType: ocispec.MediaTypeImageConfig,
+					Digest:    "scratch",
+				},
+			},
+		},
+		Tags: map[string]string{
+			"latest": "m1",
+		},
+	},
+}
+
+// unknownDigest holds the digest of some content that's never
+// pushed by any of the tests.
+var unknownDigest = digest.FromString("unknown content")
+
+func pushSuiteContent(t *testing.T, r ociregistry.Interface) map[string]PushedRepoContent {
+	t.Helper()
+	content, err := PushContent(r, suiteContent)
+	qt.Assert(t, qt.IsNil(err))
+	return content
+}
+
+func testGetBlob(t *testing.T, r ociregistry.Interface) {
+	ctx := context.Background()
+	content := pushSuiteContent(t, r)["foo/bar"]
+
+	desc := content.Blobs["b1"]
+	rd, err := r.GetBlob(ctx, "foo/bar", desc.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	checkReader(t, rd, []byte("hello world"), desc)
+
+	_, err = r.GetBlob(ctx, "foo/bar", unknownDigest)
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrBlobUnknown))
+
+	_, err = r.GetBlob(ctx, "nonexistent", desc.Digest)
+	checkNotFound(t, err, ociregistry.ErrBlobUnknown)
+}
+
+func testGetBlobRange(t *testing.T, r ociregistry.Interface) {
+	ctx := context.Background()
+	content := pushSuiteContent(t, r)["foo/bar"]
+	desc := content.Blobs["b1"]
+	data := "hello world"
+	for _, test := range []struct {
+		o0, o1 int64
+		want   string
+	}{
+		{0, -1, data},
+		{0, 5, data[0:5]},
+		{2, 5, data[2:5]},
+		{6, -1, data[6:]},
+		{6, 1000, data[6:]},
+		{0, int64(len(data)), data},
+		{5, 5, ""},
+		{int64(len(data)), -1, ""},
+	} {
+		t.Run(fmt.Sprintf("%d-%d", test.o0, test.o1), func(t *testing.T) {
+			rd, err := r.GetBlobRange(ctx, "foo/bar", desc.Digest, test.o0, test.o1)
+			skipIfUnsupported(t, err)
+			qt.Assert(t, qt.IsNil(err))
+			defer rd.Close()
+			got, err := io.ReadAll(rd)
+			qt.Assert(t, qt.IsNil(err))
+			qt.Check(t, qt.Equals(string(got), test.want))
+			// The descriptor is for the whole blob, not the range.
+			qt.Check(t, qt.Equals(rd.Descriptor().Digest, desc.Digest))
+			qt.Check(t, qt.Equals(rd.Descriptor().Size, desc.Size))
+		})
+	}
+	for _, test := range []struct {
+		o0, o1 int64
+	}{
+		{-1, 3},
+		{5, 3},
+		{int64(len(data)) + 1, -1},
+		{int64(len(data)) + 1, 1000},
+	} {
+		t.Run(fmt.Sprintf("invalid-%d-%d", test.o0, test.o1), func(t *testing.T) {
+			rd, err := r.GetBlobRange(ctx, "foo/bar", desc.Digest, test.o0, test.o1)
+			skipIfUnsupported(t, err)
+			if err == nil {
+				rd.Close()
+			}
+			qt.Check(t, qt.ErrorIs(err, ociregistry.ErrRangeInvalid))
+		})
+	}
+	_, err := r.GetBlobRange(ctx, "foo/bar", unknownDigest, 1, 2)
+	skipIfUnsupported(t, err)
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrBlobUnknown))
+}
+
+func testGetManifest(t *testing.T, r ociregistry.Interface) {
+	ctx := context.Background()
+	content := pushSuiteContent(t, r)["foo/bar"]
+
+	desc := content.Manifests["m1"]
+	rd, err := r.GetManifest(ctx, "foo/bar", desc.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	checkReader(t, rd, content.ManifestData["m1"], desc)
+
+	_, err = r.GetManifest(ctx, "foo/bar", unknownDigest)
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrManifestUnknown))
+
+	_, err = r.GetManifest(ctx, "nonexistent", desc.Digest)
+	checkNotFound(t, err, ociregistry.ErrManifestUnknown)
+}
+
+func testGetTag(t *testing.T, r ociregistry.Interface) {
+	ctx := context.Background()
+	content := pushSuiteContent(t, r)["foo/bar"]
+
+	desc := content.Manifests["m1"]
+	rd, err := r.GetTag(ctx, "foo/bar", "t1")
+	qt.Assert(t, qt.IsNil(err))
+	checkReader(t, rd, content.ManifestData["m1"], desc)
+
+	_, err = r.GetTag(ctx, "foo/bar", "nonexistent")
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrManifestUnknown))
+
+	_, err = r.GetTag(ctx, "nonexistent", "t1")
+	checkNotFound(t, err, ociregistry.ErrManifestUnknown)
+}
+
+func testResolveBlob(t *testing.T, r ociregistry.Interface) {
+	ctx := context.Background()
+	content := pushSuiteContent(t, r)["foo/bar"]
+
+	desc := content.Blobs["b1"]
+	got, err := r.ResolveBlob(ctx, "foo/bar", desc.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	checkDescriptor(t, got, desc)
+
+	_, err = r.ResolveBlob(ctx, "foo/bar", unknownDigest)
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrBlobUnknown))
+
+	_, err = r.ResolveBlob(ctx, "nonexistent", desc.Digest)
+	checkNotFound(t, err, ociregistry.ErrBlobUnknown)
+}
+
+func testResolveManifest(t *testing.T, r ociregistry.Interface) {
+	ctx := context.Background()
+	content := pushSuiteContent(t, r)["foo/bar"]
+
+	desc := content.Manifests["m1"]
+	got, err := r.ResolveManifest(ctx, "foo/bar", desc.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	checkDescriptor(t, got, desc)
+	qt.Check(t, qt.Equals(got.MediaType, desc.MediaType))
+
+	_, err = r.ResolveManifest(ctx, "foo/bar", unknownDigest)
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrManifestUnknown))
+
+	_, err = r.ResolveManifest(ctx, "nonexistent", desc.Digest)
+	checkNotFound(t, err, ociregistry.ErrManifestUnknown)
+}
+
+func testResolveTag(t *testing.T, r ociregistry.Interface) {
+	ctx := context.Background()
+	content := pushSuiteContent(t, r)["foo/bar"]
+
+	desc := content.Manifests["m1"]
+	got, err := r.ResolveTag(ctx, "foo/bar", "t2")
+	qt.Assert(t, qt.IsNil(err))
+	checkDescriptor(t, got, desc)
+	qt.Check(t, qt.Equals(got.MediaType, desc.MediaType))
+
+	_, err = r.ResolveTag(ctx, "foo/bar", "nonexistent")
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrManifestUnknown))
+
+	_, err = r.ResolveTag(ctx, "nonexistent", "t2")
+	checkNotFound(t, err, ociregistry.ErrManifestUnknown)
+}
+
+func testPushBlob(t *testing.T, r ociregistry.Interface) {
+	ctx := context.Background()
+	data := []byte("some blob data")
+	desc := ociregistry.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	got, err := r.PushBlob(ctx, "foo/bar", desc, bytes.NewReader(data))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(got.Digest, desc.Digest))
+
+	rd, err := r.GetBlob(ctx, "foo/bar", desc.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	checkReader(t, rd, data, desc)
+
+	badDesc := desc
+	badDesc.Digest = unknownDigest
+	_, err = r.PushBlob(ctx, "foo/bar", badDesc, bytes.NewReader(data))
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrDigestInvalid))
+	_, err = r.ResolveBlob(ctx, "foo/bar", unknownDigest)
+	qt.Check(t, qt.Not(qt.IsNil(err)))
+
+	badDesc = desc
+	badDesc.Size++
+	_, err = r.PushBlob(ctx, "foo/bar", badDesc, bytes.NewReader(data))
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrSizeInvalid))
+
+	_, err = r.PushBlob(ctx, "Invalid--Repo", desc, bytes.NewReader(data))
+	qt.Check(t, qt.Not(qt.IsNil(err)))
+}
+
+func testPushBlobChunked(t *testing.T, r ociregistry.Interface) {
+	ctx := context.Background()
+	data := []byte("some chunked blob data")
+	w, err := r.PushBlobChunked(ctx, "foo/bar", 0)
+	skipIfUnsupported(t, err)
+	qt.Assert(t, qt.IsNil(err))
+	defer w.Cancel()
+
+	qt.Check(t, qt.Not(qt.Equals(w.ID(), "")))
+	qt.Check(t, qt.Equals(w.Size(), int64(0)))
+	qt.Check(t, qt.Satisfies(w.ChunkSize(), func(n int) bool { return n > 0 }))
+
+	mustWrite(t, w, data[:5])
+	qt.Check(t, qt.Equals(w.Size(), int64(5)))
+	mustWrite(t, w, data[5:])
+	qt.Check(t, qt.Equals(w.Size(), int64(len(data))))
+
+	desc, err := w.Commit(digest.FromBytes(data))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(desc.Digest, digest.FromBytes(data)))
+	qt.Check(t, qt.Equals(desc.Size, int64(len(data))))
+
+	// Cancel after Commit should be a no-op.
+	qt.Check(t, qt.IsNil(w.Cancel()))
+
+	rd, err := r.GetBlob(ctx, "foo/bar", desc.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	checkReader(t, rd, data, desc)
+}
+
+func testPushBlobChunkedResume(t *testing.T, r ociregistry.Interface) {
+	ctx := context.Background()
+	data := []byte("some data that we'll upload in three parts")
+	w, err := r.PushBlobChunked(ctx, "foo/bar", 0)
+	skipIfUnsupported(t, err)
+	qt.Assert(t, qt.IsNil(err))
+	mustWrite(t, w, data[:10])
+	qt.Assert(t, qt.IsNil(w.Close()))
+	id, size, chunkSize := w.ID(), w.Size(), w.ChunkSize()
+	qt.Assert(t, qt.Equals(size, int64(10)))
+
+	// Resume with an explicit offset.
+	w, err = r.PushBlobChunkedResume(ctx, "foo/bar", id, size, chunkSize)
+	skipIfUnsupported(t, err)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(w.Size(), size))
+	mustWrite(t, w, data[10:20])
+	qt.Assert(t, qt.IsNil(w.Close()))
+	id = w.ID()
+
+	// Resume with an offset of -1 to continue where we left off.
+	w, err = r.PushBlobChunkedResume(ctx, "foo/bar", id, -1, 0)
+	qt.Assert(t, qt.IsNil(err))
+	defer w.Cancel()
+	qt.Check(t, qt.Equals(w.Size(), int64(20)))
+	mustWrite(t, w, data[20:])
+	desc, err := w.Commit(digest.FromBytes(data))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(desc.Digest, digest.FromBytes(data)))
+
+	rd, err := r.GetBlob(ctx, "foo/bar", desc.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	checkReader(t, rd, data, desc)
+}
+
+func testPushBlobChunkedBadOffset(t *testing.T, r ociregistry.Interface) {
+	ctx := context.Background()
+	data := []byte("some data")
+	w, err := r.PushBlobChunked(ctx, "foo/bar", 0)
+	skipIfUnsupported(t, err)
+	qt.Assert(t, qt.IsNil(err))
+	mustWrite(t, w, data[:4])
+	qt.Assert(t, qt.IsNil(w.Close()))
+
+	// Resuming at an offset that doesn't match the data written
+	// so far should fail at some point before the blob is committed.
+	w, err = r.PushBlobChunkedResume(ctx, "foo/bar", w.ID(), 2, 0)
+	if err == nil {
+		defer w.Cancel()
+		_, err = w.Write(data[2:])
+		if err == nil {
+			err = w.Close()
+		}
+		if err == nil {
+			_, err = w.Commit(digest.FromBytes(data))
+		}
+	}
+	skipIfUnsupported(t, err)
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrRangeInvalid))
+}
+
+func testPushBlobChunkedBadDigest(t *testing.T, r ociregistry.Interface) {
+	ctx := context.Background()
+	w, err := r.PushBlobChunked(ctx, "foo/bar", 0)
+	skipIfUnsupported(t, err)
+	qt.Assert(t, qt.IsNil(err))
+	defer w.Cancel()
+	mustWrite(t, w, []byte("some data"))
+	_, err = w.Commit(unknownDigest)
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrDigestInvalid))
+	_, err = r.ResolveBlob(ctx, "foo/bar", unknownDigest)
+	qt.Check(t, qt.Not(qt.IsNil(err)))
+}
+
+func testMountBlob(t *testing.T, r ociregistry.Interface) {
+	ctx := context.Background()
+	content := pushSuiteContent(t, r)["foo/bar"]
+	desc := content.Blobs["b1"]
+	got, err := r.MountBlob(ctx, "foo/bar", "mounted", desc.Digest)
+	skipIfUnsupported(t, err)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(got.Digest, desc.Digest))
+
+	rd, err := r.GetBlob(ctx, "mounted", desc.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	checkReader(t, rd, []byte("hello world"), desc)
+
+	_, err = r.MountBlob(ctx, "foo/bar", "mounted", unknownDigest)
+	qt.Check(t, qt.Not(qt.IsNil(err)))
+}
+
+func testPushManifest(t *testing.T, r ociregistry.Interface) {
+	ctx := context.Background()
+	content := pushSuiteContent(t, r)["foo/bar"]
+	data, err := json.Marshal(ociregistry.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    content.Blobs["scratch"],
+		Layers:    []ociregistry.Descriptor{content.Blobs["b1"]},
+		Annotations: map[string]string{
+			"something": "different",
+		},
+	})
+	qt.Assert(t, qt.IsNil(err))
+	want := ociregistry.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	desc, err := r.PushManifest(ctx, "foo/bar", "newtag", data, ocispec.MediaTypeImageManifest)
+	qt.Assert(t, qt.IsNil(err))
+	checkDescriptor(t, desc, want)
+	qt.Check(t, qt.Equals(desc.MediaType, want.MediaType))
+
+	rd, err := r.GetManifest(ctx, "foo/bar", want.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	checkReader(t, rd, data, want)
+
+	tagDesc, err := r.ResolveTag(ctx, "foo/bar", "newtag")
+	qt.Assert(t, qt.IsNil(err))
+	checkDescriptor(t, tagDesc, want)
+
+	// Pushing a tag that already exists moves it.
+	desc, err = r.PushManifest(ctx, "foo/bar", "t1", data, ocispec.MediaTypeImageManifest)
+	if errors.Is(err, ociregistry.ErrDenied) {
+		// The registry doesn't allow tags to change.
+		return
+	}
+	qt.Assert(t, qt.IsNil(err))
+	tagDesc, err = r.ResolveTag(ctx, "foo/bar", "t1")
+	qt.Assert(t, qt.IsNil(err))
+	checkDescriptor(t, tagDesc, want)
+}
+
+func testDeleteBlob(t *testing.T, r ociregistry.Interface) {
+	ctx := context.Background()
+	content := pushSuiteContent(t, r)["foo/bar"]
+	data := []byte("untagged")
+	desc := ociregistry.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	_, err := r.PushBlob(ctx, "foo/bar", desc, bytes.NewReader(data))
+	qt.Assert(t, qt.IsNil(err))
+
+	err = r.DeleteBlob(ctx, "foo/bar", desc.Digest)
+	skipIfUnsupported(t, err)
+	qt.Assert(t, qt.IsNil(err))
+	_, err = r.ResolveBlob(ctx, "foo/bar", desc.Digest)
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrBlobUnknown))
+
+	err = r.DeleteBlob(ctx, "foo/bar", desc.Digest)
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrBlobUnknown))
+
+	err = r.DeleteBlob(ctx, "nonexistent", content.Blobs["b1"].Digest)
+	checkNotFound(t, err, ociregistry.ErrBlobUnknown)
+}
+
+func testDeleteManifest(t *testing.T, r ociregistry.Interface) {
+	ctx := context.Background()
+	content := pushSuiteContent(t, r)["foo/bar"]
+	desc := content.Manifests["m2"]
+
+	err := r.DeleteManifest(ctx, "foo/bar", desc.Digest)
+	skipIfUnsupported(t, err)
+	qt.Assert(t, qt.IsNil(err))
+	_, err = r.ResolveManifest(ctx, "foo/bar", desc.Digest)
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrManifestUnknown))
+
+	err = r.DeleteManifest(ctx, "foo/bar", desc.Digest)
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrManifestUnknown))
+
+	err = r.DeleteManifest(ctx, "nonexistent", desc.Digest)
+	checkNotFound(t, err, ociregistry.ErrManifestUnknown)
+}
+
+func testDeleteTag(t *testing.T, r ociregistry.Interface) {
+	ctx := context.Background()
+	content := pushSuiteContent(t, r)["foo/bar"]
+
+	err := r.DeleteTag(ctx, "foo/bar", "t1")
+	skipIfUnsupported(t, err)
+	qt.Assert(t, qt.IsNil(err))
+	_, err = r.ResolveTag(ctx, "foo/bar", "t1")
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrManifestUnknown))
+
+	// The other tag and the manifest itself should remain.
+	_, err = r.ResolveTag(ctx, "foo/bar", "t2")
+	qt.Check(t, qt.IsNil(err))
+	_, err = r.ResolveManifest(ctx, "foo/bar", content.Manifests["m1"].Digest)
+	qt.Check(t, qt.IsNil(err))
+
+	err = r.DeleteTag(ctx, "foo/bar", "t1")
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrManifestUnknown))
+}
+
+func testDeleteRepository(t *testing.T, r ociregistry.Interface) {
+	ctx := context.Background()
+	content := pushSuiteContent(t, r)["foo/bar"]
+
+	err := ociregistry.DeleteRepository(ctx, r, "foo/bar")
+	skipIfUnsupported(t, err)
+	qt.Assert(t, qt.IsNil(err))
+	_, err = r.ResolveTag(ctx, "foo/bar", "t1")
+	checkNotFound(t, err, ociregistry.ErrManifestUnknown)
+	_, err = r.ResolveBlob(ctx, "foo/bar", content.Blobs["b1"].Digest)
+	checkNotFound(t, err, ociregistry.ErrBlobUnknown)
+
+	// Other repositories should remain.
+	repos, err := ociregistry.All(r.Repositories(ctx))
+	if !errors.Is(err, ociregistry.ErrUnsupported) {
+		qt.Assert(t, qt.IsNil(err))
+		sort.Strings(repos)
+		qt.Check(t, qt.DeepEquals(repos, []string{"other"}))
+	}
+
+	err = ociregistry.DeleteRepository(ctx, r, "foo/bar")
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrNameUnknown))
+}
+
+func testRepositories(t *testing.T, r ociregistry.Interface) {
+	ctx := context.Background()
+	pushSuiteContent(t, r)
+	repos, err := ociregistry.All(r.Repositories(ctx))
+	skipIfUnsupported(t, err)
+	qt.Assert(t, qt.IsNil(err))
+	sort.Strings(repos)
+	qt.Check(t, qt.DeepEquals(repos, mapKeys(suiteContent)))
+}
+
+func testTags(t *testing.T, r ociregistry.Interface) {
+	ctx := context.Background()
+	pushSuiteContent(t, r)
+	tags, err := ociregistry.All(r.Tags(ctx, "foo/bar"))
+	skipIfUnsupported(t, err)
+	qt.Assert(t, qt.IsNil(err))
+	sort.Strings(tags)
+	qt.Check(t, qt.DeepEquals(tags, mapKeys(suiteContent["foo/bar"].Tags)))
+
+	_, err = ociregistry.All(r.Tags(ctx, "nonexistent"))
+	qt.Check(t, qt.ErrorIs(err, ociregistry.ErrNameUnknown))
+}
+
+func testReferrers(t *testing.T, r ociregistry.Interface) {
+	ctx := context.Background()
+	content := pushSuiteContent(t, r)["foo/bar"]
+
+	descs, err := ociregistry.All(r.Referrers(ctx, "foo/bar", content.Manifests["m1"].Digest, ""))
+	skipIfUnsupported(t, err)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.HasLen(descs, 1))
+	want := content.Manifests["m2"]
+	checkDescriptor(t, descs[0], want)
+	qt.Check(t, qt.Equals(descs[0].MediaType, want.MediaType))
+
+	// A manifest with no referrers yields no items and no error.
+	descs, err = ociregistry.All(r.Referrers(ctx, "foo/bar", content.Manifests["m2"].Digest, ""))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.HasLen(descs, 0))
+
+	// The subject of a manifest does not need to exist.
+	descs, err = ociregistry.All(r.Referrers(ctx, "foo/bar", unknownDigest, ""))
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.HasLen(descs, 0))
+}
+
+func testIterClose(t *testing.T, r ociregistry.Interface) {
+	ctx := context.Background()
+	content := pushSuiteContent(t, r)["foo/bar"]
+	iters := map[string]func() ociregistry.Iter[string]{
+		"Repositories": func() ociregistry.Iter[string] {
+			return r.Repositories(ctx)
+		},
+		"Tags": func() ociregistry.Iter[string] {
+			return r.Tags(ctx, "foo/bar")
+		},
+		"Referrers": func() ociregistry.Iter[string] {
+			return iterDigests(r.Referrers(ctx, "foo/bar", content.Manifests["m1"].Digest, ""))
+		},
+	}
+	for _, name := range mapKeys(iters) {
+		newIter := iters[name]
+		t.Run(name, func(t *testing.T) {
+			// Closing an iterator before it's exhausted should not block
+			// or cause an error.
+			it := newIter()
+			_, ok := it.Next()
+			if !ok {
+				skipIfUnsupported(t, it.Error())
+			}
+			qt.Assert(t, qt.IsTrue(ok), qt.Commentf("error: %v", it.Error()))
+			it.Close()
+
+			// Closing an iterator after it's exhausted should
+			// be OK too.
+			it = newIter()
+			for {
+				if _, ok := it.Next(); !ok {
+					break
+				}
+			}
+			qt.Check(t, qt.IsNil(it.Error()))
+			it.Close()
+		})
+	}
+}
+
+// checkNotFound checks that err is the appropriate error for when a
+// repository is not found. Some registries (notably those accessed
+// with HTTP HEAD requests, which return no error body) can't
+// distinguish between a missing repository and a missing item inside
+// that repository, so itemErr is accepted too.
+func checkNotFound(t *testing.T, err error, itemErr error) {
+	t.Helper()
+	qt.Check(t, qt.IsTrue(errors.Is(err, ociregistry.ErrNameUnknown) || errors.Is(err, itemErr)), qt.Commentf("got error %v; want %v or %v", err, ociregistry.ErrNameUnknown, itemErr))
+}
+
+// checkDescriptor checks that the digest and size fields of got match
+// want and that the media type is present.
+func checkDescriptor(t *testing.T, got, want ociregistry.Descriptor) {
+	t.Helper()
+	qt.Check(t, qt.Equals(got.Digest, want.Digest))
+	qt.Check(t, qt.Equals(got.Size, want.Size))
+	qt.Check(t, qt.Not(qt.Equals(got.MediaType, "")))
+}
+
+// checkReader checks that rd holds the given content and that its
+// descriptor is consistent with want. It closes rd.
+func checkReader(t *testing.T, rd ociregistry.BlobReader, data []byte, want ociregistry.Descriptor) {
+	t.Helper()
+	defer rd.Close()
+	checkDescriptor(t, rd.Descriptor(), want)
+	got, err := io.ReadAll(rd)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Check(t, qt.Equals(string(got), string(data)))
+}
+
+func mustWrite(t *testing.T, w io.Writer, data []byte) {
+	t.Helper()
+	n, err := w.Write(data)
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.Equals(n, len(data)))
+}
+
+func skipIfUnsupported(t *testing.T, err error) {
+	t.Helper()
+	if errors.Is(err, ociregistry.ErrUnsupported) {
+		t.Skipf("operation not supported: %v", err)
+	}
+}
+
+func iterDigests(it ociregistry.Iter[ociregistry.Descriptor]) ociregistry.Iter[string] {
+	return ociregistry.Map(it, func(desc ociregistry.Descriptor) string {
+		return string(desc.Digest)
+	})
+}
@@ -0,0 +1,41 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocitest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-quicktest/qt"
+
+	"cuelabs.dev/go/oci/ociregistry/ociwatch"
+)
+
+// MustWatch returns the first n events from w after the given
+// cursor. It fails the test if they don't all arrive within
+// five seconds.
+func MustWatch(t *testing.T, w ociwatch.Watcher, after ociwatch.Cursor, n int) []ociwatch.Event {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var events []ociwatch.Event
+	for e, err := range w.Watch(ctx, after) {
+		qt.Assert(t, qt.IsNil(err))
+		if events = append(events, e); len(events) == n {
+			break
+		}
+	}
+	return events
+}
@@ -16,6 +16,7 @@ package ociunify
 
 import (
 	"context"
+	"errors"
 
 	"cuelabs.dev/go/oci/ociregistry"
 )
@@ -42,3 +43,21 @@ func (u unifier) DeleteTag(ctx context.Context, repo string, name string) error
 		return mk1(r.DeleteTag(ctx, repo, name))
 	})).err
 }
+
+// DeleteRepository deletes the repository from both registries.
+// A repository might be present in only one of them, so an
+// ErrNameUnknown error from just one registry is ignored.
+func (u unifier) DeleteRepository(ctx context.Context, repo string) error {
+	r0, r1 := both(u, func(r ociregistry.Interface, _ int) t1 {
+		return mk1(ociregistry.DeleteRepository(ctx, r, repo))
+	})
+	notFound0 := errors.Is(r0.err, ociregistry.ErrNameUnknown)
+	notFound1 := errors.Is(r1.err, ociregistry.ErrNameUnknown)
+	switch {
+	case notFound0 && r1.err == nil:
+		return nil
+	case notFound1 && r0.err == nil:
+		return nil
+	}
+	return bothResults(r0, r1).err
+}
@@ -17,7 +17,7 @@ package ociunify
 import (
 	"context"
 	"errors"
-	"sort"
+	"slices"
 	"strings"
 
 	"cuelabs.dev/go/oci/ociregistry"
@@ -48,8 +48,12 @@ func compareDescriptor(d0, d1 ociregistry.Descriptor) int {
 	return strings.Compare(string(d0.Digest), string(d1.Digest))
 }
 
+// mergeIter returns an iterator that yields the union of the items
+// in it0 and it1, ordered by cmp and without duplicates.
+// An ErrNameUnknown error from only one of the iterators is ignored.
 func mergeIter[T any](it0, it1 ociregistry.Iter[T], cmp func(T, T) int) ociregistry.Iter[T] {
-	// TODO streaming merge sort
+	// The underlying iterators don't guarantee any particular order,
+	// so we need to read them fully to sort them before merging.
 	xs0, err0 := ociregistry.All(it0)
 	xs1, err1 := ociregistry.All(it1)
 	if err0 != nil || err1 != nil {
@@ -65,24 +69,14 @@ func mergeIter[T any](it0, it1 ociregistry.Iter[T], cmp func(T, T) int) ociregis
 			err1 = nil
 		}
 	}
-	var xs []T
-	if len(xs0)+len(xs1) > 0 {
-		xs = make([]T, len(xs0)+len(xs1))
-		copy(xs, xs0)
-		copy(xs[len(xs0):], xs1)
-		sort.Slice(xs, func(i, j int) bool {
-			return cmp(xs[i], xs[j]) < 0
-		})
-		j := 0
-		for i := 1; i < len(xs); i++ {
-			if cmp(xs[i], xs[j]) != 0 {
-				j++
-				xs[j] = xs[i]
-			}
-		}
-		xs = xs[:j+1]
-	}
-	it := ociregistry.SliceIter(xs)
+	slices.SortFunc(xs0, cmp)
+	slices.SortFunc(xs1, cmp)
+	it := ociregistry.Dedupe(
+		ociregistry.Merge(ociregistry.SliceIter(xs0), ociregistry.SliceIter(xs1), cmp),
+		func(x0, x1 T) bool {
+			return cmp(x0, x1) == 0
+		},
+	)
 	err := err0
 	if err == nil {
 		err = err1
@@ -90,17 +84,19 @@ func mergeIter[T any](it0, it1 ociregistry.Iter[T], cmp func(T, T) int) ociregis
 	if err == nil {
 		return it
 	}
-	return errIter[T]{
-		Iter: it,
-		err:  err,
-	}
+	return &errorAfterIter[T]{it, err}
 }
 
-type errIter[T any] struct {
+// errorAfterIter yields the items in the embedded iterator
+// and then reports err.
+type errorAfterIter[T any] struct {
 	ociregistry.Iter[T]
 	err error
 }
 
-func (it errIter[T]) Error() error {
+func (it *errorAfterIter[T]) Error() error {
+	if err := it.Iter.Error(); err != nil {
+		return err
+	}
 	return it.err
 }
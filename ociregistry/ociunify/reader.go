@@ -16,7 +16,9 @@ package ociunify
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sync"
 
 	"cuelabs.dev/go/oci/ociregistry"
 )
@@ -30,11 +32,36 @@ func (u unifier) GetBlob(ctx context.Context, repo string, digest ociregistry.Di
 }
 
 func (u unifier) GetBlobRange(ctx context.Context, repo string, digest ociregistry.Digest, o0, o1 int64) (ociregistry.BlobReader, error) {
-	return runReadBlobReader(ctx, u,
+	if o0 < 0 || (o1 >= 0 && o1 < o0) {
+		return nil, fmt.Errorf("invalid range [%d, %d]: %w", o0, o1, ociregistry.ErrRangeInvalid)
+	}
+	// When the blob is present in one registry but the range is
+	// invalid, the error from that registry is more useful than
+	// a not-found error from the other one.
+	var (
+		mu       sync.Mutex
+		rangeErr error
+	)
+	rd, err := runReadBlobReader(ctx, u,
 		func(ctx context.Context, r ociregistry.Interface, i int) t2[ociregistry.BlobReader] {
-			return mk2(r.GetBlobRange(ctx, repo, digest, o0, o1))
+			rd, err := r.GetBlobRange(ctx, repo, digest, o0, o1)
+			if errors.Is(err, ociregistry.ErrRangeInvalid) {
+				mu.Lock()
+				rangeErr = err
+				mu.Unlock()
+			}
+			return mk2(rd, err)
 		},
 	)
+	if err != nil {
+		mu.Lock()
+		defer mu.Unlock()
+		if rangeErr != nil {
+			return nil, rangeErr
+		}
+		return nil, err
+	}
+	return rd, nil
 }
 
 func (u unifier) GetManifest(ctx context.Context, repo string, digest ociregistry.Digest) (ociregistry.BlobReader, error) {
@@ -0,0 +1,62 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociunify
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+)
+
+func TestGetBlobRangeInOneRegistry(t *testing.T) {
+	ctx := context.Background()
+	content := "hello world"
+	desc := ociregistry.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    digest.FromString(content),
+		Size:      int64(len(content)),
+	}
+	for _, policy := range []ReadPolicy{ReadSequential, ReadConcurrent} {
+		for _, which := range []int{0, 1} {
+			t.Run(fmt.Sprintf("policy%d-registry%d", policy, which), func(t *testing.T) {
+				rs := []ociregistry.Interface{ocimem.New(), ocimem.New()}
+				_, err := rs[which].PushBlob(ctx, "foo/bar", desc, strings.NewReader(content))
+				qt.Assert(t, qt.IsNil(err))
+				r := New(rs[0], rs[1], &Options{
+					ReadPolicy: policy,
+				})
+
+				rd, err := r.GetBlobRange(ctx, "foo/bar", desc.Digest, 6, -1)
+				qt.Assert(t, qt.IsNil(err))
+				data, err := io.ReadAll(rd)
+				rd.Close()
+				qt.Assert(t, qt.IsNil(err))
+				qt.Check(t, qt.Equals(string(data), "world"))
+				qt.Check(t, qt.Equals(rd.Descriptor().Size, desc.Size))
+
+				_, err = r.GetBlobRange(ctx, "foo/bar", desc.Digest, 20, -1)
+				qt.Check(t, qt.ErrorIs(err, ociregistry.ErrRangeInvalid))
+			})
+		}
+	}
+}
@@ -59,6 +59,14 @@ type unifier struct {
 	*ociregistry.Funcs
 }
 
+// Capabilities implements [ociregistry.CapabilityReporter]
+// by returning the capabilities supported by both registries,
+// because writes go to both registries and reads
+// may be satisfied by either.
+func (u unifier) Capabilities(ctx context.Context) ociregistry.Capabilities {
+	return ociregistry.CapabilitiesOf(ctx, u.r0) & ociregistry.CapabilitiesOf(ctx, u.r1)
+}
+
 func bothResults[T result[T]](r0, r1 T) T {
 	if r0.error() == nil && r1.error() == nil {
 		return r0
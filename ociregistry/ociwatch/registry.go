@@ -0,0 +1,171 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociwatch
+
+import (
+	"context"
+	"io"
+	"iter"
+
+	"cuelabs.dev/go/oci/ociregistry"
+)
+
+// Options holds options for [New].
+type Options struct {
+	// MaxEvents holds the number of recent events to retain.
+	// If it's zero, [DefaultMaxEvents] is used.
+	MaxEvents int
+}
+
+// New returns a registry that wraps r and records every successful
+// change made through it, so that the changes can be watched with
+// [Registry.Watch]. Changes made to r directly are not recorded.
+//
+// The wrapper can't tell whether content was already present in r,
+// so pushing or mounting existing content is recorded as an addition,
+// and pushing a manifest with a tag is always recorded as a
+// ManifestAdded event followed by a TagMoved event.
+//
+// When changes are made concurrently, their events might be
+// recorded in a different order from the one in which they were
+// applied to r.
+func New(r ociregistry.Interface, opts *Options) *Registry {
+	if opts == nil {
+		opts = new(Options)
+	}
+	return &Registry{
+		Interface: r,
+		log:       NewLog(opts.MaxEvents),
+	}
+}
+
+// Registry is the implementation of [ociregistry.Interface]
+// returned by [New].
+type Registry struct {
+	ociregistry.Interface
+	log *Log
+}
+
+var _ Watcher = (*Registry)(nil)
+
+// Cursor returns the cursor of the most recent event.
+func (r *Registry) Cursor() Cursor {
+	return r.log.Cursor()
+}
+
+// Watch returns a sequence of the changes made after the
+// event with the given cursor, as described in [Log.Watch].
+func (r *Registry) Watch(ctx context.Context, after Cursor) iter.Seq2[Event, error] {
+	return r.log.Watch(ctx, after)
+}
+
+func (r *Registry) Capabilities(ctx context.Context) ociregistry.Capabilities {
+	return ociregistry.CapabilitiesOf(ctx, r.Interface)
+}
+
+func (r *Registry) PushBlob(ctx context.Context, repo string, desc ociregistry.Descriptor, rd io.Reader) (ociregistry.Descriptor, error) {
+	desc, err := r.Interface.PushBlob(ctx, repo, desc, rd)
+	if err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	r.log.Add(Event{Kind: BlobAdded, Repo: repo, Desc: desc})
+	return desc, nil
+}
+
+func (r *Registry) PushBlobChunked(ctx context.Context, repo string, chunkSize int) (ociregistry.BlobWriter, error) {
+	w, err := r.Interface.PushBlobChunked(ctx, repo, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+	return &blobWriter{BlobWriter: w, r: r, repo: repo}, nil
+}
+
+func (r *Registry) PushBlobChunkedResume(ctx context.Context, repo, id string, offset int64, chunkSize int) (ociregistry.BlobWriter, error) {
+	w, err := r.Interface.PushBlobChunkedResume(ctx, repo, id, offset, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+	return &blobWriter{BlobWriter: w, r: r, repo: repo}, nil
+}
+
+func (r *Registry) MountBlob(ctx context.Context, fromRepo, toRepo string, digest ociregistry.Digest) (ociregistry.Descriptor, error) {
+	desc, err := r.Interface.MountBlob(ctx, fromRepo, toRepo, digest)
+	if err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	r.log.Add(Event{Kind: BlobAdded, Repo: toRepo, Desc: desc})
+	return desc, nil
+}
+
+func (r *Registry) PushManifest(ctx context.Context, repo string, tag string, contents []byte, mediaType string) (ociregistry.Descriptor, error) {
+	desc, err := r.Interface.PushManifest(ctx, repo, tag, contents, mediaType)
+	if err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	r.log.Add(Event{Kind: ManifestAdded, Repo: repo, Desc: desc})
+	if tag != "" {
+		r.log.Add(Event{Kind: TagMoved, Repo: repo, Tag: tag, Desc: desc})
+	}
+	return desc, nil
+}
+
+func (r *Registry) DeleteBlob(ctx context.Context, repo string, digest ociregistry.Digest) error {
+	if err := r.Interface.DeleteBlob(ctx, repo, digest); err != nil {
+		return err
+	}
+	r.log.Add(Event{Kind: BlobDeleted, Repo: repo, Desc: ociregistry.Descriptor{Digest: digest}})
+	return nil
+}
+
+func (r *Registry) DeleteManifest(ctx context.Context, repo string, digest ociregistry.Digest) error {
+	if err := r.Interface.DeleteManifest(ctx, repo, digest); err != nil {
+		return err
+	}
+	r.log.Add(Event{Kind: ManifestDeleted, Repo: repo, Desc: ociregistry.Descriptor{Digest: digest}})
+	return nil
+}
+
+func (r *Registry) DeleteTag(ctx context.Context, repo string, name string) error {
+	if err := r.Interface.DeleteTag(ctx, repo, name); err != nil {
+		return err
+	}
+	r.log.Add(Event{Kind: TagDeleted, Repo: repo, Tag: name})
+	return nil
+}
+
+func (r *Registry) DeleteRepository(ctx context.Context, repo string) error {
+	if err := ociregistry.DeleteRepository(ctx, r.Interface, repo); err != nil {
+		return err
+	}
+	r.log.Add(Event{Kind: RepositoryDeleted, Repo: repo})
+	return nil
+}
+
+// blobWriter records a BlobAdded event when
+// the blob is committed.
+type blobWriter struct {
+	ociregistry.BlobWriter
+	r    *Registry
+	repo string
+}
+
+func (w *blobWriter) Commit(digest ociregistry.Digest) (ociregistry.Descriptor, error) {
+	desc, err := w.BlobWriter.Commit(digest)
+	if err != nil {
+		return ociregistry.Descriptor{}, err
+	}
+	w.r.log.Add(Event{Kind: BlobAdded, Repo: w.repo, Desc: desc})
+	return desc, nil
+}
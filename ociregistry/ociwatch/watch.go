@@ -0,0 +1,255 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ociwatch provides a way to subscribe to changes in a registry,
+// such as tags being moved and manifests and blobs being added or deleted.
+//
+// Each change is recorded as an [Event] with a [Cursor] that can be used
+// to resume watching from just after that event, so a client can wait
+// for a particular change without polling, or mirror changes
+// incrementally.
+package ociwatch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"slices"
+	"sync"
+
+	"cuelabs.dev/go/oci/ociregistry"
+)
+
+// Kind represents the kind of change recorded by an [Event].
+type Kind int
+
+const (
+	// TagMoved records that a tag has been created or
+	// changed to refer to a different manifest.
+	TagMoved Kind = iota + 1
+
+	// TagDeleted records that a tag has been deleted.
+	TagDeleted
+
+	// ManifestAdded records that a manifest has been pushed.
+	ManifestAdded
+
+	// ManifestDeleted records that a manifest has been deleted.
+	ManifestDeleted
+
+	// BlobAdded records that a blob has been pushed or mounted.
+	BlobAdded
+
+	// BlobDeleted records that a blob has been deleted.
+	BlobDeleted
+
+	// RepositoryDeleted records that a repository
+	// and all its content has been deleted.
+	RepositoryDeleted
+
+	// Reset records that the entire content of the registry
+	// has been replaced, so any copy of it should be
+	// fetched again.
+	Reset
+)
+
+var kindNames = []string{
+	TagMoved:          "tagmoved",
+	TagDeleted:        "tagdeleted",
+	ManifestAdded:     "manifestadded",
+	ManifestDeleted:   "manifestdeleted",
+	BlobAdded:         "blobadded",
+	BlobDeleted:       "blobdeleted",
+	RepositoryDeleted: "repositorydeleted",
+	Reset:             "reset",
+}
+
+func (k Kind) String() string {
+	if k > 0 && int(k) < len(kindNames) {
+		return kindNames[k]
+	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
+// Cursor identifies an event in a [Log]. Cursors increase
+// with each event, starting at 1. The zero Cursor comes
+// before any event.
+type Cursor uint64
+
+// Event records a change to a registry.
+type Event struct {
+	// Cursor identifies the event. Watching from it
+	// yields only the events that follow it.
+	Cursor Cursor
+
+	Kind Kind
+
+	// Repo holds the repository that changed.
+	// It's empty for Reset events.
+	Repo string
+
+	// Tag holds the tag for TagMoved and TagDeleted events.
+	Tag string
+
+	// Desc describes the manifest or blob for manifest and blob
+	// events, and the manifest that the tag now refers to for
+	// TagMoved events. Only the digest is guaranteed to be set
+	// for ManifestDeleted and BlobDeleted events. It's zero
+	// for other events.
+	Desc ociregistry.Descriptor
+}
+
+// Watcher is implemented by registries that record changes,
+// such as [Registry] and the in-memory registry in package ocimem.
+type Watcher interface {
+	// Cursor returns the cursor of the most recent event.
+	Cursor() Cursor
+
+	// Watch returns a sequence of the events after the given cursor,
+	// as described in [Log.Watch].
+	Watch(ctx context.Context, after Cursor) iter.Seq2[Event, error]
+}
+
+// ErrInvalidCursor is returned when watching from a cursor
+// that can't be used, either because the events after
+// it are no longer retained or because it's beyond the
+// most recent event. A client that sees this error should
+// treat everything it knows about the registry as out of date.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// DefaultMaxEvents holds the default number of events
+// that a [Log] retains.
+const DefaultMaxEvents = 10000
+
+// Log records a bounded history of events and
+// lets clients watch for new ones. It's safe to use
+// concurrently.
+type Log struct {
+	maxEvents int
+
+	mu sync.Mutex
+
+	// events holds the retained events, oldest first.
+	events []Event
+
+	// last holds the cursor of the most recent event.
+	last Cursor
+
+	// added is closed when the next event is added.
+	// It's nil when nothing is waiting for events.
+	added chan struct{}
+}
+
+// NewLog returns a new log that retains at least the
+// maxEvents most recent events. If maxEvents is zero or
+// negative, [DefaultMaxEvents] is used.
+func NewLog(maxEvents int) *Log {
+	if maxEvents <= 0 {
+		maxEvents = DefaultMaxEvents
+	}
+	return &Log{
+		maxEvents: maxEvents,
+	}
+}
+
+// Add records an event and returns it with its cursor set.
+// The Cursor field in e is ignored.
+func (l *Log) Add(e Event) Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.last++
+	e.Cursor = l.last
+	l.events = append(l.events, e)
+	if len(l.events) > 2*l.maxEvents {
+		// Trim in bulk so that adding events takes
+		// constant amortized time.
+		l.events = append(l.events[:0], l.events[len(l.events)-l.maxEvents:]...)
+	}
+	if l.added != nil {
+		close(l.added)
+		l.added = nil
+	}
+	return e
+}
+
+// Cursor returns the cursor of the most recent event, or zero
+// if there have been none. Watching from the returned cursor
+// yields only events that are added after the call.
+func (l *Log) Cursor() Cursor {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.last
+}
+
+// Watch returns a sequence of all the events after the one with
+// the given cursor, in order. When there are no more events, it waits
+// for new ones until ctx is done, when it yields ctx.Err()
+// and finishes.
+//
+// If the given cursor is invalid, or the events after it are discarded
+// before they're yielded, it yields an error wrapping
+// [ErrInvalidCursor] and finishes.
+func (l *Log) Watch(ctx context.Context, after Cursor) iter.Seq2[Event, error] {
+	return func(yield func(Event, error) bool) {
+		for {
+			if err := ctx.Err(); err != nil {
+				yield(Event{}, err)
+				return
+			}
+			events, added, err := l.since(after)
+			if err != nil {
+				yield(Event{}, err)
+				return
+			}
+			for _, e := range events {
+				if !yield(e, nil) {
+					return
+				}
+				after = e.Cursor
+			}
+			if added == nil {
+				continue
+			}
+			select {
+			case <-added:
+			case <-ctx.Done():
+				yield(Event{}, ctx.Err())
+				return
+			}
+		}
+	}
+}
+
+// since returns the events after the given cursor.
+// If there are none, it returns a channel that's
+// closed when the next event is added instead.
+func (l *Log) since(after Cursor) ([]Event, <-chan struct{}, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if after > l.last {
+		return nil, nil, fmt.Errorf("%w: cursor %d is beyond the most recent event %d", ErrInvalidCursor, after, l.last)
+	}
+	if after == l.last {
+		if l.added == nil {
+			l.added = make(chan struct{})
+		}
+		return nil, l.added, nil
+	}
+	first := l.last - Cursor(len(l.events)) + 1
+	if after+1 < first {
+		return nil, nil, fmt.Errorf("%w: events after cursor %d have been discarded", ErrInvalidCursor, after)
+	}
+	return slices.Clone(l.events[after+1-first:]), nil, nil
+}
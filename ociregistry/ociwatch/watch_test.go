@@ -0,0 +1,138 @@
+// Copyright 2023 CUE Labs AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociwatch_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-quicktest/qt"
+	"github.com/opencontainers/go-digest"
+
+	"cuelabs.dev/go/oci/ociregistry"
+	"cuelabs.dev/go/oci/ociregistry/ocimem"
+	"cuelabs.dev/go/oci/ociregistry/ocitest"
+	"cuelabs.dev/go/oci/ociregistry/ociwatch"
+)
+
+func TestInterface(t *testing.T) {
+	ocitest.RunInterfaceTests(t, func(t *testing.T) ociregistry.Interface {
+		return ociwatch.New(ocimem.New(), nil)
+	})
+}
+
+func TestLogWatch(t *testing.T) {
+	ctx := context.Background()
+	l := ociwatch.NewLog(0)
+	qt.Check(t, qt.Equals(l.Cursor(), 0))
+	e := l.Add(ociwatch.Event{Kind: ociwatch.TagMoved, Repo: "foo", Tag: "a"})
+	qt.Check(t, qt.Equals(e.Cursor, 1))
+	l.Add(ociwatch.Event{Kind: ociwatch.TagMoved, Repo: "foo", Tag: "b"})
+	qt.Check(t, qt.Equals(l.Cursor(), 2))
+
+	events := ocitest.MustWatch(t, l, 0, 2)
+	qt.Check(t, qt.DeepEquals(events, []ociwatch.Event{
+		{Cursor: 1, Kind: ociwatch.TagMoved, Repo: "foo", Tag: "a"},
+		{Cursor: 2, Kind: ociwatch.TagMoved, Repo: "foo", Tag: "b"},
+	}))
+
+	// Watching resumes after the given cursor and waits
+	// for events that haven't happened yet.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		l.Add(ociwatch.Event{Kind: ociwatch.TagDeleted, Repo: "foo", Tag: "a"})
+	}()
+	events = ocitest.MustWatch(t, l, 1, 2)
+	qt.Check(t, qt.Equals(events[0].Tag, "b"))
+	qt.Check(t, qt.Equals(events[1].Kind, ociwatch.TagDeleted))
+	qt.Check(t, qt.Equals(events[1].Cursor, 3))
+
+	// Watching finishes when the context is done.
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	for _, err := range l.Watch(ctx, l.Cursor()) {
+		qt.Check(t, qt.ErrorIs(err, context.Canceled))
+	}
+}
+
+func TestLogInvalidCursor(t *testing.T) {
+	ctx := context.Background()
+	l := ociwatch.NewLog(2)
+	for range 5 {
+		l.Add(ociwatch.Event{Kind: ociwatch.BlobAdded, Repo: "foo"})
+	}
+	// At least the two most recent events are retained.
+	events := ocitest.MustWatch(t, l, 3, 2)
+	qt.Check(t, qt.Equals(events[0].Cursor, 4))
+
+	for _, after := range []ociwatch.Cursor{0, 6} {
+		for _, err := range l.Watch(ctx, after) {
+			qt.Check(t, qt.ErrorIs(err, ociwatch.ErrInvalidCursor))
+		}
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	ctx := context.Background()
+	r := ociwatch.New(ocimem.New(), nil)
+	content := "hello"
+	desc := ociregistry.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    digest.FromString(content),
+		Size:      int64(len(content)),
+	}
+	_, err := r.PushBlob(ctx, "foo", desc, strings.NewReader(content))
+	qt.Assert(t, qt.IsNil(err))
+	_, err = r.MountBlob(ctx, "foo", "bar", desc.Digest)
+	qt.Assert(t, qt.IsNil(err))
+	w, err := r.PushBlobChunked(ctx, "foo", 0)
+	qt.Assert(t, qt.IsNil(err))
+	_, err = w.Write([]byte("other"))
+	qt.Assert(t, qt.IsNil(err))
+	_, err = w.Commit(digest.FromString("other"))
+	qt.Assert(t, qt.IsNil(err))
+	mdesc, err := r.PushManifest(ctx, "foo", "latest", []byte(`{}`), "application/x-something")
+	qt.Assert(t, qt.IsNil(err))
+	qt.Assert(t, qt.IsNil(r.DeleteTag(ctx, "foo", "latest")))
+	qt.Assert(t, qt.IsNil(r.DeleteManifest(ctx, "foo", mdesc.Digest)))
+	qt.Assert(t, qt.IsNil(r.DeleteBlob(ctx, "foo", desc.Digest)))
+	qt.Assert(t, qt.IsNil(r.DeleteRepository(ctx, "bar")))
+
+	// Failed changes are not recorded.
+	err = r.DeleteTag(ctx, "foo", "latest")
+	qt.Assert(t, qt.ErrorIs(err, ociregistry.ErrManifestUnknown))
+
+	qt.Check(t, qt.Equals(r.Cursor(), 9))
+	var got []string
+	for _, e := range ocitest.MustWatch(t, r, 0, 9) {
+		got = append(got, e.Kind.String()+" "+e.Repo+" "+e.Tag)
+	}
+	qt.Check(t, qt.DeepEquals(got, []string{
+		"blobadded foo ",
+		"blobadded bar ",
+		"blobadded foo ",
+		"manifestadded foo ",
+		"tagmoved foo latest",
+		"tagdeleted foo latest",
+		"manifestdeleted foo ",
+		"blobdeleted foo ",
+		"repositorydeleted bar ",
+	}))
+}